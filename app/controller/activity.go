@@ -0,0 +1,220 @@
+// Copyright 2015 realglobe, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"github.com/go-martini/martini"
+	"github.com/realglobe-Inc/edo-xrs/app/model"
+	"github.com/realglobe-Inc/edo-xrs/app/validator"
+)
+
+// FindActivity は Activities リソースの GET リクエストを扱うハンドラである。
+// 保存されているステートメントから activityId の Activity の定義をまとめて返す。
+// (Experience API, Section 7.5 を参照)
+func (c *Controller) FindActivity(params martini.Params, w http.ResponseWriter, req *http.Request) (int, string) {
+	setDocumentHeader(w, req)
+	user, app := params["user"], params["app"]
+	ctx := req.Context()
+
+	xAPIVersion := req.Header.Get("X-Experience-API-Version")
+	if !validator.IsValidXAPIVersion(xAPIVersion) {
+		return NewBadRequestErr("Invalid or empty xAPI version given in X-Experience-API-Version").Response()
+	}
+
+	activityID := req.URL.Query().Get("activityId")
+	if len(activityID) == 0 {
+		return NewBadRequestErr("activityId is required").Response()
+	}
+
+	definition, err := c.findActivityDefinition(ctx, user, app, activityID)
+	if err != nil {
+		logger.Err("An unexpected error occured on find DB: ", err)
+		return http.StatusInternalServerError, "Internal Server Error"
+	}
+
+	activity := map[string]interface{}{
+		"objectType": "Activity",
+		"id":         activityID,
+	}
+	if definition != nil {
+		activity["definition"] = definition
+	}
+
+	body, err := json.Marshal(activity)
+	if err != nil {
+		logger.Err("An unexpected error occured: ", err)
+		return http.StatusInternalServerError, "Internal Server Error"
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	return http.StatusOK, string(body)
+}
+
+// findActivityDefinition は保存されているステートメントの object.definition をマージした
+// Activity の定義を返す。定義が一つも無い場合は nil を返す。
+func (c *Controller) findActivityDefinition(ctx context.Context, user, app, activityID string) (map[string]interface{}, error) {
+	definitions, err := c.store.FindActivityDefinitions(ctx, user, app, activityID)
+	if err != nil {
+		return nil, err
+	}
+
+	return mergeActivityDefinitions(definitions), nil
+}
+
+// 言語マップを持つ interaction component のフィールド
+var interactionComponentFields = []string{"choices", "scale", "source", "target", "steps"}
+
+// mergeActivityDefinitions は新しいものから順に並べられた Activity の定義をマージする。
+// 言語マップは全ての定義から集め、同じ言語は新しい定義のものを優先する。
+// それ以外のフィールドは最も新しい定義のものを用いる。
+func mergeActivityDefinitions(definitions []map[string]interface{}) map[string]interface{} {
+	if len(definitions) == 0 {
+		return nil
+	}
+
+	merged := make(map[string]interface{})
+	for k, v := range definitions[0] {
+		merged[k] = v
+	}
+
+	for _, field := range []string{"name", "description"} {
+		if langMap := mergeLangMaps(definitions, func(d map[string]interface{}) interface{} {
+			return d[field]
+		}); len(langMap) > 0 {
+			merged[field] = langMap
+		}
+	}
+
+	// interaction component の description は id ごとにマージする
+	for _, field := range interactionComponentFields {
+		components, ok := merged[field].([]interface{})
+		if !ok {
+			continue
+		}
+
+		mergedComponents := make([]interface{}, 0, len(components))
+		for _, c := range components {
+			component, ok := c.(map[string]interface{})
+			if !ok {
+				mergedComponents = append(mergedComponents, c)
+				continue
+			}
+
+			id := component["id"]
+			mergedComponent := make(map[string]interface{})
+			for k, v := range component {
+				mergedComponent[k] = v
+			}
+			if langMap := mergeLangMaps(definitions, func(d map[string]interface{}) interface{} {
+				return componentDescription(d, field, id)
+			}); len(langMap) > 0 {
+				mergedComponent["description"] = langMap
+			}
+
+			mergedComponents = append(mergedComponents, mergedComponent)
+		}
+		merged[field] = mergedComponents
+	}
+
+	return merged
+}
+
+// mergeLangMaps は各定義から get により取り出した言語マップをマージする。
+// definitions は新しいものから順に並んでいるため、古い定義から順に上書きする。
+func mergeLangMaps(definitions []map[string]interface{}, get func(map[string]interface{}) interface{}) map[string]interface{} {
+	langMap := make(map[string]interface{})
+
+	for i := len(definitions) - 1; i >= 0; i-- {
+		if m, ok := get(definitions[i]).(map[string]interface{}); ok {
+			for lang, v := range m {
+				langMap[lang] = v
+			}
+		}
+	}
+
+	return langMap
+}
+
+// componentDescription は定義の field にある interaction component のうち、
+// id が一致するものの description を返す。
+func componentDescription(definition map[string]interface{}, field string, id interface{}) interface{} {
+	components, ok := definition[field].([]interface{})
+	if !ok {
+		return nil
+	}
+
+	for _, c := range components {
+		if component, ok := c.(map[string]interface{}); ok && component["id"] == id {
+			return component["description"]
+		}
+	}
+
+	return nil
+}
+
+// canonicalizeActivities は object が Activity であるステートメントの object.definition を
+// findActivityDefinition によりマージしたものに置き換える。
+func (c *Controller) canonicalizeActivities(ctx context.Context, user, app string, docs model.DocumentSlice) error {
+	cache := make(map[string]map[string]interface{})
+
+	for _, doc := range docs {
+		object, ok := doc.Data["object"].(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if objectType, ok := object["objectType"]; ok && objectType != "Activity" {
+			continue
+		}
+		id, ok := object["id"].(string)
+		if !ok {
+			continue
+		}
+
+		definition, ok := cache[id]
+		if !ok {
+			var err error
+			if definition, err = c.findActivityDefinition(ctx, user, app, id); err != nil {
+				return err
+			}
+			cache[id] = definition
+		}
+
+		if definition != nil {
+			object["definition"] = copyDefinition(definition)
+		}
+	}
+
+	return nil
+}
+
+// copyDefinition は定義を複製する。canonical フォーマットでは言語マップを
+// ステートメントごとに書き換えるため、共有している定義を書き換えないようにする。
+func copyDefinition(definition map[string]interface{}) map[string]interface{} {
+	var copied map[string]interface{}
+
+	b, err := json.Marshal(definition)
+	if err != nil {
+		return definition
+	}
+	if err := json.Unmarshal(b, &copied); err != nil {
+		return definition
+	}
+
+	return copied
+}
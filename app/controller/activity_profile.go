@@ -0,0 +1,196 @@
+// Copyright 2015 realglobe, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/go-martini/martini"
+	"github.com/realglobe-Inc/edo-xrs/app/model"
+	"github.com/realglobe-Inc/edo-xrs/app/validator"
+)
+
+// FindActivityProfile は Activity Profile の GET リクエストを扱うハンドラである。
+// profileId が指定されている場合はその Activity Profile を、そうでなければ profileId の一覧を返す。
+// (Experience API, Section 7.5 を参照)
+func (c *Controller) FindActivityProfile(params martini.Params, w http.ResponseWriter, req *http.Request) (int, string) {
+	setDocumentHeader(w, req)
+	user, app := params["user"], params["app"]
+
+	xAPIVersion := req.Header.Get("X-Experience-API-Version")
+	if !validator.IsValidXAPIVersion(xAPIVersion) {
+		return NewBadRequestErr("Invalid or empty xAPI version given in X-Experience-API-Version").Response()
+	}
+
+	urlParams := req.URL.Query()
+	activityID := urlParams.Get("activityId")
+	if len(activityID) == 0 {
+		return NewBadRequestErr("activityId is required").Response()
+	}
+
+	ctx := req.Context()
+
+	// profileId が指定されていない場合は profileId の一覧を返す
+	profileID := urlParams.Get("profileId")
+	if len(profileID) == 0 {
+		since, err := parseParamTime(urlParams, "since")
+		if err != nil {
+			return NewBadRequestErr(err.Error()).Response()
+		}
+
+		ids, err := c.store.FindActivityProfileIDs(ctx, user, app, activityID, since)
+		if err != nil {
+			logger.Err("An unexpected error occured on find DB: ", err)
+			return http.StatusInternalServerError, "Internal Server Error"
+		}
+
+		return writeIDs(w, ids)
+	}
+
+	if _, ok := urlParams["since"]; ok {
+		return NewBadRequestErr("since cannot be given with profileId").Response()
+	}
+
+	profile, err := c.store.FindActivityProfile(ctx, user, app, activityID, profileID)
+	if err == model.ErrNotFound {
+		return http.StatusNotFound, "Activity Profile Not Found"
+	}
+	if err != nil {
+		logger.Err("An unexpected error occured on find DB: ", err)
+		return http.StatusInternalServerError, "Internal Server Error"
+	}
+
+	return writeDocument(w, profile.ContentType, profile.Content, profile.Updated)
+}
+
+// StoreActivityProfile は Activity Profile の PUT リクエストを扱うハンドラである。
+// 同じキーを持つ Activity Profile が既に存在する場合は置き換える。
+func (c *Controller) StoreActivityProfile(params martini.Params, w http.ResponseWriter, req *http.Request) (int, string) {
+	return c.saveActivityProfile(params, w, req, false)
+}
+
+// MergeActivityProfile は Activity Profile の POST リクエストを扱うハンドラである。
+// 既に保存されているものと与えられたものが共に JSON オブジェクトである場合はマージする。
+func (c *Controller) MergeActivityProfile(params martini.Params, w http.ResponseWriter, req *http.Request) (int, string) {
+	return c.saveActivityProfile(params, w, req, true)
+}
+
+func (c *Controller) saveActivityProfile(params martini.Params, w http.ResponseWriter, req *http.Request, merge bool) (int, string) {
+	setDocumentHeader(w, req)
+	user, app := params["user"], params["app"]
+
+	xAPIVersion := req.Header.Get("X-Experience-API-Version")
+	if !validator.IsValidXAPIVersion(xAPIVersion) {
+		return NewBadRequestErr("Invalid or empty xAPI version given in X-Experience-API-Version").Response()
+	}
+
+	urlParams := req.URL.Query()
+	activityID, profileID := urlParams.Get("activityId"), urlParams.Get("profileId")
+	if len(activityID) == 0 || len(profileID) == 0 {
+		return NewBadRequestErr("activityId and profileId are required").Response()
+	}
+
+	contentType, content, err := readDocumentBody(req)
+	if err != nil {
+		return NewBadRequestErrF("An error occured on read request: %s", err).Response()
+	}
+
+	ctx := req.Context()
+
+	if code, mess := c.checkQuota(ctx, user); code != http.StatusOK {
+		return code, mess
+	}
+
+	old, err := c.store.FindActivityProfile(ctx, user, app, activityID, profileID)
+	if err != nil && err != model.ErrNotFound {
+		logger.Err("An unexpected error occured on find DB: ", err)
+		return http.StatusInternalServerError, "Internal Server Error"
+	}
+
+	var oldContent []byte
+	if old != nil {
+		oldContent = old.Content
+	}
+	if code, mess := checkPrecondition(req, oldContent, !merge); code != http.StatusOK {
+		return code, mess
+	}
+
+	if old != nil && merge {
+		if !isJSONContentType(old.ContentType) || !isJSONContentType(contentType) {
+			return NewBadRequestErr("Both stored and given profile must be JSON on POST request").Response()
+		}
+		if content, err = mergeJSONDocument(old.Content, content); err != nil {
+			return NewBadRequestErrF("Cannot merge profile: %s", err).Response()
+		}
+	}
+
+	profile := model.NewActivityProfile(user, app, activityID, profileID, contentType, content, time.Now())
+	if err := c.store.SaveActivityProfile(ctx, profile); err != nil {
+		logger.Err("An unexpected error occured on save activity profile into DB: ", err)
+		return http.StatusInternalServerError, "Internal Server Error"
+	}
+
+	if err := c.store.AddQuotaUsage(ctx, user, int64(len(content)-len(oldContent))); err != nil {
+		logger.Err("An unexpected error occured on increment quota: ", err)
+		return http.StatusInternalServerError, "Internal Server Error"
+	}
+
+	return http.StatusNoContent, "No Content"
+}
+
+// DeleteActivityProfile は Activity Profile の DELETE リクエストを扱うハンドラである。
+func (c *Controller) DeleteActivityProfile(params martini.Params, w http.ResponseWriter, req *http.Request) (int, string) {
+	setDocumentHeader(w, req)
+	user, app := params["user"], params["app"]
+
+	xAPIVersion := req.Header.Get("X-Experience-API-Version")
+	if !validator.IsValidXAPIVersion(xAPIVersion) {
+		return NewBadRequestErr("Invalid or empty xAPI version given in X-Experience-API-Version").Response()
+	}
+
+	urlParams := req.URL.Query()
+	activityID, profileID := urlParams.Get("activityId"), urlParams.Get("profileId")
+	if len(activityID) == 0 || len(profileID) == 0 {
+		return NewBadRequestErr("activityId and profileId are required").Response()
+	}
+
+	ctx := req.Context()
+
+	profile, err := c.store.FindActivityProfile(ctx, user, app, activityID, profileID)
+	if err == model.ErrNotFound {
+		return http.StatusNoContent, "No Content"
+	}
+	if err != nil {
+		logger.Err("An unexpected error occured on find DB: ", err)
+		return http.StatusInternalServerError, "Internal Server Error"
+	}
+
+	if code, mess := checkPrecondition(req, profile.Content, false); code != http.StatusOK {
+		return code, mess
+	}
+
+	if err := c.store.RemoveActivityProfile(ctx, user, app, activityID, profileID); err != nil && err != model.ErrNotFound {
+		logger.Err("An unexpected error occured on remove activity profile from DB: ", err)
+		return http.StatusInternalServerError, "Internal Server Error"
+	}
+
+	if err := c.store.AddQuotaUsage(ctx, user, -int64(len(profile.Content))); err != nil {
+		logger.Err("An unexpected error occured on decrement quota: ", err)
+		return http.StatusInternalServerError, "Internal Server Error"
+	}
+
+	return http.StatusNoContent, "No Content"
+}
@@ -0,0 +1,142 @@
+// Copyright 2015 realglobe, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-martini/martini"
+	"github.com/satori/go.uuid"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+func initActivityProfileHandler(db *mongo.Database) *martini.ClassicMartini {
+	mart := martini.Classic()
+	hand := newController(db)
+	mart.Get("/:user/:app/activities/profile", hand.FindActivityProfile)
+	mart.Put("/:user/:app/activities/profile", hand.StoreActivityProfile)
+	mart.Post("/:user/:app/activities/profile", hand.MergeActivityProfile)
+	mart.Delete("/:user/:app/activities/profile", hand.DeleteActivityProfile)
+
+	return mart
+}
+
+func requestActivityProfile(t *testing.T, mart *martini.ClassicMartini, method string, v *url.Values, body io.Reader, header map[string]string) *httptest.ResponseRecorder {
+	req, err := http.NewRequest(method, "/test/test/activities/profile?"+v.Encode(), body)
+	fatalIfError(t, err)
+
+	req.Header.Add("X-Experience-API-Version", "1.0.2")
+	for k, v := range header {
+		req.Header.Add(k, v)
+	}
+
+	resp := httptest.NewRecorder()
+	mart.ServeHTTP(resp, req)
+
+	return resp
+}
+
+func TestPutAndGetActivityProfile(t *testing.T) {
+	db := initDatabase(t)
+	defer closeDatabase(db)
+	mart := initActivityProfileHandler(db)
+
+	v := &url.Values{}
+	v.Add("activityId", "http://example.com/activities/"+uuid.NewV4().String())
+	v.Add("profileId", "leaderboard")
+
+	resp := requestActivityProfile(t, mart, "PUT", v, strings.NewReader(`{"top": "alice"}`),
+		map[string]string{"Content-Type": "application/json"})
+	if got, expected := resp.Code, http.StatusNoContent; got != expected {
+		t.Fatalf("Expected %v response code from put activity profile; got %d", expected, got)
+	}
+
+	// If-Match, If-None-Match が無い上書きは Conflict
+	resp = requestActivityProfile(t, mart, "PUT", v, strings.NewReader(`{"top": "bob"}`),
+		map[string]string{"Content-Type": "application/json"})
+	if got, expected := resp.Code, http.StatusConflict; got != expected {
+		t.Fatalf("Expected %v response code from put activity profile; got %d", expected, got)
+	}
+
+	resp = requestActivityProfile(t, mart, "GET", v, nil, nil)
+	if got, expected := resp.Code, http.StatusOK; got != expected {
+		t.Fatalf("Expected %v response code from get activity profile; got %d", expected, got)
+	}
+	etag := resp.Header().Get("ETag")
+	body, err := ioutil.ReadAll(resp.Body)
+	fatalIfError(t, err)
+	if got, expected := string(body), `{"top": "alice"}`; got != expected {
+		t.Fatalf("Expected activity profile %v; got %v", expected, got)
+	}
+
+	resp = requestActivityProfile(t, mart, "PUT", v, strings.NewReader(`{"top": "bob"}`),
+		map[string]string{"Content-Type": "application/json", "If-Match": etag})
+	if got, expected := resp.Code, http.StatusNoContent; got != expected {
+		t.Fatalf("Expected %v response code from put activity profile with If-Match; got %d", expected, got)
+	}
+
+	// 古い ETag による更新は失敗する
+	resp = requestActivityProfile(t, mart, "DELETE", v, nil, map[string]string{"If-Match": etag})
+	if got, expected := resp.Code, http.StatusPreconditionFailed; got != expected {
+		t.Fatalf("Expected %v response code from delete activity profile; got %d", expected, got)
+	}
+}
+
+func TestGetActivityProfileIDsWithSince(t *testing.T) {
+	db := initDatabase(t)
+	defer closeDatabase(db)
+	mart := initActivityProfileHandler(db)
+
+	activityID := "http://example.com/activities/" + uuid.NewV4().String()
+	put := func(profileID string) {
+		v := &url.Values{}
+		v.Add("activityId", activityID)
+		v.Add("profileId", profileID)
+
+		resp := requestActivityProfile(t, mart, "POST", v, strings.NewReader(`{}`),
+			map[string]string{"Content-Type": "application/json"})
+		if got, expected := resp.Code, http.StatusNoContent; got != expected {
+			t.Fatalf("Expected %v response code from post activity profile; got %d", expected, got)
+		}
+	}
+
+	put("profile-1")
+	time.Sleep(10 * time.Millisecond)
+	since := time.Now()
+	time.Sleep(10 * time.Millisecond)
+	put("profile-2")
+
+	v := &url.Values{}
+	v.Add("activityId", activityID)
+	v.Add("since", since.Format(time.RFC3339Nano))
+
+	resp := requestActivityProfile(t, mart, "GET", v, nil, nil)
+	if got, expected := resp.Code, http.StatusOK; got != expected {
+		t.Fatalf("Expected %v response code from get activity profile ids; got %d", expected, got)
+	}
+	var ids []string
+	fatalIfError(t, json.NewDecoder(resp.Body).Decode(&ids))
+	if len(ids) != 1 || ids[0] != "profile-2" {
+		t.Fatalf("Expected [profile-2] as profile ids; got %v", ids)
+	}
+}
@@ -0,0 +1,86 @@
+// Copyright 2015 realglobe, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/Jeffail/gabs"
+	"github.com/satori/go.uuid"
+)
+
+func TestGetActivityWithMergedDefinition(t *testing.T) {
+	db := initDatabase(t)
+	defer closeDatabase(db)
+	mart := initHandler(db)
+	mart.Get("/:user/:app/activities", newController(db).FindActivity)
+
+	activityID := "http://example.com/activities/" + uuid.NewV4().String()
+
+	stmt1, err := gabs.ParseJSON([]byte(singleStatement02))
+	fatalIfError(t, err)
+	_, err = stmt1.SetP(activityID, "object.id")
+	fatalIfError(t, err)
+	_, err = stmt1.SetP("Old Name", "object.definition.name.en-US")
+	fatalIfError(t, err)
+	_, err = stmt1.SetP("Namae", "object.definition.name.ja-JP")
+	fatalIfError(t, err)
+	putStatement(t, mart, stmt1.String(), uuid.NewV4().String())
+
+	stmt2, err := gabs.ParseJSON([]byte(singleStatement02))
+	fatalIfError(t, err)
+	_, err = stmt2.SetP(activityID, "object.id")
+	fatalIfError(t, err)
+	_, err = stmt2.SetP("New Name", "object.definition.name.en-US")
+	fatalIfError(t, err)
+	_, err = stmt2.SetP("http://example.com/activity-types/website", "object.definition.type")
+	fatalIfError(t, err)
+	putStatement(t, mart, stmt2.String(), uuid.NewV4().String())
+
+	v := &url.Values{}
+	v.Add("activityId", activityID)
+
+	resp := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "/test/test/activities?"+v.Encode(), nil)
+	fatalIfError(t, err)
+	req.Header.Add("X-Experience-API-Version", "1.0.2")
+	mart.ServeHTTP(resp, req)
+
+	if got, expected := resp.Code, http.StatusOK; got != expected {
+		t.Fatalf("Expected %v response code from get activity; got %d", expected, got)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	fatalIfError(t, err)
+	activity, err := gabs.ParseJSON(body)
+	fatalIfError(t, err)
+
+	if id, ok := activity.Search("id").Data().(string); !ok || id != activityID {
+		t.Fatalf("Expected activity id %v; got %v", activityID, id)
+	}
+	for path, expected := range map[string]string{
+		"definition.name.en-US": "New Name",
+		"definition.name.ja-JP": "Namae",
+		"definition.type":       "http://example.com/activity-types/website",
+	} {
+		if got, ok := activity.Path(path).Data().(string); !ok || got != expected {
+			t.Fatalf("Expected %v in %s of activity; got %v", expected, path, got)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+// Copyright 2015 realglobe, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/go-martini/martini"
+	"github.com/realglobe-Inc/edo-xrs/app/validator"
+)
+
+// FindAgent は Agents リソースの GET リクエストを扱うハンドラである。
+// 保存されているステートメントに現れる、agent と同じ IFI を持つエージェントの name を
+// agent に加えた Person オブジェクトを返す。(Experience API, Section 7.6 を参照)
+// 同じ人物の異なる IFI を結び付ける情報は持たないため、IFI は agent のもののみとなる。
+func (c *Controller) FindAgent(params martini.Params, w http.ResponseWriter, req *http.Request) (int, string) {
+	setDocumentHeader(w, req)
+	user, app := params["user"], params["app"]
+	ctx := req.Context()
+
+	xAPIVersion := req.Header.Get("X-Experience-API-Version")
+	if !validator.IsValidXAPIVersion(xAPIVersion) {
+		return NewBadRequestErr("Invalid or empty xAPI version given in X-Experience-API-Version").Response()
+	}
+
+	agent, err := parseAgent(xAPIVersion, req.URL.Query().Get("agent"))
+	if err != nil {
+		return NewBadRequestErrF("Invalid agent given: %s", err).Response()
+	}
+
+	if !hasIFI(agent) {
+		return NewBadRequestErr("Agent must have an inverse functional identifier").Response()
+	}
+
+	names, err := c.store.FindAgentNames(ctx, user, app, agent)
+	if err != nil {
+		logger.Err("An unexpected error occured on find DB: ", err)
+		return http.StatusInternalServerError, "Internal Server Error"
+	}
+
+	person := newPerson()
+	person.add(agent)
+	for _, name := range names {
+		person.add(map[string]interface{}{"name": name})
+	}
+
+	body, err := json.Marshal(person.toMap())
+	if err != nil {
+		logger.Err("An unexpected error occured: ", err)
+		return http.StatusInternalServerError, "Internal Server Error"
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	return http.StatusOK, string(body)
+}
+
+// person は Person オブジェクトを組み立てるために、各フィールドの値を重複なく保持する。
+type person struct {
+	fields map[string][]interface{}
+	seen   map[string]bool
+}
+
+// Person オブジェクトが配列として持つフィールド
+var personFields = []string{"name", "mbox", "mbox_sha1sum", "openid", "account"}
+
+func newPerson() *person {
+	return &person{
+		fields: make(map[string][]interface{}),
+		seen:   make(map[string]bool),
+	}
+}
+
+// add はエージェントの name と IFI を Person に加える。
+func (p *person) add(agent map[string]interface{}) {
+	for _, field := range personFields {
+		v, ok := agent[field]
+		if !ok {
+			continue
+		}
+
+		key, err := json.Marshal(map[string]interface{}{field: v})
+		if err != nil || p.seen[string(key)] {
+			continue
+		}
+		p.seen[string(key)] = true
+		p.fields[field] = append(p.fields[field], v)
+	}
+}
+
+func (p *person) toMap() map[string]interface{} {
+	m := map[string]interface{}{
+		"objectType": "Person",
+	}
+	for field, values := range p.fields {
+		m[field] = values
+	}
+
+	return m
+}
+
+// hasIFI はエージェントが IFI を持つかを返す。
+func hasIFI(agent map[string]interface{}) bool {
+	for _, field := range []string{"mbox", "mbox_sha1sum", "openid", "account"} {
+		if _, ok := agent[field]; ok {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,121 @@
+// Copyright 2015 realglobe, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/go-martini/martini"
+	"github.com/satori/go.uuid"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+func initAgentProfileHandler(db *mongo.Database) *martini.ClassicMartini {
+	mart := martini.Classic()
+	hand := newController(db)
+	mart.Get("/:user/:app/agents/profile", hand.FindAgentProfile)
+	mart.Put("/:user/:app/agents/profile", hand.StoreAgentProfile)
+	mart.Post("/:user/:app/agents/profile", hand.MergeAgentProfile)
+	mart.Delete("/:user/:app/agents/profile", hand.DeleteAgentProfile)
+
+	return mart
+}
+
+func requestAgentProfile(t *testing.T, mart *martini.ClassicMartini, method string, v *url.Values, body io.Reader) *httptest.ResponseRecorder {
+	req, err := http.NewRequest(method, "/test/test/agents/profile?"+v.Encode(), body)
+	fatalIfError(t, err)
+
+	req.Header.Add("X-Experience-API-Version", "1.0.2")
+	req.Header.Add("Content-Type", "application/json")
+
+	resp := httptest.NewRecorder()
+	mart.ServeHTTP(resp, req)
+
+	return resp
+}
+
+func TestAgentProfile(t *testing.T) {
+	db := initDatabase(t)
+	defer closeDatabase(db)
+	mart := initAgentProfileHandler(db)
+
+	agent := `{"objectType": "Agent", "mbox": "mailto:` + uuid.NewV4().String() + `@example.com"}`
+	v := &url.Values{}
+	v.Add("agent", agent)
+	v.Add("profileId", "preferences")
+
+	resp := requestAgentProfile(t, mart, "POST", v, strings.NewReader(`{"language": "ja-JP"}`))
+	if got, expected := resp.Code, http.StatusNoContent; got != expected {
+		t.Fatalf("Expected %v response code from post agent profile; got %d", expected, got)
+	}
+	resp = requestAgentProfile(t, mart, "POST", v, strings.NewReader(`{"fontSize": "large"}`))
+	if got, expected := resp.Code, http.StatusNoContent; got != expected {
+		t.Fatalf("Expected %v response code from post agent profile; got %d", expected, got)
+	}
+
+	resp = requestAgentProfile(t, mart, "GET", v, nil)
+	if got, expected := resp.Code, http.StatusOK; got != expected {
+		t.Fatalf("Expected %v response code from get agent profile; got %d", expected, got)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	fatalIfError(t, err)
+	if got, expected := string(body), `{"fontSize":"large","language":"ja-JP"}`; got != expected {
+		t.Fatalf("Expected agent profile %v; got %v", expected, got)
+	}
+
+	// profileId の一覧
+	lv := &url.Values{}
+	lv.Add("agent", agent)
+	resp = requestAgentProfile(t, mart, "GET", lv, nil)
+	if got, expected := resp.Code, http.StatusOK; got != expected {
+		t.Fatalf("Expected %v response code from get agent profile ids; got %d", expected, got)
+	}
+	var ids []string
+	fatalIfError(t, json.NewDecoder(resp.Body).Decode(&ids))
+	if len(ids) != 1 || ids[0] != "preferences" {
+		t.Fatalf("Expected [preferences] as profile ids; got %v", ids)
+	}
+
+	resp = requestAgentProfile(t, mart, "DELETE", v, nil)
+	if got, expected := resp.Code, http.StatusNoContent; got != expected {
+		t.Fatalf("Expected %v response code from delete agent profile; got %d", expected, got)
+	}
+	resp = requestAgentProfile(t, mart, "GET", v, nil)
+	if got, expected := resp.Code, http.StatusNotFound; got != expected {
+		t.Fatalf("Expected %v response code from get deleted agent profile; got %d", expected, got)
+	}
+}
+
+func TestAgentProfileWithInvalidAgent(t *testing.T) {
+	db := initDatabase(t)
+	defer closeDatabase(db)
+	mart := initAgentProfileHandler(db)
+
+	v := &url.Values{}
+	v.Add("agent", `{"objectType": "Agent", "name": "no identifier"}`)
+	v.Add("profileId", "preferences")
+
+	resp := requestAgentProfile(t, mart, "GET", v, nil)
+	if got, expected := resp.Code, http.StatusBadRequest; got != expected {
+		t.Fatalf("Expected %v response code from get agent profile; got %d", expected, got)
+	}
+}
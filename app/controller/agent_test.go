@@ -0,0 +1,74 @@
+// Copyright 2015 realglobe, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/Jeffail/gabs"
+	"github.com/satori/go.uuid"
+)
+
+func TestGetAgentAsPerson(t *testing.T) {
+	db := initDatabase(t)
+	defer closeDatabase(db)
+	mart := initHandler(db)
+	mart.Get("/:user/:app/agents", newController(db).FindAgent)
+
+	mbox := "mailto:" + uuid.NewV4().String() + "@example.com"
+	for _, name := range []string{"Taro Realglobe", "Realglobe Taro"} {
+		stmt, err := gabs.ParseJSON([]byte(singleStatement01))
+		fatalIfError(t, err)
+		_, err = stmt.SetP(map[string]interface{}{
+			"objectType": "Agent",
+			"name":       name,
+			"mbox":       mbox,
+		}, "actor")
+		fatalIfError(t, err)
+		putStatement(t, mart, stmt.String(), uuid.NewV4().String())
+	}
+
+	v := &url.Values{}
+	v.Add("agent", `{"objectType": "Agent", "mbox": "`+mbox+`"}`)
+
+	resp := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "/test/test/agents?"+v.Encode(), nil)
+	fatalIfError(t, err)
+	req.Header.Add("X-Experience-API-Version", "1.0.2")
+	mart.ServeHTTP(resp, req)
+
+	if got, expected := resp.Code, http.StatusOK; got != expected {
+		t.Fatalf("Expected %v response code from get agent; got %d", expected, got)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	fatalIfError(t, err)
+	person, err := gabs.ParseJSON(body)
+	fatalIfError(t, err)
+
+	if got, ok := person.Search("objectType").Data().(string); !ok || got != "Person" {
+		t.Fatalf("Expected Person as objectType; got %v", got)
+	}
+	if cnt, err := person.ArrayCount("name"); err != nil || cnt != 2 {
+		t.Fatalf("Expected 2 names in person; got %d", cnt)
+	}
+	if cnt, err := person.ArrayCount("mbox"); err != nil || cnt != 1 {
+		t.Fatalf("Expected 1 mbox in person; got %d", cnt)
+	}
+}
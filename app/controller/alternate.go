@@ -0,0 +1,129 @@
+// Copyright 2015 realglobe, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/go-martini/martini"
+	"github.com/martini-contrib/acceptlang"
+)
+
+// 代替リクエスト構文においてフォームのフィールドとして与えられるヘッダ
+var alternateRequestHeaders = []string{
+	"Authorization",
+	"X-Experience-API-Version",
+	"Content-Type",
+	"Content-Length",
+	"If-Match",
+	"If-None-Match",
+	"Accept-Language",
+}
+
+// AlternateRequest は代替リクエスト構文 (Experience API, Section 7.8 を参照) で送られた
+// リクエストを、本来のリクエストに書き換えるミドルウェアである。
+// URL パラメータに method が無い場合は何もしない。
+// method がある場合、フォームのフィールドからヘッダとリクエストボディ (content) を、
+// それ以外のフィールドから URL パラメータを組み立てる。
+func AlternateRequest(w http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	method := query.Get("method")
+	if len(method) == 0 {
+		return
+	}
+
+	// method 以外の URL パラメータは認められない
+	if len(query) != 1 || len(query["method"]) != 1 {
+		writeAlternateRequestError(w, req, NewBadRequestErr("Only method parameter is allowed in URL on alternate request syntax"))
+		return
+	}
+
+	switch method = strings.ToUpper(method); method {
+	case "GET", "HEAD", "PUT", "POST":
+	default:
+		writeAlternateRequestError(w, req, NewBadRequestErrF("Unsupported method given on alternate request syntax: %s", method))
+		return
+	}
+
+	mediatype, _, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if err != nil || mediatype != "application/x-www-form-urlencoded" {
+		writeAlternateRequestError(w, req, NewBadRequestErr("Content-Type must be application/x-www-form-urlencoded on alternate request syntax"))
+		return
+	}
+
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		writeAlternateRequestError(w, req, NewBadRequestErrF("An error occured on read request: %s", err))
+		return
+	}
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		writeAlternateRequestError(w, req, NewBadRequestErrF("Invalid form given on alternate request syntax: %s", err))
+		return
+	}
+
+	// ヘッダを組み立てる
+	for _, name := range alternateRequestHeaders {
+		req.Header.Del(name)
+		if v, ok := form[name]; ok {
+			for _, value := range v {
+				req.Header.Add(name, value)
+			}
+			delete(form, name)
+		}
+	}
+
+	// リクエストボディを組み立てる
+	content := form.Get("content")
+	delete(form, "content")
+	req.Body = ioutil.NopCloser(strings.NewReader(content))
+	req.ContentLength = int64(len(content))
+	req.Header.Set("Content-Length", strconv.Itoa(len(content)))
+
+	// 残りのフィールドは URL パラメータとなる
+	req.URL.RawQuery = form.Encode()
+	req.Method = method
+}
+
+func writeAlternateRequestError(w http.ResponseWriter, req *http.Request, e BadRequestErr) {
+	code, body := e.Response()
+
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	setXAPIVersionHeader(w, req)
+	w.WriteHeader(code)
+	w.Write([]byte(body))
+}
+
+// DispatchStatement は POST /statements に送られたリクエストを、AlternateRequest により
+// 書き換えられたメソッドに応じたハンドラに振り分ける。
+// 代替リクエスト構文でない場合は StoreMultStatement により扱われる。
+func (c *Controller) DispatchStatement(params martini.Params,
+	languages acceptlang.AcceptLanguages, w http.ResponseWriter, req *http.Request) (int, string) {
+	switch req.Method {
+	case "PUT":
+		return c.StoreStatement(params, w, req)
+	case "GET":
+		return c.FindStatement(params, languages, w, req)
+	case "HEAD":
+		return c.FindStatementHead(params, languages, w, req)
+	default:
+		return c.StoreMultStatement(params, w, req)
+	}
+}
@@ -0,0 +1,100 @@
+// Copyright 2015 realglobe, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/Jeffail/gabs"
+	"github.com/go-martini/martini"
+	"github.com/martini-contrib/acceptlang"
+	"github.com/satori/go.uuid"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+func initAlternateHandler(db *mongo.Database) *martini.ClassicMartini {
+	mart := martini.Classic()
+	hand := newController(db)
+	mart.Post("/:user/:app/statements", AlternateRequest, acceptlang.Languages(), hand.DispatchStatement)
+
+	return mart
+}
+
+func requestAlternate(t *testing.T, mart http.Handler, method string, form url.Values) *httptest.ResponseRecorder {
+	resp := httptest.NewRecorder()
+	req, err := http.NewRequest("POST", "/test/test/statements?method="+method, strings.NewReader(form.Encode()))
+	fatalIfError(t, err)
+
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	mart.ServeHTTP(resp, req)
+
+	return resp
+}
+
+func TestAlternatePutAndGetStatement(t *testing.T) {
+	db := initDatabase(t)
+	defer closeDatabase(db)
+	mart := initAlternateHandler(db)
+
+	id := uuid.NewV4().String()
+
+	form := url.Values{}
+	form.Add("X-Experience-API-Version", "1.0.2")
+	form.Add("Content-Type", "application/json")
+	form.Add("content", singleStatement01)
+	form.Add("statementId", id)
+
+	resp := requestAlternate(t, mart, "PUT", form)
+	if got, expected := resp.Code, http.StatusNoContent; got != expected {
+		t.Fatalf("Expected %v response code from alternate put statement; got %d", expected, got)
+	}
+
+	form = url.Values{}
+	form.Add("X-Experience-API-Version", "1.0.2")
+	form.Add("statementId", id)
+
+	resp = requestAlternate(t, mart, "GET", form)
+	if got, expected := resp.Code, http.StatusOK; got != expected {
+		t.Fatalf("Expected %v response code from alternate get statement; got %d", expected, got)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	fatalIfError(t, err)
+	respstmt, err := gabs.ParseJSON(body)
+	fatalIfError(t, err)
+	if got, ok := respstmt.Search("id").Data().(string); !ok || got != id {
+		t.Fatalf("Expected statement %s from alternate get statement; got %v", id, got)
+	}
+}
+
+func TestAlternateRequestWithExtraParameter(t *testing.T) {
+	db := initDatabase(t)
+	defer closeDatabase(db)
+	mart := initAlternateHandler(db)
+
+	form := url.Values{}
+	form.Add("X-Experience-API-Version", "1.0.2")
+	form.Add("statementId", uuid.NewV4().String())
+
+	resp := requestAlternate(t, mart, "GET&limit=1", form)
+	if got, expected := resp.Code, http.StatusBadRequest; got != expected {
+		t.Fatalf("Expected %v response code from alternate request with extra parameter; got %d", expected, got)
+	}
+}
@@ -0,0 +1,238 @@
+// Copyright 2015 realglobe, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"syscall"
+	"time"
+
+	"github.com/realglobe-Inc/edo-xrs/app/miscs"
+	"github.com/realglobe-Inc/edo-xrs/app/model"
+)
+
+// fileUrl により参照される添付ファイルの扱い
+const (
+	// fileUrl のみを持つ添付ファイルを受け付けない
+	fileURLPolicyReject = "reject"
+	// fileUrl を参照としてのみ保存し、内容は保存しない
+	fileURLPolicyReference = "reference"
+	// fileUrl から内容を取得し、sha2 値を確認して保存する
+	fileURLPolicyFetch = "fetch"
+)
+
+// fileUrl から取得する添付ファイルの、設定で指定されない場合の最大サイズ
+const defaultFetchMaxSize = 100 << 20
+
+// uploadedAttachments は一つのリクエストの処理中にストレージに保存した添付ファイルの ID を保持する。
+// ステートメントの保存に失敗した場合、これらの添付ファイルを削除する。
+// fetched は fileUrl から取得した添付ファイルの合計サイズであり、ステートメントと共にディスク使用量に加える。
+type uploadedAttachments struct {
+	ids     []interface{}
+	fetched int64
+}
+
+func (u *uploadedAttachments) add(id interface{}) {
+	u.ids = append(u.ids, id)
+}
+
+// removeUploadedAttachments はリクエストの処理中に保存した添付ファイルを削除する。
+// 以前のリクエストで保存された同じ sha2 値の添付ファイルは削除しない。
+// リクエストがキャンセルされていても削除できるよう、新しいコンテキストを用いる。
+func (c *Controller) removeUploadedAttachments(uploaded *uploadedAttachments) {
+	if len(uploaded.ids) == 0 {
+		return
+	}
+
+	for _, id := range uploaded.ids {
+		if err := c.store.RemoveAttachment(context.Background(), id); err != nil {
+			logger.Err("An unexpected error occured on remove attachment from DB: ", err)
+		}
+	}
+	uploaded.ids = nil
+}
+
+// storeAttachment は添付ファイルの内容をストレージに保存し、そのファイルの ID を返す。
+// 内容の sha2 値が hash と一致しない場合は保存せず、エラーを返す。
+func storeAttachment(ctx context.Context, store model.StatementStore, hash, contentType, encoding string, r io.Reader) (interface{}, error) {
+	sha2 := sha256.New()
+	id, err := store.PutAttachment(ctx, hash, contentType, encoding, io.TeeReader(r, sha2))
+	if err != nil {
+		return nil, err
+	}
+	if fmt.Sprintf("%x", sha2.Sum(nil)) != hash {
+		store.RemoveAttachment(ctx, id)
+		return nil, errors.New("content hash and X-Experiece-API-Hash does not match")
+	}
+
+	return id, nil
+}
+
+// storeFileURLAttachments は multipart/mixed のパートを持たず、fileUrl により参照される
+// 添付ファイルを、設定された fileUrlPolicy に従って扱う。取得して保存した添付ファイルは uploaded に加える。
+func (c *Controller) storeFileURLAttachments(ctx context.Context, statements []interface{}, attachmentSHA2s []string, uploaded *uploadedAttachments) (int, string) {
+	given := make(map[string]bool)
+	for _, sha2 := range attachmentSHA2s {
+		given[sha2] = true
+	}
+
+	var attachments []map[string]interface{}
+	for _, stmt := range statements {
+		atts, _ := stmt.(map[string]interface{})["attachments"].([]interface{})
+		for _, att := range atts {
+			a, ok := att.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			sha2, _ := a["sha2"].(string)
+			if _, ok := a["fileUrl"]; ok && !given[sha2] {
+				attachments = append(attachments, a)
+			}
+		}
+	}
+	if len(attachments) == 0 {
+		return http.StatusOK, "ok"
+	}
+
+	switch miscs.GlobalConfig.Attachment.FileURLPolicy {
+	case fileURLPolicyReject:
+		return NewBadRequestErr("Attachment content must be given in multipart/mixed request; fileUrl is not accepted").Response()
+	case fileURLPolicyFetch:
+		for _, a := range attachments {
+			id, size, err := fetchAttachment(ctx, c.store, a)
+			if err != nil {
+				return NewBadRequestErrF("An error occured on fetch attachment: %s", err).Response()
+			}
+			uploaded.add(id)
+			uploaded.fetched += size
+		}
+	}
+
+	return http.StatusOK, "ok"
+}
+
+// isFetchableIP は fileUrl から取得する際に接続してよいアドレスであるかを返す。
+// 内部のサービスへのリクエストを送らせないよう、プライベート、ループバック、リンクローカルなどの
+// グローバルでないアドレスには接続しない。
+var isFetchableIP = func(ip net.IP) bool {
+	return ip.IsGlobalUnicast() && !ip.IsPrivate() && !sharedAddressSpace.Contains(ip)
+}
+
+// sharedAddressSpace はキャリアグレード NAT のためのアドレス (RFC 6598) である。
+var sharedAddressSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// refuseUnfetchableAddress は net.Dialer の Control として、名前解決した後のアドレスを確認する。
+// リダイレクトの先や、名前解決の結果が変わった場合にも確認するため、接続の度に呼ばれるここで行う。
+func refuseUnfetchableAddress(network, address string, conn syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || !isFetchableIP(ip) {
+		return fmt.Errorf("fileUrl must not refer to a non-public address: %s", host)
+	}
+
+	return nil
+}
+
+// newFetchClient は fileUrl から取得するための http.Client を返す。
+// 環境変数のプロキシを経由すると接続先のアドレスを確認できないため、プロキシは用いない。
+func newFetchClient() *http.Client {
+	timeout := time.Duration(miscs.GlobalConfig.Attachment.FetchTimeout) * time.Second
+	dialer := &net.Dialer{
+		Timeout: timeout,
+		Control: refuseUnfetchableAddress,
+	}
+
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: timeout,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 10 {
+				return errors.New("stopped after 10 redirects")
+			}
+			return checkFetchURL(req.URL)
+		},
+	}
+}
+
+// checkFetchURL は fileUrl が取得できる URL であるかを確認する。
+func checkFetchURL(u *url.URL) error {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("fileUrl must be http or https: %s", u)
+	}
+
+	return nil
+}
+
+// fetchAttachment は添付ファイルの fileUrl から内容を取得し、ストレージに保存する。
+// 保存したファイルの ID とサイズを返す。設定された最大サイズを超える場合は保存しない。
+func fetchAttachment(ctx context.Context, store model.StatementStore, attachment map[string]interface{}) (interface{}, int64, error) {
+	fileURL, _ := attachment["fileUrl"].(string)
+	sha2, _ := attachment["sha2"].(string)
+	contentType, _ := attachment["contentType"].(string)
+
+	maxSize := miscs.GlobalConfig.Attachment.FetchMaxSize
+	if maxSize == 0 {
+		maxSize = defaultFetchMaxSize
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fileURL, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	if err := checkFetchURL(req.URL); err != nil {
+		return nil, 0, err
+	}
+	client := newFetchClient()
+	defer client.CloseIdleConnections()
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("unexpected status %d from %s", resp.StatusCode, fileURL)
+	}
+	if resp.ContentLength > maxSize {
+		return nil, 0, fmt.Errorf("attachment from %s exceeds %d bytes", fileURL, maxSize)
+	}
+
+	// io.LimitReader と同じく最大サイズを 1 バイト超えるまで読み、超えた場合は保存したファイルを削除する
+	body := &io.LimitedReader{R: resp.Body, N: maxSize + 1}
+	id, err := storeAttachment(ctx, store, sha2, contentType, "binary", body)
+	if body.N == 0 {
+		if err == nil {
+			store.RemoveAttachment(ctx, id)
+		}
+		return nil, 0, fmt.Errorf("attachment from %s exceeds %d bytes", fileURL, maxSize)
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return id, maxSize + 1 - body.N, nil
+}
@@ -0,0 +1,208 @@
+// Copyright 2015 realglobe, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/realglobe-Inc/edo-xrs/app/miscs"
+	"github.com/satori/go.uuid"
+)
+
+const fileURLContent = "example content text from fileUrl\n"
+
+// putStatementWithFileURL は fileUrl により参照される添付ファイルを持つステートメントを PUT し、
+// ステートメントIDとレスポンスコードを返す。
+func putStatementWithFileURL(t *testing.T, mart http.Handler, fileURL string) (string, int) {
+	var statement map[string]interface{}
+	fatalIfError(t, json.Unmarshal([]byte(singleStatement01), &statement))
+	statement["attachments"] = []interface{}{
+		map[string]interface{}{
+			"usageType":   "http://example.com/attachment-usage/test",
+			"display":     map[string]interface{}{"en-US": "A test attachment"},
+			"contentType": "text/plain",
+			"length":      len(fileURLContent),
+			"sha2":        fmt.Sprintf("%x", sha256.Sum256([]byte(fileURLContent))),
+			"fileUrl":     fileURL,
+		},
+	}
+	stmt, err := json.Marshal(statement)
+	fatalIfError(t, err)
+
+	id := uuid.NewV4().String()
+	req, err := http.NewRequest("PUT", "/test/test/statements?statementId="+id, bytes.NewReader(stmt))
+	fatalIfError(t, err)
+
+	resp := httptest.NewRecorder()
+	req.Header.Add("X-Experience-API-Version", "1.0.2")
+	mart.ServeHTTP(resp, req)
+
+	return id, resp.Code
+}
+
+// getAttachmentParts は attachments=true によりステートメントを取得し、添付ファイルのパートの
+// X-Experience-API-Hash を返す。
+func getAttachmentParts(t *testing.T, mart http.Handler, id string) []string {
+	v := &url.Values{}
+	v.Add("statementId", id)
+	v.Add("attachments", "true")
+
+	resp := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "/test/test/statements?"+v.Encode(), nil)
+	fatalIfError(t, err)
+	req.Header.Add("X-Experience-API-Version", "1.0.2")
+	mart.ServeHTTP(resp, req)
+
+	if got, expected := resp.Code, http.StatusOK; got != expected {
+		t.Fatalf("Expected %v response code from get statement with attachments; got %d", expected, got)
+	}
+
+	_, ps, err := mime.ParseMediaType(resp.Header().Get("Content-Type"))
+	fatalIfError(t, err)
+	r := multipart.NewReader(resp.Body, ps["boundary"])
+
+	// ステートメントのパート
+	if _, err := r.NextPart(); err != nil {
+		t.Fatal(err)
+	}
+
+	var hashes []string
+	for {
+		p, err := r.NextPart()
+		if err != nil {
+			break
+		}
+		hashes = append(hashes, p.Header.Get("X-Experience-API-Hash"))
+	}
+
+	return hashes
+}
+
+func setFileURLPolicy(policy string) func() {
+	config := miscs.GlobalConfig.Attachment
+	miscs.GlobalConfig.Attachment.FileURLPolicy = policy
+	miscs.GlobalConfig.Attachment.FetchTimeout = 10
+
+	return func() {
+		miscs.GlobalConfig.Attachment = config
+	}
+}
+
+// allowLoopbackFetch はテストのサーバーから取得できるよう、ループバックアドレスへの接続を許す。
+func allowLoopbackFetch() func() {
+	isFetchable := isFetchableIP
+	isFetchableIP = func(ip net.IP) bool {
+		return ip.IsLoopback() || isFetchable(ip)
+	}
+
+	return func() {
+		isFetchableIP = isFetchable
+	}
+}
+
+func TestPutStatementWithFileURLRejected(t *testing.T) {
+	db := initDatabase(t)
+	defer closeDatabase(db)
+	mart := initHandler(db)
+	defer setFileURLPolicy(fileURLPolicyReject)()
+
+	if _, code := putStatementWithFileURL(t, mart, "http://example.com/attachment"); code != http.StatusBadRequest {
+		t.Fatalf("Expected %v response code from put statement with fileUrl; got %d", http.StatusBadRequest, code)
+	}
+}
+
+func TestGetStatementWithFileURLReference(t *testing.T) {
+	db := initDatabase(t)
+	defer closeDatabase(db)
+	mart := initHandler(db)
+	defer setFileURLPolicy(fileURLPolicyReference)()
+
+	id, code := putStatementWithFileURL(t, mart, "http://example.com/attachment/"+uuid.NewV4().String())
+	if code != http.StatusNoContent {
+		t.Fatalf("Expected %v response code from put statement with fileUrl; got %d", http.StatusNoContent, code)
+	}
+
+	if hashes := getAttachmentParts(t, mart, id); len(hashes) != 0 {
+		t.Fatalf("Expected no attachment parts for referenced attachment; got %v", hashes)
+	}
+}
+
+func TestGetStatementWithFileURLFetched(t *testing.T) {
+	db := initDatabase(t)
+	defer closeDatabase(db)
+	mart := initHandler(db)
+	defer setFileURLPolicy(fileURLPolicyFetch)()
+	defer allowLoopbackFetch()()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if strings.HasSuffix(req.URL.Path, "/broken") {
+			w.Write([]byte("unexpected content"))
+			return
+		}
+		w.Write([]byte(fileURLContent))
+	}))
+	defer server.Close()
+
+	if _, code := putStatementWithFileURL(t, mart, server.URL+"/broken"); code != http.StatusBadRequest {
+		t.Fatalf("Expected %v response code from put statement with mismatched fileUrl; got %d", http.StatusBadRequest, code)
+	}
+
+	id, code := putStatementWithFileURL(t, mart, server.URL+"/attachment")
+	if code != http.StatusNoContent {
+		t.Fatalf("Expected %v response code from put statement with fileUrl; got %d", http.StatusNoContent, code)
+	}
+
+	hashes := getAttachmentParts(t, mart, id)
+	if expected := fmt.Sprintf("%x", sha256.Sum256([]byte(fileURLContent))); len(hashes) != 1 || hashes[0] != expected {
+		t.Fatalf("Expected attachment part %s; got %v", expected, hashes)
+	}
+}
+
+func TestPutStatementWithFileURLNotFetchable(t *testing.T) {
+	db := initDatabase(t)
+	defer closeDatabase(db)
+	mart := initHandler(db)
+	defer setFileURLPolicy(fileURLPolicyFetch)()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(fileURLContent))
+	}))
+	defer server.Close()
+
+	// ループバックアドレスや http, https 以外の URL からは取得しない
+	for _, fileURL := range []string{server.URL + "/attachment", "file:///etc/passwd", "http://169.254.169.254/latest/meta-data"} {
+		if _, code := putStatementWithFileURL(t, mart, fileURL); code != http.StatusBadRequest {
+			t.Fatalf("Expected %v response code from put statement with fileUrl %s; got %d", http.StatusBadRequest, fileURL, code)
+		}
+	}
+
+	// 最大サイズを超える添付ファイルは保存しない
+	defer allowLoopbackFetch()()
+	miscs.GlobalConfig.Attachment.FetchMaxSize = int64(len(fileURLContent) - 1)
+	if _, code := putStatementWithFileURL(t, mart, server.URL+"/attachment"); code != http.StatusBadRequest {
+		t.Fatalf("Expected %v response code from put statement with too large attachment; got %d", http.StatusBadRequest, code)
+	}
+}
@@ -0,0 +1,426 @@
+// Copyright 2015 realglobe, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/go-martini/martini"
+	"github.com/realglobe-Inc/edo-xrs/app/miscs"
+	"github.com/realglobe-Inc/edo-xrs/app/model"
+)
+
+// cmi5 で定義される動詞
+const (
+	cmi5VerbLaunched    = "http://adlnet.gov/expapi/verbs/launched"
+	cmi5VerbInitialized = "http://adlnet.gov/expapi/verbs/initialized"
+	cmi5VerbCompleted   = "http://adlnet.gov/expapi/verbs/completed"
+	cmi5VerbPassed      = "http://adlnet.gov/expapi/verbs/passed"
+	cmi5VerbFailed      = "http://adlnet.gov/expapi/verbs/failed"
+	cmi5VerbAbandoned   = "https://w3id.org/xapi/adl/verbs/abandoned"
+	cmi5VerbWaived      = "https://w3id.org/xapi/adl/verbs/waived"
+	cmi5VerbTerminated  = "http://adlnet.gov/expapi/verbs/terminated"
+	cmi5VerbSatisfied   = "https://w3id.org/xapi/adl/verbs/satisfied"
+)
+
+// cmi5 で定義される category activity と context の extensions
+const (
+	cmi5CategoryID          = "https://w3id.org/xapi/cmi5/context/categories/cmi5"
+	cmi5MoveOnCategoryID    = "https://w3id.org/xapi/cmi5/context/categories/moveon"
+	cmi5SessionIDExtension  = "https://w3id.org/xapi/cmi5/context/extensions/sessionid"
+	cmi5LaunchModeExtension = "https://w3id.org/xapi/cmi5/context/extensions/launchmode"
+	cmi5LaunchURLExtension  = "https://w3id.org/xapi/cmi5/context/extensions/launchurl"
+	cmi5MoveOnExtension     = "https://w3id.org/xapi/cmi5/context/extensions/moveon"
+)
+
+// cmi5 のセッションの状態
+const (
+	cmi5StateLaunched    = "launched"
+	cmi5StateInitialized = "initialized"
+	cmi5StateTerminated  = "terminated"
+	cmi5StateAbandoned   = "abandoned"
+)
+
+// cmi5 の launch mode
+var cmi5LaunchModes = []string{"Normal", "Browse", "Review"}
+
+// isCMI5App は app に cmi5 モードが設定されているかを返す。
+func isCMI5App(user, app string) bool {
+	for _, a := range miscs.GlobalConfig.CMI5.App {
+		if a == user+"/"+app {
+			return true
+		}
+	}
+
+	return false
+}
+
+// cmi5Tracker は一度のリクエストで保存されるステートメントによる、cmi5 のセッションと
+// registration の状態の変化を保持する。ステートメントの挿入に成功した後に save により保存する。
+type cmi5Tracker struct {
+	store         model.DocumentStore
+	user, app     string
+	now           time.Time
+	sessions      map[string]*model.CMI5Session
+	registrations map[string]*model.CMI5Registration
+	changed       map[string]bool
+}
+
+func newCMI5Tracker(store model.DocumentStore, user, app string) *cmi5Tracker {
+	return &cmi5Tracker{
+		store:         store,
+		user:          user,
+		app:           app,
+		now:           time.Now(),
+		sessions:      make(map[string]*model.CMI5Session),
+		registrations: make(map[string]*model.CMI5Registration),
+		changed:       make(map[string]bool),
+	}
+}
+
+// session は指定されたセッションの状態を返す。launched より前の場合は nil を返す。
+func (t *cmi5Tracker) session(ctx context.Context, registration, sessionID string) (*model.CMI5Session, error) {
+	key := registration + " " + sessionID
+	if s, ok := t.sessions[key]; ok {
+		return s, nil
+	}
+
+	s, err := t.store.FindCMI5Session(ctx, t.user, t.app, registration, sessionID)
+	if err == model.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	t.sessions[key] = s
+
+	return s, nil
+}
+
+func (t *cmi5Tracker) setSession(s *model.CMI5Session, state string) {
+	s.State = state
+	s.Updated = t.now
+
+	key := s.Registration + " " + s.SessionID
+	t.sessions[key] = s
+	t.changed["session "+key] = true
+}
+
+// registration は registration の状態を返す。存在しない場合は新たに作成する。
+// 呼び出した場合は状態を変更するものとして保存の対象とする。
+func (t *cmi5Tracker) registration(ctx context.Context, registration string) (*model.CMI5Registration, error) {
+	if r, ok := t.registrations[registration]; ok {
+		return r, nil
+	}
+
+	r, err := t.store.FindCMI5Registration(ctx, t.user, t.app, registration)
+	if err == model.ErrNotFound {
+		r = model.NewCMI5Registration(t.user, t.app, registration, t.now)
+	} else if err != nil {
+		return nil, err
+	}
+	r.Updated = t.now
+	t.registrations[registration] = r
+
+	return r, nil
+}
+
+// apply はステートメントにより cmi5 の状態を遷移させる。
+// 状態遷移に反する場合や、必要な context の情報が無い場合は 400 を返す。
+func (t *cmi5Tracker) apply(ctx context.Context, stmt map[string]interface{}) (int, string) {
+	context, _ := stmt["context"].(map[string]interface{})
+	registration, _ := context["registration"].(string)
+	extensions, _ := context["extensions"].(map[string]interface{})
+	sessionID, _ := extensions[cmi5SessionIDExtension].(string)
+	verbID := ""
+	if verb, ok := stmt["verb"].(map[string]interface{}); ok {
+		verbID, _ = verb["id"].(string)
+	}
+
+	// cmi5 の category を持たない "cmi5 allowed" ステートメントは、
+	// セッションの initialized と terminated の間にのみ保存できる
+	isDefined := hasCategoryActivity(context, cmi5CategoryID)
+	if !isDefined && (len(registration) == 0 || len(sessionID) == 0) {
+		return http.StatusOK, "ok"
+	}
+
+	session, err := t.session(ctx, registration, sessionID)
+	if err != nil {
+		logger.Err("An unexpected error occured on find DB: ", err)
+		return http.StatusInternalServerError, "Internal Server Error"
+	}
+
+	if !isDefined {
+		if session == nil || session.State != cmi5StateInitialized {
+			return NewBadRequestErrF("Invalid cmi5 statement: statement in session %s must be issued between initialized and terminated", sessionID).Response()
+		}
+		return http.StatusOK, "ok"
+	}
+
+	if len(registration) == 0 {
+		return NewBadRequestErr("Invalid cmi5 statement: context.registration is required").Response()
+	}
+	if len(sessionID) == 0 {
+		return NewBadRequestErrF("Invalid cmi5 statement: context extension %s is required", cmi5SessionIDExtension).Response()
+	}
+
+	switch verbID {
+	case cmi5VerbLaunched:
+		if session != nil {
+			return NewBadRequestErrF("Invalid cmi5 statement: session %s has already been launched", sessionID).Response()
+		}
+		launchMode, _ := extensions[cmi5LaunchModeExtension].(string)
+		if !containsString(cmi5LaunchModes, launchMode) {
+			return NewBadRequestErrF("Invalid cmi5 statement: context extension %s must be one of Normal, Browse or Review", cmi5LaunchModeExtension).Response()
+		}
+		for _, ext := range []string{cmi5LaunchURLExtension, cmi5MoveOnExtension} {
+			if _, ok := extensions[ext].(string); !ok {
+				return NewBadRequestErrF("Invalid cmi5 statement: context extension %s is required on launched", ext).Response()
+			}
+		}
+		t.setSession(model.NewCMI5Session(t.user, t.app, registration, sessionID, launchMode, cmi5StateLaunched, t.now), cmi5StateLaunched)
+
+	case cmi5VerbInitialized:
+		if code, mess := requireCMI5State(session, sessionID, verbID, cmi5StateLaunched); code != http.StatusOK {
+			return code, mess
+		}
+		t.setSession(session, cmi5StateInitialized)
+
+	case cmi5VerbCompleted, cmi5VerbPassed, cmi5VerbFailed:
+		if code, mess := requireCMI5State(session, sessionID, verbID, cmi5StateInitialized); code != http.StatusOK {
+			return code, mess
+		}
+		if session.LaunchMode != "Normal" {
+			return NewBadRequestErrF("Invalid cmi5 statement: %s is not allowed in %s launch mode", verbID, session.LaunchMode).Response()
+		}
+		if code, mess := checkCMI5Result(stmt, verbID); code != http.StatusOK {
+			return code, mess
+		}
+
+		r, err := t.registration(ctx, registration)
+		if err != nil {
+			logger.Err("An unexpected error occured on find DB: ", err)
+			return http.StatusInternalServerError, "Internal Server Error"
+		}
+		switch verbID {
+		case cmi5VerbCompleted:
+			if r.Completed {
+				return NewBadRequestErrF("Invalid cmi5 statement: registration %s has already been completed", registration).Response()
+			}
+			r.Completed = true
+		case cmi5VerbPassed:
+			if r.Passed {
+				return NewBadRequestErrF("Invalid cmi5 statement: registration %s has already been passed", registration).Response()
+			}
+			r.Passed = true
+		case cmi5VerbFailed:
+			if r.Passed {
+				return NewBadRequestErrF("Invalid cmi5 statement: registration %s has already been passed", registration).Response()
+			}
+			r.Failed = true
+		}
+
+	case cmi5VerbTerminated:
+		if code, mess := requireCMI5State(session, sessionID, verbID, cmi5StateInitialized); code != http.StatusOK {
+			return code, mess
+		}
+		t.setSession(session, cmi5StateTerminated)
+
+	case cmi5VerbAbandoned:
+		if code, mess := requireCMI5State(session, sessionID, verbID, cmi5StateLaunched, cmi5StateInitialized); code != http.StatusOK {
+			return code, mess
+		}
+		t.setSession(session, cmi5StateAbandoned)
+
+	case cmi5VerbWaived, cmi5VerbSatisfied:
+		// LMS が発行するステートメントであり、セッションの状態によらない
+		if verbID == cmi5VerbWaived {
+			if code, mess := checkCMI5Result(stmt, verbID); code != http.StatusOK {
+				return code, mess
+			}
+		}
+
+		r, err := t.registration(ctx, registration)
+		if err != nil {
+			logger.Err("An unexpected error occured on find DB: ", err)
+			return http.StatusInternalServerError, "Internal Server Error"
+		}
+		if verbID == cmi5VerbWaived {
+			r.Waived = true
+		} else {
+			r.Satisfied = true
+		}
+
+	default:
+		return NewBadRequestErrF("Invalid cmi5 statement: verb %s is not defined by cmi5", verbID).Response()
+	}
+
+	return http.StatusOK, "ok"
+}
+
+// save は apply により変化した状態をデータベースに保存する。
+func (t *cmi5Tracker) save(ctx context.Context) error {
+	for key, s := range t.sessions {
+		if !t.changed["session "+key] {
+			continue
+		}
+		if err := t.store.SaveCMI5Session(ctx, s); err != nil {
+			return err
+		}
+	}
+	for _, r := range t.registrations {
+		if err := t.store.SaveCMI5Registration(ctx, r); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// requireCMI5State はセッションが states のいずれかの状態であることを確認する。
+func requireCMI5State(session *model.CMI5Session, sessionID, verbID string, states ...string) (int, string) {
+	if session == nil {
+		return NewBadRequestErrF("Invalid cmi5 statement: %s is not allowed before launched in session %s", verbID, sessionID).Response()
+	}
+	if !containsString(states, session.State) {
+		return NewBadRequestErrF("Invalid cmi5 statement: %s is not allowed after %s in session %s", verbID, session.State, sessionID).Response()
+	}
+
+	return http.StatusOK, "ok"
+}
+
+// checkCMI5Result は completed, passed, failed, waived のステートメントが moveon の category と
+// 動詞に対応する result を持つかを確認する。
+func checkCMI5Result(stmt map[string]interface{}, verbID string) (int, string) {
+	context, _ := stmt["context"].(map[string]interface{})
+	if !hasCategoryActivity(context, cmi5MoveOnCategoryID) {
+		return NewBadRequestErrF("Invalid cmi5 statement: category activity %s is required on %s", cmi5MoveOnCategoryID, verbID).Response()
+	}
+
+	result, _ := stmt["result"].(map[string]interface{})
+	switch verbID {
+	case cmi5VerbCompleted:
+		if result["completion"] != true {
+			return NewBadRequestErr("Invalid cmi5 statement: result.completion must be true on completed").Response()
+		}
+	case cmi5VerbPassed:
+		if result["success"] != true {
+			return NewBadRequestErr("Invalid cmi5 statement: result.success must be true on passed").Response()
+		}
+	case cmi5VerbFailed:
+		if result["success"] != false {
+			return NewBadRequestErr("Invalid cmi5 statement: result.success must be false on failed").Response()
+		}
+	case cmi5VerbWaived:
+		if result["completion"] != true || result["success"] != true {
+			return NewBadRequestErr("Invalid cmi5 statement: result.completion and result.success must be true on waived").Response()
+		}
+	}
+
+	return http.StatusOK, "ok"
+}
+
+// hasCategoryActivity は context.contextActivities.category に id の Activity が含まれるかを返す。
+func hasCategoryActivity(context map[string]interface{}, id string) bool {
+	activities, _ := context["contextActivities"].(map[string]interface{})
+
+	switch category := activities["category"].(type) {
+	case []interface{}:
+		for _, a := range category {
+			if activity, ok := a.(map[string]interface{}); ok && activity["id"] == id {
+				return true
+			}
+		}
+	case map[string]interface{}:
+		return category["id"] == id
+	}
+
+	return false
+}
+
+func containsString(slice []string, s string) bool {
+	for _, v := range slice {
+		if v == s {
+			return true
+		}
+	}
+
+	return false
+}
+
+// FindCMI5Status は registration の cmi5 の状態を返す GET リクエストを扱うハンドラである。
+// registration ごとの completed, passed, failed, satisfied, waived の有無と、
+// 各セッションの状態を返す。
+func (c *Controller) FindCMI5Status(params martini.Params, w http.ResponseWriter, req *http.Request) (int, string) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	user, app := params["user"], params["app"]
+
+	if !isCMI5App(user, app) {
+		return NewBadRequestErr("cmi5 mode is not enabled on the app").Response()
+	}
+
+	registration := req.URL.Query().Get("registration")
+	if len(registration) == 0 {
+		return NewBadRequestErr("registration is required").Response()
+	}
+
+	ctx := req.Context()
+
+	sessions, err := c.store.FindCMI5Sessions(ctx, user, app, registration)
+	if err != nil {
+		logger.Err("An unexpected error occured on find DB: ", err)
+		return http.StatusInternalServerError, "Internal Server Error"
+	}
+	r, err := c.store.FindCMI5Registration(ctx, user, app, registration)
+	if err == model.ErrNotFound {
+		if len(sessions) == 0 {
+			return http.StatusNotFound, "cmi5 Registration Not Found"
+		}
+		r = model.NewCMI5Registration(user, app, registration, time.Time{})
+	} else if err != nil {
+		logger.Err("An unexpected error occured on find DB: ", err)
+		return http.StatusInternalServerError, "Internal Server Error"
+	}
+
+	sessionList := make([]interface{}, 0, len(sessions))
+	for _, s := range sessions {
+		sessionList = append(sessionList, map[string]interface{}{
+			"sessionId":  s.SessionID,
+			"launchMode": s.LaunchMode,
+			"state":      s.State,
+			"updated":    s.Updated,
+		})
+	}
+
+	body, err := json.Marshal(map[string]interface{}{
+		"registration": registration,
+		"completed":    r.Completed,
+		"passed":       r.Passed,
+		"failed":       r.Failed,
+		"satisfied":    r.Satisfied,
+		"waived":       r.Waived,
+		"sessions":     sessionList,
+	})
+	if err != nil {
+		logger.Err("An unexpected error occured: ", err)
+		return http.StatusInternalServerError, "Internal Server Error"
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	return http.StatusOK, string(body)
+}
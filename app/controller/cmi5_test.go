@@ -0,0 +1,177 @@
+// Copyright 2015 realglobe, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-martini/martini"
+	"github.com/realglobe-Inc/edo-xrs/app/miscs"
+	"github.com/satori/go.uuid"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// cmi5 のステートメントの雛形。verb, registration, context の extensions, category, result を埋める
+const cmi5Statement = `{
+  "actor": {"objectType": "Agent", "account": {"homePage": "http://www.example.com", "name": "cmi5-learner"}},
+  "verb": {"id": "%s"},
+  "object": {"objectType": "Activity", "id": "http://www.example.com/au/1"},
+  "context": {
+    "registration": "%s",
+    "extensions": %s,
+    "contextActivities": {"category": %s}
+  }%s
+}`
+
+func initCMI5Handler(db *mongo.Database) *martini.ClassicMartini {
+	mart := martini.Classic()
+	hand := newController(db)
+	mart.Post("/:user/:app/statements", hand.StoreMultStatement)
+	mart.Get("/:user/:app/cmi5/status", hand.FindCMI5Status)
+
+	return mart
+}
+
+func enableCMI5(user, app string) func() {
+	config := miscs.GlobalConfig.CMI5
+	miscs.GlobalConfig.CMI5.App = append(append([]string{}, config.App...), user+"/"+app)
+
+	return func() {
+		miscs.GlobalConfig.CMI5 = config
+	}
+}
+
+func newCMI5Statement(verb, registration, sessionID string, moveOn bool, result string) string {
+	extensions := fmt.Sprintf(`{"%s": "%s"}`, cmi5SessionIDExtension, sessionID)
+	if verb == cmi5VerbLaunched {
+		extensions = fmt.Sprintf(`{"%s": "%s", "%s": "Normal", "%s": "http://www.example.com/au/1", "%s": "CompletedOrPassed"}`,
+			cmi5SessionIDExtension, sessionID, cmi5LaunchModeExtension, cmi5LaunchURLExtension, cmi5MoveOnExtension)
+	}
+
+	category := fmt.Sprintf(`[{"id": "%s"}]`, cmi5CategoryID)
+	if moveOn {
+		category = fmt.Sprintf(`[{"id": "%s"}, {"id": "%s"}]`, cmi5CategoryID, cmi5MoveOnCategoryID)
+	}
+
+	if len(result) > 0 {
+		result = `, "result": ` + result
+	}
+
+	return fmt.Sprintf(cmi5Statement, verb, registration, extensions, category, result)
+}
+
+func postCMI5Statement(t *testing.T, mart http.Handler, path, stmt string) *httptest.ResponseRecorder {
+	resp := httptest.NewRecorder()
+	req, err := http.NewRequest("POST", path+"/statements", strings.NewReader(stmt))
+	fatalIfError(t, err)
+
+	req.Header.Add("Content-Type", "application/json")
+	req.Header.Add("X-Experience-API-Version", "1.0.2")
+	mart.ServeHTTP(resp, req)
+
+	return resp
+}
+
+func TestCMI5SessionStateMachine(t *testing.T) {
+	db := initDatabase(t)
+	defer closeDatabase(db)
+	mart := initCMI5Handler(db)
+
+	app := "cmi5-" + uuid.NewV4().String()
+	defer enableCMI5("test", app)()
+	base := "/test/" + app
+
+	registration := uuid.NewV4().String()
+	sessionID := uuid.NewV4().String()
+
+	// launched の前に initialized は保存できない
+	resp := postCMI5Statement(t, mart, base, newCMI5Statement(cmi5VerbInitialized, registration, sessionID, false, ""))
+	if got, expected := resp.Code, http.StatusBadRequest; got != expected {
+		t.Fatalf("Expected %v response code from post initialized before launched; got %d", expected, got)
+	}
+
+	for _, stmt := range []string{
+		newCMI5Statement(cmi5VerbLaunched, registration, sessionID, false, ""),
+		newCMI5Statement(cmi5VerbInitialized, registration, sessionID, false, ""),
+		newCMI5Statement(cmi5VerbPassed, registration, sessionID, true, `{"success": true}`),
+		newCMI5Statement(cmi5VerbTerminated, registration, sessionID, false, ""),
+	} {
+		resp := postCMI5Statement(t, mart, base, stmt)
+		if got, expected := resp.Code, http.StatusOK; got != expected {
+			body, _ := ioutil.ReadAll(resp.Body)
+			t.Fatalf("Expected %v response code from post cmi5 statement; got %d: %s", expected, got, string(body))
+		}
+	}
+
+	// terminated の後にはステートメントを保存できない
+	resp = postCMI5Statement(t, mart, base, newCMI5Statement(cmi5VerbCompleted, registration, sessionID, true, `{"completion": true}`))
+	if got, expected := resp.Code, http.StatusBadRequest; got != expected {
+		t.Fatalf("Expected %v response code from post completed after terminated; got %d", expected, got)
+	}
+
+	resp = httptest.NewRecorder()
+	req, err := http.NewRequest("GET", base+"/cmi5/status?registration="+registration, nil)
+	fatalIfError(t, err)
+	mart.ServeHTTP(resp, req)
+	if got, expected := resp.Code, http.StatusOK; got != expected {
+		t.Fatalf("Expected %v response code from get cmi5 status; got %d", expected, got)
+	}
+
+	var status struct {
+		Passed    bool `json:"passed"`
+		Completed bool `json:"completed"`
+		Sessions  []struct {
+			SessionID string `json:"sessionId"`
+			State     string `json:"state"`
+		} `json:"sessions"`
+	}
+	fatalIfError(t, json.NewDecoder(resp.Body).Decode(&status))
+	if !status.Passed || status.Completed {
+		t.Fatalf("Unexpected registration status: %+v", status)
+	}
+	if len(status.Sessions) != 1 || status.Sessions[0].SessionID != sessionID || status.Sessions[0].State != cmi5StateTerminated {
+		t.Fatalf("Unexpected session status: %+v", status.Sessions)
+	}
+}
+
+func TestCMI5RequiresContext(t *testing.T) {
+	db := initDatabase(t)
+	defer closeDatabase(db)
+	mart := initCMI5Handler(db)
+
+	app := "cmi5-" + uuid.NewV4().String()
+	defer enableCMI5("test", app)()
+	base := "/test/" + app
+
+	// sessionid の無い cmi5 のステートメント
+	stmt := newCMI5Statement(cmi5VerbLaunched, uuid.NewV4().String(), "", false, "")
+	stmt = strings.Replace(stmt, `"`+cmi5SessionIDExtension+`": "",`, "", 1)
+	resp := postCMI5Statement(t, mart, base, stmt)
+	if got, expected := resp.Code, http.StatusBadRequest; got != expected {
+		t.Fatalf("Expected %v response code from post statement without sessionid; got %d", expected, got)
+	}
+
+	// cmi5 モードでない app では検査しない
+	resp = postCMI5Statement(t, mart, "/test/"+uuid.NewV4().String(), newCMI5Statement(cmi5VerbInitialized, uuid.NewV4().String(), uuid.NewV4().String(), false, ""))
+	if got, expected := resp.Code, http.StatusOK; got != expected {
+		t.Fatalf("Expected %v response code from post statement on non cmi5 app; got %d", expected, got)
+	}
+}
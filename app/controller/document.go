@@ -0,0 +1,201 @@
+// Copyright 2015 realglobe, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/realglobe-Inc/edo-xrs/app/model"
+)
+
+// State API, Activity Profile API, Agent Profile API で共通に使う処理をまとめる。
+
+// setDocumentHeader はドキュメント API の各レスポンスに共通のヘッダを設定する。
+func setDocumentHeader(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	setXAPIVersionHeader(w, req)
+}
+
+// agentKeyOf は agent パラメータの文字列を parseAgent によりパース、検査し、
+// その IFI を一意に表す文字列を返す。
+func agentKeyOf(xAPIVersion, agentString string) (string, error) {
+	agent, err := parseAgent(xAPIVersion, agentString)
+	if err != nil {
+		return "", err
+	}
+
+	// スキーマにより IFI はちょうど一つ与えられている
+	ifi := make(map[string]interface{})
+	for _, key := range []string{"mbox", "mbox_sha1sum", "openid", "account"} {
+		if v, ok := agent[key]; ok {
+			ifi[key] = v
+		}
+	}
+	if len(ifi) != 1 {
+		return "", errors.New("agent must have exactly one inverse functional identifier")
+	}
+
+	// map のキーはソートされて出力されるため、同じ IFI は常に同じ文字列になる
+	key, err := json.Marshal(ifi)
+	if err != nil {
+		return "", err
+	}
+
+	return string(key), nil
+}
+
+// parseParamTime は URL パラメータの field に指定された時刻を取得する。
+// 指定されていない場合はゼロ値を返す。
+func parseParamTime(params url.Values, field string) (time.Time, error) {
+	if v, ok := params[field]; ok && len(v) > 0 {
+		t, err := time.Parse(time.RFC3339Nano, v[0])
+		if err != nil {
+			return time.Time{}, fmt.Errorf("%s must be of the form of RFC3339 Date/Time", field)
+		}
+		return t, nil
+	}
+
+	return time.Time{}, nil
+}
+
+// readDocumentBody はリクエストボディとその Content-Type を返す。
+// Content-Type が指定されていない場合は application/octet-stream として扱う。
+func readDocumentBody(req *http.Request) (string, []byte, error) {
+	contentType := req.Header.Get("Content-Type")
+	if len(contentType) == 0 {
+		contentType = "application/octet-stream"
+	}
+
+	content, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return contentType, content, nil
+}
+
+// isJSONContentType は Content-Type が application/json であるかを返す。
+func isJSONContentType(contentType string) bool {
+	mediatype, _, err := mime.ParseMediaType(contentType)
+	return err == nil && mediatype == "application/json"
+}
+
+// mergeJSONDocument は JSON オブジェクトである二つのドキュメントをマージする。
+// 同じキーが存在する場合は newContent の値で上書きする (Experience API, Section 7.3 を参照)。
+func mergeJSONDocument(oldContent, newContent []byte) ([]byte, error) {
+	var oldDoc, newDoc map[string]interface{}
+
+	if err := json.Unmarshal(oldContent, &oldDoc); err != nil {
+		return nil, errors.New("stored document is not a JSON object")
+	}
+	if err := json.Unmarshal(newContent, &newDoc); err != nil {
+		return nil, errors.New("given document is not a JSON object")
+	}
+
+	for k, v := range newDoc {
+		oldDoc[k] = v
+	}
+
+	return json.Marshal(oldDoc)
+}
+
+// documentETag はドキュメントの ETag を返す。
+func documentETag(content []byte) string {
+	return fmt.Sprintf(`"%x"`, sha1.Sum(content))
+}
+
+// checkPrecondition は If-Match, If-None-Match ヘッダによる並行性制御を行う。
+// (Experience API, Section 6.3 を参照)
+// current には保存されているドキュメントの内容を、存在しない場合は nil を与える。
+// requireHeader が真のとき、ドキュメントが存在するのにどちらのヘッダも無い場合は Conflict となる。
+func checkPrecondition(req *http.Request, current []byte, requireHeader bool) (int, string) {
+	ifMatch := req.Header.Get("If-Match")
+	ifNoneMatch := req.Header.Get("If-None-Match")
+
+	if len(ifMatch) > 0 {
+		if current == nil || !matchETag(ifMatch, documentETag(current)) {
+			return http.StatusPreconditionFailed, "Precondition Failed"
+		}
+	}
+	if len(ifNoneMatch) > 0 {
+		if current != nil && matchETag(ifNoneMatch, documentETag(current)) {
+			return http.StatusPreconditionFailed, "Precondition Failed"
+		}
+	}
+
+	if requireHeader && current != nil && len(ifMatch) == 0 && len(ifNoneMatch) == 0 {
+		return http.StatusConflict, "Conflict: If-Match or If-None-Match header is required to update the document"
+	}
+
+	return http.StatusOK, "ok"
+}
+
+// matchETag はヘッダに与えられた ETag の列に etag が含まれるかを返す。
+func matchETag(header, etag string) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || tag == etag {
+			return true
+		}
+	}
+
+	return false
+}
+
+// writeDocument は保存されているドキュメントをレスポンスとして返す。
+func writeDocument(w http.ResponseWriter, contentType string, content []byte, updated time.Time) (int, string) {
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("ETag", documentETag(content))
+	w.Header().Set("Last-Modified", updated.UTC().Format(http.TimeFormat))
+
+	return http.StatusOK, string(content)
+}
+
+// writeIDs は ID の一覧をレスポンスとして返す。
+func writeIDs(w http.ResponseWriter, ids []string) (int, string) {
+	body, err := json.Marshal(ids)
+	if err != nil {
+		logger.Err("An unexpected error occured: ", err)
+		return http.StatusInternalServerError, "Internal Server Error"
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	return http.StatusOK, string(body)
+}
+
+// checkQuota はユーザーのディスク使用量を確認する。
+func (c *Controller) checkQuota(ctx context.Context, user string) (int, string) {
+	usage, err := c.store.QuotaUsage(ctx, user)
+	if err != nil {
+		logger.Err("An unexpected error occured on get quota: ", err)
+		return http.StatusInternalServerError, "Internal Server Error"
+	}
+
+	if !(&model.Quota{Usage: usage}).Check() {
+		return NewBadRequestErrF("The disk is full of user: %s", user).Response()
+	}
+
+	return http.StatusOK, "ok"
+}
@@ -18,10 +18,13 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+
+	"github.com/realglobe-Inc/edo-xrs/app/validator"
 )
 
 type BadRequestErr struct {
 	message string
+	errors  validator.ValidationError
 }
 
 func NewBadRequestErr(message string) BadRequestErr {
@@ -36,16 +39,34 @@ func NewBadRequestErrF(format string, a ...interface{}) BadRequestErr {
 	}
 }
 
+// NewInvalidStatementErr はステートメントの検査のエラーから BadRequestErr を作る。
+// err が validator.ValidationError の場合、レスポンスの errors に各エラーを含める。
+func NewInvalidStatementErr(err error) BadRequestErr {
+	if errs, ok := err.(validator.ValidationError); ok {
+		return BadRequestErr{
+			message: "Invalid statement",
+			errors:  errs,
+		}
+	}
+
+	return NewBadRequestErrF("Invalid statement: %s", err)
+}
+
 func (e BadRequestErr) Response() (int, string) {
 	return http.StatusBadRequest, e.JSON()
 }
 
 func (e BadRequestErr) JSON() string {
-	body, err := json.Marshal(map[string]interface{}{
+	content := map[string]interface{}{
 		"title":  "invalid request body",
 		"status": 400,
 		"detail": e.message,
-	})
+	}
+	if len(e.errors) > 0 {
+		content["errors"] = e.errors
+	}
+
+	body, err := json.Marshal(content)
 	if err != nil {
 		logger.Err("Unexpected error occured:", err)
 	}
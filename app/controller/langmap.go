@@ -0,0 +1,175 @@
+// Copyright 2015 realglobe, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/martini-contrib/acceptlang"
+	"github.com/realglobe-Inc/edo-xrs/app/miscs"
+)
+
+// languageRanges は言語マップの検索に用いる言語の範囲を優先順に返す。
+// Accept-Language の言語を q の値の順に並べ、その後に設定された既定の言語を続ける。
+// q=0 の言語と "*" は含めない。
+func languageRanges(languages acceptlang.AcceptLanguages) []string {
+	sorted := make(acceptlang.AcceptLanguages, len(languages))
+	copy(sorted, languages)
+	sort.Stable(sorted)
+
+	var ranges []string
+	for _, lang := range sorted {
+		if lang.Quality <= 0 || lang.Language == "*" {
+			continue
+		}
+		ranges = append(ranges, lang.Language)
+	}
+
+	return append(ranges, miscs.GlobalConfig.Global.DefaultLanguage...)
+}
+
+// lookupLanguage は言語マップから ranges に最も合う言語のタグを返す。
+// 各範囲について RFC 4647 Section 3.4 の lookup と同様に末尾のサブタグを削りながら
+// (zh-Hant-TW → zh-Hant → zh) 一致するタグを探す。一致するタグが無い場合は、
+// その範囲で始まるタグ (ja に対する ja-JP) を用いる。
+// どの範囲にも合わない場合は、タグを辞書順に並べた先頭のものを返す。
+func lookupLanguage(langMap map[string]interface{}, ranges []string) (string, bool) {
+	if len(langMap) == 0 {
+		return "", false
+	}
+
+	tags := make([]string, 0, len(langMap))
+	for tag := range langMap {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+
+	for _, r := range ranges {
+		for prefix := strings.ToLower(r); len(prefix) > 0; prefix = truncateLanguageRange(prefix) {
+			for _, tag := range tags {
+				if strings.ToLower(tag) == prefix {
+					return tag, true
+				}
+			}
+			for _, tag := range tags {
+				if strings.HasPrefix(strings.ToLower(tag), prefix+"-") {
+					return tag, true
+				}
+			}
+		}
+	}
+
+	return tags[0], true
+}
+
+// truncateLanguageRange は言語の範囲から末尾のサブタグを取り除く。
+// 取り除いた後の末尾が singleton (x- など) の場合は、それも取り除く。
+func truncateLanguageRange(r string) string {
+	i := strings.LastIndex(r, "-")
+	if i < 0 {
+		return ""
+	}
+	r = r[:i]
+
+	if i := strings.LastIndex(r, "-"); i >= 0 && len(r)-i-1 == 1 {
+		r = r[:i]
+	}
+
+	return r
+}
+
+// selectLanguage は言語マップを ranges に最も合う一つの言語のみを持つものにする。
+func selectLanguage(langMap map[string]interface{}, ranges []string) map[string]interface{} {
+	selected := make(map[string]interface{})
+	if tag, ok := lookupLanguage(langMap, ranges); ok {
+		selected[tag] = langMap[tag]
+	}
+
+	return selected
+}
+
+// selectLanguageOf は m の field にある言語マップを selectLanguage により絞り込む。
+func selectLanguageOf(m map[string]interface{}, field string, ranges []string) {
+	if langMap, ok := m[field].(map[string]interface{}); ok {
+		m[field] = selectLanguage(langMap, ranges)
+	}
+}
+
+// selectStatementLanguages はステートメントに含まれる全ての言語マップを、
+// ranges に最も合う一つの言語のみを持つものにする。
+// (verb.display, Activity の定義, contextActivities, SubStatement, attachments)
+func selectStatementLanguages(stmt map[string]interface{}, ranges []string) {
+	if verb, ok := stmt["verb"].(map[string]interface{}); ok {
+		selectLanguageOf(verb, "display", ranges)
+	}
+
+	if object, ok := stmt["object"].(map[string]interface{}); ok {
+		switch object["objectType"] {
+		case "SubStatement":
+			selectStatementLanguages(object, ranges)
+		case nil, "Activity":
+			selectActivityLanguages(object, ranges)
+		}
+	}
+
+	if context, ok := stmt["context"].(map[string]interface{}); ok {
+		if activities, ok := context["contextActivities"].(map[string]interface{}); ok {
+			for _, v := range activities {
+				switch t := v.(type) {
+				case []interface{}:
+					for _, a := range t {
+						if activity, ok := a.(map[string]interface{}); ok {
+							selectActivityLanguages(activity, ranges)
+						}
+					}
+				case map[string]interface{}:
+					selectActivityLanguages(t, ranges)
+				}
+			}
+		}
+	}
+
+	if attachments, ok := stmt["attachments"].([]interface{}); ok {
+		for _, a := range attachments {
+			if attachment, ok := a.(map[string]interface{}); ok {
+				selectLanguageOf(attachment, "display", ranges)
+				selectLanguageOf(attachment, "description", ranges)
+			}
+		}
+	}
+}
+
+// selectActivityLanguages は Activity の定義の name, description と
+// interaction component の description を絞り込む。
+func selectActivityLanguages(activity map[string]interface{}, ranges []string) {
+	definition, ok := activity["definition"].(map[string]interface{})
+	if !ok {
+		return
+	}
+
+	selectLanguageOf(definition, "name", ranges)
+	selectLanguageOf(definition, "description", ranges)
+
+	for _, field := range interactionComponentFields {
+		if components, ok := definition[field].([]interface{}); ok {
+			for _, c := range components {
+				if component, ok := c.(map[string]interface{}); ok {
+					selectLanguageOf(component, "description", ranges)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,221 @@
+// Copyright 2015 realglobe, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"crypto"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/realglobe-Inc/edo-xrs/app/miscs"
+)
+
+// 署名の添付ファイルを表す usageType, Experience API, Section 4.4 を参照
+const signatureUsageType = "http://adlnet.gov/expapi/attachments/signature"
+
+// 署名に用いることができるアルゴリズムとハッシュ関数
+var signatureAlgorithms = map[string]crypto.Hash{
+	"RS256": crypto.SHA256,
+	"RS384": crypto.SHA384,
+	"RS512": crypto.SHA512,
+}
+
+// checkSignedStatements は署名付きステートメントを検証し、正しくない場合は 400 を返す。
+// octets は parseRequestBody により得られた application/octet-stream の添付ファイルの内容である。
+func checkSignedStatements(statements []interface{}, octets map[string][]byte) (int, string) {
+	roots, err := loadTrustStore(miscs.GlobalConfig.Signature.TrustStore)
+	if err != nil {
+		logger.Err("An unexpected error occured on load trust store: ", err)
+		return http.StatusInternalServerError, "Internal Server Error"
+	}
+
+	for _, stmt := range statements {
+		// バリデート済みのため変換可能
+		if err := verifySignedStatement(stmt.(map[string]interface{}), octets, roots); err != nil {
+			return NewBadRequestErrF("Invalid signed statement: %s", err).Response()
+		}
+	}
+
+	return http.StatusOK, "ok"
+}
+
+// loadTrustStore は path の PEM ファイルから CA 証明書を読み込む。
+// path が空の場合は nil を返し、システムの証明書を用いる。
+func loadTrustStore(path string) (*x509.CertPool, error) {
+	if len(path) == 0 {
+		return nil, nil
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(b) {
+		return nil, fmt.Errorf("no certificate found in %s", path)
+	}
+
+	return roots, nil
+}
+
+// verifySignedStatement は署名の添付ファイルを持つステートメントについて、JWS の署名を検証し、
+// そのペイロードが署名の添付ファイルを除いたステートメントと同じであるかを確認する。
+// 署名の添付ファイルを持たない場合は何もしない。
+func verifySignedStatement(statement map[string]interface{}, octets map[string][]byte, roots *x509.CertPool) error {
+	attachments, _ := statement["attachments"].([]interface{})
+
+	var signature map[string]interface{}
+	others := make([]interface{}, 0, len(attachments))
+	for _, att := range attachments {
+		if a, ok := att.(map[string]interface{}); ok && a["usageType"] == signatureUsageType {
+			if signature != nil {
+				return errors.New("multiple signature attachments given")
+			}
+			signature = a
+			continue
+		}
+		others = append(others, att)
+	}
+	if signature == nil {
+		return nil
+	}
+
+	if signature["contentType"] != "application/octet-stream" {
+		return errors.New("contentType of signature attachment must be application/octet-stream")
+	}
+	sha2, _ := signature["sha2"].(string)
+	jws, ok := octets[sha2]
+	if !ok {
+		return errors.New("content of signature attachment not found")
+	}
+
+	payload, err := verifyJWS(string(jws), roots)
+	if err != nil {
+		return err
+	}
+
+	var signed map[string]interface{}
+	if err := json.Unmarshal(payload, &signed); err != nil {
+		return errors.New("JWS payload must be a statement")
+	}
+
+	// 署名されたステートメントは署名の添付ファイルを含まない
+	original := make(map[string]interface{}, len(statement))
+	for k, v := range statement {
+		original[k] = v
+	}
+	if len(others) == 0 {
+		delete(original, "attachments")
+	} else {
+		original["attachments"] = others
+	}
+
+	if !isEquivalentStatement(original, signed) {
+		return errors.New("JWS payload does not match the statement")
+	}
+
+	return nil
+}
+
+// verifyJWS は JWS Compact Serialization の署名を、x5c ヘッダの証明書チェーンと roots により検証し、
+// ペイロードを返す。
+func verifyJWS(jws string, roots *x509.CertPool) ([]byte, error) {
+	parts := strings.Split(strings.TrimSpace(jws), ".")
+	if len(parts) != 3 {
+		return nil, errors.New("JWS must be of compact serialization")
+	}
+
+	b, err := decodeBase64URL(parts[0])
+	if err != nil {
+		return nil, errors.New("invalid JWS header")
+	}
+	var header struct {
+		Alg string   `json:"alg"`
+		X5c []string `json:"x5c"`
+	}
+	if err := json.Unmarshal(b, &header); err != nil {
+		return nil, errors.New("invalid JWS header")
+	}
+
+	hash, ok := signatureAlgorithms[header.Alg]
+	if !ok {
+		return nil, fmt.Errorf("unsupported JWS algorithm: %s", header.Alg)
+	}
+	if len(header.X5c) == 0 {
+		return nil, errors.New("x5c is required in JWS header")
+	}
+
+	// 証明書チェーンを検証
+	var certs []*x509.Certificate
+	for _, c := range header.X5c {
+		der, err := base64.StdEncoding.DecodeString(c)
+		if err != nil {
+			return nil, errors.New("invalid certificate in x5c")
+		}
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return nil, errors.New("invalid certificate in x5c")
+		}
+		certs = append(certs, cert)
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	if _, err := certs[0].Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	}); err != nil {
+		return nil, fmt.Errorf("untrusted certificate: %s", err)
+	}
+
+	// 署名を検証
+	pub, ok := certs[0].PublicKey.(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.New("certificate must have RSA public key")
+	}
+	sig, err := decodeBase64URL(parts[2])
+	if err != nil {
+		return nil, errors.New("invalid JWS signature")
+	}
+	h := hash.New()
+	h.Write([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(pub, hash, h.Sum(nil), sig); err != nil {
+		return nil, errors.New("JWS signature verification failed")
+	}
+
+	payload, err := decodeBase64URL(parts[1])
+	if err != nil {
+		return nil, errors.New("invalid JWS payload")
+	}
+
+	return payload, nil
+}
+
+// decodeBase64URL はパディングの無い base64url をデコードする。
+func decodeBase64URL(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+}
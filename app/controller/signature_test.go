@@ -0,0 +1,188 @@
+// Copyright 2015 realglobe, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-martini/martini"
+	"github.com/realglobe-Inc/edo-xrs/app/miscs"
+)
+
+// initSigner は CA と、その CA により署名された証明書を生成し、CA の証明書を trust store として設定する。
+func initSigner(t *testing.T) (*rsa.PrivateKey, [][]byte, func()) {
+	template := func(serial int64, isCA bool) *x509.Certificate {
+		return &x509.Certificate{
+			SerialNumber:          big.NewInt(serial),
+			Subject:               pkix.Name{CommonName: fmt.Sprintf("edo-xrs test %d", serial)},
+			NotBefore:             time.Now().Add(-time.Hour),
+			NotAfter:              time.Now().Add(time.Hour),
+			KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+			BasicConstraintsValid: true,
+			IsCA:                  isCA,
+		}
+	}
+
+	caKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	fatalIfError(t, err)
+	caTemplate := template(1, true)
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	fatalIfError(t, err)
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	fatalIfError(t, err)
+	der, err := x509.CreateCertificate(rand.Reader, template(2, false), caTemplate, &key.PublicKey, caKey)
+	fatalIfError(t, err)
+
+	f, err := ioutil.TempFile("", "edo-xrs-truststore")
+	fatalIfError(t, err)
+	fatalIfError(t, pem.Encode(f, &pem.Block{Type: "CERTIFICATE", Bytes: caDER}))
+	f.Close()
+
+	config := miscs.GlobalConfig.Signature
+	miscs.GlobalConfig.Signature.Verify = true
+	miscs.GlobalConfig.Signature.TrustStore = f.Name()
+
+	return key, [][]byte{der}, func() {
+		miscs.GlobalConfig.Signature = config
+		os.Remove(f.Name())
+	}
+}
+
+func signJWS(t *testing.T, key *rsa.PrivateKey, chain [][]byte, payload []byte) string {
+	var x5c []string
+	for _, der := range chain {
+		x5c = append(x5c, base64.StdEncoding.EncodeToString(der))
+	}
+	header, err := json.Marshal(map[string]interface{}{"alg": "RS256", "x5c": x5c})
+	fatalIfError(t, err)
+
+	input := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(input))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	fatalIfError(t, err)
+
+	return input + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+// postSignedStatement は signed をペイロードとする署名を添付して statement を POST する。
+func postSignedStatement(t *testing.T, mart http.Handler, key *rsa.PrivateKey, chain [][]byte, statement, signed map[string]interface{}) *httptest.ResponseRecorder {
+	payload, err := json.Marshal(signed)
+	fatalIfError(t, err)
+	jws := signJWS(t, key, chain, payload)
+	sha2 := fmt.Sprintf("%x", sha256.Sum256([]byte(jws)))
+
+	statement["attachments"] = []interface{}{
+		map[string]interface{}{
+			"usageType":   signatureUsageType,
+			"display":     map[string]interface{}{"en-US": "Signature"},
+			"contentType": "application/octet-stream",
+			"length":      len(jws),
+			"sha2":        sha2,
+		},
+	}
+	stmt, err := json.Marshal(statement)
+	fatalIfError(t, err)
+
+	buffer := bytes.NewBuffer(nil)
+	encoder := multipart.NewWriter(buffer)
+
+	header := make(textproto.MIMEHeader)
+	header.Add("Content-Type", "application/json")
+	jsonfield, err := encoder.CreatePart(header)
+	fatalIfError(t, err)
+	jsonfield.Write(stmt)
+
+	header = make(textproto.MIMEHeader)
+	header.Add("Content-Type", "application/octet-stream")
+	header.Add("Content-Transfer-Encoding", "binary")
+	header.Add("X-Experience-API-Hash", sha2)
+	sigfield, err := encoder.CreatePart(header)
+	fatalIfError(t, err)
+	sigfield.Write([]byte(jws))
+
+	encoder.Close()
+
+	resp := httptest.NewRecorder()
+	req, err := http.NewRequest("POST", "/test/test/statements", buffer)
+	fatalIfError(t, err)
+	req.Header.Add("Content-Type", "multipart/mixed; boundary="+encoder.Boundary())
+	req.Header.Add("X-Experience-API-Version", "1.0.2")
+	mart.ServeHTTP(resp, req)
+
+	return resp
+}
+
+func TestPostSignedStatement(t *testing.T) {
+	db := initDatabase(t)
+	defer closeDatabase(db)
+	mart := martini.Classic()
+	mart.Post("/:user/:app/statements", newController(db).StoreMultStatement)
+
+	key, chain, cleanup := initSigner(t)
+	defer cleanup()
+
+	var statement, signed map[string]interface{}
+	fatalIfError(t, json.Unmarshal([]byte(singleStatement01), &statement))
+	fatalIfError(t, json.Unmarshal([]byte(singleStatement01), &signed))
+
+	resp := postSignedStatement(t, mart, key, chain, statement, signed)
+	if got, expected := resp.Code, http.StatusOK; got != expected {
+		r, _ := ioutil.ReadAll(resp.Body)
+		t.Fatalf("Expected %v response code from post signed statement; got %d, %v", expected, got, string(r))
+	}
+}
+
+func TestPostSignedStatementWithMismatchedPayload(t *testing.T) {
+	db := initDatabase(t)
+	defer closeDatabase(db)
+	mart := martini.Classic()
+	mart.Post("/:user/:app/statements", newController(db).StoreMultStatement)
+
+	key, chain, cleanup := initSigner(t)
+	defer cleanup()
+
+	var statement, signed map[string]interface{}
+	fatalIfError(t, json.Unmarshal([]byte(singleStatement01), &statement))
+	fatalIfError(t, json.Unmarshal([]byte(singleStatement02), &signed))
+
+	resp := postSignedStatement(t, mart, key, chain, statement, signed)
+	if got, expected := resp.Code, http.StatusBadRequest; got != expected {
+		t.Fatalf("Expected %v response code from post signed statement with mismatched payload; got %d", expected, got)
+	}
+	if r, _ := ioutil.ReadAll(resp.Body); !strings.Contains(string(r), "does not match") {
+		t.Fatalf("Unexpected error message: %s", string(r))
+	}
+}
@@ -0,0 +1,221 @@
+// Copyright 2015 realglobe, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/go-martini/martini"
+	"github.com/realglobe-Inc/edo-xrs/app/model"
+	"github.com/realglobe-Inc/edo-xrs/app/validator"
+)
+
+// stateParams は State API のリクエストパラメータを表す。
+type stateParams struct {
+	activityID   string
+	agent        string // agentKeyOf により変換された IFI
+	registration string
+	stateID      string
+}
+
+// parseStateParams は State API のリクエストパラメータを検査し、変換する。
+// (Experience API, Section 7.4 を参照)
+func parseStateParams(xAPIVersion string, params url.Values) (*stateParams, error) {
+	activityID := params.Get("activityId")
+	if len(activityID) == 0 {
+		return nil, errors.New("activityId is required")
+	}
+
+	agentString := params.Get("agent")
+	if len(agentString) == 0 {
+		return nil, errors.New("agent is required")
+	}
+	agent, err := agentKeyOf(xAPIVersion, agentString)
+	if err != nil {
+		return nil, err
+	}
+
+	registration := params.Get("registration")
+	if len(registration) > 0 && !validator.IsUUID(registration) {
+		return nil, errors.New("registration must be valid UUID")
+	}
+
+	return &stateParams{
+		activityID:   activityID,
+		agent:        agent,
+		registration: registration,
+		stateID:      params.Get("stateId"),
+	}, nil
+}
+
+// FindState は State の GET リクエストを扱うハンドラである。
+// stateId が指定されている場合はその State を、そうでなければ stateId の一覧を返す。
+func (c *Controller) FindState(params martini.Params, w http.ResponseWriter, req *http.Request) (int, string) {
+	setDocumentHeader(w, req)
+	user, app := params["user"], params["app"]
+
+	xAPIVersion := req.Header.Get("X-Experience-API-Version")
+	if !validator.IsValidXAPIVersion(xAPIVersion) {
+		return NewBadRequestErr("Invalid or empty xAPI version given in X-Experience-API-Version").Response()
+	}
+
+	urlParams := req.URL.Query()
+	sp, err := parseStateParams(xAPIVersion, urlParams)
+	if err != nil {
+		return NewBadRequestErrF("Invalid parameter given: %s", err).Response()
+	}
+
+	ctx := req.Context()
+
+	// stateId が指定されていない場合は stateId の一覧を返す
+	if len(sp.stateID) == 0 {
+		since, err := parseParamTime(urlParams, "since")
+		if err != nil {
+			return NewBadRequestErr(err.Error()).Response()
+		}
+
+		ids, err := c.store.FindStateIDs(ctx, user, app, sp.activityID, sp.agent, sp.registration, since)
+		if err != nil {
+			logger.Err("An unexpected error occured on find DB: ", err)
+			return http.StatusInternalServerError, "Internal Server Error"
+		}
+
+		return writeIDs(w, ids)
+	}
+
+	if _, ok := urlParams["since"]; ok {
+		return NewBadRequestErr("since cannot be given with stateId").Response()
+	}
+
+	state, err := c.store.FindState(ctx, user, app, sp.activityID, sp.agent, sp.registration, sp.stateID)
+	if err == model.ErrNotFound {
+		return http.StatusNotFound, "State Not Found"
+	}
+	if err != nil {
+		logger.Err("An unexpected error occured on find DB: ", err)
+		return http.StatusInternalServerError, "Internal Server Error"
+	}
+
+	return writeDocument(w, state.ContentType, state.Content, state.Updated)
+}
+
+// StoreState は State の PUT リクエストを扱うハンドラである。
+// 同じキーを持つ State が既に存在する場合は置き換える。
+func (c *Controller) StoreState(params martini.Params, w http.ResponseWriter, req *http.Request) (int, string) {
+	return c.saveState(params, w, req, false)
+}
+
+// MergeState は State の POST リクエストを扱うハンドラである。
+// 既に保存されている State と与えられた State が共に JSON オブジェクトである場合はマージする。
+func (c *Controller) MergeState(params martini.Params, w http.ResponseWriter, req *http.Request) (int, string) {
+	return c.saveState(params, w, req, true)
+}
+
+func (c *Controller) saveState(params martini.Params, w http.ResponseWriter, req *http.Request, merge bool) (int, string) {
+	setDocumentHeader(w, req)
+	user, app := params["user"], params["app"]
+
+	xAPIVersion := req.Header.Get("X-Experience-API-Version")
+	if !validator.IsValidXAPIVersion(xAPIVersion) {
+		return NewBadRequestErr("Invalid or empty xAPI version given in X-Experience-API-Version").Response()
+	}
+
+	sp, err := parseStateParams(xAPIVersion, req.URL.Query())
+	if err != nil {
+		return NewBadRequestErrF("Invalid parameter given: %s", err).Response()
+	}
+	if len(sp.stateID) == 0 {
+		return NewBadRequestErr("stateId is required").Response()
+	}
+
+	contentType, content, err := readDocumentBody(req)
+	if err != nil {
+		return NewBadRequestErrF("An error occured on read request: %s", err).Response()
+	}
+
+	ctx := req.Context()
+
+	if code, mess := c.checkQuota(ctx, user); code != http.StatusOK {
+		return code, mess
+	}
+
+	var oldSize int64
+	old, err := c.store.FindState(ctx, user, app, sp.activityID, sp.agent, sp.registration, sp.stateID)
+	if err != nil && err != model.ErrNotFound {
+		logger.Err("An unexpected error occured on find DB: ", err)
+		return http.StatusInternalServerError, "Internal Server Error"
+	}
+	if old != nil {
+		oldSize = int64(len(old.Content))
+
+		if merge {
+			if !isJSONContentType(old.ContentType) || !isJSONContentType(contentType) {
+				return NewBadRequestErr("Both stored and given state must be JSON on POST request").Response()
+			}
+			if content, err = mergeJSONDocument(old.Content, content); err != nil {
+				return NewBadRequestErrF("Cannot merge state: %s", err).Response()
+			}
+		}
+	}
+
+	state := model.NewState(user, app, sp.activityID, sp.agent, sp.registration, sp.stateID, contentType, content, time.Now())
+	if err := c.store.SaveState(ctx, state); err != nil {
+		logger.Err("An unexpected error occured on save state into DB: ", err)
+		return http.StatusInternalServerError, "Internal Server Error"
+	}
+
+	if err := c.store.AddQuotaUsage(ctx, user, int64(len(content))-oldSize); err != nil {
+		logger.Err("An unexpected error occured on increment quota: ", err)
+		return http.StatusInternalServerError, "Internal Server Error"
+	}
+
+	return http.StatusNoContent, "No Content"
+}
+
+// DeleteState は State の DELETE リクエストを扱うハンドラである。
+// stateId が指定されていない場合は activityId, agent, registration が一致する全ての State を削除する。
+// その際 registration も指定されていなければ、全ての registration の State を削除する。
+func (c *Controller) DeleteState(params martini.Params, w http.ResponseWriter, req *http.Request) (int, string) {
+	setDocumentHeader(w, req)
+	user, app := params["user"], params["app"]
+
+	xAPIVersion := req.Header.Get("X-Experience-API-Version")
+	if !validator.IsValidXAPIVersion(xAPIVersion) {
+		return NewBadRequestErr("Invalid or empty xAPI version given in X-Experience-API-Version").Response()
+	}
+
+	sp, err := parseStateParams(xAPIVersion, req.URL.Query())
+	if err != nil {
+		return NewBadRequestErrF("Invalid parameter given: %s", err).Response()
+	}
+
+	ctx := req.Context()
+
+	size, err := c.store.RemoveStates(ctx, user, app, sp.activityID, sp.agent, sp.registration, sp.stateID)
+	if err != nil {
+		logger.Err("An unexpected error occured on remove state from DB: ", err)
+		return http.StatusInternalServerError, "Internal Server Error"
+	}
+
+	if err := c.store.AddQuotaUsage(ctx, user, -size); err != nil {
+		logger.Err("An unexpected error occured on decrement quota: ", err)
+		return http.StatusInternalServerError, "Internal Server Error"
+	}
+
+	return http.StatusNoContent, "No Content"
+}
@@ -0,0 +1,188 @@
+// Copyright 2015 realglobe, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/Jeffail/gabs"
+	"github.com/go-martini/martini"
+	"github.com/satori/go.uuid"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+func initStateHandler(db *mongo.Database) *martini.ClassicMartini {
+	mart := martini.Classic()
+	hand := newController(db)
+	mart.Get("/:user/:app/activities/state", hand.FindState)
+	mart.Put("/:user/:app/activities/state", hand.StoreState)
+	mart.Post("/:user/:app/activities/state", hand.MergeState)
+	mart.Delete("/:user/:app/activities/state", hand.DeleteState)
+
+	return mart
+}
+
+func stateValues(activityID, stateID string) *url.Values {
+	v := &url.Values{}
+	v.Add("activityId", activityID)
+	v.Add("agent", `{"objectType": "Agent", "mbox": "mailto:state@example.com"}`)
+	if len(stateID) > 0 {
+		v.Add("stateId", stateID)
+	}
+
+	return v
+}
+
+func requestState(t *testing.T, mart *martini.ClassicMartini, method string, v *url.Values, body io.Reader, contentType string) *httptest.ResponseRecorder {
+	req, err := http.NewRequest(method, "/test/test/activities/state?"+v.Encode(), body)
+	fatalIfError(t, err)
+
+	req.Header.Add("X-Experience-API-Version", "1.0.2")
+	if len(contentType) > 0 {
+		req.Header.Add("Content-Type", contentType)
+	}
+
+	resp := httptest.NewRecorder()
+	mart.ServeHTTP(resp, req)
+
+	return resp
+}
+
+func TestPutAndGetState(t *testing.T) {
+	db := initDatabase(t)
+	defer closeDatabase(db)
+	mart := initStateHandler(db)
+
+	activityID := "http://example.com/activities/" + uuid.NewV4().String()
+	v := stateValues(activityID, "bookmark")
+
+	resp := requestState(t, mart, "PUT", v, strings.NewReader("page-12"), "text/plain")
+	if got, expected := resp.Code, http.StatusNoContent; got != expected {
+		t.Fatalf("Expected %v response code from put state; got %d", expected, got)
+	}
+
+	resp = requestState(t, mart, "GET", v, nil, "")
+	if got, expected := resp.Code, http.StatusOK; got != expected {
+		t.Fatalf("Expected %v response code from get state; got %d", expected, got)
+	}
+	if got, expected := resp.Header().Get("Content-Type"), "text/plain"; got != expected {
+		t.Fatalf("Expected Content-Type: %v; got %v", expected, got)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	fatalIfError(t, err)
+	if got, expected := string(body), "page-12"; got != expected {
+		t.Fatalf("Expected state %v; got %v", expected, got)
+	}
+
+	// 別の registration の State は見えない
+	v.Add("registration", uuid.NewV4().String())
+	resp = requestState(t, mart, "GET", v, nil, "")
+	if got, expected := resp.Code, http.StatusNotFound; got != expected {
+		t.Fatalf("Expected %v response code from get state; got %d", expected, got)
+	}
+}
+
+func TestPostStateWithMerge(t *testing.T) {
+	db := initDatabase(t)
+	defer closeDatabase(db)
+	mart := initStateHandler(db)
+
+	activityID := "http://example.com/activities/" + uuid.NewV4().String()
+	v := stateValues(activityID, "suspend")
+
+	resp := requestState(t, mart, "POST", v, strings.NewReader(`{"a": 1, "b": 2}`), "application/json")
+	if got, expected := resp.Code, http.StatusNoContent; got != expected {
+		t.Fatalf("Expected %v response code from post state; got %d", expected, got)
+	}
+	resp = requestState(t, mart, "POST", v, strings.NewReader(`{"b": 3, "c": 4}`), "application/json")
+	if got, expected := resp.Code, http.StatusNoContent; got != expected {
+		t.Fatalf("Expected %v response code from post state; got %d", expected, got)
+	}
+
+	resp = requestState(t, mart, "GET", v, nil, "")
+	if got, expected := resp.Code, http.StatusOK; got != expected {
+		t.Fatalf("Expected %v response code from get state; got %d", expected, got)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	fatalIfError(t, err)
+	state, err := gabs.ParseJSON(body)
+	fatalIfError(t, err)
+
+	for key, expected := range map[string]float64{"a": 1, "b": 3, "c": 4} {
+		if got, ok := state.Search(key).Data().(float64); !ok || got != expected {
+			t.Fatalf("Expected %v of field %s in merged state; got %v", expected, key, got)
+		}
+	}
+
+	// JSON でない State とはマージできない
+	resp = requestState(t, mart, "POST", v, strings.NewReader("plain text"), "text/plain")
+	if got, expected := resp.Code, http.StatusBadRequest; got != expected {
+		t.Fatalf("Expected %v response code from post state; got %d", expected, got)
+	}
+}
+
+func TestGetStateIDsAndDeleteStates(t *testing.T) {
+	db := initDatabase(t)
+	defer closeDatabase(db)
+	mart := initStateHandler(db)
+
+	activityID := "http://example.com/activities/" + uuid.NewV4().String()
+	for _, stateID := range []string{"state-1", "state-2"} {
+		resp := requestState(t, mart, "PUT", stateValues(activityID, stateID), strings.NewReader("{}"), "application/json")
+		if got, expected := resp.Code, http.StatusNoContent; got != expected {
+			t.Fatalf("Expected %v response code from put state; got %d", expected, got)
+		}
+	}
+
+	// registration を持つ State
+	registered := stateValues(activityID, "state-3")
+	registered.Add("registration", uuid.NewV4().String())
+	resp := requestState(t, mart, "PUT", registered, strings.NewReader("{}"), "application/json")
+	if got, expected := resp.Code, http.StatusNoContent; got != expected {
+		t.Fatalf("Expected %v response code from put state; got %d", expected, got)
+	}
+
+	// registration を指定しない場合は全ての registration の State を対象とする
+	resp = requestState(t, mart, "GET", stateValues(activityID, ""), nil, "")
+	if got, expected := resp.Code, http.StatusOK; got != expected {
+		t.Fatalf("Expected %v response code from get state ids; got %d", expected, got)
+	}
+	var ids []string
+	fatalIfError(t, json.NewDecoder(resp.Body).Decode(&ids))
+	if len(ids) != 3 || ids[0] != "state-1" || ids[1] != "state-2" || ids[2] != "state-3" {
+		t.Fatalf("Expected [state-1 state-2 state-3] as state ids; got %v", ids)
+	}
+
+	resp = requestState(t, mart, "DELETE", stateValues(activityID, ""), nil, "")
+	if got, expected := resp.Code, http.StatusNoContent; got != expected {
+		t.Fatalf("Expected %v response code from delete states; got %d", expected, got)
+	}
+
+	resp = requestState(t, mart, "GET", stateValues(activityID, "state-1"), nil, "")
+	if got, expected := resp.Code, http.StatusNotFound; got != expected {
+		t.Fatalf("Expected %v response code from get deleted state; got %d", expected, got)
+	}
+	resp = requestState(t, mart, "GET", registered, nil, "")
+	if got, expected := resp.Code, http.StatusNotFound; got != expected {
+		t.Fatalf("Expected %v response code from get deleted state with registration; got %d", expected, got)
+	}
+}
@@ -15,8 +15,11 @@
 package controller
 
 import (
+	"net/http"
+
+	"github.com/realglobe-Inc/edo-xrs/app/model"
+	"github.com/realglobe-Inc/edo-xrs/app/validator"
 	"github.com/realglobe-Inc/go-lib/rglog"
-	"gopkg.in/mgo.v2"
 )
 
 var (
@@ -25,11 +28,22 @@ var (
 
 // Controller stores the local configuration of controller.
 type Controller struct {
-	session *mgo.Session // Mongo DB のセッション
+	store model.Store // ステートメント、添付ファイル、その他のドキュメントのストレージ
 }
 
 // New は新しい Controller のインスタンスを返す。
-// 引数の s にはこのコントローラで使用する Mongo DB のセッションが与えられる。
-func New(s *mgo.Session) *Controller {
-	return &Controller{s}
+// 引数の store にはステートメントと添付ファイル、State や Profile などのドキュメントを保存するストレージが与えられる。
+func New(store model.Store) *Controller {
+	return &Controller{store}
+}
+
+// setXAPIVersionHeader はクライアントが指定した xAPI のバージョンに応じて、
+// X-Experience-API-Version ヘッダを設定する。バージョンが不正な場合は 1.0.2 とする。
+func setXAPIVersionHeader(w http.ResponseWriter, req *http.Request) {
+	version := validator.ToXAPIVersion(req.Header.Get("X-Experience-API-Version"))
+	if version == validator.XAPIVersionVoid {
+		version = validator.XAPIVersion10x
+	}
+
+	w.Header().Set("X-Experience-API-Version", version.String())
 }
@@ -0,0 +1,91 @@
+// Copyright 2015 realglobe, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"encoding/json"
+	"reflect"
+	"time"
+)
+
+// ステートメントの比較において無視するフィールド。これらは LRS により補完、
+// もしくは上書きされうる。
+var ignoredFieldsOnCompare = []string{"authority", "stored", "id", "version"}
+
+// isEquivalentStatement は二つのステートメントが、ignoredFieldsOnCompare のフィールドを除いて
+// 同じであるかを返す。言語マップなどのオブジェクトのキーの順序は比較に影響しない。
+func isEquivalentStatement(a, b map[string]interface{}) bool {
+	na, err := normalizeStatement(a)
+	if err != nil {
+		return false
+	}
+	nb, err := normalizeStatement(b)
+	if err != nil {
+		return false
+	}
+
+	return reflect.DeepEqual(na, nb)
+}
+
+// normalizeStatement は比較のため、ignoredFieldsOnCompare のフィールドを除いたステートメントを
+// JSON として解釈し直したものを返す。これにより数値や配列の型の違いを無くす。
+func normalizeStatement(statement map[string]interface{}) (map[string]interface{}, error) {
+	copied := make(map[string]interface{}, len(statement))
+	for k, v := range statement {
+		copied[k] = v
+	}
+	for _, field := range ignoredFieldsOnCompare {
+		delete(copied, field)
+	}
+
+	b, err := json.Marshal(copied)
+	if err != nil {
+		return nil, err
+	}
+
+	var normalized map[string]interface{}
+	if err := json.Unmarshal(b, &normalized); err != nil {
+		return nil, err
+	}
+
+	// timestamp の表記 (タイムゾーンなど) や contextActivities の単一の Activity と配列の違いは、
+	// 以前に保存されたものを含めて同じとみなす
+	canonicalizeStatement(normalized)
+
+	return normalized, nil
+}
+
+// isEquivalentResentStatement は再送されたステートメントが、保存されているステートメントと
+// 同等であるかを返す。再送されたステートメントに timestamp が無く、LRS が補完した場合
+// (time.Time として保持されている) は timestamp を比較しない。
+func isEquivalentResentStatement(stored, resent map[string]interface{}) bool {
+	if _, filled := resent["timestamp"].(time.Time); filled {
+		stored = withoutField(stored, "timestamp")
+		resent = withoutField(resent, "timestamp")
+	}
+
+	return isEquivalentStatement(stored, resent)
+}
+
+func withoutField(statement map[string]interface{}, field string) map[string]interface{} {
+	copied := make(map[string]interface{}, len(statement))
+	for k, v := range statement {
+		if k != field {
+			copied[k] = v
+		}
+	}
+
+	return copied
+}
@@ -0,0 +1,126 @@
+// Copyright 2015 realglobe, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"time"
+
+	"github.com/realglobe-Inc/edo-xrs/app/model"
+	"github.com/realglobe-Inc/edo-xrs/app/validator"
+)
+
+// timestampWithoutTimezone はタイムゾーンの無い timestamp の形式である。1.0.x では認められ、UTC とみなす。
+const timestampWithoutTimezone = "2006-01-02T15:04:05.999999999"
+
+// parseTimestamp は timestamp を解釈する。タイムゾーンの無いものは UTC とみなす。
+func parseTimestamp(timestamp string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339Nano, timestamp); err == nil {
+		return t, nil
+	}
+
+	return time.Parse(timestampWithoutTimezone, timestamp)
+}
+
+// formatTimestamp は timestamp, stored の値を UTC の RFC 3339 の文字列とする。
+// 解釈できない値はそのまま返す。
+func formatTimestamp(v interface{}) interface{} {
+	switch t := v.(type) {
+	case time.Time:
+		return t.UTC().Format(time.RFC3339Nano)
+	case string:
+		if parsed, err := parseTimestamp(t); err == nil {
+			return parsed.UTC().Format(time.RFC3339Nano)
+		}
+	}
+
+	return v
+}
+
+// statementTargets はステートメント自身と、object が SubStatement であればそれを返す。
+func statementTargets(statement map[string]interface{}) []map[string]interface{} {
+	targets := []map[string]interface{}{statement}
+	if object, ok := statement["object"].(map[string]interface{}); ok && object["objectType"] == "SubStatement" {
+		targets = append(targets, object)
+	}
+
+	return targets
+}
+
+// canonicalizeStatement はステートメントを xAPI のバージョンによらない形式とする。ステートメントは
+// この形式で保存し、保存時のバージョンは Document.Version に残す。
+//   - 文字列の timestamp は UTC とする。LRS が補完した time.Time の timestamp は再送の判定に用いるため変更しない
+//   - contextActivities の単一の Activity は配列とする
+func canonicalizeStatement(statement map[string]interface{}) {
+	for _, target := range statementTargets(statement) {
+		if timestamp, ok := target["timestamp"].(string); ok {
+			target["timestamp"] = formatTimestamp(timestamp)
+		}
+
+		context, ok := target["context"].(map[string]interface{})
+		if !ok {
+			continue
+		}
+		activities, ok := context["contextActivities"].(map[string]interface{})
+		if !ok {
+			continue
+		}
+		for key, activity := range activities {
+			if object, ok := activity.(map[string]interface{}); ok {
+				activities[key] = []interface{}{object}
+			}
+		}
+	}
+}
+
+// convertStatements は保存されているステートメントを、クライアントが指定した xAPI のバージョンの
+// 形式に変換する。保存時のバージョンは Document.Version に残る。
+func convertStatements(docs model.DocumentSlice, xAPIVersion string) {
+	to := validator.ToXAPIVersion(xAPIVersion)
+
+	for _, doc := range docs {
+		convertStatement(doc.Data, to)
+	}
+}
+
+// convertStatement は保存されているステートメントを to のバージョンの形式に変換する。
+// canonicalizeStatement 以前に保存されたものも扱えるよう、保存時のバージョンによらず変換する。
+func convertStatement(statement map[string]interface{}, to validator.XAPIVersion) {
+	if to == validator.XAPIVersionVoid {
+		return
+	}
+
+	for _, target := range statementTargets(statement) {
+		// 2.0.0 ではタイムゾーンが必須で、オフセット -00:00 は認められないため、
+		// タイムゾーンの無いものを含め、どのバージョンにも UTC として返す
+		if timestamp, ok := target["timestamp"]; ok {
+			target["timestamp"] = formatTimestamp(timestamp)
+		}
+
+		if to == validator.XAPIVersion10x {
+			// contextAgents, contextGroups は 2.0.0 で追加されたため 1.0.x には含めない
+			if context, ok := target["context"].(map[string]interface{}); ok {
+				delete(context, "contextAgents")
+				delete(context, "contextGroups")
+			}
+		}
+	}
+
+	if stored, ok := statement["stored"]; ok {
+		statement["stored"] = formatTimestamp(stored)
+	}
+	if _, ok := statement["version"]; ok {
+		statement["version"] = to.String()
+	}
+}
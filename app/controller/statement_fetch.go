@@ -16,6 +16,7 @@ package controller
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -32,14 +33,13 @@ import (
 	"github.com/realglobe-Inc/edo-xrs/app/miscs"
 	"github.com/realglobe-Inc/edo-xrs/app/model"
 	"github.com/realglobe-Inc/edo-xrs/app/validator"
-	"gopkg.in/mgo.v2"
-	"gopkg.in/mgo.v2/bson"
 )
 
 // FindStatement handles request of search statement
 func (c *Controller) FindStatement(params martini.Params,
 	languages acceptlang.AcceptLanguages, w http.ResponseWriter, req *http.Request) (int, string) {
 	user, app := params["user"], params["app"]
+	ctx := req.Context()
 
 	// check version of xAPI
 	xAPIVersion := req.Header.Get("X-Experience-API-Version")
@@ -49,15 +49,53 @@ func (c *Controller) FindStatement(params martini.Params,
 
 	urlParams := req.URL.Query()
 	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("X-Experience-API-Version", "1.0.2")
+	setXAPIVersionHeader(w, req)
 
 	// find single statement if statementId or voidedStatementId is specified
 	if len(urlParams.Get("statementId")) > 0 || len(urlParams.Get("voidedStatementId")) > 0 {
-		return c.findSingleStatement(xAPIVersion, user, app, urlParams, w)
+		return c.findSingleStatement(ctx, xAPIVersion, user, app, urlParams, w)
 	}
 
 	// otherwise find multiple statments
-	return c.findMultipleStatements(xAPIVersion, user, app, languages, urlParams, w)
+	return c.findMultipleStatements(ctx, xAPIVersion, user, app, languages, urlParams, w, nil)
+}
+
+// FindMoreStatements は more URL による、複数ステートメントの検索結果の続きを返すハンドラである。
+// URL パラメータの more には直前の検索結果で発行された MoreCursor の ID が与えられる。
+func (c *Controller) FindMoreStatements(params martini.Params,
+	languages acceptlang.AcceptLanguages, w http.ResponseWriter, req *http.Request) (int, string) {
+	user, app := params["user"], params["app"]
+	ctx := req.Context()
+
+	// check version of xAPI
+	xAPIVersion := req.Header.Get("X-Experience-API-Version")
+	if !validator.IsValidXAPIVersion(xAPIVersion) {
+		return NewBadRequestErr("Invalid or empty xAPI version given in X-Experience-API-Version").Response()
+	}
+
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	setXAPIVersionHeader(w, req)
+
+	cursor, err := c.store.FindMoreCursor(ctx, user, app, params["more"])
+	if err == model.ErrNotFound {
+		return http.StatusNotFound, "Not Found"
+	}
+	if err != nil {
+		logger.Err("An unexpected error occured on find DB: ", err)
+		return http.StatusInternalServerError, "Internal Server Error"
+	}
+	if expiration := miscs.GlobalConfig.Global.MoreExpiration; expiration > 0 &&
+		cursor.IsExpired(time.Duration(expiration)*time.Second) {
+		return http.StatusNotFound, "Not Found"
+	}
+
+	urlParams, err := url.ParseQuery(cursor.Params)
+	if err != nil {
+		logger.Err("An unexpected error occured: ", err)
+		return http.StatusInternalServerError, "Internal Server Error"
+	}
+
+	return c.findMultipleStatements(ctx, xAPIVersion, user, app, languages, urlParams, w, cursor)
 }
 
 // FindStatementHead handles request of get meta information
@@ -71,15 +109,17 @@ func (c *Controller) FindStatementHead(params martini.Params,
 	}
 
 	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("X-Experience-API-Version", "1.0.2")
+	setXAPIVersionHeader(w, req)
 	w.Header().Set("Content-Type", "application/json")  // BUG: this header is wrong when attachments given
 
+	setConsistentThrough(w, c.store.ConsistentThrough(req.Context()))
+
 	return http.StatusOK, ""
 }
 
 // findSingleStatement は単一のステートメントをレスポンスとして返す。
 // この関数はリクエストパラメータに statementId もしくは voidedStatementId が指定されている時のみ呼ばれる。
-func (c *Controller) findSingleStatement(xAPIVersion, user, app string, params url.Values, rw http.ResponseWriter) (int, string) {
+func (c *Controller) findSingleStatement(ctx context.Context, xAPIVersion, user, app string, params url.Values, rw http.ResponseWriter) (int, string) {
 
 	// リクエストパラメータのバリデート
 	if !validSingleStmtRequestOf(params) {
@@ -91,39 +131,30 @@ func (c *Controller) findSingleStatement(xAPIVersion, user, app string, params u
 		return NewBadRequestErrF("Invalid attachments parameter given: %s", err).Response()
 	}
 
-	query := bson.M{
-		"version": xAPIVersion,
-		"user":    user,
-		"app":     app,
-	}
-
-	// データベースのセッションを取得
-	sess := c.session.New()
-	defer sess.Close()
-	col := sess.DB(miscs.GlobalConfig.MongoDB.DBName).C("statement")
+	setConsistentThrough(rw, c.store.ConsistentThrough(ctx))
 
-	// statementId, もしくは voidedStatementId をチェックし、データベースのクエリを生成する。
+	// statementId, もしくは voidedStatementId をチェックし、検索するステートメントIDを決める。
+	var id string
 	if statementID := params.Get("statementId"); validator.IsUUID(statementID) {
 		// リクエストパラメータに statementId が指定されていたとき
-		if isVoidedStatement(col, xAPIVersion, user, app, statementID) {
+		if c.isVoidedStatement(ctx, user, app, statementID) {
 			// 指定されたステートメントIDが Voided ならば not found
 			return http.StatusNotFound, "Not Found"
 		}
-		query["data.id"] = statementID
+		id = statementID
 	} else if voidedStatementID := params.Get("voidedStatementId"); validator.IsUUID(voidedStatementID) {
 		// リクエストパラメータに voidedStatementId が指定されていたとき
-		if !isVoidedStatement(col, xAPIVersion, user, app, voidedStatementID) {
+		if !c.isVoidedStatement(ctx, user, app, voidedStatementID) {
 			// 指定されたステートメントIDが Voided """でなければ"" not found
 			return http.StatusNotFound, "Not Found"
 		}
-		query["data.id"] = voidedStatementID
+		id = voidedStatementID
 	} else {
 		return NewBadRequestErr("A statementId or voidedStatementId is required").Response()
 	}
 
-	var document model.Document
-	err = col.Find(query).One(&document)
-	if err == mgo.ErrNotFound {
+	document, err := c.store.FindStatement(ctx, user, app, id)
+	if err == model.ErrNotFound {
 		return http.StatusNotFound, "Statement Not Found"
 	}
 	if err != nil {
@@ -131,6 +162,8 @@ func (c *Controller) findSingleStatement(xAPIVersion, user, app string, params u
 		return http.StatusInternalServerError, "Internal Server Error"
 	}
 
+	convertStatements(model.DocumentSlice{*document}, xAPIVersion)
+
 	res, err := json.Marshal(document.Data)
 	if err != nil {
 		// data はデータベースから受け取った値なので、このエラーが起きる場合は深刻な問題がある。
@@ -145,8 +178,8 @@ func (c *Controller) findSingleStatement(xAPIVersion, user, app string, params u
 	}
 
 	// attachment を含むリクエスト
-	sha2s := collectSHA2sOfAttachments(model.DocumentSlice{document})
-	buf, boundary, err := appendAttachments(sess, res, sha2s)
+	sha2s := collectSHA2sOfAttachments(model.DocumentSlice{*document})
+	buf, boundary, err := appendAttachments(ctx, c.store, res, sha2s)
 	if err != nil {
 		logger.Warn(err)
 		return http.StatusInternalServerError, "Internal Server Error"
@@ -156,75 +189,57 @@ func (c *Controller) findSingleStatement(xAPIVersion, user, app string, params u
 	return http.StatusOK, string(buf)
 }
 
-func (c *Controller) findMultipleStatements(xAPIVersion, user, app string,
-	languages acceptlang.AcceptLanguages, params url.Values, rw http.ResponseWriter) (int, string) {
-	var queryTerms []interface{}
+// findMultipleStatements は条件に合うステートメントの列をレスポンスとして返す。
+// cursor が nil でない場合は、cursor が表す位置から検索を再開する。
+func (c *Controller) findMultipleStatements(ctx context.Context, xAPIVersion, user, app string,
+	languages acceptlang.AcceptLanguages, params url.Values, rw http.ResponseWriter, cursor *model.MoreCursor) (int, string) {
+	// 最初のページを検索した時刻より後に保存されたステートメントは、続きのページにも含めない
+	filter := &model.StatementFilter{
+		Snapshot: time.Now(),
+		Cursor:   cursor,
+	}
+	if cursor != nil {
+		filter.Snapshot = cursor.Snapshot
+	}
 
 	if agent := params.Get("agent"); len(agent) > 0 {
 		relatedAgents, err := parseParamBool(params, "related_agents")
 		if err != nil {
 			return NewBadRequestErrF("Invalid related_agents paramter given: %s", err).Response()
 		}
-		qs, err := queryOfAgent(xAPIVersion, agent, relatedAgents)
-		if err != nil {
+		if filter.Agent, err = parseAgent(xAPIVersion, agent); err != nil {
 			return NewBadRequestErrF("Invalid agent given: %s", err).Response()
 		}
-
-		queryTerms = append(queryTerms, qs)
+		filter.RelatedAgents = relatedAgents
 	}
 
 	if v, ok := params["verb"]; ok && len(v) > 0 {
-		queryTerms = append(queryTerms, bson.M{"data.verb.id": v[0]})
+		filter.Verb = v[0]
 	}
 
 	if v, ok := params["activity"]; ok && len(v) > 0 {
-		id := v[0]
-		activityQuery := []bson.M{}
-
-		activityQuery = append(activityQuery, bson.M{
-			"data.object.objectType": "Activity",
-			"data.object.id":         id,
-		})
-
 		relatedActivities, err := parseParamBool(params, "related_activities")
 		if err != nil {
 			return NewBadRequestErrF("Invalid related_activities paramter given: %s", err).Response()
 		}
-
-		if relatedActivities {
-			activityQuery = append(activityQuery, bson.M{
-				"data.context.contextActivities.parent": bson.M{"$elemMatch": bson.M{"id": id}},
-			}, bson.M{
-				"data.context.contextActivities.grouping": bson.M{"$elemMatch": bson.M{"id": id}},
-			}, bson.M{
-				"data.context.contextActivities.category": bson.M{"$elemMatch": bson.M{"id": id}},
-			}, bson.M{
-				"data.context.contextActivities.other": bson.M{"$elemMatch": bson.M{"id": id}},
-			})
-		}
-		queryTerms = append(queryTerms, bson.M{"$or": activityQuery})
+		filter.Activity = v[0]
+		filter.RelatedActivities = relatedActivities
 	}
 
 	if v, ok := params["registration"]; ok && len(v) > 0 {
-		queryTerms = append(queryTerms, bson.M{
-			"data.context.registration": v[0],
-		})
+		filter.Registration = v[0]
 	}
 
 	if v, ok := params["since"]; ok && len(v) > 0 {
 		if t, err := time.Parse(time.RFC3339Nano, v[0]); err == nil {
-			queryTerms = append(queryTerms, bson.M{
-				"timestamp": bson.M{"$gt": t},
-			})
+			filter.Since = t
 		} else {
 			return NewBadRequestErr("Since must be of the form of RFC3339 Date/Time").Response()
 		}
 	}
 	if v, ok := params["until"]; ok && len(v) > 0 {
 		if t, err := time.Parse(time.RFC3339Nano, v[0]); err == nil {
-			queryTerms = append(queryTerms, bson.M{
-				"timestamp": bson.M{"$lt": t},
-			})
+			filter.Until = t
 		} else {
 			return NewBadRequestErr("Until must be of the form of RFC3339 Date/Time").Response()
 		}
@@ -238,6 +253,12 @@ func (c *Controller) findMultipleStatements(xAPIVersion, user, app string,
 			return NewBadRequestErr("Limit must be integer value").Response()
 		}
 	}
+	// 0 はサーバーの上限を表す (Experience API, Section 7.2.3 を参照)
+	if limit <= 0 || limit > miscs.GlobalConfig.Global.MaxStatements {
+		limit = miscs.GlobalConfig.Global.MaxStatements
+	}
+	// 続きの有無を知るため、limit より一つ多く取得する
+	filter.Limit = limit + 1
 
 	formatType := "exact"
 	if v, ok := params["format"]; ok && len(v) > 0 {
@@ -250,42 +271,47 @@ func (c *Controller) findMultipleStatements(xAPIVersion, user, app string,
 	}
 
 	// ソート順
-	sortField := "timestamp"
-	ascending, err := parseParamBool(params, "ascending")
-	if err != nil {
+	if filter.Ascending, err = parseParamBool(params, "ascending"); err != nil {
 		return NewBadRequestErrF("Invalid ascending parameter given: %s", err).Response()
 	}
-	if ascending {
-		sortField = "-timestamp"
+
+	// snapshot より後に保存されたステートメントは検索結果に含まれない
+	consistentThrough := c.store.ConsistentThrough(ctx)
+	if filter.Snapshot.Before(consistentThrough) {
+		consistentThrough = filter.Snapshot
 	}
+	setConsistentThrough(rw, consistentThrough)
 
-	queryTerms = append(queryTerms, bson.M{
-		"version": xAPIVersion,
-		"user":    user,
-		"app":     app,
-	})
+	// fetch statemsnts from DB and construct response body
+	respStatements, err := c.store.QueryStatements(ctx, user, app, filter)
+	if err != nil {
+		logger.Err("An unexpected error occured: ", err)
+		return http.StatusInternalServerError, "Internal Server Error"
+	}
 
-	query := bson.M{"$and": queryTerms}
+	var more string
+	if len(respStatements) > limit {
+		respStatements = respStatements[:limit]
 
-	// データベースのセッションを取得
-	session := c.session.New()
-	defer session.Close()
-	col := session.DB(miscs.GlobalConfig.MongoDB.DBName).C("statement")
+		next := model.NewMoreCursor(xAPIVersion, user, app, params.Encode(), &respStatements[limit-1], filter.Snapshot)
+		if err := c.store.InsertMoreCursor(ctx, next); err != nil {
+			logger.Err("An unexpected error occured on insert more cursor into DB: ", err)
+			return http.StatusInternalServerError, "Internal Server Error"
+		}
+		more = (&url.URL{Path: "/" + user + "/" + app + "/statements/more/" + next.ID.Hex()}).String()
+	}
 
-	// fetch statemsnts from DB and construct response body
-	var respStatements model.DocumentSlice
+	convertStatements(respStatements, xAPIVersion)
 
-	var result model.Document
-	iter := col.Find(query).Sort(sortField).Limit(limit).Iter()
-	for iter.Next(&result) {
-		respStatements = append(respStatements, result)
-	}
-	if err := iter.Close(); err != nil {
-		logger.Err("An unexpected error occured: ", err)
-		return http.StatusInternalServerError, "Internal Server Error"
+	// canonical フォーマットでは Activity の定義を保存されている全ての定義をまとめたものにする
+	if formatType == "canonical" {
+		if err := c.canonicalizeActivities(ctx, user, app, respStatements); err != nil {
+			logger.Err("An unexpected error occured: ", err)
+			return http.StatusInternalServerError, "Internal Server Error"
+		}
 	}
 
-	respBody, err := formatRespMultipleStatements(formatType, languages, respStatements)
+	respBody, err := formatRespMultipleStatements(formatType, languages, respStatements, more)
 	if err != nil {
 		logger.Err("An unexpected error occured: ", err)
 		return http.StatusInternalServerError, "Internal Server Error"
@@ -299,7 +325,7 @@ func (c *Controller) findMultipleStatements(xAPIVersion, user, app string,
 
 	// attachment を含むリクエスト
 	sha2s := collectSHA2sOfAttachments(respStatements)
-	buf, boundary, err := appendAttachments(session, respBody, sha2s)
+	buf, boundary, err := appendAttachments(ctx, c.store, respBody, sha2s)
 	if err != nil {
 		logger.Err("An unexpected error occured: ", err)
 		return http.StatusInternalServerError, "Internal Server Error"
@@ -309,23 +335,22 @@ func (c *Controller) findMultipleStatements(xAPIVersion, user, app string,
 	return http.StatusOK, string(buf)
 }
 
-func isVoidedStatement(collection *mgo.Collection, version, user, app, id string) bool {
-	query := bson.M{
-		"version":                version,
-		"user":                   user,
-		"app":                    app,
-		"data.verb.id":           miscs.GlobalConfig.Global.VoidedStatementID,
-		"data.object.objectType": "StatementRef",
-		"data.object.id":         id,
-	}
+// setConsistentThrough は X-Experience-API-Consistent-Through ヘッダを設定する。
+// (Experience API, Section 7.2.3 を参照)
+func setConsistentThrough(w http.ResponseWriter, t time.Time) {
+	w.Header().Set("X-Experience-API-Consistent-Through", t.UTC().Format(time.RFC3339Nano))
+}
 
-	count, err := collection.Find(query).Count()
+// isVoidedStatement は id のステートメントが Voided となっているかを返す。
+// 検索に失敗した場合は Voided でないものとして扱う。
+func (c *Controller) isVoidedStatement(ctx context.Context, user, app, id string) bool {
+	voided, err := c.store.IsVoided(ctx, user, app, id)
 	if err != nil {
 		logger.Err("An unexpected error occured on find voided statement in DB: ", err)
 		return false
 	}
 
-	return count > 0
+	return voided
 }
 
 // validSingleStmtRequestOf は引数にリクエストパラメータを与えることでその
@@ -356,125 +381,8 @@ func validSingleStmtRequestOf(values url.Values) bool {
 	return len(values) <= count
 }
 
-func queryOfTerms(terms []map[string]interface{}) bson.M {
-	var identTerms []bson.M
-
-	for _, term := range terms {
-		for k, v := range term {
-			identTerms = append(identTerms, bson.M{k: v})
-		}
-	}
-
-	return bson.M{"$or": identTerms}
-}
-
-func constructIFITerms(prefix string, agent map[string]interface{}) (terms []map[string]interface{}) {
-	if account, ok := agent["account"]; ok {
-		terms = append(terms, map[string]interface{}{
-			"$and": []bson.M{
-				{prefix + ".account.name": (account.(map[string]interface{}))["name"].(string)},
-				{prefix + ".account.homePage": (account.(map[string]interface{}))["homePage"].(string)},
-			},
-		})
-	}
-	if mbox, ok := agent["mbox"]; ok {
-		terms = append(terms, map[string]interface{}{prefix + ".mbox": mbox.(string)})
-	}
-	if mboxSHA1, ok := agent["mbox_sha1sum"]; ok {
-		terms = append(terms, map[string]interface{}{prefix + ".mbox_sha1sum": mboxSHA1.(string)})
-	}
-	if openID, ok := agent["openid"]; ok {
-		terms = append(terms, map[string]interface{}{prefix + ".openid": openID.(string)})
-	}
-
-	return
-}
-
-func constructIFITermsOfArray(prefix string, agent map[string]interface{}) (terms []map[string]interface{}) {
-	if account, ok := agent["account"]; ok {
-		terms = append(terms, map[string]interface{}{
-			"$and": []bson.M{
-				{
-					prefix: bson.M{
-						"$elemMatch": bson.M{
-							"account.name": (account.(map[string]interface{}))["name"].(string),
-						},
-					},
-				},
-				{
-					prefix: bson.M{
-						"$elemMatch": bson.M{
-							"account.homePage": (account.(map[string]interface{}))["homePage"].(string),
-						},
-					},
-				},
-			},
-		})
-	}
-	if mbox, ok := agent["mbox"]; ok {
-		terms = append(terms, map[string]interface{}{
-			prefix: bson.M{"$elemMatch": bson.M{"mbox": mbox.(string)}},
-		})
-	}
-	if mboxSHA1, ok := agent["mbox_sha1sum"]; ok {
-		terms = append(terms, map[string]interface{}{
-			prefix: bson.M{"$elemMatch": bson.M{"mbox_sha1sum": mboxSHA1.(string)}},
-		})
-	}
-	if openID, ok := agent["openid"]; ok {
-		terms = append(terms, map[string]interface{}{
-			prefix: bson.M{"$elemMatch": bson.M{"openid": openID.(string)}},
-		})
-	}
-
-	return
-}
-
-func ifiTermsOfAgent(agent map[string]interface{}, isRelated bool) (terms []map[string]interface{}) {
-	terms = append(terms, constructIFITerms("data.actor", agent)...)
-
-	if isRelated {
-		// statement
-		terms = append(terms, constructIFITermsOfArray("data.actor.member", agent)...)
-		terms = append(terms, constructIFITerms("data.object", agent)...)
-		terms = append(terms, constructIFITermsOfArray("data.object.member", agent)...)
-		terms = append(terms, constructIFITermsOfArray("data.authority.member", agent)...)
-		terms = append(terms, constructIFITerms("data.context.instructor", agent)...)
-		terms = append(terms, constructIFITermsOfArray("data.context.instructor.member", agent)...)
-		terms = append(terms, constructIFITerms("data.context.team", agent)...)
-		terms = append(terms, constructIFITermsOfArray("data.context.team.member", agent)...)
-		// substatement
-		terms = append(terms, constructIFITerms("data.object.actor", agent)...)
-		terms = append(terms, constructIFITermsOfArray("data.object.actor.member", agent)...)
-		terms = append(terms, constructIFITerms("data.object.object", agent)...)
-		terms = append(terms, constructIFITermsOfArray("data.object.object.member", agent)...)
-		terms = append(terms, constructIFITermsOfArray("data.object.authority.member", agent)...)
-		terms = append(terms, constructIFITerms("data.object.context.instructor", agent)...)
-		terms = append(terms, constructIFITermsOfArray("data.object.context.instructor.member", agent)...)
-		terms = append(terms, constructIFITerms("data.object.context.team", agent)...)
-		terms = append(terms, constructIFITermsOfArray("data.object.context.team.member", agent)...)
-	}
-
-	return
-}
-
-func termsOfAgent(agent map[string]interface{}, isRelated bool) (terms []map[string]interface{}) {
-	terms = append(terms, ifiTermsOfAgent(agent, isRelated)...)
-
-	if memberSlice, ok := agent["member"]; ok {
-		for _, m := range memberSlice.([]interface{}) {
-			member := m.(map[string]interface{})
-
-			terms = append(terms, ifiTermsOfAgent(member, isRelated)...)
-		}
-	}
-
-	return
-}
-
-// queryOfAgent は agnet の文字列を受け取り、データベースのクエリを返す。
-// 引数に与えられた文字列が変換不可ならエラーを返す。
-func queryOfAgent(xAPIVersion, agentString string, relatedActivities bool) (bson.M, error) {
+// parseAgent は agent の文字列をパースし、xAPI のエージェントであることを検査する。
+func parseAgent(xAPIVersion, agentString string) (map[string]interface{}, error) {
 	var agent map[string]interface{}
 	err := json.Unmarshal([]byte(agentString), &agent)
 
@@ -486,9 +394,7 @@ func queryOfAgent(xAPIVersion, agentString string, relatedActivities bool) (bson
 		return nil, err
 	}
 
-	terms := termsOfAgent(agent, relatedActivities)
-
-	return queryOfTerms(terms), nil
+	return agent, nil
 }
 
 // URLパラーメタの field に指定されたキーに格納されている bool 値を取得する。
@@ -507,142 +413,51 @@ func parseParamBool(params url.Values, field string) (bool, error) {
 	return result, nil
 }
 
-func projectMapSingle(object map[string]interface{}, keys []string) map[string]interface{} {
-	ran := make(map[string]interface{})
-	for _, key := range keys {
-		if content, ok := object[key]; ok {
-			ran[key] = content
-			break
-		}
-	}
-	return ran
-}
-
-func projectDescriptionInArray(root []interface{}, keys []string) []map[string]interface{} {
-	var cs []map[string]interface{}
-
-	for _, c := range root {
-		m := c.(map[string]interface{})
-		desc, ok := m["description"]
-		if ok {
-			m["description"] = projectMapSingle(
-				desc.(map[string]interface{}),
-				keys,
-			)
-		}
-
-		cs = append(cs, m)
-	}
-
-	return cs
-}
-
-// canonical フォーマットが指定されたとき、優先して取得する言語のリスト.
-// リストの先頭が最も優先順位が高い
-var canonFormatFilterPriority = []string{"ja-JP", "en-US"}
-
-func formatCanonicalResponse(docs model.DocumentSlice, languages acceptlang.AcceptLanguages) ([]byte, error) {
-	var formatFilterPriori []string
-	if languages.Len() > 0 {
-		var langstr []string
-		for _, lang := range languages {
-			langstr = append(langstr, lang.Language)
-		}
-		formatFilterPriori = append(langstr, canonFormatFilterPriority...)
-	} else {
-		formatFilterPriori = canonFormatFilterPriority
-	}
+func formatCanonicalResponse(docs model.DocumentSlice, languages acceptlang.AcceptLanguages, more string) ([]byte, error) {
+	ranges := languageRanges(languages)
 
 	// Language Map 型をもつフィールドの言語の種類を一つに絞る
 	docs.Map(func(d model.Document) model.Document {
-		// TODO: 工夫すれば、Mongo の Projection 機能でいけるかもしれない
-		if verb, ok := d.Data["verb"].(map[string]interface{}); ok {
-			if display, ok := verb["display"].(map[string]interface{}); ok {
-				verb["display"] = projectMapSingle(display, formatFilterPriori)
-			}
-		}
-		if object, ok := d.Data["object"].(map[string]interface{}); ok {
-			if objectDefinition, ok := object["definition"].(map[string]interface{}); ok {
-				if name, ok := objectDefinition["name"].(map[string]interface{}); ok {
-					objectDefinition["name"] =
-						projectMapSingle(name, formatFilterPriori)
-				}
-				if description, ok := objectDefinition["description"].(map[string]interface{}); ok {
-					objectDefinition["description"] =
-						projectMapSingle(description, formatFilterPriori)
-				}
-				if choices, ok := objectDefinition["choices"].([]interface{}); ok {
-					objectDefinition["choices"] =
-						projectDescriptionInArray(choices, formatFilterPriori)
-				}
-				if scale, ok := objectDefinition["scale"].([]interface{}); ok {
-					objectDefinition["scale"] =
-						projectDescriptionInArray(scale, formatFilterPriori)
-				}
-				if source, ok := objectDefinition["source"].([]interface{}); ok {
-					objectDefinition["source"] =
-						projectDescriptionInArray(source, formatFilterPriori)
-				}
-				if target, ok := objectDefinition["target"].([]interface{}); ok {
-					objectDefinition["target"] =
-						projectDescriptionInArray(target, formatFilterPriori)
-				}
-				if steps, ok := objectDefinition["steps"].([]interface{}); ok {
-					objectDefinition["steps"] =
-						projectDescriptionInArray(steps, formatFilterPriori)
-				}
-			}
-		}
-		if attachments, ok := d.Data["attachments"].(map[string]interface{}); ok {
-			if display, ok := attachments["display"].(map[string]interface{}); ok {
-				attachments["display"] =
-					projectMapSingle(display, formatFilterPriori)
-			}
-			if display, ok := attachments["description"].(map[string]interface{}); ok {
-				attachments["description"] =
-					projectMapSingle(display, formatFilterPriori)
-			}
-		}
-
+		selectStatementLanguages(d.Data, ranges)
 		return d
 	})
 
 	return json.Marshal(map[string]interface{}{
 		"statements": docs.ToDataArray(),
-		"more":       "",
+		"more":       more,
 	})
 }
 
-func formatExactResponse(docs model.DocumentSlice) ([]byte, error) {
+func formatExactResponse(docs model.DocumentSlice, more string) ([]byte, error) {
 	var respData []interface{}
 	for _, doc := range docs {
 		respData = append(respData, doc.Data)
 	}
 	return json.Marshal(map[string]interface{}{
 		"statements": respData,
-		"more":       "",
+		"more":       more,
 	})
 }
 
-func formatIDsResponse(docs model.DocumentSlice) ([]byte, error) {
+func formatIDsResponse(docs model.DocumentSlice, more string) ([]byte, error) {
 	var respData []interface{}
 	for _, doc := range docs {
 		respData = append(respData, doc.Data["id"])
 	}
 	return json.Marshal(map[string]interface{}{
 		"statements": respData,
-		"more":       "",
+		"more":       more,
 	})
 }
 
-func formatRespMultipleStatements(formatType string, languages acceptlang.AcceptLanguages, docs model.DocumentSlice) ([]byte, error) {
+func formatRespMultipleStatements(formatType string, languages acceptlang.AcceptLanguages, docs model.DocumentSlice, more string) ([]byte, error) {
 	switch formatType {
 	case "exact":
-		return formatExactResponse(docs)
+		return formatExactResponse(docs, more)
 	case "ids":
-		return formatIDsResponse(docs)
+		return formatIDsResponse(docs, more)
 	case "canonical":
-		return formatCanonicalResponse(docs, languages)
+		return formatCanonicalResponse(docs, languages, more)
 	default:
 		return nil, errors.New("invalid formatType given")
 	}
@@ -667,7 +482,7 @@ func collectSHA2sOfAttachments(statments model.DocumentSlice) []string {
 	return sha2s
 }
 
-func appendAttachments(session *mgo.Session, respBody []byte, sha2s []string) (body []byte, boundary string, err error) {
+func appendAttachments(ctx context.Context, store model.StatementStore, respBody []byte, sha2s []string) (body []byte, boundary string, err error) {
 	buf := new(bytes.Buffer)
 	w := multipart.NewWriter(buf)
 	boundary = w.Boundary()
@@ -679,27 +494,32 @@ func appendAttachments(session *mgo.Session, respBody []byte, sha2s []string) (b
 	}
 	io.Copy(pw, bytes.NewReader(respBody))
 
-	gfs := session.DB(miscs.GlobalConfig.MongoDB.DBName).GridFS("fs")
 	for _, sha2 := range sha2s {
-		gfsfile, err := gfs.Open(sha2)
-		if err != nil {
-			return nil, "", err
+		attachment, err := store.OpenAttachment(ctx, sha2)
+		if err == model.ErrNotFound {
+			// fileUrl により参照されるのみで、内容が保存されていない添付ファイルは含めない
+			continue
 		}
-		var metadata map[string]interface{}
-		err = gfsfile.GetMeta(&metadata)
 		if err != nil {
 			return nil, "", err
 		}
 
+		contentType := attachment.ContentType
+		if len(contentType) == 0 {
+			contentType = "application/octet-stream"
+		}
+
 		part := make(textproto.MIMEHeader)
-		part.Set("Content-Type", metadata["Content-Type"].(string))
+		part.Set("Content-Type", contentType)
 		part.Set("Content-Transfer-Encoding", "binary")
 		part.Set("X-Experience-API-Hash", sha2)
 		pw, err := w.CreatePart(part)
 		if err != nil {
+			attachment.Close()
 			return nil, "", err
 		}
-		io.Copy(pw, gfsfile)
+		io.Copy(pw, attachment)
+		attachment.Close()
 	}
 	w.Close()
 	body = buf.Bytes()
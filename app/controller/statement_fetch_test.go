@@ -16,6 +16,7 @@ package controller
 
 import (
 	"bytes"
+	"context"
 	"crypto/rand"
 	"crypto/sha1"
 	"crypto/sha256"
@@ -37,23 +38,35 @@ import (
 	"github.com/go-martini/martini"
 	"github.com/martini-contrib/acceptlang"
 	"github.com/realglobe-Inc/edo-xrs/app/miscs"
+	"github.com/realglobe-Inc/edo-xrs/app/model"
 	"github.com/satori/go.uuid"
-	"gopkg.in/mgo.v2"
+	"go.mongodb.org/mongo-driver/mongo"
 )
 
-func initDatabase(t *testing.T) *mgo.Session {
-	sess, err := mgo.Dial(miscs.GlobalConfig.MongoDB.URL)
+// initDatabase はテストで用いる MongoDB のデータベースを返す。
+// ストレージに MongoDB を用いない場合は nil を返す。
+func initDatabase(t *testing.T) *mongo.Database {
+	if testStore != nil {
+		return nil
+	}
+
+	client, err := model.Connect(context.Background(), miscs.GlobalConfig.MongoDB.URL)
 	if err != nil {
 		t.Fatal(err)
 	}
-	sess.SetMode(mgo.Strong, true)
 
-	return sess
+	return client.Database(miscs.GlobalConfig.MongoDB.DBName)
+}
+
+func closeDatabase(db *mongo.Database) {
+	if db != nil {
+		db.Client().Disconnect(context.Background())
+	}
 }
 
-func initHandler(s *mgo.Session) *martini.ClassicMartini {
+func initHandler(db *mongo.Database) *martini.ClassicMartini {
 	mart := martini.Classic()
-	hand := New(s)
+	hand := newController(db)
 	mart.Get("/:user/:app/statements", acceptlang.Languages(), hand.FindStatement)
 	mart.Put("/:user/:app/statements", hand.StoreStatement)
 	mart.Post("/:user/:app/statements", hand.StoreMultStatement)
@@ -114,7 +127,7 @@ func fatalIfError(t *testing.T, err error) {
 
 func TestGetMultStatementWithAscending(t *testing.T) {
 	db := initDatabase(t)
-	defer db.Close()
+	defer closeDatabase(db)
 	mart := initHandler(db)
 
 	id1 := uuid.NewV4().String()
@@ -145,22 +158,23 @@ func TestGetMultStatementWithAscending(t *testing.T) {
 		t.Fatalf("Expected 2 statements in response; got %d", cnt)
 	}
 
-	s1, err := respstmt.ArrayElement(1, "statements")
+	// ascending が true の場合は古いものから順に並ぶ
+	s0, err := respstmt.ArrayElement(0, "statements")
 	fatalIfError(t, err)
-	if id, ok := s1.Search("id").Data().(string); !ok || id != id1 {
+	if id, ok := s0.Search("id").Data().(string); !ok || id != id1 {
 		t.Fatalf("Got invalid order of statement array")
 	}
 
-	s0, err := respstmt.ArrayElement(0, "statements")
+	s1, err := respstmt.ArrayElement(1, "statements")
 	fatalIfError(t, err)
-	if id, ok := s0.Search("id").Data().(string); !ok || id != id2 {
+	if id, ok := s1.Search("id").Data().(string); !ok || id != id2 {
 		t.Fatalf("Got invalid order of statement array")
 	}
 }
 
 func TestGetMultStatementWithLimit(t *testing.T) {
 	db := initDatabase(t)
-	defer db.Close()
+	defer closeDatabase(db)
 	mart := initHandler(db)
 
 	id1 := uuid.NewV4().String()
@@ -191,9 +205,10 @@ func TestGetMultStatementWithLimit(t *testing.T) {
 		t.Fatalf("Expected 1 statements in response; got %d", cnt)
 	}
 
+	// 既定では新しいものから順に並ぶ
 	s0, err := respstmt.ArrayElement(0, "statements")
 	fatalIfError(t, err)
-	if id, ok := s0.Search("id").Data().(string); !ok || id != id1 {
+	if id, ok := s0.Search("id").Data().(string); !ok || id != id2 {
 		t.Fatalf("Got invalid order of statement array")
 	}
 }
@@ -241,7 +256,7 @@ var singleStatementWithLangMap = `
 
 func TestGetStatementWithCanonicalFormat(t *testing.T) {
 	db := initDatabase(t)
-	defer db.Close()
+	defer closeDatabase(db)
 	mart := initHandler(db)
 
 	id1 := uuid.NewV4().String()
@@ -295,9 +310,113 @@ func TestGetStatementWithCanonicalFormat(t *testing.T) {
 	}
 }
 
+func TestGetStatementWithCanonicalFormatLanguage(t *testing.T) {
+	db := initDatabase(t)
+	defer closeDatabase(db)
+	mart := initHandler(db)
+
+	stmt, err := gabs.ParseJSON([]byte(singleStatementWithLangMap))
+	fatalIfError(t, err)
+
+	verbID := "http://example.com/realglobe/XAPIprofile/test-" + uuid.NewV4().String()
+	_, err = stmt.SetP(verbID, "verb.id")
+	fatalIfError(t, err)
+
+	putStatement(t, mart, stmt.String(), uuid.NewV4().String())
+
+	v := &url.Values{}
+	v.Add("verb", verbID)
+	v.Add("format", "canonical")
+
+	for _, c := range []struct {
+		acceptLanguage, expected string
+	}{
+		{"ja", "ja-JP"},
+		{"fr, en;q=0.5", "en-US"},
+		{"en-US;q=0.2, ja-JP-x-test;q=0.8", "ja-JP"},
+	} {
+		resp := httptest.NewRecorder()
+		req, err := http.NewRequest("GET", "/test/test/statements?"+v.Encode(), nil)
+		fatalIfError(t, err)
+		req.Header.Add("X-Experience-API-Version", "1.0.2")
+		req.Header.Add("Accept-Language", c.acceptLanguage)
+		mart.ServeHTTP(resp, req)
+
+		respstmt, err := gabs.ParseJSON(resp.Body.Bytes())
+		fatalIfError(t, err)
+		s0, err := respstmt.ArrayElement(0, "statements")
+		fatalIfError(t, err)
+
+		for _, path := range [][]string{
+			{"verb", "display"},
+			{"object", "definition", "description"},
+		} {
+			langMap, ok := s0.Search(path...).Data().(map[string]interface{})
+			if !ok || len(langMap) != 1 || langMap[c.expected] == nil {
+				t.Fatalf("Expected only %s in %v on Accept-Language %q; got %v", c.expected, path, c.acceptLanguage, langMap)
+			}
+		}
+	}
+}
+
+func TestGetMultStatementWithStatementRefAndVoided(t *testing.T) {
+	db := initDatabase(t)
+	defer closeDatabase(db)
+	mart := initHandler(db)
+
+	targetID := uuid.NewV4().String()
+	refID := uuid.NewV4().String()
+	voidingID := uuid.NewV4().String()
+
+	stmt, err := gabs.ParseJSON([]byte(singleStatement01))
+	fatalIfError(t, err)
+	verbID := "http://example.com/realglobe/XAPIprofile/test-" + uuid.NewV4().String()
+	_, err = stmt.SetP(verbID, "verb.id")
+	fatalIfError(t, err)
+	putStatement(t, mart, stmt.String(), targetID)
+
+	// 異なる verb で targetID を参照するステートメント
+	_, err = stmt.SetP("http://example.com/realglobe/XAPIprofile/test-"+uuid.NewV4().String(), "verb.id")
+	fatalIfError(t, err)
+	_, err = stmt.SetP("StatementRef", "object.objectType")
+	fatalIfError(t, err)
+	_, err = stmt.SetP(targetID, "object.id")
+	fatalIfError(t, err)
+	putStatement(t, mart, stmt.String(), refID)
+
+	v := &url.Values{}
+	v.Add("verb", verbID)
+
+	ids := func() map[string]bool {
+		respstmt, err := gabs.ParseJSON(getStatement(t, mart, v))
+		fatalIfError(t, err)
+		children, err := respstmt.S("statements").Children()
+		fatalIfError(t, err)
+
+		ids := make(map[string]bool)
+		for _, c := range children {
+			ids[c.Path("id").Data().(string)] = true
+		}
+		return ids
+	}
+
+	if got := ids(); len(got) != 2 || !got[targetID] || !got[refID] {
+		t.Fatalf("Expected the matched and the referring statement; got %v", got)
+	}
+
+	// targetID を Voided にすると、targetID は含まれず voiding ステートメントが参照するステートメントとして含まれる
+	_, err = stmt.SetP(miscs.GlobalConfig.Global.VoidedStatementID, "verb.id")
+	fatalIfError(t, err)
+	putStatement(t, mart, stmt.String(), voidingID)
+
+	if got := ids(); len(got) != 2 || got[targetID] || !got[refID] || !got[voidingID] {
+		t.Fatalf("Expected voided statement to be excluded; got %v", got)
+	}
+}
+
 func TestGetMultStatementWithVerbID(t *testing.T) {
 	db := initDatabase(t)
-	defer db.Close()
+	defer closeDatabase(db)
 	mart := initHandler(db)
 
 	id1 := uuid.NewV4().String()
@@ -317,6 +436,7 @@ func TestGetMultStatementWithVerbID(t *testing.T) {
 	// construct query
 	v := &url.Values{}
 	v.Add("verb", verbID)
+	v.Add("ascending", "true")
 
 	respstmt, err := gabs.ParseJSON(getStatement(t, mart, v))
 	fatalIfError(t, err)
@@ -342,7 +462,7 @@ func TestGetMultStatementWithVerbID(t *testing.T) {
 
 func TestGetMultStatementWithSinceUntil(t *testing.T) {
 	db := initDatabase(t)
-	defer db.Close()
+	defer closeDatabase(db)
 	mart := initHandler(db)
 
 	id1 := uuid.NewV4().String()
@@ -389,20 +509,24 @@ func TestGetMultStatementWithSinceUntil(t *testing.T) {
 
 func TestInvalidXAPIVersion(t *testing.T) {
 	mart := initHandler(nil)
-	resp := httptest.NewRecorder()
-	req, err := http.NewRequest("GET", "/test/test/statements", nil)
-	fatalIfError(t, err)
-	req.Header.Add("X-Experience-API-Version", "0.0.0")
-	mart.ServeHTTP(resp, req)
 
-	if got, expected := resp.Code, http.StatusBadRequest; got != expected {
-		t.Fatalf("Expected %v response code from put single statement; got %d", expected, got)
+	// 存在しない 2.0.x のバージョンも 2.0.0 とはみなさない
+	for _, version := range []string{"0.0.0", "2.0.7"} {
+		resp := httptest.NewRecorder()
+		req, err := http.NewRequest("GET", "/test/test/statements", nil)
+		fatalIfError(t, err)
+		req.Header.Add("X-Experience-API-Version", version)
+		mart.ServeHTTP(resp, req)
+
+		if got, expected := resp.Code, http.StatusBadRequest; got != expected {
+			t.Fatalf("Expected %v response code from get statement with version %s; got %d", expected, version, got)
+		}
 	}
 }
 
 func TestGetMultStatementWithActivity(t *testing.T) {
 	db := initDatabase(t)
-	defer db.Close()
+	defer closeDatabase(db)
 	mart := initHandler(db)
 
 	id1 := uuid.NewV4().String()
@@ -422,6 +546,7 @@ func TestGetMultStatementWithActivity(t *testing.T) {
 	// construct query
 	v := &url.Values{}
 	v.Add("activity", activityID)
+	v.Add("ascending", "true")
 
 	respstmt, err := gabs.ParseJSON(getStatement(t, mart, v))
 	fatalIfError(t, err)
@@ -447,7 +572,7 @@ func TestGetMultStatementWithActivity(t *testing.T) {
 
 func TestGetMultStatementWithRegistration(t *testing.T) {
 	db := initDatabase(t)
-	defer db.Close()
+	defer closeDatabase(db)
 	mart := initHandler(db)
 
 	id1 := uuid.NewV4().String()
@@ -466,6 +591,7 @@ func TestGetMultStatementWithRegistration(t *testing.T) {
 	// construct query
 	v := &url.Values{}
 	v.Add("registration", registrationID)
+	v.Add("ascending", "true")
 
 	respstmt, err := gabs.ParseJSON(getStatement(t, mart, v))
 	fatalIfError(t, err)
@@ -529,7 +655,7 @@ func appendMbox(t *testing.T, stmt *gabs.Container) *gabs.Container {
 	fatalIfError(t, err)
 
 	domainPrefix := uuid.NewV4().String()
-	mbox := "mbox:test@" + domainPrefix + ".example.com"
+	mbox := "mailto:test@" + domainPrefix + ".example.com"
 	_, err = stmt.SetP(mbox, "actor.mbox")
 	fatalIfError(t, err)
 
@@ -592,7 +718,7 @@ func TestGetMultStatementWithActorAgentOpenID(t *testing.T) {
 
 func testGetMultStatementOfActor(t *testing.T, stmt *gabs.Container) {
 	db := initDatabase(t)
-	defer db.Close()
+	defer closeDatabase(db)
 	mart := initHandler(db)
 
 	id1 := uuid.NewV4().String()
@@ -604,6 +730,7 @@ func testGetMultStatementOfActor(t *testing.T, stmt *gabs.Container) {
 	// construct query
 	v := &url.Values{}
 	v.Add("agent", stmt.Search("actor").String())
+	v.Add("ascending", "true")
 
 	respstmt, err := gabs.ParseJSON(getStatement(t, mart, v))
 	fatalIfError(t, err)
@@ -673,7 +800,7 @@ func TestGetMultStatementWithActorGroupOpenID(t *testing.T) {
 
 func testGetMultStatementOfGroup(t *testing.T, group *gabs.Container) {
 	db := initDatabase(t)
-	defer db.Close()
+	defer closeDatabase(db)
 	mart := initHandler(db)
 
 	ids := []string{
@@ -707,6 +834,7 @@ func testGetMultStatementOfGroup(t *testing.T, group *gabs.Container) {
 	v := &url.Values{}
 	//t.Log(group.Search("actor").String())
 	v.Add("agent", group.Search("actor").String())
+	v.Add("ascending", "true")
 
 	resp := getStatement(t, mart, v)
 	//t.Log(string(resp))
@@ -803,7 +931,7 @@ func postStatementWithFile(t *testing.T, mart *martini.ClassicMartini, stmt, id
 
 func TestGetStatementWithFile(t *testing.T) {
 	db := initDatabase(t)
-	defer db.Close()
+	defer closeDatabase(db)
 	mart := initHandler(db)
 
 	id1 := uuid.NewV4().String()
@@ -877,7 +1005,7 @@ var singleStatementWithMember = `
         "member": [
             {
                 "name": "Andrew Downes",
-                "mbox": "mailto: andrew@realglobe.example.com",
+                "mbox": "mailto:andrew@realglobe.example.com",
                 "objectType": "Agent"
             }
         ]
@@ -913,7 +1041,7 @@ func TestGetMultStatementWithRelatedAgentsAccount(t *testing.T) {
 
 func TestGetMultStatementWithRelatedAgentsMbox(t *testing.T) {
 	domainPrefix := uuid.NewV4().String()
-	mbox := "mbox:test@" + domainPrefix + ".example.com"
+	mbox := "mailto:test@" + domainPrefix + ".example.com"
 
 	testGetMultStatementWithRelatedAgents(t, map[string]interface{}{
 		"objectType": "Agent",
@@ -948,7 +1076,7 @@ func TestGetMultStatementWithRelatedAgentsOpenID(t *testing.T) {
 
 func testGetMultStatementWithRelatedAgents(t *testing.T, agent map[string]interface{}) {
 	db := initDatabase(t)
-	defer db.Close()
+	defer closeDatabase(db)
 	mart := initHandler(db)
 
 	id1 := uuid.NewV4().String()
@@ -974,6 +1102,7 @@ func testGetMultStatementWithRelatedAgents(t *testing.T, agent map[string]interf
 	v := &url.Values{}
 	v.Add("agent", actor.String())
 	v.Add("related_agents", "true")
+	v.Add("ascending", "true")
 
 	respstmt, err := gabs.ParseJSON(getStatement(t, mart, v))
 	fatalIfError(t, err)
@@ -999,7 +1128,7 @@ func testGetMultStatementWithRelatedAgents(t *testing.T, agent map[string]interf
 
 func getStatementWithUnusedStatementID(t *testing.T) {
 	db := initDatabase(t)
-	defer db.Close()
+	defer closeDatabase(db)
 	mart := initHandler(db)
 
 	unusedStatementID := "ffffffff-ffff-ffff-ffff-ffffffffffff"
@@ -1014,3 +1143,153 @@ func getStatementWithUnusedStatementID(t *testing.T) {
 		t.Fatalf("Expected %v response code from get statement(s); got %d", expected, got)
 	}
 }
+
+func TestGetStatementWithConsistentThrough(t *testing.T) {
+	db := initDatabase(t)
+	defer closeDatabase(db)
+	mart := initHandler(db)
+	mart.Head("/:user/:app/statements", acceptlang.Languages(), newController(db).FindStatementHead)
+
+	id := uuid.NewV4().String()
+	putStatement(t, mart, singleStatement01, id)
+	// stored はミリ秒単位のため、同じミリ秒に保存を始めるものがありうる間は consistent-through に含まれない
+	time.Sleep(time.Millisecond)
+
+	v := &url.Values{}
+	v.Add("statementId", id)
+	body, head := getStatementWithHeader(t, mart, v)
+
+	respstmt, err := gabs.ParseJSON(body)
+	fatalIfError(t, err)
+	stored, err := time.Parse(time.RFC3339Nano, respstmt.Path("stored").Data().(string))
+	fatalIfError(t, err)
+
+	// 保存済みのステートメントの stored 以降の時刻となる
+	consistent, err := time.Parse(time.RFC3339Nano, head.Get("X-Experience-API-Consistent-Through"))
+	fatalIfError(t, err)
+	if consistent.Before(stored) {
+		t.Fatalf("Expected consistent-through time after %v; got %v", stored, consistent)
+	}
+
+	// HEAD リクエストにも付加される
+	resp := httptest.NewRecorder()
+	req, err := http.NewRequest("HEAD", "/test/test/statements", nil)
+	fatalIfError(t, err)
+	req.Header.Add("X-Experience-API-Version", "1.0.2")
+	mart.ServeHTTP(resp, req)
+
+	if _, err := time.Parse(time.RFC3339Nano, resp.Header().Get("X-Experience-API-Consistent-Through")); err != nil {
+		t.Fatalf("Invalid X-Experience-API-Consistent-Through header in HEAD response: %v", err)
+	}
+}
+
+func requestStatementWithVersion(t *testing.T, mart *martini.ClassicMartini, method, query, body, version string) *httptest.ResponseRecorder {
+	resp := httptest.NewRecorder()
+	req, err := http.NewRequest(method, "/test/test/statements?"+query, strings.NewReader(body))
+	fatalIfError(t, err)
+
+	req.Header.Add("X-Experience-API-Version", version)
+	mart.ServeHTTP(resp, req)
+
+	return resp
+}
+
+func TestGetStatementAcrossXAPIVersions(t *testing.T) {
+	db := initDatabase(t)
+	defer closeDatabase(db)
+	mart := initHandler(db)
+
+	stmt, err := gabs.ParseJSON([]byte(singleStatement02))
+	fatalIfError(t, err)
+	_, err = stmt.SetP([]interface{}{map[string]interface{}{
+		"objectType": "contextAgent",
+		"agent":      map[string]interface{}{"objectType": "Agent", "mbox": "mailto:instructor@realglobe.example.com"},
+	}}, "context.contextAgents")
+	fatalIfError(t, err)
+
+	id := uuid.NewV4().String()
+	query := url.Values{"statementId": []string{id}}.Encode()
+
+	resp := requestStatementWithVersion(t, mart, "PUT", query, stmt.String(), "2.0.0")
+	if got, expected := resp.Code, http.StatusNoContent; got != expected {
+		t.Fatalf("Expected %v response code from put 2.0.0 statement; got %d", expected, got)
+	}
+
+	// 同じ ID は xAPI のバージョンによらず重複となる
+	resp = requestStatementWithVersion(t, mart, "PUT", query, singleStatement01, "1.0.1")
+	if got, expected := resp.Code, http.StatusConflict; got != expected {
+		t.Fatalf("Expected %v response code from put 1.0.1 statement with same id; got %d", expected, got)
+	}
+
+	// 1.0.x のクライアントには 1.0.x の形式に変換して返す
+	resp = requestStatementWithVersion(t, mart, "GET", query, "", "1.0.2")
+	if got, expected := resp.Code, http.StatusOK; got != expected {
+		t.Fatalf("Expected %v response code from get statement with 1.0.2; got %d", expected, got)
+	}
+	respstmt, err := gabs.ParseJSON(resp.Body.Bytes())
+	fatalIfError(t, err)
+	if respstmt.ExistsP("context.contextAgents") {
+		t.Fatal("Expected contextAgents to be removed for 1.0.2 client")
+	}
+
+	resp = requestStatementWithVersion(t, mart, "GET", query, "", "2.0.0")
+	if got, expected := resp.Code, http.StatusOK; got != expected {
+		t.Fatalf("Expected %v response code from get statement with 2.0.0; got %d", expected, got)
+	}
+	respstmt, err = gabs.ParseJSON(resp.Body.Bytes())
+	fatalIfError(t, err)
+	if !respstmt.ExistsP("context.contextAgents") {
+		t.Fatal("Expected contextAgents for 2.0.0 client")
+	}
+}
+
+func TestGetStatementWithoutTimezoneAcrossXAPIVersions(t *testing.T) {
+	db := initDatabase(t)
+	defer closeDatabase(db)
+	mart := initHandler(db)
+
+	// 1.0.x ではタイムゾーンの無い timestamp と単一の contextActivities が認められる
+	stmt, err := gabs.ParseJSON([]byte(singleStatement01))
+	fatalIfError(t, err)
+	_, err = stmt.SetP("2015-05-07T01:59:39.423", "timestamp")
+	fatalIfError(t, err)
+	_, err = stmt.SetP(map[string]interface{}{"id": "http://example.com/activities/parent"}, "context.contextActivities.parent")
+	fatalIfError(t, err)
+
+	id := uuid.NewV4().String()
+	query := url.Values{"statementId": []string{id}}.Encode()
+
+	resp := requestStatementWithVersion(t, mart, "PUT", query, stmt.String(), "1.0.2")
+	if got, expected := resp.Code, http.StatusNoContent; got != expected {
+		t.Fatalf("Expected %v response code from put 1.0.2 statement without timezone; got %d", expected, got)
+	}
+
+	// 同じステートメントの再送は、保存されている形式によらず重複とならない
+	resp = requestStatementWithVersion(t, mart, "PUT", query, stmt.String(), "1.0.2")
+	if got, expected := resp.Code, http.StatusNoContent; got != expected {
+		t.Fatalf("Expected %v response code from resent 1.0.2 statement; got %d", expected, got)
+	}
+
+	for _, version := range []string{"1.0.2", "2.0.0"} {
+		resp = requestStatementWithVersion(t, mart, "GET", query, "", version)
+		if got, expected := resp.Code, http.StatusOK; got != expected {
+			t.Fatalf("Expected %v response code from get statement with %s; got %d", expected, version, got)
+		}
+		respstmt, err := gabs.ParseJSON(resp.Body.Bytes())
+		fatalIfError(t, err)
+
+		if got, expected := respstmt.Path("timestamp").Data(), "2015-05-07T01:59:39.423Z"; got != expected {
+			t.Fatalf("Expected timestamp %v for %s client; got %v", expected, version, got)
+		}
+		stored, ok := respstmt.Path("stored").Data().(string)
+		if !ok || !strings.HasSuffix(stored, "Z") {
+			t.Fatalf("Expected stored in UTC for %s client; got %v", version, respstmt.Path("stored").Data())
+		}
+		if _, err := time.Parse(time.RFC3339Nano, stored); err != nil {
+			t.Fatalf("Expected stored of the form of RFC3339 for %s client; got %v", version, stored)
+		}
+		if _, ok := respstmt.Path("context.contextActivities.parent").Data().([]interface{}); !ok {
+			t.Fatalf("Expected contextActivities.parent to be an array for %s client", version)
+		}
+	}
+}
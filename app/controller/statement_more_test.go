@@ -0,0 +1,113 @@
+// Copyright 2015 realglobe, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/Jeffail/gabs"
+	"github.com/martini-contrib/acceptlang"
+	"github.com/satori/go.uuid"
+)
+
+func getMoreStatements(t *testing.T, mart http.Handler, more string) *gabs.Container {
+	resp := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", more, nil)
+	fatalIfError(t, err)
+
+	req.Header.Add("X-Experience-API-Version", "1.0.2")
+	mart.ServeHTTP(resp, req)
+
+	if got, expected := resp.Code, http.StatusOK; got != expected {
+		t.Fatalf("Expected %v response code from get more statements; got %d", expected, got)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	fatalIfError(t, err)
+	respstmt, err := gabs.ParseJSON(body)
+	fatalIfError(t, err)
+
+	return respstmt
+}
+
+func TestGetMultStatementWithMore(t *testing.T) {
+	db := initDatabase(t)
+	defer closeDatabase(db)
+	mart := initHandler(db)
+	mart.Get("/:user/:app/statements/more/:more", acceptlang.Languages(), newController(db).FindMoreStatements)
+
+	stmt, err := gabs.ParseJSON([]byte(singleStatement01))
+	fatalIfError(t, err)
+
+	verbID := "http://example.com/realglobe/XAPIprofile/test-" + uuid.NewV4().String()
+	_, err = stmt.SetP(verbID, "verb.id")
+	fatalIfError(t, err)
+
+	ids := []string{uuid.NewV4().String(), uuid.NewV4().String(), uuid.NewV4().String()}
+	for _, id := range ids {
+		putStatement(t, mart, stmt.String(), id)
+	}
+
+	v := &url.Values{}
+	v.Add("verb", verbID)
+	v.Add("limit", "2")
+
+	respstmt, err := gabs.ParseJSON(getStatement(t, mart, v))
+	fatalIfError(t, err)
+	if cnt, err := respstmt.ArrayCount("statements"); err != nil || cnt != 2 {
+		t.Fatalf("Expected 2 statements in first page; got %d", cnt)
+	}
+	more, ok := respstmt.Search("more").Data().(string)
+	if !ok || len(more) == 0 {
+		t.Fatal("more URL not found in first page")
+	}
+
+	// 最初のページの後に保存されたステートメントは続きのページに含まれない
+	putStatement(t, mart, stmt.String(), uuid.NewV4().String())
+
+	respstmt = getMoreStatements(t, mart, more)
+	if cnt, err := respstmt.ArrayCount("statements"); err != nil || cnt != 1 {
+		t.Fatalf("Expected 1 statements in second page; got %d", cnt)
+	}
+	s0, err := respstmt.ArrayElement(0, "statements")
+	fatalIfError(t, err)
+	if id, ok := s0.Search("id").Data().(string); !ok || id != ids[0] {
+		t.Fatalf("Got invalid statement in second page")
+	}
+	if more, ok := respstmt.Search("more").Data().(string); !ok || len(more) != 0 {
+		t.Fatalf("Expected empty more URL in last page; got %v", more)
+	}
+}
+
+func TestGetMoreStatementsWithUnknownID(t *testing.T) {
+	db := initDatabase(t)
+	defer closeDatabase(db)
+	mart := initHandler(db)
+	mart.Get("/:user/:app/statements/more/:more", acceptlang.Languages(), newController(db).FindMoreStatements)
+
+	resp := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "/test/test/statements/more/unknown", nil)
+	fatalIfError(t, err)
+	req.Header.Add("X-Experience-API-Version", "1.0.2")
+	mart.ServeHTTP(resp, req)
+
+	if got, expected := resp.Code, http.StatusNotFound; got != expected {
+		t.Fatalf("Expected %v response code from get more statements; got %d", expected, got)
+	}
+}
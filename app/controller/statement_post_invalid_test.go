@@ -15,31 +15,31 @@
 package controller
 
 import (
+	"encoding/json"
 	"net/http"
 	"net/http/httptest"
 	"strings"
 	"testing"
 
+	"github.com/Jeffail/gabs"
 	"github.com/go-martini/martini"
-	"github.com/realglobe-Inc/edo-xrs/app/miscs"
-	"gopkg.in/mgo.v2"
+	"github.com/realglobe-Inc/edo-xrs/app/validator"
 )
 
 var postInvalidStatementTestCases = []string{
 	postInvalidStatement01,
 	postInvalidStatement02,
 	postInvalidStatement03,
+	postInvalidStatement04,
+	postInvalidStatement05,
 }
 
 func TestPostInvalidStatement(t *testing.T) {
 	m := martini.Classic()
 
-	sess, err := mgo.Dial(miscs.GlobalConfig.MongoDB.URL)
-	defer sess.Close()
-	if err != nil {
-		t.Fatalf("%v", err)
-	}
-	c := New(sess)
+	db := initDatabase(t)
+	defer closeDatabase(db)
+	c := newController(db)
 
 	m.Post("/:user/:app/statements", c.StoreMultStatement)
 
@@ -56,6 +56,42 @@ func TestPostInvalidStatement(t *testing.T) {
 	}
 }
 
+func TestPostInvalidStatementErrors(t *testing.T) {
+	db := initDatabase(t)
+	defer closeDatabase(db)
+	mart := initHandler(db)
+
+	// 2 番目のステートメントの timestamp のみが正しくない
+	invalid, err := gabs.ParseJSON([]byte(singleStatement02))
+	fatalIfError(t, err)
+	_, err = invalid.Set("invalid timestamp", "timestamp")
+	fatalIfError(t, err)
+
+	resp := httptest.NewRecorder()
+	req, err := http.NewRequest("POST", "/test/test/statements", strings.NewReader("["+singleStatement02+","+invalid.String()+"]"))
+	fatalIfError(t, err)
+	req.Header.Add("Content-Type", "application/json")
+	req.Header.Add("X-Experience-API-Version", "1.0.2")
+	mart.ServeHTTP(resp, req)
+
+	if got, expected := resp.Code, http.StatusBadRequest; got != expected {
+		t.Fatalf("Expected %v response code from post invalid statement; got %d", expected, got)
+	}
+
+	var body struct {
+		Errors []validator.FieldError `json:"errors"`
+	}
+	fatalIfError(t, json.NewDecoder(resp.Body).Decode(&body))
+	if len(body.Errors) == 0 {
+		t.Fatalf("Expected errors in response")
+	}
+	for _, e := range body.Errors {
+		if e.Index != 1 || e.Pointer != "/timestamp" || len(e.Rule) == 0 {
+			t.Fatalf("Unexpected validation error: %+v", e)
+		}
+	}
+}
+
 var postInvalidStatement01 = `
 [
   {
@@ -116,3 +152,57 @@ var postInvalidStatement03 = `
   }
 ]
 `
+
+var postInvalidStatement04 = `
+[
+  {
+    "actor": {
+      "objectType": "Agent",
+      "name": "Statement with raw score greater than max",
+      "mbox": "mailto:user@example.com"
+    },
+    "verb": {
+      "id": "http://adlnet.gov/expapi/verbs/scored",
+      "display": {
+        "en-US": "scored"
+      }
+    },
+    "object": {
+      "objectType": "Activity",
+      "id": "http:\/\/example.com\/quiz"
+    },
+    "result": {
+      "score": {
+        "raw": 120,
+        "min": 0,
+        "max": 100
+      }
+    }
+  }
+]
+`
+
+var postInvalidStatement05 = `
+[
+  {
+    "actor": {
+      "objectType": "Agent",
+      "name": "Statement with context.revision on StatementRef",
+      "mbox": "mailto:user@example.com"
+    },
+    "verb": {
+      "id": "http://adlnet.gov/expapi/verbs/commented",
+      "display": {
+        "en-US": "commented"
+      }
+    },
+    "object": {
+      "objectType": "StatementRef",
+      "id": "1cabcb4f-c41c-49a5-ad89-9a9c8c5fd20a"
+    },
+    "context": {
+      "revision": "1"
+    }
+  }
+]
+`
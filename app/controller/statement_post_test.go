@@ -15,6 +15,7 @@
 package controller
 
 import (
+	"context"
 	"encoding/json"
 	"io/ioutil"
 	"net/http"
@@ -22,10 +23,11 @@ import (
 	"strings"
 	"testing"
 
+	"github.com/Jeffail/gabs"
 	"github.com/go-martini/martini"
 	"github.com/martini-contrib/acceptlang"
-	"github.com/realglobe-Inc/edo-xrs/app/miscs"
-	"gopkg.in/mgo.v2"
+	"github.com/realglobe-Inc/edo-xrs/app/model"
+	"github.com/satori/go.uuid"
 )
 
 var postStatementTestCases = []string{
@@ -54,12 +56,9 @@ var postStatementTestCases = []string{
 func TestPostStatement(t *testing.T) {
 	m := martini.Classic()
 
-	sess, err := mgo.Dial(miscs.GlobalConfig.MongoDB.URL)
-	defer sess.Close()
-	if err != nil {
-		t.Fatalf("%v", err)
-	}
-	c := New(sess)
+	db := initDatabase(t)
+	defer closeDatabase(db)
+	c := newController(db)
 
 	m.Post("/:user/:app/statements", c.StoreMultStatement)
 
@@ -76,15 +75,75 @@ func TestPostStatement(t *testing.T) {
 	}
 }
 
+func TestPostStatementBatchIsAtomic(t *testing.T) {
+	db := initDatabase(t)
+	defer closeDatabase(db)
+	mart := initHandler(db)
+
+	// ディスク使用量を確認するため専用のユーザーを用いる
+	user := "batch-" + uuid.NewV4().String()
+	post := func(stmts ...*gabs.Container) int {
+		var body []string
+		for _, stmt := range stmts {
+			body = append(body, stmt.String())
+		}
+
+		resp := httptest.NewRecorder()
+		req, err := http.NewRequest("POST", "/"+user+"/test/statements", strings.NewReader("["+strings.Join(body, ",")+"]"))
+		fatalIfError(t, err)
+		req.Header.Add("X-Experience-API-Version", "1.0.2")
+		mart.ServeHTTP(resp, req)
+
+		return resp.Code
+	}
+	newStatement := func(id string) *gabs.Container {
+		stmt, err := gabs.ParseJSON([]byte(singleStatement01))
+		fatalIfError(t, err)
+		_, err = stmt.SetP(id, "id")
+		fatalIfError(t, err)
+		return stmt
+	}
+	store := testStatementStore(db)
+	usage := func() int64 {
+		usage, err := store.QuotaUsage(context.Background(), user)
+		fatalIfError(t, err)
+		return usage
+	}
+
+	existing := newStatement(uuid.NewV4().String())
+	if got, expected := post(existing), http.StatusOK; got != expected {
+		t.Fatalf("Expected %v response code from post statement; got %d", expected, got)
+	}
+	before := usage()
+
+	// 2 番目のステートメントが保存済みのものと異なるため、バッチ全体を保存しない
+	firstID := uuid.NewV4().String()
+	_, err := existing.SetP("Other Name", "actor.name")
+	fatalIfError(t, err)
+	if got, expected := post(newStatement(firstID), existing), http.StatusConflict; got != expected {
+		t.Fatalf("Expected %v response code from post conflicting batch; got %d", expected, got)
+	}
+
+	if _, err := store.FindStatement(context.Background(), user, "test", firstID); err != model.ErrNotFound {
+		t.Fatalf("Expected no statement stored from failed batch; got %v", err)
+	}
+	if after := usage(); after != before {
+		t.Fatalf("Expected quota not to change on failed batch; got %d -> %d", before, after)
+	}
+
+	// 同じ ID を含むバッチは不正
+	duplicateID := uuid.NewV4().String()
+	if got, expected := post(newStatement(duplicateID), newStatement(duplicateID)), http.StatusBadRequest; got != expected {
+		t.Fatalf("Expected %v response code from post batch with duplicate ids; got %d", expected, got)
+	}
+}
+
 func TestPostAndGetStatement(t *testing.T) {
 	m := martini.Classic()
 
-	sess, err := mgo.Dial(miscs.GlobalConfig.MongoDB.URL)
-	defer sess.Close()
-	if err != nil {
-		t.Fatalf("%v", err)
-	}
-	c := New(sess)
+	db := initDatabase(t)
+	defer closeDatabase(db)
+	c := newController(db)
 
 	m.Get("/:user/:app/statements", acceptlang.Languages(), c.FindStatement)
 	m.Post("/:user/:app/statements", c.StoreMultStatement)
@@ -623,7 +682,7 @@ var postStatement13 = `
       "success": true,
       "completion": true,
       "response": "OK",
-      "duration": "2004-04-01T12:00:00+09:00/2007-08-31T15:00:00+09:00"
+      "duration": "PT50M"
     }
   }
 ]
@@ -28,8 +28,6 @@ import (
 	"testing"
 
 	"github.com/go-martini/martini"
-	"github.com/realglobe-Inc/edo-xrs/app/miscs"
-	"gopkg.in/mgo.v2"
 )
 
 var postStatementWithFileTestCases = []string{
@@ -39,12 +37,9 @@ var postStatementWithFileTestCases = []string{
 func TestPostStatementWithFile(t *testing.T) {
 	m := martini.Classic()
 
-	sess, err := mgo.Dial(miscs.GlobalConfig.MongoDB.URL)
-	defer sess.Close()
-	if err != nil {
-		t.Fatalf("%v", err)
-	}
-	c := New(sess)
+	db := initDatabase(t)
+	defer closeDatabase(db)
+	c := newController(db)
 
 	m.Post("/:user/:app/statements", c.StoreMultStatement)
 
@@ -24,9 +24,7 @@ import (
 	"github.com/Jeffail/gabs"
 	"github.com/go-martini/martini"
 	"github.com/martini-contrib/acceptlang"
-	"github.com/realglobe-Inc/edo-xrs/app/miscs"
 	"github.com/satori/go.uuid"
-	"gopkg.in/mgo.v2"
 )
 
 var putStatementTestCases = []string{
@@ -38,12 +36,9 @@ var putStatementTestCases = []string{
 func TestPutStatement(t *testing.T) {
 	m := martini.Classic()
 
-	sess, err := mgo.Dial(miscs.GlobalConfig.MongoDB.URL)
-	defer sess.Close()
-	if err != nil {
-		t.Fatalf("%v", err)
-	}
-	c := New(sess)
+	db := initDatabase(t)
+	defer closeDatabase(db)
+	c := newController(db)
 
 	m.Put("/:user/:app/statements", c.StoreStatement)
 
@@ -64,12 +59,9 @@ func TestPutStatement(t *testing.T) {
 func TestPutStatementWithInvalidXAPIHeader(t *testing.T) {
 	m := martini.Classic()
 
-	sess, err := mgo.Dial(miscs.GlobalConfig.MongoDB.URL)
-	defer sess.Close()
-	if err != nil {
-		t.Fatalf("%v", err)
-	}
-	c := New(sess)
+	db := initDatabase(t)
+	defer closeDatabase(db)
+	c := newController(db)
 
 	m.Put("/:user/:app/statements", c.StoreStatement)
 	stmt := singleStatement01
@@ -89,12 +81,9 @@ func TestPutStatementWithInvalidXAPIHeader(t *testing.T) {
 func TestPutStatementWithInvalidStatementID(t *testing.T) {
 	m := martini.Classic()
 
-	sess, err := mgo.Dial(miscs.GlobalConfig.MongoDB.URL)
-	defer sess.Close()
-	if err != nil {
-		t.Fatalf("%v", err)
-	}
-	c := New(sess)
+	db := initDatabase(t)
+	defer closeDatabase(db)
+	c := newController(db)
 
 	m.Put("/:user/:app/statements", c.StoreStatement)
 	stmt := singleStatement01
@@ -117,12 +106,9 @@ func TestPutStatementWithInvalidStatementID(t *testing.T) {
 func TestPutStatementWithMismatchID(t *testing.T) {
 	m := martini.Classic()
 
-	sess, err := mgo.Dial(miscs.GlobalConfig.MongoDB.URL)
-	defer sess.Close()
-	if err != nil {
-		t.Fatalf("%v", err)
-	}
-	c := New(sess)
+	db := initDatabase(t)
+	defer closeDatabase(db)
+	c := newController(db)
 
 	m.Put("/:user/:app/statements", c.StoreStatement)
 	stmt, err := gabs.ParseJSON([]byte(singleStatement01))
@@ -152,12 +138,9 @@ func TestPutStatementWithMismatchID(t *testing.T) {
 func TestPutStatementWithConflictID(t *testing.T) {
 	m := martini.Classic()
 
-	sess, err := mgo.Dial(miscs.GlobalConfig.MongoDB.URL)
-	defer sess.Close()
-	if err != nil {
-		t.Fatalf("%v", err)
-	}
-	c := New(sess)
+	db := initDatabase(t)
+	defer closeDatabase(db)
+	c := newController(db)
 
 	m.Put("/:user/:app/statements", c.StoreStatement)
 	stmt1, err := gabs.ParseJSON([]byte(singleStatement01))
@@ -209,15 +192,56 @@ func TestPutStatementWithConflictID(t *testing.T) {
 	}
 }
 
+func TestPutResentStatement(t *testing.T) {
+	db := initDatabase(t)
+	defer closeDatabase(db)
+	mart := initHandler(db)
+
+	statementID := uuid.NewV4().String()
+	stmt1, err := gabs.ParseJSON([]byte(singleStatement01))
+	fatalIfError(t, err)
+	_, err = stmt1.SetP("2015-04-01T09:00:00+09:00", "timestamp")
+	fatalIfError(t, err)
+
+	// 言語マップの順序と timestamp の表記のみが異なるステートメント
+	stmt2, err := gabs.ParseJSON([]byte(strings.Replace(singleStatement01,
+		`"ja-JP": "hashita",
+      "en-US": "ran"`, `"en-US": "ran",
+      "ja-JP": "hashita"`, 1)))
+	fatalIfError(t, err)
+	_, err = stmt2.SetP("2015-04-01T00:00:00Z", "timestamp")
+	fatalIfError(t, err)
+
+	put := func(stmt string) int {
+		resp := httptest.NewRecorder()
+		req, err := http.NewRequest("PUT", "/test/test/statements?statementId="+statementID, strings.NewReader(stmt))
+		fatalIfError(t, err)
+		req.Header.Add("X-Experience-API-Version", "1.0.2")
+		mart.ServeHTTP(resp, req)
+
+		return resp.Code
+	}
+
+	for _, stmt := range []string{stmt1.String(), stmt1.String(), stmt2.String()} {
+		if got, expected := put(stmt), http.StatusNoContent; got != expected {
+			t.Fatalf("Expected %v response code from put resent statement; got %d", expected, got)
+		}
+	}
+
+	// 内容が異なる場合は Conflict
+	_, err = stmt2.SetP("Other Name", "actor.name")
+	fatalIfError(t, err)
+	if got, expected := put(stmt2.String()), http.StatusConflict; got != expected {
+		t.Fatalf("Expected %v response code from put different statement; got %d", expected, got)
+	}
+}
+
 func TestPutStatementAndCheckAuthority(t *testing.T) {
 	m := martini.Classic()
 
-	sess, err := mgo.Dial(miscs.GlobalConfig.MongoDB.URL)
-	defer sess.Close()
-	if err != nil {
-		t.Fatalf("%v", err)
-	}
-	c := New(sess)
+	db := initDatabase(t)
+	defer closeDatabase(db)
+	c := newController(db)
 
 	m.Get("/:user/:app/statements", acceptlang.Languages(), c.FindStatement)
 	m.Put("/:user/:app/statements", c.StoreStatement)
@@ -264,3 +288,77 @@ func TestPutStatementAndCheckAuthority(t *testing.T) {
 		t.Fatal("Field authority.account.name is invalid or not found in get response")
 	}
 }
+
+func putStatementWithVersion(t *testing.T, stmt, version string) *httptest.ResponseRecorder {
+	m := martini.Classic()
+
+	db := initDatabase(t)
+	defer closeDatabase(db)
+	c := newController(db)
+
+	m.Put("/:user/:app/statements", c.StoreStatement)
+
+	resp := httptest.NewRecorder()
+	req, _ := http.NewRequest("PUT",
+		"/test/test/statements?statementId="+uuid.NewV4().String(),
+		strings.NewReader(stmt),
+	)
+	req.Header.Add("X-Experience-API-Version", version)
+
+	m.ServeHTTP(resp, req)
+
+	return resp
+}
+
+func TestPutStatementWithXAPIVersion20(t *testing.T) {
+	stmt, err := gabs.ParseJSON([]byte(singleStatement02))
+	if err != nil {
+		t.Fatal(err)
+	}
+	contextAgent, err := gabs.ParseJSON([]byte(`{
+		"objectType": "contextAgent",
+		"agent": {"objectType": "Agent", "mbox": "mailto:instructor@realglobe.example.com"},
+		"relevantTypes": ["http://example.com/types/instructor"]
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stmt.SetP([]interface{}{contextAgent.Data()}, "context.contextAgents"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stmt.SetP("2015-05-07T01:59:39.423+09:00", "timestamp"); err != nil {
+		t.Fatal(err)
+	}
+
+	resp := putStatementWithVersion(t, stmt.String(), "2.0.0")
+	if got, expected := resp.Code, http.StatusNoContent; got != expected {
+		r, _ := ioutil.ReadAll(resp.Body)
+		t.Fatalf("Expected %v response code from put 2.0.0 statement; got %d, %s", expected, got, string(r))
+	}
+	if got, expected := resp.Header().Get("X-Experience-API-Version"), "2.0.0"; got != expected {
+		t.Fatalf("Expected X-Experience-API-Version %v; got %v", expected, got)
+	}
+
+	// contextAgents は 1.0.x では認められない
+	resp = putStatementWithVersion(t, stmt.String(), "1.0.2")
+	if got, expected := resp.Code, http.StatusBadRequest; got != expected {
+		t.Fatalf("Expected %v response code from put 1.0.2 statement with contextAgents; got %d", expected, got)
+	}
+}
+
+func TestPutStatementWithXAPIVersion20AndNoTimezone(t *testing.T) {
+	for _, timestamp := range []string{"2015-05-07T01:59:39.423", "2015-05-07T01:59:39.423-00:00"} {
+		stmt, err := gabs.ParseJSON([]byte(singleStatement01))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := stmt.SetP(timestamp, "timestamp"); err != nil {
+			t.Fatal(err)
+		}
+
+		resp := putStatementWithVersion(t, stmt.String(), "2.0.0")
+		if got, expected := resp.Code, http.StatusBadRequest; got != expected {
+			t.Fatalf("Expected %v response code from put 2.0.0 statement with timestamp %s; got %d", expected, timestamp, got)
+		}
+	}
+}
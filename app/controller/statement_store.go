@@ -15,7 +15,8 @@
 package controller
 
 import (
-	"crypto/sha256"
+	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -30,23 +31,31 @@ import (
 	"github.com/realglobe-Inc/edo-xrs/app/model"
 	"github.com/realglobe-Inc/edo-xrs/app/validator"
 	"github.com/satori/go.uuid"
-	"gopkg.in/mgo.v2"
-	"gopkg.in/mgo.v2/bson"
+	"go.mongodb.org/mongo-driver/bson"
 )
 
 // StoreStatement はステートメントの PUT リクエストを扱うハンドラである。
 // このハンドラは与えられたステートメントをバリデートし、データベースに挿入する。
 // URLパラメータには UUID (ステートメントID) が与えられており、そのIDのステートメントを挿入する。
-func (c *Controller) StoreStatement(params martini.Params, w http.ResponseWriter, req *http.Request) (int, string) {
+func (c *Controller) StoreStatement(params martini.Params, w http.ResponseWriter, req *http.Request) (code int, mess string) {
 	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("X-Experience-API-Version", "1.0.2")
+	setXAPIVersionHeader(w, req)
 	user, app := params["user"], params["app"]
+	ctx := req.Context()
+
+	// ステートメントを保存できなかった場合は、このリクエストで保存した添付ファイルを削除する
+	uploaded := &uploadedAttachments{}
+	defer func() {
+		if code >= http.StatusBadRequest {
+			c.removeUploadedAttachments(uploaded)
+		}
+	}()
 
 	contentType := req.Header.Get("Content-Type")
 	if len(contentType) == 0 {
 		contentType = "application/json"
 	}
-	statements, attachmentSHA2s, err := c.parseRequestBody(req.Body, contentType)
+	statements, attachmentSHA2s, octets, err := c.parseRequestBody(ctx, req.Body, contentType, uploaded)
 	if err != nil {
 		return NewBadRequestErrF("An error occured on parse request: %s", err).Response()
 	}
@@ -59,8 +68,16 @@ func (c *Controller) StoreStatement(params martini.Params, w http.ResponseWriter
 
 	// xAPI のバージョンを確認, Experience API, Section 6.2 を参照
 	xAPIVersion := req.Header.Get("X-Experience-API-Version")
-	if err := validator.Statement(validator.ToXAPIVersion(xAPIVersion), statement); err != nil {
-		return NewBadRequestErrF("Invalid statement: %s", err).Response()
+	if err := validator.Statement(validator.ToXAPIVersion(xAPIVersion), statement, miscs.GlobalConfig.Global.VoidedStatementID); err != nil {
+		return NewInvalidStatementErr(err).Response()
+	}
+
+	// xAPI のバージョンによらない形式とし、以降の検査と保存はこの形式に対して行う
+	canonicalizeStatement(statement)
+
+	// app に登録された xAPI Profile により検査
+	if code, mess := c.checkXAPIProfiles(ctx, user, app, statements); code != http.StatusOK {
+		return code, mess
 	}
 
 	// ステートメントIDをチェック, Experience API, Section 7.2.1 を参照
@@ -74,6 +91,18 @@ func (c *Controller) StoreStatement(params martini.Params, w http.ResponseWriter
 		return NewBadRequestErr("Unexpected content hash given on attachment or multipart header").Response()
 	}
 
+	// 署名付きステートメントを検証, Experience API, Section 4.4 を参照
+	if miscs.GlobalConfig.Signature.Verify {
+		if code, mess := checkSignedStatements(statements, octets); code != http.StatusOK {
+			return code, mess
+		}
+	}
+
+	// fileUrl により参照される添付ファイルを扱う
+	if code, mess := c.storeFileURLAttachments(ctx, statements, attachmentSHA2s, uploaded); code != http.StatusOK {
+		return code, mess
+	}
+
 	// 与えられたステートメントと、URLのパラメータのIDをチェック
 	if id, ok := statement["id"]; !ok {
 		// URL にのみ ID が付加されているときは, ステートメントにその ID を補完
@@ -84,13 +113,13 @@ func (c *Controller) StoreStatement(params martini.Params, w http.ResponseWriter
 	}
 
 	// タイムスタンプに関する処理
+	// stored はストレージが保存の直前に設定する
 	currentTime := time.Now()
 
 	timestamp := currentTime
-	statement["stored"] = currentTime
 
 	if ts, ok := statement["timestamp"]; ok {
-		t, err := time.Parse(time.RFC3339Nano, ts.(string))
+		t, err := parseTimestamp(ts.(string))
 		if err != nil {
 			return NewBadRequestErr("Timestamp must be of the form of RFC3339").Response()
 		}
@@ -108,23 +137,35 @@ func (c *Controller) StoreStatement(params martini.Params, w http.ResponseWriter
 		},
 	}
 
-	if code, mess := c.insertIntoDB(xAPIVersion, user, app, model.DocumentSlice{
+	if code, mess := c.insertIntoDB(ctx, xAPIVersion, user, app, model.DocumentSlice{
 		*model.NewDocument(xAPIVersion, user, app, timestamp, statement),
-	}); code != http.StatusOK {
+	}, uploaded.fetched); code != http.StatusOK {
 		return code, mess
 	}
 
 	return http.StatusNoContent, "No Content"
 }
 
+// hasSameHashBetween はステートメントの添付ファイルと、multipart/mixed の各パートの
+// sha2 値が対応しているかを返す。fileUrl を持つ添付ファイルはパートを省略できる。
 func hasSameHashBetween(statements []interface{}, attachmentSHA2s []string) bool {
+	given := make(map[string]bool)
+	for _, sha2 := range attachmentSHA2s {
+		given[sha2] = true
+	}
+
 	sha2map := make(map[string]bool)
 	for _, stmt := range statements {
 		if attachments, ok := (stmt.(map[string]interface{}))["attachments"]; ok {
 			for _, att := range attachments.([]interface{}) {
 				a := att.(map[string]interface{})
-				if sha2, ok := a["sha2"]; ok {
-					sha2map[sha2.(string)] = true
+				sha2, ok := a["sha2"].(string)
+				if !ok {
+					continue
+				}
+				sha2map[sha2] = true
+				if _, ok := a["fileUrl"]; !ok && !given[sha2] {
+					return false
 				}
 			}
 		}
@@ -135,29 +176,49 @@ func hasSameHashBetween(statements []interface{}, attachmentSHA2s []string) bool
 		}
 	}
 
-	return len(sha2map) == len(attachmentSHA2s)
+	return true
 }
 
 // StoreMultStatement はステートメントを単一、もしくは複数挿入するためのハンドラである。
 // ステートメントは配列、もしくは単一のJSONの形でリクエストボディに与えられる。
-func (c *Controller) StoreMultStatement(params martini.Params, w http.ResponseWriter, req *http.Request) (int, string) {
+func (c *Controller) StoreMultStatement(params martini.Params, w http.ResponseWriter, req *http.Request) (code int, mess string) {
 	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("X-Experience-API-Version", "1.0.2")
+	setXAPIVersionHeader(w, req)
 	user, app := params["user"], params["app"]
+	ctx := req.Context()
+
+	// バッチのステートメントを保存できなかった場合は、このリクエストで保存した添付ファイルを削除する
+	uploaded := &uploadedAttachments{}
+	defer func() {
+		if code >= http.StatusBadRequest {
+			c.removeUploadedAttachments(uploaded)
+		}
+	}()
 
 	contentType := req.Header.Get("Content-Type")
 	if len(contentType) == 0 {
 		contentType = "application/json"
 	}
-	statements, attachmentSHA2s, err := c.parseRequestBody(req.Body, contentType)
+	statements, attachmentSHA2s, octets, err := c.parseRequestBody(ctx, req.Body, contentType, uploaded)
 	if err != nil {
 		return NewBadRequestErrF("An error occured on parse request: %s", err).Response()
 	}
 
 	// xAPI のバージョンを確認, Experience API, Section 6.2 を参照
 	xAPIVersion := req.Header.Get("X-Experience-API-Version")
-	if err := validator.MultStatement(validator.ToXAPIVersion(xAPIVersion), statements); err != nil {
-		return NewBadRequestErrF("Invalid statement: %s", err).Response()
+	if err := validator.MultStatement(validator.ToXAPIVersion(xAPIVersion), statements, miscs.GlobalConfig.Global.VoidedStatementID); err != nil {
+		return NewInvalidStatementErr(err).Response()
+	}
+
+	// xAPI のバージョンによらない形式とし、以降の検査と保存はこの形式に対して行う
+	// MultStatement で検査しているため変換可能
+	for _, stmt := range statements {
+		canonicalizeStatement(stmt.(map[string]interface{}))
+	}
+
+	// app に登録された xAPI Profile により検査
+	if code, mess := c.checkXAPIProfiles(ctx, user, app, statements); code != http.StatusOK {
+		return code, mess
 	}
 
 	// attachments がある場合、チェック
@@ -165,6 +226,18 @@ func (c *Controller) StoreMultStatement(params martini.Params, w http.ResponseWr
 		return NewBadRequestErr("Unexpected content hash given on attachment or multipart header").Response()
 	}
 
+	// 署名付きステートメントを検証, Experience API, Section 4.4 を参照
+	if miscs.GlobalConfig.Signature.Verify {
+		if code, mess := checkSignedStatements(statements, octets); code != http.StatusOK {
+			return code, mess
+		}
+	}
+
+	// fileUrl により参照される添付ファイルを扱う
+	if code, mess := c.storeFileURLAttachments(ctx, statements, attachmentSHA2s, uploaded); code != http.StatusOK {
+		return code, mess
+	}
+
 	// authority を取得
 	authority := bson.M{
 		"objectType": "Agent",
@@ -179,7 +252,7 @@ func (c *Controller) StoreMultStatement(params martini.Params, w http.ResponseWr
 		return NewBadRequestErrF("Invalid statements: %s", err).Response()
 	}
 
-	if status, mess := c.insertIntoDB(xAPIVersion, user, app, docs); status != http.StatusOK {
+	if status, mess := c.insertIntoDB(ctx, xAPIVersion, user, app, docs, uploaded.fetched); status != http.StatusOK {
 		return status, mess
 	}
 
@@ -193,47 +266,98 @@ func (c *Controller) StoreMultStatement(params martini.Params, w http.ResponseWr
 	return http.StatusOK, string(result)
 }
 
-func (c *Controller) insertIntoDB(xAPIVersion, user, app string, docs model.DocumentSlice) (int, string) {
-	// データベースのセッションを取得
-	sess := c.session.New()
-	defer sess.Close()
-	db := sess.DB(miscs.GlobalConfig.MongoDB.DBName)
+// insertIntoDB はステートメントをストレージに挿入する。ディスク使用量にはステートメントのサイズと
+// attachmentSize を加える。attachmentSize は fileUrl から取得して保存した添付ファイルのサイズである。
+func (c *Controller) insertIntoDB(ctx context.Context, xAPIVersion, user, app string, docs model.DocumentSlice, attachmentSize int64) (int, string) {
+	// 既に保存されているステートメントの再送は挿入しない
+	docs, code, mess := c.excludeResentStatements(ctx, user, app, docs)
+	if code != http.StatusOK {
+		return code, mess
+	}
+	if len(docs) == 0 {
+		// 取得した添付ファイルは残るため、そのサイズのみディスク使用量に加える
+		if err := c.store.AddQuotaUsage(ctx, user, attachmentSize); err != nil {
+			logger.Err("An unexpected error occured on update quota: ", err)
+			return http.StatusInternalServerError, "Internal Server Error"
+		}
+		return http.StatusOK, "ok"
+	}
 
-	if valid, err := isValidVoidedStatements(db, docs, xAPIVersion, user, app); !valid && err != nil {
+	if valid, err := c.isValidVoidedStatements(ctx, docs, xAPIVersion, user, app); !valid && err != nil {
 		return NewBadRequestErrF("Invalid voided statement: %s", err).Response()
 	}
 
-	quota, err := model.GetQuota(db, user)
-	if err != nil {
-		logger.Err("An unexpected error occured on get quota: ", err)
-		return http.StatusInternalServerError, "Internal Server Error"
+	// cmi5 モードの app ではセッションの状態遷移を検査し、ステートメントと共に保存する。
+	var commit func(ctx context.Context) error
+	if isCMI5App(user, app) {
+		tracker := newCMI5Tracker(c.store, user, app)
+		for _, doc := range docs {
+			if code, mess := tracker.apply(ctx, doc.Data); code != http.StatusOK {
+				return code, mess
+			}
+		}
+		commit = tracker.save
 	}
 
-	// ユーザーのディスク使用量をチェック
-	if !quota.Check() {
+	// ストレージに挿入し、同じ ID のステートメントが既にある場合は Conflict を返す。
+	// xAPI の仕様によると Conflict は statement の id フィールド値が重複する場合と規定されている。
+	// バッチは全て保存されるか、全く保存されないかのいずれかとなる。
+	switch err := c.store.InsertStatements(ctx, user, app, docs, getSizeOfDocuments(docs)+attachmentSize, commit); err {
+	case nil:
+	case model.ErrDuplicateStatement:
+		return http.StatusConflict, "Conflict"
+	case model.ErrQuotaExceeded:
+		// ユーザーのディスク使用量が上限に達している
 		return NewBadRequestErrF("The disk is full of user: %s", user).Response()
+	default:
+		logger.Err("An unexpected error occured on insert statement into DB: ", err)
+		return http.StatusInternalServerError, "Internal Server Error"
 	}
 
-	if err := quota.IncrementUsageTo(db, getSizeOfDocuments(docs)); err != nil {
-		logger.Err("An unexpected error occured on increment quota: ", err)
-		return http.StatusInternalServerError, "Internal Server Error"
+	return http.StatusOK, "ok"
+}
+
+// excludeResentStatements は既に同じ ID のステートメントが保存されている場合、そのステートメントを
+// docs から除く。保存されているものと同等でない場合は Conflict を返す。
+// これにより、タイムアウトなどで再送されたステートメントは成功として扱われる。
+// (Experience API, Section 7.2.1, 7.2.2 を参照)
+func (c *Controller) excludeResentStatements(ctx context.Context, user, app string, docs model.DocumentSlice) (model.DocumentSlice, int, string) {
+	ids := make([]string, 0, len(docs))
+	for _, doc := range docs {
+		if id, ok := doc.Data["id"].(string); ok {
+			ids = append(ids, id)
+		}
 	}
 
-	// データベースに挿入し、duplicate key エラーが発生しない場合に正常終了、
-	// そうでなければ Conflict を返す。xAPI の仕様によると Conflict は
-	// statement の id フィールド値が重複する場合と規定されている。
-	// そこで、この箇所では statement の id フィールドを unique index にすることで
-	// duplicate key エラーを発生させ、Conflict の判定を行っている。
-	if err := docs.InsertTo(db.C("statement")); err != nil {
-		if !mgo.IsDup(err) {
-			logger.Err("An unexpected error occured on insert statement into DB: ", err)
-			return http.StatusInternalServerError, "Internal Server Error"
+	stored, err := c.store.FindStatements(ctx, user, app, ids)
+	if err != nil {
+		logger.Err("An unexpected error occured on find DB: ", err)
+		return nil, http.StatusInternalServerError, "Internal Server Error"
+	}
+	if len(stored) == 0 {
+		return docs, http.StatusOK, "ok"
+	}
+
+	storedByID := make(map[string]map[string]interface{}, len(stored))
+	for _, doc := range stored {
+		if id, ok := doc.Data["id"].(string); ok {
+			storedByID[id] = doc.Data
 		}
+	}
 
-		return http.StatusConflict, "Conflict"
+	filtered := make(model.DocumentSlice, 0, len(docs))
+	for _, doc := range docs {
+		s, ok := storedByID[doc.Data["id"].(string)]
+		if !ok {
+			filtered = append(filtered, doc)
+			continue
+		}
+		if !isEquivalentResentStatement(s, doc.Data) {
+			return nil, http.StatusConflict, "Conflict"
+		}
 	}
 
-	return http.StatusOK, "ok"
+	return filtered, http.StatusOK, "ok"
 }
 
 func getSizeOfDocuments(docs model.DocumentSlice) int64 {
@@ -250,7 +374,7 @@ func getSizeOfDocuments(docs model.DocumentSlice) int64 {
 	return total
 }
 
-func isValidVoidedStatement(db *mgo.Database, doc *model.Document, xAPIVersion, user, app string) (bool, error) {
+func (c *Controller) isValidVoidedStatement(ctx context.Context, doc *model.Document, xAPIVersion, user, app string) (bool, error) {
 	reqBody := doc.Data
 
 	// ステートメントが Voided である時の処理
@@ -262,7 +386,11 @@ func isValidVoidedStatement(db *mgo.Database, doc *model.Document, xAPIVersion,
 			}
 
 			// Voided に Voided を被せる時はエラーを返す
-			if isVoidedStatement(db.C("statement"), xAPIVersion, user, app, object["id"].(string)) {
+			voided, err := c.store.IsVoided(ctx, user, app, object["id"].(string))
+			if err != nil {
+				logger.Err("An unexpected error occured on find voided statement in DB: ", err)
+			}
+			if voided {
 				return false, errors.New("voided statement cannot be voided")
 			}
 		}
@@ -271,9 +399,9 @@ func isValidVoidedStatement(db *mgo.Database, doc *model.Document, xAPIVersion,
 	return true, nil
 }
 
-func isValidVoidedStatements(db *mgo.Database, docs model.DocumentSlice, xAPIVersion, user, app string) (bool, error) {
+func (c *Controller) isValidVoidedStatements(ctx context.Context, docs model.DocumentSlice, xAPIVersion, user, app string) (bool, error) {
 	for _, doc := range docs {
-		if valid, err := isValidVoidedStatement(db, &doc, xAPIVersion, user, app); !valid {
+		if valid, err := c.isValidVoidedStatement(ctx, &doc, xAPIVersion, user, app); !valid {
 			return valid, err
 		}
 	}
@@ -281,10 +409,13 @@ func isValidVoidedStatements(db *mgo.Database, docs model.DocumentSlice, xAPIVer
 	return true, nil
 }
 
-func (c *Controller) parseRequestBody(r io.Reader, t string) ([]interface{}, []string, error) {
+// parseRequestBody はリクエストボディからステートメントを取り出す。multipart/mixed の場合は
+// 添付ファイルの sha2 値と、署名の検証のために application/octet-stream の添付ファイルの内容を
+// sha2 値ごとに返す。ストレージに保存した添付ファイルは uploaded に加える。
+func (c *Controller) parseRequestBody(ctx context.Context, r io.Reader, t string, uploaded *uploadedAttachments) ([]interface{}, []string, map[string][]byte, error) {
 	mediatype, params, err := mime.ParseMediaType(t)
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, nil, err
 	}
 
 	var statements []interface{}
@@ -293,15 +424,12 @@ func (c *Controller) parseRequestBody(r io.Reader, t string) ([]interface{}, []s
 	// その sha2 値を collect する。また, json 値がきたときにはステートメントとする
 	if mediatype == "multipart/mixed" {
 		var sha2slice []string
+		octets := make(map[string][]byte)
 		boundary, ok := params["boundary"]
 		if !ok {
-			return nil, nil, errors.New("invalid or no multipart boundary in Content-Type")
+			return nil, nil, nil, errors.New("invalid or no multipart boundary in Content-Type")
 		}
 
-		sha2 := sha256.New()
-		sess := c.session.New()
-		defer sess.Close()
-		gfs := sess.DB(miscs.GlobalConfig.MongoDB.DBName).GridFS("fs")
 		mr := multipart.NewReader(r, boundary)
 
 		for {
@@ -310,57 +438,49 @@ func (c *Controller) parseRequestBody(r io.Reader, t string) ([]interface{}, []s
 				break
 			}
 			if err != nil {
-				return nil, nil, err
+				return nil, nil, nil, err
 			}
 			mt, _, err := mime.ParseMediaType(p.Header.Get("Content-Type"))
 			switch mt {
 			case "application/json":
 				stmts, err := readBodyJSONOfArray(p)
 				if err != nil {
-					return nil, nil, err
+					return nil, nil, nil, err
 				}
 				statements = append(statements, stmts...)
 			default:
 				hash := p.Header.Get("X-Experience-API-Hash")
 				if len(hash) == 0 {
-					return nil, nil, errors.New("X-Experience-API-Hash is empty or not specified")
+					return nil, nil, nil, errors.New("X-Experience-API-Hash is empty or not specified")
 				}
-				gfsfile, err := gfs.Create(hash)
-				if err != nil {
-					return nil, nil, err
-				}
-				gfsfile.SetMeta(bson.M{
-					"Content-Type":              p.Header.Get("Content-Type"),
-					"Content-Transfer-Encoding": p.Header.Get("Content-Transfer-Encoding"),
-				})
-				_, err = io.Copy(io.MultiWriter(gfsfile, sha2), p)
-				if err != nil { // NOTE: A successful Copy returns err == nil, not err == os.EOF
-					return nil, nil, err
+				var r io.Reader = p
+				var octet bytes.Buffer
+				if mt == "application/octet-stream" {
+					r = io.TeeReader(p, &octet)
 				}
-				if err = gfsfile.Close(); err != nil {
-					return nil, nil, err
-				}
-				if fmt.Sprintf("%x", sha2.Sum(nil)) != hash {
-					gfs.RemoveId(gfsfile.Id())
-					return nil, nil, errors.New("content hash and X-Experiece-API-Hash does not match")
+				id, err := storeAttachment(ctx, c.store, hash, p.Header.Get("Content-Type"), p.Header.Get("Content-Transfer-Encoding"), r)
+				if err != nil {
+					return nil, nil, nil, err
 				}
+				uploaded.add(id)
 				sha2slice = append(sha2slice, hash)
-
-				sha2.Reset()
+				if mt == "application/octet-stream" {
+					octets[hash] = octet.Bytes()
+				}
 			}
 		}
 		if len(statements) == 0 {
-			return nil, nil, errors.New("statement is empty on multipart content")
+			return nil, nil, nil, errors.New("statement is empty on multipart content")
 		}
-		return statements, sha2slice, nil
+		return statements, sha2slice, octets, nil
 	}
 
 	// when mediatype == "application/json", then
 	statements, err = readBodyJSONOfArray(r)
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, nil, err
 	}
-	return statements, nil, err
+	return statements, nil, nil, err
 }
 
 // readBodyJSON は与えられたリクエストボディを読み、それを JSON としてパースした結果を返す。
@@ -401,6 +521,7 @@ func parseStatementsAndGetIDs(version, user, app string, reqBody []interface{},
 	docs := make(model.DocumentSlice, 0, len(reqBody))
 	insertedIDs := make([]string, 0, len(reqBody))
 	currentTime := time.Now()
+	seen := make(map[string]bool, len(reqBody))
 
 	for _, v := range reqBody {
 		stmt, ok := v.(map[string]interface{})
@@ -413,12 +534,19 @@ func parseStatementsAndGetIDs(version, user, app string, reqBody []interface{},
 			stmt["id"] = uuid.NewV4().String()
 		}
 
+		// 同じバッチに同じ ID のステートメントを含めることはできない
+		id, _ := stmt["id"].(string)
+		if seen[id] {
+			return nil, nil, fmt.Errorf("duplicate statement id in batch: %s", id)
+		}
+		seen[id] = true
+
 		// タイムスタンプに関する処理
+		// stored はストレージが保存の直前に設定する
 		timestamp := currentTime
-		stmt["stored"] = currentTime
 
 		if ts, ok := stmt["timestamp"]; ok {
-			t, err := time.Parse(time.RFC3339Nano, ts.(string))
+			t, err := parseTimestamp(ts.(string))
 
 			if err != nil {
 				return nil, nil, fmt.Errorf("timestamp must be of the form of RFC3339")
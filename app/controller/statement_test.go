@@ -15,27 +15,73 @@
 package controller
 
 import (
+	"context"
 	"os"
 	"testing"
 
 	"github.com/realglobe-Inc/edo-xrs/app/miscs"
 	"github.com/realglobe-Inc/edo-xrs/app/model"
-	"gopkg.in/mgo.v2"
+	"go.mongodb.org/mongo-driver/mongo"
 )
 
+// testStore はストレージに MongoDB を用いない場合に、全てのテストで共有するストレージである。
+var testStore model.Store
+
 func TestMain(m *testing.M) {
-	session, err := mgo.Dial(miscs.GlobalConfig.MongoDB.URL)
-	defer session.Close()
-	if err != nil {
-		os.Exit(1)
-	}
-	model.InitDB(session.DB(miscs.GlobalConfig.MongoDB.DBName))
 	miscs.InitConfig(os.Getenv("GOPATH") + "/src/github.com/realglobe-Inc/edo-xrs/conf/app.conf")
 
+	// XRS_TEST_POSTGRESQL_URL が与えられた場合は設定ファイルによらず PostgreSQL に対してテストする
+	if url := os.Getenv("XRS_TEST_POSTGRESQL_URL"); len(url) > 0 {
+		miscs.GlobalConfig.Storage.Backend = "postgresql"
+		miscs.GlobalConfig.PostgreSQL.URL = url
+	}
+
+	switch miscs.GlobalConfig.Storage.Backend {
+	case "memory":
+		testStore = model.NewMemoryStore()
+	case "postgresql":
+		store, err := model.OpenPostgresStore(miscs.GlobalConfig.PostgreSQL.URL)
+		if err != nil {
+			logger.Err("Cannot open PostgreSQL: ", err)
+			os.Exit(1)
+		}
+		testStore = store
+	case "sqlite":
+		store, err := model.OpenSQLiteStore(miscs.GlobalConfig.SQLite.Path, miscs.GlobalConfig.SQLite.WAL)
+		if err != nil {
+			logger.Err("Cannot open SQLite: ", err)
+			os.Exit(1)
+		}
+		testStore = store
+	default:
+		ctx := context.Background()
+		client, err := model.Connect(ctx, miscs.GlobalConfig.MongoDB.URL)
+		if err != nil {
+			logger.Err("Cannot connect to MongoDB: ", err)
+			os.Exit(1)
+		}
+		model.InitDB(ctx, client.Database(miscs.GlobalConfig.MongoDB.DBName))
+		client.Disconnect(ctx)
+	}
+
 	code := m.Run()
 	os.Exit(code)
 }
 
+// testStatementStore はテストで用いるストレージを返す。
+func testStatementStore(db *mongo.Database) model.Store {
+	if testStore != nil {
+		return testStore
+	}
+
+	return model.NewMongoStore(db)
+}
+
+// newController はテストのための、db を用いる Controller を返す。
+func newController(db *mongo.Database) *Controller {
+	return New(testStatementStore(db))
+}
+
 var singleStatement01 = `
 {
   "actor": {
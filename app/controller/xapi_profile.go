@@ -0,0 +1,142 @@
+// Copyright 2015 realglobe, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/go-martini/martini"
+	"github.com/realglobe-Inc/edo-xrs/app/model"
+	"github.com/realglobe-Inc/edo-xrs/app/validator"
+)
+
+// FindXAPIProfile は app に登録された xAPI Profile の GET リクエストを扱うハンドラである。
+// profileId が指定されている場合はその xAPI Profile を、そうでなければ profileId の一覧を返す。
+func (c *Controller) FindXAPIProfile(params martini.Params, w http.ResponseWriter, req *http.Request) (int, string) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	user, app := params["user"], params["app"]
+
+	ctx := req.Context()
+
+	profileID := req.URL.Query().Get("profileId")
+	if len(profileID) == 0 {
+		profiles, err := c.store.FindXAPIProfiles(ctx, user, app)
+		if err != nil {
+			logger.Err("An unexpected error occured on find DB: ", err)
+			return http.StatusInternalServerError, "Internal Server Error"
+		}
+
+		ids := make([]string, 0, len(profiles))
+		for _, p := range profiles {
+			ids = append(ids, p.ProfileID)
+		}
+
+		return writeIDs(w, ids)
+	}
+
+	profile, err := c.store.FindXAPIProfile(ctx, user, app, profileID)
+	if err == model.ErrNotFound {
+		return http.StatusNotFound, "xAPI Profile Not Found"
+	}
+	if err != nil {
+		logger.Err("An unexpected error occured on find DB: ", err)
+		return http.StatusInternalServerError, "Internal Server Error"
+	}
+
+	return writeDocument(w, "application/ld+json", profile.Content, profile.Updated)
+}
+
+// StoreXAPIProfile は xAPI Profile を app に登録する PUT リクエストを扱うハンドラである。
+// xAPI Profile はその id により識別され、同じ id のものが既に存在する場合は置き換える。
+// 登録された xAPI Profile の Statement Template は、以後保存されるステートメントの検査に用いる。
+func (c *Controller) StoreXAPIProfile(params martini.Params, w http.ResponseWriter, req *http.Request) (int, string) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	user, app := params["user"], params["app"]
+
+	content, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return NewBadRequestErrF("An error occured on read request: %s", err).Response()
+	}
+
+	profile, err := validator.ParseProfile(content)
+	if err != nil {
+		return NewBadRequestErrF("Invalid xAPI Profile: %s", err).Response()
+	}
+
+	ctx := req.Context()
+
+	if err := c.store.SaveXAPIProfile(ctx, model.NewXAPIProfile(user, app, profile.ID, content, time.Now())); err != nil {
+		logger.Err("An unexpected error occured on save xAPI Profile into DB: ", err)
+		return http.StatusInternalServerError, "Internal Server Error"
+	}
+
+	return http.StatusNoContent, "No Content"
+}
+
+// DeleteXAPIProfile は app に登録された xAPI Profile の DELETE リクエストを扱うハンドラである。
+func (c *Controller) DeleteXAPIProfile(params martini.Params, w http.ResponseWriter, req *http.Request) (int, string) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	user, app := params["user"], params["app"]
+
+	profileID := req.URL.Query().Get("profileId")
+	if len(profileID) == 0 {
+		return NewBadRequestErr("profileId is required").Response()
+	}
+
+	ctx := req.Context()
+
+	if err := c.store.RemoveXAPIProfile(ctx, user, app, profileID); err != nil && err != model.ErrNotFound {
+		logger.Err("An unexpected error occured on remove xAPI Profile from DB: ", err)
+		return http.StatusInternalServerError, "Internal Server Error"
+	}
+
+	return http.StatusNoContent, "No Content"
+}
+
+// checkXAPIProfiles は app に登録された xAPI Profile の Statement Template により
+// ステートメントを検査し、満たさない場合は 400 を返す。
+func (c *Controller) checkXAPIProfiles(ctx context.Context, user, app string, statements []interface{}) (int, string) {
+	stored, err := c.store.FindXAPIProfiles(ctx, user, app)
+	if err != nil {
+		logger.Err("An unexpected error occured on find DB: ", err)
+		return http.StatusInternalServerError, "Internal Server Error"
+	}
+	if len(stored) == 0 {
+		return http.StatusOK, "ok"
+	}
+
+	profiles := make([]*validator.Profile, 0, len(stored))
+	for _, p := range stored {
+		profile, err := validator.ParseProfile(p.Content)
+		if err != nil {
+			// 登録時に検査しているため、このエラーが起きる場合はデータベースに問題がある
+			logger.Err("An unexpected error occured on parse xAPI Profile: ", err)
+			return http.StatusInternalServerError, "Internal Server Error"
+		}
+		profiles = append(profiles, profile)
+	}
+
+	for _, stmt := range statements {
+		// バリデート済みのため変換可能
+		if err := validator.ValidateProfiles(profiles, stmt.(map[string]interface{})); err != nil {
+			return NewBadRequestErrF("Statement does not conform to xAPI Profile: %s", err).Response()
+		}
+	}
+
+	return http.StatusOK, "ok"
+}
@@ -0,0 +1,135 @@
+// Copyright 2015 realglobe, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/Jeffail/gabs"
+	"github.com/go-martini/martini"
+	"github.com/satori/go.uuid"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const xAPIProfile01 = `{
+  "@context": "https://w3id.org/xapi/profiles/context",
+  "id": "http://example.com/profiles/test",
+  "type": "Profile",
+  "prefLabel": {"en": "Test Profile"},
+  "templates": [
+    {
+      "id": "http://example.com/profiles/test/templates/visited",
+      "type": "StatementTemplate",
+      "verb": "http://example.com/visited",
+      "rules": [
+        {
+          "location": "$.object.definition.name['en-US']",
+          "presence": "included"
+        },
+        {
+          "location": "$.result.score.raw",
+          "presence": "excluded"
+        }
+      ]
+    }
+  ]
+}`
+
+func initXAPIProfileHandler(db *mongo.Database) *martini.ClassicMartini {
+	mart := martini.Classic()
+	hand := newController(db)
+	mart.Put("/:user/:app/profiles", hand.StoreXAPIProfile)
+	mart.Get("/:user/:app/profiles", hand.FindXAPIProfile)
+	mart.Delete("/:user/:app/profiles", hand.DeleteXAPIProfile)
+	mart.Put("/:user/:app/statements", hand.StoreStatement)
+
+	return mart
+}
+
+func requestXAPIProfile(t *testing.T, mart http.Handler, method, path, body string) *httptest.ResponseRecorder {
+	resp := httptest.NewRecorder()
+	req, err := http.NewRequest(method, path, strings.NewReader(body))
+	fatalIfError(t, err)
+
+	req.Header.Add("X-Experience-API-Version", "1.0.2")
+	mart.ServeHTTP(resp, req)
+
+	return resp
+}
+
+func TestStoreStatementWithXAPIProfile(t *testing.T) {
+	db := initDatabase(t)
+	defer closeDatabase(db)
+	mart := initXAPIProfileHandler(db)
+
+	// 他のテストに影響しないように専用の app を用いる
+	base := "/test/profile-" + uuid.NewV4().String()
+
+	resp := requestXAPIProfile(t, mart, "PUT", base+"/profiles", xAPIProfile01)
+	if got, expected := resp.Code, http.StatusNoContent; got != expected {
+		t.Fatalf("Expected %v response code from put xAPI Profile; got %d", expected, got)
+	}
+	defer requestXAPIProfile(t, mart, "DELETE", base+"/profiles?profileId=http://example.com/profiles/test", "")
+
+	resp = requestXAPIProfile(t, mart, "GET", base+"/profiles", "")
+	if body, _ := ioutil.ReadAll(resp.Body); string(body) != `["http://example.com/profiles/test"]` {
+		t.Fatalf("Unexpected list of xAPI Profile: %s", string(body))
+	}
+
+	// Statement Template の rules を満たす
+	resp = requestXAPIProfile(t, mart, "PUT", base+"/statements?statementId="+uuid.NewV4().String(), singleStatement02)
+	if got, expected := resp.Code, http.StatusNoContent; got != expected {
+		t.Fatalf("Expected %v response code from put conforming statement; got %d", expected, got)
+	}
+
+	// rules を満たさない
+	stmt, err := gabs.ParseJSON([]byte(singleStatement02))
+	fatalIfError(t, err)
+	_, err = stmt.SetP(10, "result.score.raw")
+	fatalIfError(t, err)
+
+	resp = requestXAPIProfile(t, mart, "PUT", base+"/statements?statementId="+uuid.NewV4().String(), stmt.String())
+	if got, expected := resp.Code, http.StatusBadRequest; got != expected {
+		t.Fatalf("Expected %v response code from put nonconforming statement; got %d", expected, got)
+	}
+	if body, _ := ioutil.ReadAll(resp.Body); !strings.Contains(string(body), "rule 1") {
+		t.Fatalf("Expected the failed rule in response; got %s", string(body))
+	}
+
+	// verb が一致しないステートメントには Statement Template を適用しない
+	_, err = stmt.SetP("http://example.com/other", "verb.id")
+	fatalIfError(t, err)
+
+	resp = requestXAPIProfile(t, mart, "PUT", base+"/statements?statementId="+uuid.NewV4().String(), stmt.String())
+	if got, expected := resp.Code, http.StatusNoContent; got != expected {
+		t.Fatalf("Expected %v response code from put statement with other verb; got %d", expected, got)
+	}
+}
+
+func TestStoreInvalidXAPIProfile(t *testing.T) {
+	db := initDatabase(t)
+	defer closeDatabase(db)
+	mart := initXAPIProfileHandler(db)
+
+	profile := strings.Replace(xAPIProfile01, `"$.result.score.raw"`, `"result.score.raw"`, 1)
+	resp := requestXAPIProfile(t, mart, "PUT", "/test/profile-"+uuid.NewV4().String()+"/profiles", profile)
+	if got, expected := resp.Code, http.StatusBadRequest; got != expected {
+		t.Fatalf("Expected %v response code from put invalid xAPI Profile; got %d", expected, got)
+	}
+}
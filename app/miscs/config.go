@@ -15,6 +15,7 @@
 package miscs
 
 import (
+	"fmt"
 	"log"
 
 	"gopkg.in/gcfg.v1"
@@ -26,11 +27,23 @@ type Config struct {
 		HostName          string
 		MaxStatements     int
 		VoidedStatementID string
+		MoreExpiration    int      // more URL の有効期間 (秒)
+		DefaultLanguage   []string // canonical フォーマットで Accept-Language に合う言語が無い場合に用いる言語 (優先順)
+	}
+	Storage struct {
+		Backend string // ステートメントのストレージ (mongodb, memory, postgresql, sqlite)
 	}
 	MongoDB struct {
 		URL    string
 		DBName string
 	}
+	PostgreSQL struct {
+		URL string // lib/pq の接続文字列
+	}
+	SQLite struct {
+		Path string // データベースファイルのパス
+		WAL  bool   // WAL モードを用いるか
+	}
 	Quota struct {
 		UserMaxUsage int64
 	}
@@ -38,6 +51,18 @@ type Config struct {
 		HomePageHeader string
 		NameHeader     string
 	}
+	Signature struct {
+		Verify     bool   // 署名付きステートメントを検証するか
+		TrustStore string // 信頼する CA 証明書 (PEM) のファイル。空の場合はシステムの証明書を用いる
+	}
+	Attachment struct {
+		FileURLPolicy string // fileUrl のみを持つ添付ファイルの扱い (reject, reference, fetch)
+		FetchTimeout  int    // fileUrl から取得する際のタイムアウト (秒)
+		FetchMaxSize  int64  // fileUrl から取得する添付ファイルの最大サイズ (バイト)。0 の場合は 100 MB とする
+	}
+	CMI5 struct {
+		App []string // cmi5 モードを有効にするアプリケーション ("ユーザー/アプリケーション" の形式)
+	}
 }
 
 // GlobalConfig is entity of global config
@@ -48,4 +73,21 @@ func InitConfig(filename string) {
 	if err := gcfg.ReadFileInto(&GlobalConfig, filename); err != nil {
 		log.Panic(err)
 	}
+	if err := GlobalConfig.validate(); err != nil {
+		log.Panic(err)
+	}
+}
+
+// validate は設定の値が取りうるものであるかを確認する。
+func (c *Config) validate() error {
+	switch c.Attachment.FileURLPolicy {
+	case "", "reject", "reference", "fetch":
+	default:
+		return fmt.Errorf("unknown fileurlpolicy in [attachment]: %s (must be reject, reference or fetch)", c.Attachment.FileURLPolicy)
+	}
+	if c.Attachment.FetchMaxSize < 0 {
+		return fmt.Errorf("fetchmaxsize in [attachment] must not be negative: %d", c.Attachment.FetchMaxSize)
+	}
+
+	return nil
 }
@@ -0,0 +1,62 @@
+// Copyright 2015 realglobe, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package model
+
+import (
+	"context"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// FindActivityDefinitions は object が activityID の Activity であるステートメントから
+// object.definition を集め、新しく保存されたものから順に返す。
+func FindActivityDefinitions(ctx context.Context, col *mongo.Collection, user, app, activityID string) ([]map[string]interface{}, error) {
+	query := bson.M{
+		"user":                   user,
+		"app":                    app,
+		"data.object.id":         activityID,
+		"data.object.objectType": bson.M{"$in": []interface{}{"Activity", nil}},
+		"data.object.definition": bson.M{"$exists": true},
+	}
+
+	var definitions []map[string]interface{}
+
+	cursor, err := col.Find(ctx, query, options.Find().
+		SetProjection(bson.M{"data.object.definition": 1}).
+		SetSort(bson.D{{Key: "data.stored", Value: -1}}))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		var result Document
+		if err := cursor.Decode(&result); err != nil {
+			return nil, err
+		}
+		if object, ok := result.Data["object"].(map[string]interface{}); ok {
+			if definition, ok := object["definition"].(map[string]interface{}); ok {
+				definitions = append(definitions, definition)
+			}
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		return nil, err
+	}
+
+	return definitions, nil
+}
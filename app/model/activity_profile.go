@@ -0,0 +1,128 @@
+// Copyright 2015 realglobe, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package model
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ActivityProfile represents a document stored by the Activity Profile API.
+type ActivityProfile struct {
+	ID          primitive.ObjectID `bson:"_id,omitempty"`
+	User        string             `bson:"user"`
+	App         string             `bson:"app"`
+	ActivityID  string             `bson:"activityId"`
+	ProfileID   string             `bson:"profileId"`
+	ContentType string             `bson:"contentType"`
+	Content     []byte             `bson:"content"`
+	Updated     time.Time          `bson:"updated"`
+}
+
+func NewActivityProfile(user, app, activityID, profileID, contentType string, content []byte, updated time.Time) *ActivityProfile {
+	return &ActivityProfile{
+		primitive.NewObjectID(),
+		user,
+		app,
+		activityID,
+		profileID,
+		contentType,
+		content,
+		updated,
+	}
+}
+
+func activityProfileQuery(user, app, activityID string) bson.M {
+	return bson.M{
+		"user":       user,
+		"app":        app,
+		"activityId": activityID,
+	}
+}
+
+// SaveTo は同じキーを持つ ActivityProfile を置き換えて保存する。
+func (p *ActivityProfile) SaveTo(ctx context.Context, col *mongo.Collection) error {
+	query := activityProfileQuery(p.User, p.App, p.ActivityID)
+	query["profileId"] = p.ProfileID
+
+	_, err := col.UpdateOne(ctx, query, bson.M{
+		"$set": bson.M{
+			"contentType": p.ContentType,
+			"content":     p.Content,
+			"updated":     p.Updated,
+		},
+		"$setOnInsert": bson.M{"_id": p.ID},
+	}, options.Update().SetUpsert(true))
+	return err
+}
+
+// FindActivityProfile は指定されたキーの ActivityProfile を返す。
+// 存在しない場合は ErrNotFound を返す。
+func FindActivityProfile(ctx context.Context, col *mongo.Collection, user, app, activityID, profileID string) (*ActivityProfile, error) {
+	query := activityProfileQuery(user, app, activityID)
+	query["profileId"] = profileID
+
+	var profile ActivityProfile
+	err := col.FindOne(ctx, query).Decode(&profile)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &profile, nil
+}
+
+// FindActivityProfileIDs は since 以降に更新された ActivityProfile の profileId を返す。
+// since がゼロ値の場合は全ての profileId を返す。
+func FindActivityProfileIDs(ctx context.Context, col *mongo.Collection, user, app, activityID string, since time.Time) ([]string, error) {
+	query := activityProfileQuery(user, app, activityID)
+	if !since.IsZero() {
+		query["updated"] = bson.M{"$gt": since}
+	}
+
+	cursor, err := col.Find(ctx, query, options.Find().
+		SetProjection(bson.M{"profileId": 1}).
+		SetSort(bson.D{{Key: "profileId", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+
+	var profiles []ActivityProfile
+	if err := cursor.All(ctx, &profiles); err != nil {
+		return nil, err
+	}
+
+	ids := make([]string, 0, len(profiles))
+	for _, p := range profiles {
+		ids = append(ids, p.ProfileID)
+	}
+
+	return ids, nil
+}
+
+// RemoveActivityProfile は指定されたキーの ActivityProfile を削除する。
+func RemoveActivityProfile(ctx context.Context, col *mongo.Collection, user, app, activityID, profileID string) error {
+	query := activityProfileQuery(user, app, activityID)
+	query["profileId"] = profileID
+
+	return removeOne(ctx, col, query)
+}
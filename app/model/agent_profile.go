@@ -0,0 +1,129 @@
+// Copyright 2015 realglobe, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package model
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// AgentProfile represents a document stored by the Agent Profile API.
+// Agent には IFI を一意に表す文字列が入る。
+type AgentProfile struct {
+	ID          primitive.ObjectID `bson:"_id,omitempty"`
+	User        string             `bson:"user"`
+	App         string             `bson:"app"`
+	Agent       string             `bson:"agent"`
+	ProfileID   string             `bson:"profileId"`
+	ContentType string             `bson:"contentType"`
+	Content     []byte             `bson:"content"`
+	Updated     time.Time          `bson:"updated"`
+}
+
+func NewAgentProfile(user, app, agent, profileID, contentType string, content []byte, updated time.Time) *AgentProfile {
+	return &AgentProfile{
+		primitive.NewObjectID(),
+		user,
+		app,
+		agent,
+		profileID,
+		contentType,
+		content,
+		updated,
+	}
+}
+
+func agentProfileQuery(user, app, agent string) bson.M {
+	return bson.M{
+		"user":  user,
+		"app":   app,
+		"agent": agent,
+	}
+}
+
+// SaveTo は同じキーを持つ AgentProfile を置き換えて保存する。
+func (p *AgentProfile) SaveTo(ctx context.Context, col *mongo.Collection) error {
+	query := agentProfileQuery(p.User, p.App, p.Agent)
+	query["profileId"] = p.ProfileID
+
+	_, err := col.UpdateOne(ctx, query, bson.M{
+		"$set": bson.M{
+			"contentType": p.ContentType,
+			"content":     p.Content,
+			"updated":     p.Updated,
+		},
+		"$setOnInsert": bson.M{"_id": p.ID},
+	}, options.Update().SetUpsert(true))
+	return err
+}
+
+// FindAgentProfile は指定されたキーの AgentProfile を返す。
+// 存在しない場合は ErrNotFound を返す。
+func FindAgentProfile(ctx context.Context, col *mongo.Collection, user, app, agent, profileID string) (*AgentProfile, error) {
+	query := agentProfileQuery(user, app, agent)
+	query["profileId"] = profileID
+
+	var profile AgentProfile
+	err := col.FindOne(ctx, query).Decode(&profile)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &profile, nil
+}
+
+// FindAgentProfileIDs は since 以降に更新された AgentProfile の profileId を返す。
+// since がゼロ値の場合は全ての profileId を返す。
+func FindAgentProfileIDs(ctx context.Context, col *mongo.Collection, user, app, agent string, since time.Time) ([]string, error) {
+	query := agentProfileQuery(user, app, agent)
+	if !since.IsZero() {
+		query["updated"] = bson.M{"$gt": since}
+	}
+
+	cursor, err := col.Find(ctx, query, options.Find().
+		SetProjection(bson.M{"profileId": 1}).
+		SetSort(bson.D{{Key: "profileId", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+
+	var profiles []AgentProfile
+	if err := cursor.All(ctx, &profiles); err != nil {
+		return nil, err
+	}
+
+	ids := make([]string, 0, len(profiles))
+	for _, p := range profiles {
+		ids = append(ids, p.ProfileID)
+	}
+
+	return ids, nil
+}
+
+// RemoveAgentProfile は指定されたキーの AgentProfile を削除する。
+func RemoveAgentProfile(ctx context.Context, col *mongo.Collection, user, app, agent, profileID string) error {
+	query := agentProfileQuery(user, app, agent)
+	query["profileId"] = profileID
+
+	return removeOne(ctx, col, query)
+}
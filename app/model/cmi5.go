@@ -0,0 +1,172 @@
+// Copyright 2015 realglobe, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package model
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// CMI5Session は cmi5 のセッションの状態を表す。
+// セッションは registration と、context の extensions に与えられる sessionid により識別する。
+type CMI5Session struct {
+	ID           primitive.ObjectID `bson:"_id,omitempty"`
+	User         string             `bson:"user"`
+	App          string             `bson:"app"`
+	Registration string             `bson:"registration"`
+	SessionID    string             `bson:"sessionId"`
+	LaunchMode   string             `bson:"launchMode"`
+	State        string             `bson:"state"`
+	Updated      time.Time          `bson:"updated"`
+}
+
+func NewCMI5Session(user, app, registration, sessionID, launchMode, state string, updated time.Time) *CMI5Session {
+	return &CMI5Session{
+		primitive.NewObjectID(),
+		user,
+		app,
+		registration,
+		sessionID,
+		launchMode,
+		state,
+		updated,
+	}
+}
+
+// SaveTo は同じセッションの CMI5Session を置き換えて保存する。
+func (s *CMI5Session) SaveTo(ctx context.Context, col *mongo.Collection) error {
+	_, err := col.UpdateOne(ctx, bson.M{
+		"user":         s.User,
+		"app":          s.App,
+		"registration": s.Registration,
+		"sessionId":    s.SessionID,
+	}, bson.M{
+		"$set": bson.M{
+			"launchMode": s.LaunchMode,
+			"state":      s.State,
+			"updated":    s.Updated,
+		},
+		"$setOnInsert": bson.M{"_id": s.ID},
+	}, options.Update().SetUpsert(true))
+	return err
+}
+
+// FindCMI5Session は指定されたセッションの CMI5Session を返す。
+// 存在しない場合は ErrNotFound を返す。
+func FindCMI5Session(ctx context.Context, col *mongo.Collection, user, app, registration, sessionID string) (*CMI5Session, error) {
+	var session CMI5Session
+	err := col.FindOne(ctx, bson.M{
+		"user":         user,
+		"app":          app,
+		"registration": registration,
+		"sessionId":    sessionID,
+	}).Decode(&session)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &session, nil
+}
+
+// FindCMI5Sessions は registration の全ての CMI5Session を更新された順に返す。
+func FindCMI5Sessions(ctx context.Context, col *mongo.Collection, user, app, registration string) ([]CMI5Session, error) {
+	cursor, err := col.Find(ctx, bson.M{
+		"user":         user,
+		"app":          app,
+		"registration": registration,
+	}, options.Find().SetSort(bson.D{{Key: "updated", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+
+	var sessions []CMI5Session
+	if err := cursor.All(ctx, &sessions); err != nil {
+		return nil, err
+	}
+
+	return sessions, nil
+}
+
+// CMI5Registration は cmi5 の registration ごとの状態を表す。
+// 各フィールドは対応する動詞のステートメントが保存されたかを表す。
+type CMI5Registration struct {
+	ID           primitive.ObjectID `bson:"_id,omitempty"`
+	User         string             `bson:"user"`
+	App          string             `bson:"app"`
+	Registration string             `bson:"registration"`
+	Completed    bool               `bson:"completed"`
+	Passed       bool               `bson:"passed"`
+	Failed       bool               `bson:"failed"`
+	Satisfied    bool               `bson:"satisfied"`
+	Waived       bool               `bson:"waived"`
+	Updated      time.Time          `bson:"updated"`
+}
+
+func NewCMI5Registration(user, app, registration string, updated time.Time) *CMI5Registration {
+	return &CMI5Registration{
+		ID:           primitive.NewObjectID(),
+		User:         user,
+		App:          app,
+		Registration: registration,
+		Updated:      updated,
+	}
+}
+
+// SaveTo は同じ registration の CMI5Registration を置き換えて保存する。
+func (r *CMI5Registration) SaveTo(ctx context.Context, col *mongo.Collection) error {
+	_, err := col.UpdateOne(ctx, bson.M{
+		"user":         r.User,
+		"app":          r.App,
+		"registration": r.Registration,
+	}, bson.M{
+		"$set": bson.M{
+			"completed": r.Completed,
+			"passed":    r.Passed,
+			"failed":    r.Failed,
+			"satisfied": r.Satisfied,
+			"waived":    r.Waived,
+			"updated":   r.Updated,
+		},
+		"$setOnInsert": bson.M{"_id": r.ID},
+	}, options.Update().SetUpsert(true))
+	return err
+}
+
+// FindCMI5Registration は registration の CMI5Registration を返す。
+// 存在しない場合は ErrNotFound を返す。
+func FindCMI5Registration(ctx context.Context, col *mongo.Collection, user, app, registration string) (*CMI5Registration, error) {
+	var r CMI5Registration
+	err := col.FindOne(ctx, bson.M{
+		"user":         user,
+		"app":          app,
+		"registration": registration,
+	}).Decode(&r)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &r, nil
+}
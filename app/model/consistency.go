@@ -0,0 +1,110 @@
+// Copyright 2015 realglobe, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package model
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+)
+
+// isMasterResult は isMaster コマンドの結果のうち、必要なフィールドを表す。
+// lastWrite は MongoDB 3.4 以降のレプリカセットでのみ返される。
+type isMasterResult struct {
+	IsMaster  bool `bson:"ismaster"`
+	LastWrite struct {
+		LastWriteDate time.Time `bson:"lastWriteDate"`
+	} `bson:"lastWrite"`
+}
+
+// ConsistentThrough は、返す時刻以前に保存されたステートメントが、この後 db で行う検索の結果に
+// 全て含まれることを保証できる時刻を返す。検索の前に呼ばなければならない。
+// ステートメントは同期的に書き込んでいるため、プライマリから読む場合は現在時刻となる。
+// セカンダリから読む場合は、db の読み込み設定により選ばれたノードに最後に反映された書き込みの時刻となる。
+func ConsistentThrough(ctx context.Context, db *mongo.Database) time.Time {
+	now := time.Now()
+	rp := db.ReadPreference()
+	if rp == nil || rp.Mode() == readpref.PrimaryMode {
+		return now
+	}
+
+	var result isMasterResult
+	err := db.RunCommand(ctx, bson.D{{Key: "isMaster", Value: 1}}, options.RunCmd().SetReadPreference(rp)).Decode(&result)
+	if err != nil || result.IsMaster {
+		return now
+	}
+
+	if lastWrite := result.LastWrite.LastWriteDate; !lastWrite.IsZero() && lastWrite.Before(now) {
+		return lastWrite
+	}
+
+	return now
+}
+
+// insertWindow は挿入中のバッチの stored を保持する。ステートメントの stored は挿入の直前に
+// begin により定め、挿入を終えるまでは検索の対象とならないため、ConsistentThrough は through により
+// 挿入中のバッチと、この後に挿入を始めるバッチのいずれの stored よりも前の時刻を返す。
+// 同じプロセスで行う挿入のみを対象とする。
+type insertWindow struct {
+	mu     sync.Mutex
+	next   int
+	stored map[int]time.Time
+}
+
+// begin は挿入を開始し、バッチの stored とする時刻と、挿入を終えたときに呼ぶ関数を返す。
+// MongoDB は時刻をミリ秒単位で保存するため、stored は現在時刻をミリ秒単位に切り捨てたものとする。
+// 切り上げると stored が未来の時刻となり、直後の検索の Snapshot に含まれなくなる。
+func (w *insertWindow) begin() (time.Time, func()) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.stored == nil {
+		w.stored = make(map[int]time.Time)
+	}
+	stored := time.Now().Truncate(time.Millisecond)
+	id := w.next
+	w.next++
+	w.stored[id] = stored
+
+	return stored, func() {
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		delete(w.stored, id)
+	}
+}
+
+// through は t と、挿入中のバッチやこの後に挿入を始めるバッチの stored の直前の時刻のうち、
+// 最も前のものを返す。
+func (w *insertWindow) through(t time.Time) time.Time {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	// この後に挿入を始めるバッチの stored は、現在時刻をミリ秒単位に切り捨てたもの以降となる
+	if before := time.Now().Truncate(time.Millisecond).Add(-time.Nanosecond); before.Before(t) {
+		t = before
+	}
+	for _, stored := range w.stored {
+		if before := stored.Add(-time.Nanosecond); before.Before(t) {
+			t = before
+		}
+	}
+
+	return t
+}
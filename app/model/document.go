@@ -15,34 +15,41 @@
 package model
 
 import (
+	"context"
 	"time"
 
-	"gopkg.in/mgo.v2"
-	"gopkg.in/mgo.v2/bson"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
 )
 
 type Document struct {
-	ID        bson.ObjectId          `bson:"_id,omitempty"`
+	ID        primitive.ObjectID     `bson:"_id,omitempty"`
 	Version   string                 `bson:"version"`
 	User      string                 `bson:"user"`
 	App       string                 `bson:"app"`
 	Timestamp time.Time              `bson:"timestamp"`
 	Data      map[string]interface{} `bson:"data"`
+
+	// VoidedAt は voiding ステートメントによりこのステートメントが Voided となった時刻である。
+	// Voided でない場合は nil とする。ステートメントを保存する際にストレージが設定する。
+	VoidedAt *time.Time `bson:"voidedAt,omitempty"`
 }
 
 func NewDocument(version, user, app string, timestamp time.Time, body bson.M) *Document {
 	return &Document{
-		bson.NewObjectId(),
-		version,
-		user,
-		app,
-		timestamp,
-		body,
+		ID:        primitive.NewObjectID(),
+		Version:   version,
+		User:      user,
+		App:       app,
+		Timestamp: timestamp,
+		Data:      body,
 	}
 }
 
-func (d *Document) InsertTo(col *mgo.Collection) error {
-	return col.Insert(d)
+func (d *Document) InsertTo(ctx context.Context, col *mongo.Collection) error {
+	_, err := col.InsertOne(ctx, d)
+	return err
 }
 
 // DocumentSlice represents the slice of documents.
@@ -70,8 +77,87 @@ func (d DocumentSlice) Swap(i, j int) {
 	d[i], d[j] = d[j], d[i]
 }
 
-func (d DocumentSlice) InsertTo(col *mgo.Collection) error {
-	return col.Insert((d.toInterfaceArray())...)
+// InsertTo は col に d のドキュメントを順に挿入する。途中で失敗した場合、それ以降のドキュメントは挿入しない。
+func (d DocumentSlice) InsertTo(ctx context.Context, col *mongo.Collection) error {
+	if len(d) == 0 {
+		return nil
+	}
+
+	_, err := col.InsertMany(ctx, d.toInterfaceArray())
+	return err
+}
+
+// RemoveFrom は col から d のドキュメントを _id により削除する。
+func (d DocumentSlice) RemoveFrom(ctx context.Context, col *mongo.Collection) error {
+	ids := make([]primitive.ObjectID, 0, len(d))
+	for _, doc := range d {
+		ids = append(ids, doc.ID)
+	}
+
+	_, err := col.DeleteMany(ctx, bson.M{"_id": bson.M{"$in": ids}})
+	return err
+}
+
+// removeOne は col から query に合うドキュメントを一つ削除する。存在しない場合は ErrNotFound を返す。
+func removeOne(ctx context.Context, col *mongo.Collection, query interface{}) error {
+	result, err := col.DeleteOne(ctx, query)
+	if err != nil {
+		return err
+	}
+	if result.DeletedCount == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+// setStored は d のステートメントの stored を t とする。
+func (d DocumentSlice) setStored(t time.Time) {
+	for _, doc := range d {
+		doc.Data["stored"] = t
+	}
+}
+
+// statementIDs は d のステートメントの ID を返す。
+func (d DocumentSlice) statementIDs() []string {
+	ids := make([]string, 0, len(d))
+	for _, doc := range d {
+		ids = append(ids, stringAt(doc.Data, "id"))
+	}
+
+	return ids
+}
+
+// applyVoiding は d のうち Voided となるステートメントに VoidedAt を設定する。
+// 同じバッチの voiding ステートメントにより Voided となる場合はその stored を、voided に ID が含まれる
+// (既に保存されている voiding ステートメントにより Voided となっている) 場合は自身の stored を用いる。
+// 返り値は、バッチの voiding ステートメントが Voided とする、d に含まれないステートメントの ID と、
+// Voided とする時刻である。ストレージはバッチを保存する際にこれらにも VoidedAt を設定する。
+func (d DocumentSlice) applyVoiding(voided map[string]bool) map[string]time.Time {
+	targets := make(map[string]time.Time)
+	for _, doc := range d {
+		if target, ok := voidedTarget(doc.Data); ok {
+			targets[target] = storedAt(doc.Data)
+		}
+	}
+
+	for i := range d {
+		id := stringAt(d[i].Data, "id")
+		if t, ok := targets[id]; ok {
+			d[i].VoidedAt = &t
+			delete(targets, id)
+		} else if voided[id] {
+			t := storedAt(d[i].Data)
+			d[i].VoidedAt = &t
+		}
+	}
+
+	return targets
+}
+
+// isVoidedAt はステートメントが時刻 t の時点で Voided となっているかを返す。
+func (d *Document) isVoidedAt(t time.Time) bool {
+	return d.VoidedAt != nil && !d.VoidedAt.After(t)
 }
 
 func (d DocumentSlice) Map(f func(Document) Document) {
@@ -0,0 +1,209 @@
+// Copyright 2015 realglobe, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package model
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestStates(t *testing.T) {
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			user := testUser()
+			updated := time.Now().UTC().Truncate(time.Millisecond)
+			for _, registration := range []string{"", "r1", "r2"} {
+				state := NewState(user, "app", "act", "agent", registration, "s"+registration, "text/plain", []byte("abc"), updated)
+				if err := store.SaveState(ctx, state); err != nil {
+					t.Fatal(err)
+				}
+			}
+			// 同じキーの State は置き換える
+			for _, content := range []string{"ab", "abcd"} {
+				state := NewState(user, "app", "act", "agent", "r1", "s", "text/plain", []byte(content), updated)
+				if err := store.SaveState(ctx, state); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			state, err := store.FindState(ctx, user, "app", "act", "agent", "r1", "sr1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(state.Content) != "abc" || state.ContentType != "text/plain" || !state.Updated.Equal(updated) {
+				t.Errorf("Unexpected state: %+v", state)
+			}
+			if _, err := store.FindState(ctx, user, "app", "act", "agent", "", "sr1"); err != ErrNotFound {
+				t.Errorf("Expected ErrNotFound for another registration; got %v", err)
+			}
+
+			ids, err := store.FindStateIDs(ctx, user, "app", "act", "agent", "", time.Time{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(ids) != 3 || ids[0] != "s" || ids[1] != "sr1" || ids[2] != "sr2" {
+				t.Errorf("Expected [s sr1 sr2]; got %v", ids)
+			}
+			if ids, err := store.FindStateIDs(ctx, user, "app", "act", "agent", "r1", updated); err != nil || len(ids) != 0 {
+				t.Errorf("Expected no states updated since %v; got %v (%v)", updated, ids, err)
+			}
+
+			size, err := store.RemoveStates(ctx, user, "app", "act", "agent", "r1", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, expected := size, int64(7); got != expected {
+				t.Errorf("Expected removed size %v; got %v", expected, got)
+			}
+			size, err = store.RemoveStates(ctx, user, "app", "act", "agent", "", "s")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, expected := size, int64(3); got != expected {
+				t.Errorf("Expected removed size %v; got %v", expected, got)
+			}
+			if ids, _ := store.FindStateIDs(ctx, user, "app", "act", "agent", "", time.Time{}); len(ids) != 1 || ids[0] != "sr2" {
+				t.Errorf("Expected [sr2]; got %v", ids)
+			}
+		})
+	}
+}
+
+func TestProfiles(t *testing.T) {
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			user := testUser()
+			updated := time.Now().UTC().Truncate(time.Millisecond)
+			for _, id := range []string{"p2", "p1"} {
+				if err := store.SaveActivityProfile(ctx, NewActivityProfile(user, "app", "act", id, "application/json", []byte(`{}`), updated)); err != nil {
+					t.Fatal(err)
+				}
+				if err := store.SaveAgentProfile(ctx, NewAgentProfile(user, "app", "agent", id, "application/json", []byte(`{}`), updated)); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			ids, err := store.FindActivityProfileIDs(ctx, user, "app", "act", time.Time{})
+			if err != nil || len(ids) != 2 || ids[0] != "p1" {
+				t.Errorf("Expected [p1 p2]; got %v (%v)", ids, err)
+			}
+			ids, err = store.FindAgentProfileIDs(ctx, user, "app", "agent", time.Time{})
+			if err != nil || len(ids) != 2 || ids[0] != "p1" {
+				t.Errorf("Expected [p1 p2]; got %v (%v)", ids, err)
+			}
+			if profile, err := store.FindAgentProfile(ctx, user, "app", "agent", "p2"); err != nil || string(profile.Content) != `{}` {
+				t.Errorf("Unexpected agent profile: %+v (%v)", profile, err)
+			}
+
+			if err := store.RemoveActivityProfile(ctx, user, "app", "act", "p1"); err != nil {
+				t.Fatal(err)
+			}
+			if err := store.RemoveActivityProfile(ctx, user, "app", "act", "p1"); err != ErrNotFound {
+				t.Errorf("Expected ErrNotFound; got %v", err)
+			}
+			if _, err := store.FindActivityProfile(ctx, user, "app", "act", "p1"); err != ErrNotFound {
+				t.Errorf("Expected ErrNotFound; got %v", err)
+			}
+			if err := store.RemoveAgentProfile(ctx, user, "app", "agent", "p1"); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := store.SaveXAPIProfile(ctx, NewXAPIProfile(user, "app", "x2", []byte(`{"v": 1}`), updated)); err != nil {
+				t.Fatal(err)
+			}
+			if err := store.SaveXAPIProfile(ctx, NewXAPIProfile(user, "app", "x1", []byte(`{}`), updated)); err != nil {
+				t.Fatal(err)
+			}
+			profiles, err := store.FindXAPIProfiles(ctx, user, "app")
+			if err != nil || len(profiles) != 2 || profiles[0].ProfileID != "x1" || string(profiles[1].Content) != `{"v": 1}` {
+				t.Errorf("Unexpected xAPI Profiles: %+v (%v)", profiles, err)
+			}
+			if err := store.RemoveXAPIProfile(ctx, user, "app", "x1"); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := store.FindXAPIProfile(ctx, user, "app", "x1"); err != ErrNotFound {
+				t.Errorf("Expected ErrNotFound; got %v", err)
+			}
+		})
+	}
+}
+
+// TestCMI5InCommit は InsertStatements の commit から cmi5 の状態を読み書きできることを確認する。
+func TestCMI5InCommit(t *testing.T) {
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			user := testUser()
+			updated := time.Now().UTC().Truncate(time.Millisecond)
+			doc := NewDocument("1.0.3", user, "app", time.Now(), testStatement("c1", nil))
+
+			err := store.InsertStatements(ctx, user, "app", DocumentSlice{*doc}, 1, func(ctx context.Context) error {
+				if err := store.SaveCMI5Session(ctx, NewCMI5Session(user, "app", "reg", "session", "Normal", "launched", updated)); err != nil {
+					return err
+				}
+				if _, err := store.FindCMI5Session(ctx, user, "app", "reg", "session"); err != nil {
+					return err
+				}
+				registration := NewCMI5Registration(user, "app", "reg", updated)
+				registration.Passed = true
+				return store.SaveCMI5Registration(ctx, registration)
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			sessions, err := store.FindCMI5Sessions(ctx, user, "app", "reg")
+			if err != nil || len(sessions) != 1 || sessions[0].State != "launched" {
+				t.Errorf("Unexpected cmi5 sessions: %+v (%v)", sessions, err)
+			}
+			registration, err := store.FindCMI5Registration(ctx, user, "app", "reg")
+			if err != nil || !registration.Passed || registration.Completed {
+				t.Errorf("Unexpected cmi5 registration: %+v (%v)", registration, err)
+			}
+
+			// commit が失敗した場合はステートメントも保存しない
+			doc = NewDocument("1.0.3", user, "app", time.Now(), testStatement("c2", nil))
+			err = store.InsertStatements(ctx, user, "app", DocumentSlice{*doc}, 1, func(ctx context.Context) error {
+				return ErrNotFound
+			})
+			if err != ErrNotFound {
+				t.Errorf("Expected the error of commit; got %v", err)
+			}
+			if _, err := store.FindStatement(ctx, user, "app", "c2"); err != ErrNotFound {
+				t.Errorf("Expected ErrNotFound; got %v", err)
+			}
+		})
+	}
+}
+
+func TestAddQuotaUsage(t *testing.T) {
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			user := testUser()
+			for _, amount := range []int64{10, -3, 0} {
+				if err := store.AddQuotaUsage(ctx, user, amount); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if usage, err := store.QuotaUsage(ctx, user); err != nil || usage != 7 {
+				t.Errorf("Expected usage 7; got %v (%v)", usage, err)
+			}
+		})
+	}
+}
@@ -15,33 +15,248 @@
 package model
 
 import (
-	"gopkg.in/mgo.v2"
+	"context"
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/realglobe-Inc/edo-xrs/app/miscs"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsoncodec"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
-func InitDB(db *mgo.Database) {
-	fatalOnErr(ensureUniqueIndexOn(db.C("quota"), []string{"user"}))
-	fatalOnErr(ensureIndexOn(db.C("statement"), []string{"version", "user", "app"}))
-	fatalOnErr(ensureUniqueIndexOn(db.C("statement"), []string{"version", "user", "app", "data.id"}))
+// registry は埋め込みドキュメントを map[string]interface{} として、配列を []interface{} として、
+// 日時を time.Time として読むためのレジストリである。ステートメントの内容はこれらの型であることを前提とする。
+var registry = newRegistry()
+
+func newRegistry() *bsoncodec.Registry {
+	r := bson.NewRegistry()
+	r.RegisterTypeMapEntry(bson.TypeEmbeddedDocument, reflect.TypeOf(map[string]interface{}(nil)))
+	r.RegisterTypeMapEntry(bson.TypeArray, reflect.TypeOf([]interface{}(nil)))
+	r.RegisterTypeMapEntry(bson.TypeDateTime, reflect.TypeOf(time.Time{}))
+
+	return r
+}
+
+// Connect は url の MongoDB に接続し、接続できることを確認したクライアントを返す。
+// 読み出した日時はローカルのタイムゾーンとする。
+func Connect(ctx context.Context, url string) (*mongo.Client, error) {
+	client, err := mongo.Connect(ctx, options.Client().
+		ApplyURI(url).
+		SetRegistry(registry).
+		SetBSONOptions(&options.BSONOptions{UseLocalTimeZone: true}))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := client.Ping(ctx, nil); err != nil {
+		client.Disconnect(ctx)
+		return nil, err
+	}
+
+	return client, nil
+}
+
+// InitDB は各コレクションのインデックスを作成する。
+// dropDups は MongoDB 3.0 以降では無視されるため指定しない。
+func InitDB(ctx context.Context, db *mongo.Database) {
+	fatalOnErr(ensureUniqueIndexOn(ctx, db.Collection("quota"), []string{"user"}))
+	// ステートメントは xAPI のバージョンによらず user, app, id により一意に定まる
+	fatalOnErr(ensureIndexOn(ctx, db.Collection("statement"), []string{"user", "app"}))
+	fatalOnErr(dropIndexIfExists(ctx, db.Collection("statement"), []string{"version", "user", "app"}))
+	fatalOnErr(dropIndexIfExists(ctx, db.Collection("statement"), []string{"version", "user", "app", "data.id"}))
+	fatalOnErr(moveDuplicatedStatements(ctx, db))
+	fatalOnErr(ensureUniqueIndexOn(ctx, db.Collection("statement"), []string{"user", "app", "data.id"}))
+	fatalOnErr(markStoredVoidedStatements(ctx, db.Collection("statement")))
+	fatalOnErr(ensureUniqueIndexOn(ctx, db.Collection("state"), []string{"user", "app", "activityId", "agent", "registration", "stateId"}))
+	fatalOnErr(ensureUniqueIndexOn(ctx, db.Collection("activityProfile"), []string{"user", "app", "activityId", "profileId"}))
+	fatalOnErr(ensureUniqueIndexOn(ctx, db.Collection("agentProfile"), []string{"user", "app", "agent", "profileId"}))
+	fatalOnErr(ensureUniqueIndexOn(ctx, db.Collection("xapiProfile"), []string{"user", "app", "profileId"}))
+	fatalOnErr(ensureUniqueIndexOn(ctx, db.Collection("cmi5Session"), []string{"user", "app", "registration", "sessionId"}))
+	fatalOnErr(ensureUniqueIndexOn(ctx, db.Collection("cmi5Registration"), []string{"user", "app", "registration"}))
+
+	// more URL は有効期間が過ぎると削除する
+	if expiration := miscs.GlobalConfig.Global.MoreExpiration; expiration > 0 {
+		fatalOnErr(ensureTTLIndexOn(ctx, db.Collection("more"), "created", time.Duration(expiration)*time.Second))
+	}
+}
+
+// duplicatedStatementCollection は moveDuplicatedStatements が重複したステートメントを移すコレクションである。
+const duplicatedStatementCollection = "statementDuplicate"
+
+// moveDuplicatedStatements は user, app, id が同じステートメントのうち最初に保存されたものを残し、
+// 他を duplicatedStatementCollection に移す。以前のバージョンでは xAPI のバージョンが異なれば同じ ID の
+// ステートメントを保存できたため、user, app, id の一意のインデックスを作成する前に行う。
+// インデックスが既にある場合は重複が無いため何もしない。
+func moveDuplicatedStatements(ctx context.Context, db *mongo.Database) error {
+	col := db.Collection("statement")
+	exists, err := hasUniqueIndex(ctx, col, []string{"user", "app", "data.id"})
+	if err != nil || exists {
+		return err
+	}
+
+	cursor, err := col.Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$group", Value: bson.M{
+			"_id":   bson.M{"user": "$user", "app": "$app", "id": "$data.id"},
+			"count": bson.M{"$sum": 1},
+		}}},
+		{{Key: "$match", Value: bson.M{"count": bson.M{"$gt": 1}}}},
+	}, options.Aggregate().SetAllowDiskUse(true))
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+
+	dst := db.Collection(duplicatedStatementCollection)
+	for cursor.Next(ctx) {
+		var group struct {
+			Key struct {
+				User string `bson:"user"`
+				App  string `bson:"app"`
+				ID   string `bson:"id"`
+			} `bson:"_id"`
+		}
+		if err := cursor.Decode(&group); err != nil {
+			return err
+		}
+
+		// _id の順に並べ、最初に保存されたもの以外を移す
+		docs, err := col.Find(ctx, bson.M{"user": group.Key.User, "app": group.Key.App, "data.id": group.Key.ID},
+			options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}).SetSkip(1))
+		if err != nil {
+			return err
+		}
+		var duplicates []bson.Raw
+		if err := docs.All(ctx, &duplicates); err != nil {
+			return err
+		}
+		for _, doc := range duplicates {
+			if _, err := dst.InsertOne(ctx, doc); err != nil && !mongo.IsDuplicateKeyError(err) {
+				return err
+			}
+			if _, err := col.DeleteOne(ctx, bson.M{"_id": doc.Lookup("_id")}); err != nil {
+				return err
+			}
+		}
+		logger.Warn(fmt.Sprintf("Moved %d statements duplicating id %s of user %s, app %s to collection %s",
+			len(duplicates), group.Key.ID, group.Key.User, group.Key.App, duplicatedStatementCollection))
+	}
+
+	return cursor.Err()
 }
 
-func ensureIndexOn(coll *mgo.Collection, keys []string) error {
-	return coll.EnsureIndex(mgo.Index{
-		Key:        keys,
-		Unique:     false,
-		DropDups:   true,
-		Background: false,
-		Sparse:     false,
+// hasUniqueIndex は keys の各フィールドの昇順の一意のインデックスがあるかを返す。
+func hasUniqueIndex(ctx context.Context, col *mongo.Collection, keys []string) (bool, error) {
+	specs, err := col.Indexes().ListSpecifications(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	for _, spec := range specs {
+		if hasIndexKeys(spec.KeysDocument, keys) && spec.Unique != nil && *spec.Unique {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// markStoredVoidedStatements は voidedAt を持たない、以前のバージョンで保存したステートメントのうち、
+// 保存されている voiding ステートメントにより Voided となっているものに voidedAt を設定する。
+func markStoredVoidedStatements(ctx context.Context, col *mongo.Collection) error {
+	cursor, err := col.Find(ctx, bson.M{
+		"data.verb.id":           miscs.GlobalConfig.Global.VoidedStatementID,
+		"data.object.objectType": "StatementRef",
+	}, options.Find().SetSort(bson.M{"data.stored": 1}))
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		var doc Document
+		if err := cursor.Decode(&doc); err != nil {
+			return err
+		}
+		target, ok := voidedTarget(doc.Data)
+		if !ok {
+			continue
+		}
+		if err := markVoidedStatements(ctx, col, doc.User, doc.App, map[string]time.Time{target: storedAt(doc.Data)}); err != nil {
+			return err
+		}
+	}
+
+	return cursor.Err()
+}
+
+// indexKeys は keys の各フィールドの昇順のインデックスのキーを返す。
+func indexKeys(keys []string) bson.D {
+	d := make(bson.D, 0, len(keys))
+	for _, key := range keys {
+		d = append(d, bson.E{Key: key, Value: 1})
+	}
+
+	return d
+}
+
+func ensureIndexOn(ctx context.Context, col *mongo.Collection, keys []string) error {
+	_, err := col.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    indexKeys(keys),
+		Options: options.Index().SetUnique(false).SetSparse(false),
 	})
+	return err
 }
 
-func ensureUniqueIndexOn(coll *mgo.Collection, keys []string) error {
-	return coll.EnsureIndex(mgo.Index{
-		Key:        keys,
-		Unique:     true,
-		DropDups:   true,
-		Background: false,
-		Sparse:     false,
+func ensureUniqueIndexOn(ctx context.Context, col *mongo.Collection, keys []string) error {
+	_, err := col.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    indexKeys(keys),
+		Options: options.Index().SetUnique(true).SetSparse(false),
 	})
+	return err
+}
+
+func ensureTTLIndexOn(ctx context.Context, col *mongo.Collection, key string, expireAfter time.Duration) error {
+	_, err := col.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    indexKeys([]string{key}),
+		Options: options.Index().SetUnique(false).SetSparse(false).SetExpireAfterSeconds(int32(expireAfter / time.Second)),
+	})
+	return err
+}
+
+// dropIndexIfExists は以前のバージョンで作成したインデックスを削除する。
+func dropIndexIfExists(ctx context.Context, col *mongo.Collection, keys []string) error {
+	specs, err := col.Indexes().ListSpecifications(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, spec := range specs {
+		if hasIndexKeys(spec.KeysDocument, keys) {
+			_, err := col.Indexes().DropOne(ctx, spec.Name)
+			return err
+		}
+	}
+
+	return nil
+}
+
+// hasIndexKeys はインデックスのキー doc が、keys の各フィールドの昇順であるかを返す。
+func hasIndexKeys(doc bson.Raw, keys []string) bool {
+	elements, err := doc.Elements()
+	if err != nil || len(elements) != len(keys) {
+		return false
+	}
+
+	for i, e := range elements {
+		if n, ok := e.Value().AsInt64OK(); e.Key() != keys[i] || !ok || n != 1 {
+			return false
+		}
+	}
+
+	return true
 }
 
 func fatalOnErr(err error) {
@@ -0,0 +1,379 @@
+// Copyright 2015 realglobe, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package model
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"time"
+)
+
+// documentKey はドキュメントを一意に定めるフィールドから、MemoryStore の索引のキーを作る。
+func documentKey(fields ...string) string {
+	return strings.Join(fields, "\x00")
+}
+
+// copyBytes は保存したドキュメントの内容が呼び出し元と共有されないよう、b を複製する。
+func copyBytes(b []byte) []byte {
+	return append([]byte(nil), b...)
+}
+
+// SaveState は DocumentStore.SaveState を実装する。
+func (m *MemoryStore) SaveState(ctx context.Context, state *State) error {
+	m.docMu.Lock()
+	defer m.docMu.Unlock()
+
+	key := documentKey(state.User, state.App, state.ActivityID, state.Agent, state.Registration, state.StateID)
+	saved := *state
+	if old, ok := m.states[key]; ok {
+		saved.ID = old.ID
+	}
+	saved.Content = copyBytes(state.Content)
+	m.states[key] = saved
+
+	return nil
+}
+
+// FindState は DocumentStore.FindState を実装する。
+func (m *MemoryStore) FindState(ctx context.Context, user, app, activityID, agent, registration, stateID string) (*State, error) {
+	m.docMu.RLock()
+	defer m.docMu.RUnlock()
+
+	state, ok := m.states[documentKey(user, app, activityID, agent, registration, stateID)]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	state.Content = copyBytes(state.Content)
+
+	return &state, nil
+}
+
+// matchesStateSet は State が stateSetQuery と同じ条件に合うかを返す。
+func (s *State) matchesStateSet(user, app, activityID, agent, registration string) bool {
+	return s.User == user && s.App == app && s.ActivityID == activityID && s.Agent == agent &&
+		(len(registration) == 0 || s.Registration == registration)
+}
+
+// FindStateIDs は DocumentStore.FindStateIDs を実装する。
+func (m *MemoryStore) FindStateIDs(ctx context.Context, user, app, activityID, agent, registration string, since time.Time) ([]string, error) {
+	m.docMu.RLock()
+	defer m.docMu.RUnlock()
+
+	seen := make(map[string]bool)
+	ids := []string{}
+	for _, s := range m.states {
+		if !s.matchesStateSet(user, app, activityID, agent, registration) || !s.Updated.After(since) || seen[s.StateID] {
+			continue
+		}
+		seen[s.StateID] = true
+		ids = append(ids, s.StateID)
+	}
+	sort.Strings(ids)
+
+	return ids, nil
+}
+
+// RemoveStates は DocumentStore.RemoveStates を実装する。
+func (m *MemoryStore) RemoveStates(ctx context.Context, user, app, activityID, agent, registration, stateID string) (int64, error) {
+	m.docMu.Lock()
+	defer m.docMu.Unlock()
+
+	var size int64
+	for key, s := range m.states {
+		if len(stateID) > 0 {
+			if s.StateID != stateID || s.Registration != registration {
+				continue
+			}
+		}
+		if !s.matchesStateSet(user, app, activityID, agent, registration) {
+			continue
+		}
+		delete(m.states, key)
+		size += int64(len(s.Content))
+	}
+
+	return size, nil
+}
+
+// SaveActivityProfile は DocumentStore.SaveActivityProfile を実装する。
+func (m *MemoryStore) SaveActivityProfile(ctx context.Context, profile *ActivityProfile) error {
+	m.docMu.Lock()
+	defer m.docMu.Unlock()
+
+	key := documentKey(profile.User, profile.App, profile.ActivityID, profile.ProfileID)
+	saved := *profile
+	if old, ok := m.activityProfiles[key]; ok {
+		saved.ID = old.ID
+	}
+	saved.Content = copyBytes(profile.Content)
+	m.activityProfiles[key] = saved
+
+	return nil
+}
+
+// FindActivityProfile は DocumentStore.FindActivityProfile を実装する。
+func (m *MemoryStore) FindActivityProfile(ctx context.Context, user, app, activityID, profileID string) (*ActivityProfile, error) {
+	m.docMu.RLock()
+	defer m.docMu.RUnlock()
+
+	profile, ok := m.activityProfiles[documentKey(user, app, activityID, profileID)]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	profile.Content = copyBytes(profile.Content)
+
+	return &profile, nil
+}
+
+// FindActivityProfileIDs は DocumentStore.FindActivityProfileIDs を実装する。
+func (m *MemoryStore) FindActivityProfileIDs(ctx context.Context, user, app, activityID string, since time.Time) ([]string, error) {
+	m.docMu.RLock()
+	defer m.docMu.RUnlock()
+
+	ids := []string{}
+	for _, p := range m.activityProfiles {
+		if p.User == user && p.App == app && p.ActivityID == activityID && p.Updated.After(since) {
+			ids = append(ids, p.ProfileID)
+		}
+	}
+	sort.Strings(ids)
+
+	return ids, nil
+}
+
+// RemoveActivityProfile は DocumentStore.RemoveActivityProfile を実装する。
+func (m *MemoryStore) RemoveActivityProfile(ctx context.Context, user, app, activityID, profileID string) error {
+	m.docMu.Lock()
+	defer m.docMu.Unlock()
+
+	key := documentKey(user, app, activityID, profileID)
+	if _, ok := m.activityProfiles[key]; !ok {
+		return ErrNotFound
+	}
+	delete(m.activityProfiles, key)
+
+	return nil
+}
+
+// SaveAgentProfile は DocumentStore.SaveAgentProfile を実装する。
+func (m *MemoryStore) SaveAgentProfile(ctx context.Context, profile *AgentProfile) error {
+	m.docMu.Lock()
+	defer m.docMu.Unlock()
+
+	key := documentKey(profile.User, profile.App, profile.Agent, profile.ProfileID)
+	saved := *profile
+	if old, ok := m.agentProfiles[key]; ok {
+		saved.ID = old.ID
+	}
+	saved.Content = copyBytes(profile.Content)
+	m.agentProfiles[key] = saved
+
+	return nil
+}
+
+// FindAgentProfile は DocumentStore.FindAgentProfile を実装する。
+func (m *MemoryStore) FindAgentProfile(ctx context.Context, user, app, agent, profileID string) (*AgentProfile, error) {
+	m.docMu.RLock()
+	defer m.docMu.RUnlock()
+
+	profile, ok := m.agentProfiles[documentKey(user, app, agent, profileID)]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	profile.Content = copyBytes(profile.Content)
+
+	return &profile, nil
+}
+
+// FindAgentProfileIDs は DocumentStore.FindAgentProfileIDs を実装する。
+func (m *MemoryStore) FindAgentProfileIDs(ctx context.Context, user, app, agent string, since time.Time) ([]string, error) {
+	m.docMu.RLock()
+	defer m.docMu.RUnlock()
+
+	ids := []string{}
+	for _, p := range m.agentProfiles {
+		if p.User == user && p.App == app && p.Agent == agent && p.Updated.After(since) {
+			ids = append(ids, p.ProfileID)
+		}
+	}
+	sort.Strings(ids)
+
+	return ids, nil
+}
+
+// RemoveAgentProfile は DocumentStore.RemoveAgentProfile を実装する。
+func (m *MemoryStore) RemoveAgentProfile(ctx context.Context, user, app, agent, profileID string) error {
+	m.docMu.Lock()
+	defer m.docMu.Unlock()
+
+	key := documentKey(user, app, agent, profileID)
+	if _, ok := m.agentProfiles[key]; !ok {
+		return ErrNotFound
+	}
+	delete(m.agentProfiles, key)
+
+	return nil
+}
+
+// SaveXAPIProfile は DocumentStore.SaveXAPIProfile を実装する。
+func (m *MemoryStore) SaveXAPIProfile(ctx context.Context, profile *XAPIProfile) error {
+	m.docMu.Lock()
+	defer m.docMu.Unlock()
+
+	key := documentKey(profile.User, profile.App, profile.ProfileID)
+	saved := *profile
+	if old, ok := m.xapiProfiles[key]; ok {
+		saved.ID = old.ID
+	}
+	saved.Content = copyBytes(profile.Content)
+	m.xapiProfiles[key] = saved
+
+	return nil
+}
+
+// FindXAPIProfile は DocumentStore.FindXAPIProfile を実装する。
+func (m *MemoryStore) FindXAPIProfile(ctx context.Context, user, app, profileID string) (*XAPIProfile, error) {
+	m.docMu.RLock()
+	defer m.docMu.RUnlock()
+
+	profile, ok := m.xapiProfiles[documentKey(user, app, profileID)]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	profile.Content = copyBytes(profile.Content)
+
+	return &profile, nil
+}
+
+// FindXAPIProfiles は DocumentStore.FindXAPIProfiles を実装する。
+func (m *MemoryStore) FindXAPIProfiles(ctx context.Context, user, app string) ([]XAPIProfile, error) {
+	m.docMu.RLock()
+	defer m.docMu.RUnlock()
+
+	var profiles []XAPIProfile
+	for _, p := range m.xapiProfiles {
+		if p.User == user && p.App == app {
+			p.Content = copyBytes(p.Content)
+			profiles = append(profiles, p)
+		}
+	}
+	sort.Slice(profiles, func(i, j int) bool {
+		return profiles[i].ProfileID < profiles[j].ProfileID
+	})
+
+	return profiles, nil
+}
+
+// RemoveXAPIProfile は DocumentStore.RemoveXAPIProfile を実装する。
+func (m *MemoryStore) RemoveXAPIProfile(ctx context.Context, user, app, profileID string) error {
+	m.docMu.Lock()
+	defer m.docMu.Unlock()
+
+	key := documentKey(user, app, profileID)
+	if _, ok := m.xapiProfiles[key]; !ok {
+		return ErrNotFound
+	}
+	delete(m.xapiProfiles, key)
+
+	return nil
+}
+
+// SaveCMI5Session は DocumentStore.SaveCMI5Session を実装する。
+func (m *MemoryStore) SaveCMI5Session(ctx context.Context, session *CMI5Session) error {
+	m.docMu.Lock()
+	defer m.docMu.Unlock()
+
+	key := documentKey(session.User, session.App, session.Registration, session.SessionID)
+	saved := *session
+	if old, ok := m.cmi5Sessions[key]; ok {
+		saved.ID = old.ID
+	}
+	m.cmi5Sessions[key] = saved
+
+	return nil
+}
+
+// FindCMI5Session は DocumentStore.FindCMI5Session を実装する。
+func (m *MemoryStore) FindCMI5Session(ctx context.Context, user, app, registration, sessionID string) (*CMI5Session, error) {
+	m.docMu.RLock()
+	defer m.docMu.RUnlock()
+
+	session, ok := m.cmi5Sessions[documentKey(user, app, registration, sessionID)]
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	return &session, nil
+}
+
+// FindCMI5Sessions は DocumentStore.FindCMI5Sessions を実装する。
+func (m *MemoryStore) FindCMI5Sessions(ctx context.Context, user, app, registration string) ([]CMI5Session, error) {
+	m.docMu.RLock()
+	defer m.docMu.RUnlock()
+
+	var sessions []CMI5Session
+	for _, s := range m.cmi5Sessions {
+		if s.User == user && s.App == app && s.Registration == registration {
+			sessions = append(sessions, s)
+		}
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		if sessions[i].Updated.Equal(sessions[j].Updated) {
+			return sessions[i].SessionID < sessions[j].SessionID
+		}
+		return sessions[i].Updated.Before(sessions[j].Updated)
+	})
+
+	return sessions, nil
+}
+
+// SaveCMI5Registration は DocumentStore.SaveCMI5Registration を実装する。
+func (m *MemoryStore) SaveCMI5Registration(ctx context.Context, registration *CMI5Registration) error {
+	m.docMu.Lock()
+	defer m.docMu.Unlock()
+
+	key := documentKey(registration.User, registration.App, registration.Registration)
+	saved := *registration
+	if old, ok := m.cmi5Registrations[key]; ok {
+		saved.ID = old.ID
+	}
+	m.cmi5Registrations[key] = saved
+
+	return nil
+}
+
+// FindCMI5Registration は DocumentStore.FindCMI5Registration を実装する。
+func (m *MemoryStore) FindCMI5Registration(ctx context.Context, user, app, registration string) (*CMI5Registration, error) {
+	m.docMu.RLock()
+	defer m.docMu.RUnlock()
+
+	r, ok := m.cmi5Registrations[documentKey(user, app, registration)]
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	return &r, nil
+}
+
+// AddQuotaUsage は DocumentStore.AddQuotaUsage を実装する。
+func (m *MemoryStore) AddQuotaUsage(ctx context.Context, user string, amount int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.usage[user] += amount
+
+	return nil
+}
@@ -0,0 +1,694 @@
+// Copyright 2015 realglobe, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package model
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/realglobe-Inc/edo-xrs/app/miscs"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// MemoryStore はプロセスのメモリ上にステートメントとドキュメントを保存する Store である。
+// データベースを用意せずにテストやデモを行うためのものであり、プロセスの終了時に内容は失われる。
+// 複数の goroutine から同時に用いることができる。
+type MemoryStore struct {
+	mu          sync.RWMutex
+	statements  []*Document          // 保存された順
+	ids         map[string]*Document // statementKey による索引
+	voided      map[string]bool      // voiding ステートメントが Voided とするステートメントの statementKey
+	usage       map[string]int64     // ユーザーごとのディスク使用量
+	cursors     map[primitive.ObjectID]*MoreCursor
+	attachments []*memoryAttachment // 保存された順
+	window      insertWindow
+
+	// ドキュメントは InsertStatements の commit から保存できるよう、mu とは別の docMu により保護する
+	docMu             sync.RWMutex
+	states            map[string]State
+	activityProfiles  map[string]ActivityProfile
+	agentProfiles     map[string]AgentProfile
+	xapiProfiles      map[string]XAPIProfile
+	cmi5Sessions      map[string]CMI5Session
+	cmi5Registrations map[string]CMI5Registration
+}
+
+type memoryAttachment struct {
+	id          primitive.ObjectID
+	sha2        string
+	contentType string
+	content     []byte
+}
+
+// NewMemoryStore は空の MemoryStore を返す。
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		ids:     make(map[string]*Document),
+		voided:  make(map[string]bool),
+		usage:   make(map[string]int64),
+		cursors: make(map[primitive.ObjectID]*MoreCursor),
+
+		states:            make(map[string]State),
+		activityProfiles:  make(map[string]ActivityProfile),
+		agentProfiles:     make(map[string]AgentProfile),
+		xapiProfiles:      make(map[string]XAPIProfile),
+		cmi5Sessions:      make(map[string]CMI5Session),
+		cmi5Registrations: make(map[string]CMI5Registration),
+	}
+}
+
+// statementKey はステートメントを一意に定める user, app, id の組を表す文字列を返す。
+func statementKey(user, app, id string) string {
+	return user + "\x00" + app + "\x00" + id
+}
+
+// InsertStatements は StatementStore.InsertStatements を実装する。
+// commit はバッチを保存する前に、他の操作を待たせた状態で呼ぶ。
+func (m *MemoryStore) InsertStatements(ctx context.Context, user, app string, docs DocumentSlice, usage int64, commit func(ctx context.Context) error) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	seen := make(map[string]bool, len(docs))
+	for _, doc := range docs {
+		key := statementKey(user, app, stringAt(doc.Data, "id"))
+		if _, ok := m.ids[key]; ok || seen[key] {
+			return ErrDuplicateStatement
+		}
+		seen[key] = true
+	}
+
+	if !(&Quota{User: user, Usage: m.usage[user]}).Check() {
+		return ErrQuotaExceeded
+	}
+
+	if commit != nil {
+		if err := commit(ctx); err != nil {
+			return err
+		}
+	}
+
+	stored, done := m.window.begin()
+	defer done()
+
+	batch := make(DocumentSlice, 0, len(docs))
+	voided := make(map[string]bool)
+	for _, doc := range docs {
+		id := stringAt(doc.Data, "id")
+		if m.voided[statementKey(user, app, id)] {
+			voided[id] = true
+		}
+		batch = append(batch, doc)
+	}
+	batch.setStored(stored)
+	targets := batch.applyVoiding(voided)
+
+	for _, doc := range batch {
+		stored := copyDocument(&doc)
+		stored.User, stored.App = user, app
+		m.statements = append(m.statements, stored)
+		m.ids[statementKey(user, app, stringAt(doc.Data, "id"))] = stored
+
+		if target, ok := voidedTarget(doc.Data); ok {
+			m.voided[statementKey(user, app, target)] = true
+		}
+	}
+	for target, t := range targets {
+		if doc, ok := m.ids[statementKey(user, app, target)]; ok && doc.VoidedAt == nil {
+			voidedAt := t
+			doc.VoidedAt = &voidedAt
+		}
+	}
+	m.usage[user] += usage
+
+	return nil
+}
+
+// FindStatement は StatementStore.FindStatement を実装する。
+func (m *MemoryStore) FindStatement(ctx context.Context, user, app, id string) (*Document, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	doc, ok := m.ids[statementKey(user, app, id)]
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	return copyDocument(doc), nil
+}
+
+// FindStatements は StatementStore.FindStatements を実装する。
+func (m *MemoryStore) FindStatements(ctx context.Context, user, app string, ids []string) (DocumentSlice, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var docs DocumentSlice
+	for _, id := range ids {
+		if doc, ok := m.ids[statementKey(user, app, id)]; ok {
+			docs = append(docs, *copyDocument(doc))
+		}
+	}
+
+	return docs, nil
+}
+
+// IsVoided は StatementStore.IsVoided を実装する。
+func (m *MemoryStore) IsVoided(ctx context.Context, user, app, id string) (bool, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return m.voided[statementKey(user, app, id)], nil
+}
+
+// QueryStatements は StatementStore.QueryStatements を実装する。
+func (m *MemoryStore) QueryStatements(ctx context.Context, user, app string, filter *StatementFilter) (DocumentSlice, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	// filter.Snapshot までに保存されたステートメント
+	var visible []*Document
+	for _, doc := range m.statements {
+		if doc.User == user && doc.App == app && !storedAt(doc.Data).After(filter.Snapshot) {
+			visible = append(visible, doc)
+		}
+	}
+
+	// 内容に対する条件に合うステートメントと、それを StatementRef により (間接的に) 参照するステートメント。
+	// 条件が無い場合は nil とする
+	var matched map[string]bool
+	if hasContentFilter(filter) {
+		matched = make(map[string]bool)
+		for _, doc := range visible {
+			if matchesStatementFilter(doc.Data, filter) {
+				matched[stringAt(doc.Data, "id")] = true
+			}
+		}
+
+		for added := true; added; {
+			added = false
+			for _, doc := range visible {
+				id := stringAt(doc.Data, "id")
+				if target, ok := statementRefTarget(doc.Data); ok && matched[target] && !matched[id] {
+					matched[id] = true
+					added = true
+				}
+			}
+		}
+	}
+
+	var docs DocumentSlice
+	for _, doc := range visible {
+		// Voided となったステートメントは含めない (Experience API, Section 2.5 を参照)
+		if matched != nil && !matched[stringAt(doc.Data, "id")] || doc.isVoidedAt(filter.Snapshot) {
+			continue
+		}
+		if !filter.Since.IsZero() && !doc.Timestamp.After(filter.Since) {
+			continue
+		}
+		if !filter.Until.IsZero() && !doc.Timestamp.Before(filter.Until) {
+			continue
+		}
+		if filter.Cursor != nil && !isAfterCursor(doc, filter.Cursor, filter.Ascending) {
+			continue
+		}
+
+		docs = append(docs, *copyDocument(doc))
+	}
+
+	sort.Sort(statementOrder{docs, filter.Ascending})
+	if filter.Limit > 0 && len(docs) > filter.Limit {
+		docs = docs[:filter.Limit]
+	}
+
+	return docs, nil
+}
+
+// FindActivityDefinitions は StatementStore.FindActivityDefinitions を実装する。
+func (m *MemoryStore) FindActivityDefinitions(ctx context.Context, user, app, activityID string) ([]map[string]interface{}, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var docs []*Document
+	for _, doc := range m.statements {
+		if doc.User != user || doc.App != app {
+			continue
+		}
+		object := mapAt(doc.Data, "object")
+		if objectType, ok := object["objectType"]; ok && objectType != "Activity" {
+			continue
+		}
+		if object["id"] != activityID {
+			continue
+		}
+		if _, ok := object["definition"].(map[string]interface{}); ok {
+			docs = append(docs, doc)
+		}
+	}
+
+	// 新しく保存されたものから順に並べる
+	sort.Stable(byStoredDesc(docs))
+
+	definitions := make([]map[string]interface{}, 0, len(docs))
+	for _, doc := range docs {
+		definition := mapAt(doc.Data, "object", "definition")
+		definitions = append(definitions, copyValue(definition).(map[string]interface{}))
+	}
+
+	return definitions, nil
+}
+
+// FindAgentNames は StatementStore.FindAgentNames を実装する。
+func (m *MemoryStore) FindAgentNames(ctx context.Context, user, app string, agent map[string]interface{}) ([]string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	names := make(map[string]bool)
+	for _, doc := range m.statements {
+		if doc.User != user || doc.App != app || doc.VoidedAt != nil {
+			continue
+		}
+		agentNamesOf(names, agent, agentCandidates(doc.Data, true))
+	}
+
+	return sortedNames(names), nil
+}
+
+// QuotaUsage は StatementStore.QuotaUsage を実装する。
+func (m *MemoryStore) QuotaUsage(ctx context.Context, user string) (int64, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return m.usage[user], nil
+}
+
+// ConsistentThrough は StatementStore.ConsistentThrough を実装する。
+// 保存したステートメントは即座に検索の対象となるため、この後に保存するバッチの stored より前の時刻を返す。
+func (m *MemoryStore) ConsistentThrough(ctx context.Context) time.Time {
+	return m.window.through(time.Now())
+}
+
+// InsertMoreCursor は StatementStore.InsertMoreCursor を実装する。
+func (m *MemoryStore) InsertMoreCursor(ctx context.Context, cursor *MoreCursor) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	c := *cursor
+	m.cursors[c.ID] = &c
+
+	return nil
+}
+
+// FindMoreCursor は StatementStore.FindMoreCursor を実装する。
+func (m *MemoryStore) FindMoreCursor(ctx context.Context, user, app, id string) (*MoreCursor, error) {
+	oid, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, ErrNotFound
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	cursor, ok := m.cursors[oid]
+	if !ok || cursor.User != user || cursor.App != app {
+		return nil, ErrNotFound
+	}
+	c := *cursor
+
+	return &c, nil
+}
+
+// PutAttachment は StatementStore.PutAttachment を実装する。
+func (m *MemoryStore) PutAttachment(ctx context.Context, sha2, contentType, encoding string, r io.Reader) (interface{}, error) {
+	content, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	attachment := &memoryAttachment{primitive.NewObjectID(), sha2, contentType, content}
+	m.attachments = append(m.attachments, attachment)
+
+	return attachment.id, nil
+}
+
+// OpenAttachment は StatementStore.OpenAttachment を実装する。
+// 同じ sha2 値のファイルが複数ある場合は、最も新しく保存されたものを開く。
+func (m *MemoryStore) OpenAttachment(ctx context.Context, sha2 string) (*Attachment, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for i := len(m.attachments) - 1; i >= 0; i-- {
+		if a := m.attachments[i]; a.sha2 == sha2 {
+			return &Attachment{ioutil.NopCloser(bytes.NewReader(a.content)), a.contentType}, nil
+		}
+	}
+
+	return nil, ErrNotFound
+}
+
+// RemoveAttachment は StatementStore.RemoveAttachment を実装する。
+func (m *MemoryStore) RemoveAttachment(ctx context.Context, id interface{}) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i, a := range m.attachments {
+		if a.id == id {
+			m.attachments = append(m.attachments[:i], m.attachments[i+1:]...)
+			break
+		}
+	}
+
+	return nil
+}
+
+// hasContentFilter は filter がステートメントの内容に対する条件を持つかを返す。
+func hasContentFilter(filter *StatementFilter) bool {
+	return filter.Agent != nil || len(filter.Verb) > 0 || len(filter.Activity) > 0 || len(filter.Registration) > 0
+}
+
+// matchesStatementFilter はステートメントが filter の内容に対する条件を全て満たすかを返す。
+// MongoStore のクエリ (statementFilterTerms) と同じ条件で判定する。
+func matchesStatementFilter(data map[string]interface{}, filter *StatementFilter) bool {
+	if filter.Agent != nil && !matchesAgent(data, filter.Agent, filter.RelatedAgents) {
+		return false
+	}
+
+	if len(filter.Verb) > 0 && stringAt(data, "verb", "id") != filter.Verb {
+		return false
+	}
+
+	if len(filter.Activity) > 0 && !matchesActivity(data, filter.Activity, filter.RelatedActivities) {
+		return false
+	}
+
+	if len(filter.Registration) > 0 && stringAt(data, "context", "registration") != filter.Registration {
+		return false
+	}
+
+	return true
+}
+
+// 関連するエージェントとして検索する、エージェントのフィールド
+var relatedAgentPaths = [][]string{
+	{"object"},
+	{"context", "instructor"},
+	{"context", "team"},
+	{"object", "actor"},
+	{"object", "object"},
+	{"object", "context", "instructor"},
+	{"object", "context", "team"},
+}
+
+// 関連するエージェントとして検索する、グループのメンバーのフィールド
+var relatedMemberPaths = [][]string{
+	{"actor", "member"},
+	{"object", "member"},
+	{"authority", "member"},
+	{"context", "instructor", "member"},
+	{"context", "team", "member"},
+	{"object", "actor", "member"},
+	{"object", "object", "member"},
+	{"object", "authority", "member"},
+	{"object", "context", "instructor", "member"},
+	{"object", "context", "team", "member"},
+}
+
+// matchesAgent はステートメントに agent (グループの場合はそのメンバーのいずれか) と
+// 同じ IFI を持つエージェントが現れるかを返す。related が false の場合は actor のみを対象とする。
+func matchesAgent(data, agent map[string]interface{}, related bool) bool {
+	candidates := agentCandidates(data, related)
+
+	agents := []map[string]interface{}{agent}
+	if members, ok := agent["member"].([]interface{}); ok {
+		for _, member := range members {
+			if m, ok := member.(map[string]interface{}); ok {
+				agents = append(agents, m)
+			}
+		}
+	}
+
+	for _, a := range agents {
+		for _, candidate := range candidates {
+			if candidate != nil && hasSameIFIOf(a, candidate) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// agentCandidates はステートメントの actor と、related が true の場合は関連するエージェントとして
+// 検索するフィールドのエージェントを返す。フィールドが無い場合は nil を含む。
+func agentCandidates(data map[string]interface{}, related bool) []map[string]interface{} {
+	candidates := []map[string]interface{}{mapAt(data, "actor")}
+	if !related {
+		return candidates
+	}
+
+	for _, path := range relatedAgentPaths {
+		candidates = append(candidates, mapAt(data, path...))
+	}
+	for _, path := range relatedMemberPaths {
+		members, _ := valueAt(data, path...).([]interface{})
+		for _, member := range members {
+			if m, ok := member.(map[string]interface{}); ok {
+				candidates = append(candidates, m)
+			}
+		}
+	}
+
+	return candidates
+}
+
+// agentNamesOf は candidates のうち agent と同じ IFI を持つエージェントの name を names に加える。
+func agentNamesOf(names map[string]bool, agent map[string]interface{}, candidates []map[string]interface{}) {
+	for _, candidate := range candidates {
+		if candidate == nil || !hasSameIFIOf(agent, candidate) {
+			continue
+		}
+		if name, ok := candidate["name"].(string); ok {
+			names[name] = true
+		}
+	}
+}
+
+// sortedNames は names を名前の順に並べて返す。
+func sortedNames(names map[string]bool) []string {
+	sorted := make([]string, 0, len(names))
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+
+	return sorted
+}
+
+// hasSameIFIOf は candidate が agent の IFI のいずれかと同じ値を持つかを返す。
+func hasSameIFIOf(agent, candidate map[string]interface{}) bool {
+	for _, field := range []string{"mbox", "mbox_sha1sum", "openid"} {
+		if v, ok := agent[field].(string); ok && v == candidate[field] {
+			return true
+		}
+	}
+
+	if account, ok := agent["account"].(map[string]interface{}); ok {
+		other, ok := candidate["account"].(map[string]interface{})
+		return ok && account["name"] == other["name"] && account["homePage"] == other["homePage"]
+	}
+
+	return false
+}
+
+// matchesActivity はステートメントの object が id の Activity であるかを返す。
+// related が true の場合は contextActivities に id の Activity を含むものも対象とする。
+func matchesActivity(data map[string]interface{}, id string, related bool) bool {
+	object := mapAt(data, "object")
+	if object["objectType"] == "Activity" && object["id"] == id {
+		return true
+	}
+	if !related {
+		return false
+	}
+
+	for _, field := range []string{"parent", "grouping", "category", "other"} {
+		activities, _ := valueAt(data, "context", "contextActivities", field).([]interface{})
+		for _, a := range activities {
+			if activity, ok := a.(map[string]interface{}); ok && activity["id"] == id {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// statementRefTarget は object が StatementRef であるステートメントの、参照先の ID を返す。
+func statementRefTarget(data map[string]interface{}) (string, bool) {
+	object := mapAt(data, "object")
+	if object["objectType"] != "StatementRef" {
+		return "", false
+	}
+	id, ok := object["id"].(string)
+
+	return id, ok
+}
+
+// voidedTarget は voiding ステートメントにより Voided となるステートメントの ID を返す。
+func voidedTarget(data map[string]interface{}) (string, bool) {
+	if stringAt(data, "verb", "id") != miscs.GlobalConfig.Global.VoidedStatementID {
+		return "", false
+	}
+
+	return statementRefTarget(data)
+}
+
+// isAfterCursor はステートメントが cursor の位置より後に並ぶかを返す。
+func isAfterCursor(doc *Document, cursor *MoreCursor, ascending bool) bool {
+	if doc.Timestamp.Equal(cursor.Timestamp) {
+		if ascending {
+			return compareObjectIDs(doc.ID, cursor.LastID) > 0
+		}
+		return compareObjectIDs(doc.ID, cursor.LastID) < 0
+	}
+
+	if ascending {
+		return doc.Timestamp.After(cursor.Timestamp)
+	}
+	return doc.Timestamp.Before(cursor.Timestamp)
+}
+
+// compareObjectIDs は MongoDB と同じく、ObjectID をバイト列として比較する。
+func compareObjectIDs(a, b primitive.ObjectID) int {
+	return bytes.Compare(a[:], b[:])
+}
+
+// statementOrder は MongoStore と同じく、timestamp と ID によりステートメントを並べる。
+type statementOrder struct {
+	docs      DocumentSlice
+	ascending bool
+}
+
+func (s statementOrder) Len() int {
+	return len(s.docs)
+}
+
+func (s statementOrder) Less(i, j int) bool {
+	a, b := s.docs[i], s.docs[j]
+	if !a.Timestamp.Equal(b.Timestamp) {
+		return a.Timestamp.Before(b.Timestamp) == s.ascending
+	}
+	return (compareObjectIDs(a.ID, b.ID) < 0) == s.ascending
+}
+
+func (s statementOrder) Swap(i, j int) {
+	s.docs[i], s.docs[j] = s.docs[j], s.docs[i]
+}
+
+// byStoredDesc はステートメントを stored の降順に並べる。
+type byStoredDesc []*Document
+
+func (d byStoredDesc) Len() int {
+	return len(d)
+}
+
+func (d byStoredDesc) Less(i, j int) bool {
+	return storedAt(d[i].Data).After(storedAt(d[j].Data))
+}
+
+func (d byStoredDesc) Swap(i, j int) {
+	d[i], d[j] = d[j], d[i]
+}
+
+// storedAt はステートメントの stored を返す。
+func storedAt(data map[string]interface{}) time.Time {
+	switch t := data["stored"].(type) {
+	case time.Time:
+		return t
+	case string:
+		if stored, err := time.Parse(time.RFC3339Nano, t); err == nil {
+			return stored
+		}
+	}
+
+	return time.Time{}
+}
+
+// valueAt は path に従ってオブジェクトをたどり、その値を返す。
+func valueAt(data map[string]interface{}, path ...string) interface{} {
+	var v interface{} = data
+	for _, key := range path {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		v = m[key]
+	}
+
+	return v
+}
+
+func mapAt(data map[string]interface{}, path ...string) map[string]interface{} {
+	m, _ := valueAt(data, path...).(map[string]interface{})
+	return m
+}
+
+func stringAt(data map[string]interface{}, path ...string) string {
+	s, _ := valueAt(data, path...).(string)
+	return s
+}
+
+// copyDocument はドキュメントを複製する。保存したドキュメントを呼び出し側が書き換えても
+// 影響しないようにするため、Data は全ての階層を複製する。
+func copyDocument(doc *Document) *Document {
+	copied := *doc
+	copied.Data, _ = copyValue(doc.Data).(map[string]interface{})
+	if doc.VoidedAt != nil {
+		voidedAt := *doc.VoidedAt
+		copied.VoidedAt = &voidedAt
+	}
+
+	return &copied
+}
+
+// copyValue は JSON の値を複製する。bson.M は map[string]interface{} として複製し、
+// MongoStore から読み出した値と同じ型となるようにする。
+func copyValue(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(t))
+		for k, e := range t {
+			m[k] = copyValue(e)
+		}
+		return m
+	case bson.M:
+		return copyValue(map[string]interface{}(t))
+	case []interface{}:
+		s := make([]interface{}, len(t))
+		for i, e := range t {
+			s[i] = copyValue(e)
+		}
+		return s
+	default:
+		return v
+	}
+}
@@ -0,0 +1,176 @@
+// Copyright 2015 realglobe, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package model
+
+import (
+	"context"
+	"fmt"
+	"io"
+)
+
+// MigratableStore は保存している全てのデータを列挙し、また他のストレージから受け入れることができる
+// Store である。Migrate によりストレージ間でデータを移すために用いる。
+type MigratableStore interface {
+	Store
+
+	// EachStatement は保存されている全てのステートメントについて、ID の順に f を呼ぶ。
+	// f がエラーを返した場合はそこで止め、そのエラーを返す。
+	EachStatement(ctx context.Context, f func(doc *Document) error) error
+
+	// EachAttachment は保存されている全ての添付ファイルについて、保存された順に f を呼ぶ。
+	// f がエラーを返した場合はそこで止め、そのエラーを返す。
+	EachAttachment(ctx context.Context, f func(sha2, contentType, encoding string, r io.Reader) error) error
+
+	// EachQuota は全てのユーザーのディスク使用量について f を呼ぶ。
+	// f がエラーを返した場合はそこで止め、そのエラーを返す。
+	EachQuota(ctx context.Context, f func(user string, usage int64) error) error
+
+	// EachDocument は保存されている全ての State, ActivityProfile, AgentProfile, XAPIProfile,
+	// CMI5Session, CMI5Registration について、そのポインタを引数に f を呼ぶ。
+	// f がエラーを返した場合はそこで止め、そのエラーを返す。
+	EachDocument(ctx context.Context, f func(doc interface{}) error) error
+
+	// ImportStatements は docs を ID や保存時刻を変えずにそのまま保存する。ディスク使用量は変更しない。
+	// バッチは全て保存されるか、全く保存されないかのいずれかとし、
+	// 同じ ID のステートメントが既にある場合は ErrDuplicateStatement を返す。
+	ImportStatements(ctx context.Context, docs DocumentSlice) error
+
+	// SetQuotaUsage はユーザーのディスク使用量を usage とする。
+	SetQuotaUsage(ctx context.Context, user string, usage int64) error
+}
+
+// MigrationResult は Migrate により移したデータの数である。
+type MigrationResult struct {
+	Statements         int // 移したステートメントの数
+	SkippedStatements  int // 移行先に既にあったステートメントの数
+	Attachments        int // 移した添付ファイルの数
+	SkippedAttachments int // 移行先に既に同じ sha2 値のものがあった添付ファイルの数
+	Documents          int // 移した State, Profile などのドキュメントの数
+	Users              int // ディスク使用量を移したユーザーの数
+}
+
+// migrationBatchSize は Migrate が一度に保存するステートメントの数である。
+const migrationBatchSize = 100
+
+// Migrate は src のステートメント、添付ファイル、State や Profile などのドキュメント、ディスク使用量を
+// dst に移す。src のデータは削除しない。dst に既にあるステートメントと添付ファイルは飛ばし、
+// ドキュメントとディスク使用量は src のもので上書きするため、途中で失敗した場合も再び実行することができる。
+// more URL のための検索の状態は移さない。
+func Migrate(ctx context.Context, dst, src MigratableStore) (*MigrationResult, error) {
+	var result MigrationResult
+
+	var batch DocumentSlice
+	flush := func() error {
+		err := dst.ImportStatements(ctx, batch)
+		if err == nil {
+			result.Statements += len(batch)
+		} else if err == ErrDuplicateStatement {
+			// 既にあるステートメントを飛ばすため、一つずつ保存し直す
+			for _, doc := range batch {
+				switch err := dst.ImportStatements(ctx, DocumentSlice{doc}); err {
+				case nil:
+					result.Statements++
+				case ErrDuplicateStatement:
+					result.SkippedStatements++
+				default:
+					return err
+				}
+			}
+		} else {
+			return err
+		}
+
+		batch = nil
+		return nil
+	}
+
+	if err := src.EachStatement(ctx, func(doc *Document) error {
+		if batch = append(batch, *doc); len(batch) < migrationBatchSize {
+			return nil
+		}
+		return flush()
+	}); err != nil {
+		return &result, err
+	}
+	if len(batch) > 0 {
+		if err := flush(); err != nil {
+			return &result, err
+		}
+	}
+
+	if err := src.EachAttachment(ctx, func(sha2, contentType, encoding string, r io.Reader) error {
+		attachment, err := dst.OpenAttachment(ctx, sha2)
+		if err == nil {
+			result.SkippedAttachments++
+			return attachment.Close()
+		}
+		if err != ErrNotFound {
+			return err
+		}
+
+		if _, err := dst.PutAttachment(ctx, sha2, contentType, encoding, r); err != nil {
+			return err
+		}
+		result.Attachments++
+
+		return nil
+	}); err != nil {
+		return &result, err
+	}
+
+	if err := src.EachDocument(ctx, func(doc interface{}) error {
+		if err := importDocument(ctx, dst, doc); err != nil {
+			return err
+		}
+		result.Documents++
+
+		return nil
+	}); err != nil {
+		return &result, err
+	}
+
+	if err := src.EachQuota(ctx, func(user string, usage int64) error {
+		if err := dst.SetQuotaUsage(ctx, user, usage); err != nil {
+			return err
+		}
+		result.Users++
+
+		return nil
+	}); err != nil {
+		return &result, err
+	}
+
+	return &result, nil
+}
+
+// importDocument は EachDocument が列挙したドキュメントを dst に保存する。
+func importDocument(ctx context.Context, dst DocumentStore, doc interface{}) error {
+	switch d := doc.(type) {
+	case *State:
+		return dst.SaveState(ctx, d)
+	case *ActivityProfile:
+		return dst.SaveActivityProfile(ctx, d)
+	case *AgentProfile:
+		return dst.SaveAgentProfile(ctx, d)
+	case *XAPIProfile:
+		return dst.SaveXAPIProfile(ctx, d)
+	case *CMI5Session:
+		return dst.SaveCMI5Session(ctx, d)
+	case *CMI5Registration:
+		return dst.SaveCMI5Registration(ctx, d)
+	default:
+		return fmt.Errorf("unknown document type: %T", doc)
+	}
+}
@@ -0,0 +1,79 @@
+// Copyright 2015 realglobe, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package model
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMigrate(t *testing.T) {
+	ctx := context.Background()
+	src, err := OpenSQLiteStore(filepath.Join(t.TempDir(), "src.db"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+	dst, err := OpenSQLiteStore(filepath.Join(t.TempDir(), "dst.db"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dst.Close()
+
+	user := testUser()
+	insertTestStatements(t, src, user, testStatement("m1", nil), testStatement("m2", nil))
+	insertTestStatements(t, src, user, testVoidingStatement("m3", "m1"))
+	updated := time.Now().UTC()
+	if err := src.SaveState(ctx, NewState(user, "app", "act", "agent", "", "s", "text/plain", []byte("abc"), updated)); err != nil {
+		t.Fatal(err)
+	}
+	if err := src.SaveAgentProfile(ctx, NewAgentProfile(user, "app", "agent", "p", "text/plain", []byte("x"), updated)); err != nil {
+		t.Fatal(err)
+	}
+	registration := NewCMI5Registration(user, "app", "reg", updated)
+	registration.Waived = true
+	if err := src.SaveCMI5Registration(ctx, registration); err != nil {
+		t.Fatal(err)
+	}
+
+	// 二度目は移行先に既にあるステートメントを飛ばす
+	for i, expected := range []MigrationResult{
+		{Statements: 3, Documents: 3, Users: 1},
+		{SkippedStatements: 3, Documents: 3, Users: 1},
+	} {
+		result, err := Migrate(ctx, dst, src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if *result != expected {
+			t.Errorf("Expected %+v on migration %d; got %+v", expected, i, *result)
+		}
+	}
+
+	if got := queryTestStatements(t, dst, user, &StatementFilter{}); len(got) != 2 || got["m1"] {
+		t.Errorf("Expected [m2 m3]; got %v", got)
+	}
+	if usage, err := dst.QuotaUsage(ctx, user); err != nil || usage != 3 {
+		t.Errorf("Expected usage 3; got %v (%v)", usage, err)
+	}
+	if state, err := dst.FindState(ctx, user, "app", "act", "agent", "", "s"); err != nil || string(state.Content) != "abc" {
+		t.Errorf("Unexpected state: %+v (%v)", state, err)
+	}
+	if r, err := dst.FindCMI5Registration(ctx, user, "app", "reg"); err != nil || !r.Waived {
+		t.Errorf("Unexpected cmi5 registration: %+v (%v)", r, err)
+	}
+}
@@ -0,0 +1,193 @@
+// Copyright 2015 realglobe, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package model
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// MongoStore は DocumentStore も実装し、各ドキュメントを種類ごとのコレクションに保存する。
+// InsertStatements の commit に与えるコンテキストはトランザクションのセッションを持つため、
+// commit から呼んだ場合はステートメントと同じトランザクションで書き込む。
+
+// SaveState は DocumentStore.SaveState を実装する。
+func (m *MongoStore) SaveState(ctx context.Context, state *State) error {
+	return state.SaveTo(ctx, m.db.Collection("state"))
+}
+
+// FindState は DocumentStore.FindState を実装する。
+func (m *MongoStore) FindState(ctx context.Context, user, app, activityID, agent, registration, stateID string) (*State, error) {
+	return FindState(ctx, m.db.Collection("state"), user, app, activityID, agent, registration, stateID)
+}
+
+// FindStateIDs は DocumentStore.FindStateIDs を実装する。
+func (m *MongoStore) FindStateIDs(ctx context.Context, user, app, activityID, agent, registration string, since time.Time) ([]string, error) {
+	return FindStateIDs(ctx, m.db.Collection("state"), user, app, activityID, agent, registration, since)
+}
+
+// RemoveStates は DocumentStore.RemoveStates を実装する。
+func (m *MongoStore) RemoveStates(ctx context.Context, user, app, activityID, agent, registration, stateID string) (int64, error) {
+	return RemoveStates(ctx, m.db.Collection("state"), user, app, activityID, agent, registration, stateID)
+}
+
+// SaveActivityProfile は DocumentStore.SaveActivityProfile を実装する。
+func (m *MongoStore) SaveActivityProfile(ctx context.Context, profile *ActivityProfile) error {
+	return profile.SaveTo(ctx, m.db.Collection("activityProfile"))
+}
+
+// FindActivityProfile は DocumentStore.FindActivityProfile を実装する。
+func (m *MongoStore) FindActivityProfile(ctx context.Context, user, app, activityID, profileID string) (*ActivityProfile, error) {
+	return FindActivityProfile(ctx, m.db.Collection("activityProfile"), user, app, activityID, profileID)
+}
+
+// FindActivityProfileIDs は DocumentStore.FindActivityProfileIDs を実装する。
+func (m *MongoStore) FindActivityProfileIDs(ctx context.Context, user, app, activityID string, since time.Time) ([]string, error) {
+	return FindActivityProfileIDs(ctx, m.db.Collection("activityProfile"), user, app, activityID, since)
+}
+
+// RemoveActivityProfile は DocumentStore.RemoveActivityProfile を実装する。
+func (m *MongoStore) RemoveActivityProfile(ctx context.Context, user, app, activityID, profileID string) error {
+	return RemoveActivityProfile(ctx, m.db.Collection("activityProfile"), user, app, activityID, profileID)
+}
+
+// SaveAgentProfile は DocumentStore.SaveAgentProfile を実装する。
+func (m *MongoStore) SaveAgentProfile(ctx context.Context, profile *AgentProfile) error {
+	return profile.SaveTo(ctx, m.db.Collection("agentProfile"))
+}
+
+// FindAgentProfile は DocumentStore.FindAgentProfile を実装する。
+func (m *MongoStore) FindAgentProfile(ctx context.Context, user, app, agent, profileID string) (*AgentProfile, error) {
+	return FindAgentProfile(ctx, m.db.Collection("agentProfile"), user, app, agent, profileID)
+}
+
+// FindAgentProfileIDs は DocumentStore.FindAgentProfileIDs を実装する。
+func (m *MongoStore) FindAgentProfileIDs(ctx context.Context, user, app, agent string, since time.Time) ([]string, error) {
+	return FindAgentProfileIDs(ctx, m.db.Collection("agentProfile"), user, app, agent, since)
+}
+
+// RemoveAgentProfile は DocumentStore.RemoveAgentProfile を実装する。
+func (m *MongoStore) RemoveAgentProfile(ctx context.Context, user, app, agent, profileID string) error {
+	return RemoveAgentProfile(ctx, m.db.Collection("agentProfile"), user, app, agent, profileID)
+}
+
+// SaveXAPIProfile は DocumentStore.SaveXAPIProfile を実装する。
+func (m *MongoStore) SaveXAPIProfile(ctx context.Context, profile *XAPIProfile) error {
+	return profile.SaveTo(ctx, m.db.Collection("xapiProfile"))
+}
+
+// FindXAPIProfile は DocumentStore.FindXAPIProfile を実装する。
+func (m *MongoStore) FindXAPIProfile(ctx context.Context, user, app, profileID string) (*XAPIProfile, error) {
+	return FindXAPIProfile(ctx, m.db.Collection("xapiProfile"), user, app, profileID)
+}
+
+// FindXAPIProfiles は DocumentStore.FindXAPIProfiles を実装する。
+func (m *MongoStore) FindXAPIProfiles(ctx context.Context, user, app string) ([]XAPIProfile, error) {
+	return FindXAPIProfiles(ctx, m.db.Collection("xapiProfile"), user, app)
+}
+
+// RemoveXAPIProfile は DocumentStore.RemoveXAPIProfile を実装する。
+func (m *MongoStore) RemoveXAPIProfile(ctx context.Context, user, app, profileID string) error {
+	return RemoveXAPIProfile(ctx, m.db.Collection("xapiProfile"), user, app, profileID)
+}
+
+// SaveCMI5Session は DocumentStore.SaveCMI5Session を実装する。
+func (m *MongoStore) SaveCMI5Session(ctx context.Context, session *CMI5Session) error {
+	return session.SaveTo(ctx, m.db.Collection("cmi5Session"))
+}
+
+// FindCMI5Session は DocumentStore.FindCMI5Session を実装する。
+func (m *MongoStore) FindCMI5Session(ctx context.Context, user, app, registration, sessionID string) (*CMI5Session, error) {
+	return FindCMI5Session(ctx, m.db.Collection("cmi5Session"), user, app, registration, sessionID)
+}
+
+// FindCMI5Sessions は DocumentStore.FindCMI5Sessions を実装する。
+func (m *MongoStore) FindCMI5Sessions(ctx context.Context, user, app, registration string) ([]CMI5Session, error) {
+	return FindCMI5Sessions(ctx, m.db.Collection("cmi5Session"), user, app, registration)
+}
+
+// SaveCMI5Registration は DocumentStore.SaveCMI5Registration を実装する。
+func (m *MongoStore) SaveCMI5Registration(ctx context.Context, registration *CMI5Registration) error {
+	return registration.SaveTo(ctx, m.db.Collection("cmi5Registration"))
+}
+
+// FindCMI5Registration は DocumentStore.FindCMI5Registration を実装する。
+func (m *MongoStore) FindCMI5Registration(ctx context.Context, user, app, registration string) (*CMI5Registration, error) {
+	return FindCMI5Registration(ctx, m.db.Collection("cmi5Registration"), user, app, registration)
+}
+
+// AddQuotaUsage は DocumentStore.AddQuotaUsage を実装する。
+func (m *MongoStore) AddQuotaUsage(ctx context.Context, user string, amount int64) error {
+	if amount == 0 {
+		return nil
+	}
+
+	quota, err := GetQuota(ctx, m.db, user)
+	if err != nil {
+		return err
+	}
+
+	return quota.IncrementUsageTo(ctx, m.db, amount)
+}
+
+// EachDocument は MigratableStore.EachDocument を実装する。
+func (m *MongoStore) EachDocument(ctx context.Context, f func(doc interface{}) error) error {
+	collections := []struct {
+		name   string
+		newDoc func() interface{}
+	}{
+		{"state", func() interface{} { return &State{} }},
+		{"activityProfile", func() interface{} { return &ActivityProfile{} }},
+		{"agentProfile", func() interface{} { return &AgentProfile{} }},
+		{"xapiProfile", func() interface{} { return &XAPIProfile{} }},
+		{"cmi5Session", func() interface{} { return &CMI5Session{} }},
+		{"cmi5Registration", func() interface{} { return &CMI5Registration{} }},
+	}
+
+	for _, c := range collections {
+		cursor, err := m.db.Collection(c.name).Find(ctx, bson.M{}, options.Find().
+			SetSort(bson.D{{Key: "_id", Value: 1}}))
+		if err != nil {
+			return err
+		}
+
+		for cursor.Next(ctx) {
+			doc := c.newDoc()
+			if err := cursor.Decode(doc); err != nil {
+				cursor.Close(ctx)
+				return err
+			}
+			if err := f(doc); err != nil {
+				cursor.Close(ctx)
+				return err
+			}
+		}
+		err = cursor.Err()
+		cursor.Close(ctx)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Close は MongoDB との接続を閉じる。
+func (m *MongoStore) Close() error {
+	return m.db.Client().Disconnect(context.Background())
+}
@@ -0,0 +1,301 @@
+// Copyright 2015 realglobe, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package model
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/realglobe-Inc/edo-xrs/app/miscs"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// statementFilterTerms は filter のうち、ステートメントの内容に対する条件のクエリを返す。
+// これらの条件は StatementRef による参照先にも適用する。
+func statementFilterTerms(filter *StatementFilter) []interface{} {
+	var terms []interface{}
+
+	if filter.Agent != nil {
+		terms = append(terms, queryOfTerms(termsOfAgent(filter.Agent, filter.RelatedAgents)))
+	}
+
+	if len(filter.Verb) > 0 {
+		terms = append(terms, bson.M{"data.verb.id": filter.Verb})
+	}
+
+	if id := filter.Activity; len(id) > 0 {
+		activityQuery := []bson.M{{
+			"data.object.objectType": "Activity",
+			"data.object.id":         id,
+		}}
+
+		if filter.RelatedActivities {
+			activityQuery = append(activityQuery, bson.M{
+				"data.context.contextActivities.parent": bson.M{"$elemMatch": bson.M{"id": id}},
+			}, bson.M{
+				"data.context.contextActivities.grouping": bson.M{"$elemMatch": bson.M{"id": id}},
+			}, bson.M{
+				"data.context.contextActivities.category": bson.M{"$elemMatch": bson.M{"id": id}},
+			}, bson.M{
+				"data.context.contextActivities.other": bson.M{"$elemMatch": bson.M{"id": id}},
+			})
+		}
+		terms = append(terms, bson.M{"$or": activityQuery})
+	}
+
+	if len(filter.Registration) > 0 {
+		terms = append(terms, bson.M{"data.context.registration": filter.Registration})
+	}
+
+	return terms
+}
+
+func queryOfTerms(terms []map[string]interface{}) bson.M {
+	var identTerms []bson.M
+
+	for _, term := range terms {
+		for k, v := range term {
+			identTerms = append(identTerms, bson.M{k: v})
+		}
+	}
+
+	return bson.M{"$or": identTerms}
+}
+
+func constructIFITerms(prefix string, agent map[string]interface{}) (terms []map[string]interface{}) {
+	if account, ok := agent["account"]; ok {
+		terms = append(terms, map[string]interface{}{
+			"$and": []bson.M{
+				{prefix + ".account.name": (account.(map[string]interface{}))["name"].(string)},
+				{prefix + ".account.homePage": (account.(map[string]interface{}))["homePage"].(string)},
+			},
+		})
+	}
+	if mbox, ok := agent["mbox"]; ok {
+		terms = append(terms, map[string]interface{}{prefix + ".mbox": mbox.(string)})
+	}
+	if mboxSHA1, ok := agent["mbox_sha1sum"]; ok {
+		terms = append(terms, map[string]interface{}{prefix + ".mbox_sha1sum": mboxSHA1.(string)})
+	}
+	if openID, ok := agent["openid"]; ok {
+		terms = append(terms, map[string]interface{}{prefix + ".openid": openID.(string)})
+	}
+
+	return
+}
+
+func constructIFITermsOfArray(prefix string, agent map[string]interface{}) (terms []map[string]interface{}) {
+	if account, ok := agent["account"]; ok {
+		terms = append(terms, map[string]interface{}{
+			"$and": []bson.M{
+				{
+					prefix: bson.M{
+						"$elemMatch": bson.M{
+							"account.name": (account.(map[string]interface{}))["name"].(string),
+						},
+					},
+				},
+				{
+					prefix: bson.M{
+						"$elemMatch": bson.M{
+							"account.homePage": (account.(map[string]interface{}))["homePage"].(string),
+						},
+					},
+				},
+			},
+		})
+	}
+	if mbox, ok := agent["mbox"]; ok {
+		terms = append(terms, map[string]interface{}{
+			prefix: bson.M{"$elemMatch": bson.M{"mbox": mbox.(string)}},
+		})
+	}
+	if mboxSHA1, ok := agent["mbox_sha1sum"]; ok {
+		terms = append(terms, map[string]interface{}{
+			prefix: bson.M{"$elemMatch": bson.M{"mbox_sha1sum": mboxSHA1.(string)}},
+		})
+	}
+	if openID, ok := agent["openid"]; ok {
+		terms = append(terms, map[string]interface{}{
+			prefix: bson.M{"$elemMatch": bson.M{"openid": openID.(string)}},
+		})
+	}
+
+	return
+}
+
+func ifiTermsOfAgent(agent map[string]interface{}, isRelated bool) (terms []map[string]interface{}) {
+	terms = append(terms, constructIFITerms("data.actor", agent)...)
+
+	if isRelated {
+		// statement
+		terms = append(terms, constructIFITermsOfArray("data.actor.member", agent)...)
+		terms = append(terms, constructIFITerms("data.object", agent)...)
+		terms = append(terms, constructIFITermsOfArray("data.object.member", agent)...)
+		terms = append(terms, constructIFITermsOfArray("data.authority.member", agent)...)
+		terms = append(terms, constructIFITerms("data.context.instructor", agent)...)
+		terms = append(terms, constructIFITermsOfArray("data.context.instructor.member", agent)...)
+		terms = append(terms, constructIFITerms("data.context.team", agent)...)
+		terms = append(terms, constructIFITermsOfArray("data.context.team.member", agent)...)
+		// substatement
+		terms = append(terms, constructIFITerms("data.object.actor", agent)...)
+		terms = append(terms, constructIFITermsOfArray("data.object.actor.member", agent)...)
+		terms = append(terms, constructIFITerms("data.object.object", agent)...)
+		terms = append(terms, constructIFITermsOfArray("data.object.object.member", agent)...)
+		terms = append(terms, constructIFITermsOfArray("data.object.authority.member", agent)...)
+		terms = append(terms, constructIFITerms("data.object.context.instructor", agent)...)
+		terms = append(terms, constructIFITermsOfArray("data.object.context.instructor.member", agent)...)
+		terms = append(terms, constructIFITerms("data.object.context.team", agent)...)
+		terms = append(terms, constructIFITermsOfArray("data.object.context.team.member", agent)...)
+	}
+
+	return
+}
+
+func termsOfAgent(agent map[string]interface{}, isRelated bool) (terms []map[string]interface{}) {
+	terms = append(terms, ifiTermsOfAgent(agent, isRelated)...)
+
+	if memberSlice, ok := agent["member"]; ok {
+		for _, m := range memberSlice.([]interface{}) {
+			member := m.(map[string]interface{})
+
+			terms = append(terms, ifiTermsOfAgent(member, isRelated)...)
+		}
+	}
+
+	return
+}
+
+// agentNamesPipeline は、Voided となっていないステートメントの actor と関連するエージェントとして検索する
+// フィールドに現れる、agent と同じ IFI を持つエージェントの name を重複なく返す集計パイプラインである。
+// ステートメント全体を読まないよう、エージェントのフィールドのみを取り出してから name ごとにまとめる。
+func agentNamesPipeline(user, app string, agent map[string]interface{}) mongo.Pipeline {
+	candidates := bson.A{"$data.actor"}
+	for _, path := range relatedAgentPaths {
+		candidates = append(candidates, "$data."+strings.Join(path, "."))
+	}
+	arrays := bson.A{candidates}
+	for _, path := range relatedMemberPaths {
+		arrays = append(arrays, bson.M{"$ifNull": bson.A{"$data." + strings.Join(path, "."), bson.A{}}})
+	}
+
+	return mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"$and": []interface{}{
+			bson.M{"user": user, "app": app, "voidedAt": bson.M{"$exists": false}},
+			queryOfTerms(ifiTermsOfAgent(agent, true)),
+		}}}},
+		{{Key: "$project", Value: bson.M{"_id": 0, "candidate": bson.M{"$concatArrays": arrays}}}},
+		{{Key: "$unwind", Value: "$candidate"}},
+		{{Key: "$match", Value: bson.M{"$and": []interface{}{
+			bson.M{"candidate.name": bson.M{"$type": "string"}},
+			queryOfTerms(constructIFITerms("candidate", agent)),
+		}}}},
+		{{Key: "$group", Value: bson.M{"_id": "$candidate.name"}}},
+		{{Key: "$sort", Value: bson.M{"_id": 1}}},
+	}
+}
+
+// referringStatementsPipeline は query に合うステートメントと、それを StatementRef により
+// (間接的に) 参照するステートメントを返す集計パイプラインである。(Experience API, Section 7.2.4 を参照)
+// 参照先は $graphLookup により辿るため、ソートした順に limit 件が見つかるまでのステートメントのみを調べる。
+func referringStatementsPipeline(base, query bson.M, sort bson.D, limit int64, snapshot time.Time) mongo.Pipeline {
+	isStatementRef := bson.M{"data.object.objectType": "StatementRef"}
+
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"$and": []interface{}{base, bson.M{"$or": []interface{}{query, isStatementRef}}}}}},
+		{{Key: "$sort", Value: sort}},
+		{{Key: "$graphLookup", Value: bson.M{
+			"from": "statement",
+			"startWith": bson.M{"$cond": bson.A{
+				bson.M{"$eq": bson.A{"$data.object.objectType", "StatementRef"}}, "$data.object.id", bson.A{},
+			}},
+			"connectFromField": "data.object.id",
+			"connectToField":   "data.id",
+			"as":               "referred",
+			"restrictSearchWithMatch": bson.M{
+				"user":        base["user"],
+				"app":         base["app"],
+				"data.stored": bson.M{"$lte": snapshot},
+			},
+		}}},
+		{{Key: "$match", Value: bson.M{"$or": []interface{}{query, bson.M{"referred": bson.M{"$elemMatch": query}}}}}},
+	}
+	if limit > 0 {
+		pipeline = append(pipeline, bson.D{{Key: "$limit", Value: limit}})
+	}
+
+	return append(pipeline, bson.D{{Key: "$project", Value: bson.M{"referred": 0}}})
+}
+
+// voidedStatementIDs は ids のうち、既に保存されている voiding ステートメントにより Voided となっているものを返す。
+func voidedStatementIDs(ctx context.Context, col *mongo.Collection, user, app string, ids []string) (map[string]bool, error) {
+	voided := make(map[string]bool)
+	if len(ids) == 0 {
+		return voided, nil
+	}
+
+	values, err := col.Distinct(ctx, "data.object.id", bson.M{
+		"user":                   user,
+		"app":                    app,
+		"data.verb.id":           miscs.GlobalConfig.Global.VoidedStatementID,
+		"data.object.objectType": "StatementRef",
+		"data.object.id":         bson.M{"$in": ids},
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range values {
+		if id, ok := v.(string); ok {
+			voided[id] = true
+		}
+	}
+
+	return voided, nil
+}
+
+// markVoidedStatements は targets の各ステートメントの voidedAt を設定する。
+// 既に Voided となっているステートメントは変更しない。
+func markVoidedStatements(ctx context.Context, col *mongo.Collection, user, app string, targets map[string]time.Time) error {
+	for target, t := range targets {
+		if _, err := col.UpdateOne(ctx, bson.M{
+			"user":     user,
+			"app":      app,
+			"data.id":  target,
+			"voidedAt": bson.M{"$exists": false},
+		}, bson.M{"$set": bson.M{"voidedAt": t}}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// unmarkVoidedStatements は markVoidedStatements により設定した voidedAt を取り消す。
+func unmarkVoidedStatements(ctx context.Context, col *mongo.Collection, user, app string, targets map[string]time.Time) error {
+	for target, t := range targets {
+		if _, err := col.UpdateOne(ctx, bson.M{
+			"user":     user,
+			"app":      app,
+			"data.id":  target,
+			"voidedAt": t,
+		}, bson.M{"$unset": bson.M{"voidedAt": ""}}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
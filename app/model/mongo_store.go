@@ -0,0 +1,577 @@
+// Copyright 2015 realglobe, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package model
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/realglobe-Inc/edo-xrs/app/miscs"
+	"github.com/realglobe-Inc/go-lib/rglog"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/gridfs"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var logger = rglog.Logger("xRS/model")
+
+// MongoStore は MongoDB にステートメントを保存する StatementStore である。
+// ステートメントは statement コレクションに、添付ファイルは GridFS に保存する。
+type MongoStore struct {
+	db     *mongo.Database
+	window insertWindow
+
+	transactionsOnce sync.Once
+	transactions     bool
+}
+
+// NewMongoStore は db を用いる MongoStore を返す。
+func NewMongoStore(db *mongo.Database) *MongoStore {
+	return &MongoStore{db: db}
+}
+
+// InsertStatements は StatementStore.InsertStatements を実装する。
+// レプリカセットまたは mongos に接続している場合はトランザクションを用いる。
+// トランザクションを用いることができない場合は、挿入の途中や commit で失敗した時点で
+// このバッチで行った変更を取り消す。
+func (m *MongoStore) InsertStatements(ctx context.Context, user, app string, docs DocumentSlice, usage int64, commit func(ctx context.Context) error) error {
+	quota, err := GetQuota(ctx, m.db, user)
+	if err != nil {
+		return err
+	}
+
+	// stored は挿入の時刻とする。挿入を終えるまで ConsistentThrough はこれより前の時刻を返す
+	stored, done := m.window.begin()
+	defer done()
+
+	batch := make(DocumentSlice, 0, len(docs))
+	for _, doc := range docs {
+		doc.User, doc.App = user, app
+		batch = append(batch, doc)
+	}
+	batch.setStored(stored)
+
+	if m.supportsTransactions(ctx) {
+		err = m.insertStatementsInTransaction(ctx, quota, app, batch, usage, commit)
+	} else {
+		err = m.insertStatementsWithRollback(ctx, quota, app, batch, usage, commit)
+	}
+
+	// statement の id フィールドを unique index にすることで、ID が重複する場合は
+	// duplicate key エラーを発生させている
+	if mongo.IsDuplicateKeyError(err) {
+		return ErrDuplicateStatement
+	}
+	return err
+}
+
+// supportsTransactions はトランザクションを用いることができる (レプリカセットまたは mongos に
+// 接続している) かを返す。結果は最初の呼び出しで定める。
+func (m *MongoStore) supportsTransactions(ctx context.Context) bool {
+	m.transactionsOnce.Do(func() {
+		var result struct {
+			SetName string `bson:"setName"`
+			Msg     string `bson:"msg"`
+		}
+		err := m.db.RunCommand(ctx, bson.D{{Key: "isMaster", Value: 1}}).Decode(&result)
+		if err != nil {
+			logger.Err("An unexpected error occured on isMaster, transactions are disabled: ", err)
+			return
+		}
+		m.transactions = result.SetName != "" || result.Msg == "isdbgrid"
+	})
+
+	return m.transactions
+}
+
+// insertStatementsInTransaction はディスク使用量の確認と加算、バッチの挿入、voidedAt の設定と commit を
+// 一つのトランザクションで行う。同じユーザーの挿入は quota の更新が競合するため直列化される。
+func (m *MongoStore) insertStatementsInTransaction(ctx context.Context, quota *Quota, app string, batch DocumentSlice, usage int64, commit func(ctx context.Context) error) error {
+	session, err := m.db.Client().StartSession()
+	if err != nil {
+		return err
+	}
+	defer session.EndSession(ctx)
+
+	col := m.db.Collection("statement")
+	_, err = session.WithTransaction(ctx, func(sc mongo.SessionContext) (interface{}, error) {
+		if err := quota.ReserveUsageTo(sc, m.db, usage); err != nil {
+			return nil, err
+		}
+
+		voided, err := voidedStatementIDs(sc, col, quota.User, app, batch.statementIDs())
+		if err != nil {
+			return nil, err
+		}
+		targets := batch.applyVoiding(voided)
+
+		if err := batch.InsertTo(sc, col); err != nil {
+			return nil, err
+		}
+		if err := markVoidedStatements(sc, col, quota.User, app, targets); err != nil {
+			return nil, err
+		}
+		if commit != nil {
+			if err := commit(sc); err != nil {
+				return nil, err
+			}
+		}
+
+		return nil, nil
+	})
+
+	return err
+}
+
+// insertStatementsWithRollback はトランザクションを用いずに insertStatementsInTransaction と同じ操作を行い、
+// 失敗した場合はそれまでに行った変更を取り消す。
+// ディスク使用量は確認と同時に加算し、他のリクエストと競合しないようにする。
+func (m *MongoStore) insertStatementsWithRollback(ctx context.Context, quota *Quota, app string, batch DocumentSlice, usage int64, commit func(ctx context.Context) error) error {
+	user := quota.User
+	if err := quota.ReserveUsageTo(ctx, m.db, usage); err != nil {
+		return err
+	}
+
+	col := m.db.Collection("statement")
+	var targets map[string]time.Time
+	rollback := func() {
+		// リクエストがキャンセルされていても取り消せるよう、新しいコンテキストを用いる
+		ctx := context.Background()
+		if err := unmarkVoidedStatements(ctx, col, user, app, targets); err != nil {
+			logger.Err("An unexpected error occured on rollback voided statements: ", err)
+		}
+		rollbackStatements(ctx, col, batch)
+		if err := quota.IncrementUsageTo(ctx, m.db, -usage); err != nil {
+			logger.Err("An unexpected error occured on rollback quota: ", err)
+		}
+	}
+
+	voided, err := voidedStatementIDs(ctx, col, user, app, batch.statementIDs())
+	if err != nil {
+		rollback()
+		return err
+	}
+	targets = batch.applyVoiding(voided)
+
+	if err := batch.InsertTo(ctx, col); err != nil {
+		rollback()
+		return err
+	}
+	if err := markVoidedStatements(ctx, col, user, app, targets); err != nil {
+		rollback()
+		return err
+	}
+	if commit != nil {
+		if err := commit(ctx); err != nil {
+			rollback()
+			return err
+		}
+	}
+
+	return nil
+}
+
+// rollbackStatements は既に挿入されたバッチのステートメントを削除する。
+// ドキュメントの _id は挿入前に生成しているため、他のリクエストのステートメントは削除しない。
+// 削除に失敗した場合は、元のエラーを返すためにログに記録するのみとする。
+func rollbackStatements(ctx context.Context, col *mongo.Collection, docs DocumentSlice) {
+	if err := docs.RemoveFrom(ctx, col); err != nil {
+		logger.Err("An unexpected error occured on rollback statements: ", err)
+	}
+}
+
+// FindStatement は StatementStore.FindStatement を実装する。
+func (m *MongoStore) FindStatement(ctx context.Context, user, app, id string) (*Document, error) {
+	var doc Document
+	err := m.db.Collection("statement").FindOne(ctx, bson.M{
+		"user":    user,
+		"app":     app,
+		"data.id": id,
+	}).Decode(&doc)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &doc, nil
+}
+
+// FindStatements は StatementStore.FindStatements を実装する。
+func (m *MongoStore) FindStatements(ctx context.Context, user, app string, ids []string) (DocumentSlice, error) {
+	cursor, err := m.db.Collection("statement").Find(ctx, bson.M{
+		"user":    user,
+		"app":     app,
+		"data.id": bson.M{"$in": ids},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var docs DocumentSlice
+	if err := cursor.All(ctx, &docs); err != nil {
+		return nil, err
+	}
+
+	return docs, nil
+}
+
+// IsVoided は StatementStore.IsVoided を実装する。
+func (m *MongoStore) IsVoided(ctx context.Context, user, app, id string) (bool, error) {
+	count, err := m.db.Collection("statement").CountDocuments(ctx, bson.M{
+		"user":                   user,
+		"app":                    app,
+		"data.verb.id":           miscs.GlobalConfig.Global.VoidedStatementID,
+		"data.object.objectType": "StatementRef",
+		"data.object.id":         id,
+	}, options.Count().SetLimit(1))
+	if err != nil {
+		return false, err
+	}
+
+	return count > 0, nil
+}
+
+// QueryStatements は StatementStore.QueryStatements を実装する。
+func (m *MongoStore) QueryStatements(ctx context.Context, user, app string, filter *StatementFilter) (DocumentSlice, error) {
+	col := m.db.Collection("statement")
+
+	var queryTerms []interface{}
+
+	if !filter.Since.IsZero() {
+		queryTerms = append(queryTerms, bson.M{"timestamp": bson.M{"$gt": filter.Since}})
+	}
+	if !filter.Until.IsZero() {
+		queryTerms = append(queryTerms, bson.M{"timestamp": bson.M{"$lt": filter.Until}})
+	}
+
+	// ソート順
+	// 同じ timestamp のステートメントの順序を固定するため _id でもソートする
+	order, positionOp := -1, "$lt"
+	if filter.Ascending {
+		order, positionOp = 1, "$gt"
+	}
+
+	if cursor := filter.Cursor; cursor != nil {
+		queryTerms = append(queryTerms, bson.M{"$or": []bson.M{
+			{"timestamp": bson.M{positionOp: cursor.Timestamp}},
+			{"timestamp": cursor.Timestamp, "_id": bson.M{positionOp: cursor.LastID}},
+		}})
+	}
+
+	queryTerms = append(queryTerms, bson.M{
+		"user":        user,
+		"app":         app,
+		"data.stored": bson.M{"$lte": filter.Snapshot},
+	})
+
+	// Voided となったステートメントは含めない (Experience API, Section 2.5 を参照)
+	queryTerms = append(queryTerms, bson.M{"voidedAt": bson.M{"$not": bson.M{"$lte": filter.Snapshot}}})
+
+	sort := bson.D{
+		{Key: "timestamp", Value: order},
+		{Key: "_id", Value: order},
+	}
+
+	var cursor *mongo.Cursor
+	var err error
+	if filterTerms := statementFilterTerms(filter); len(filterTerms) > 0 {
+		// 条件に合うステートメントを StatementRef により参照するステートメントも含める
+		base := bson.M{"user": user, "app": app, "$and": queryTerms}
+		pipeline := referringStatementsPipeline(base, bson.M{"$and": filterTerms}, sort, int64(filter.Limit), filter.Snapshot)
+		cursor, err = col.Aggregate(ctx, pipeline, options.Aggregate().SetAllowDiskUse(true))
+	} else {
+		opts := options.Find().SetSort(sort)
+		if filter.Limit > 0 {
+			opts.SetLimit(int64(filter.Limit))
+		}
+		cursor, err = col.Find(ctx, bson.M{"$and": queryTerms}, opts)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var docs DocumentSlice
+	if err := cursor.All(ctx, &docs); err != nil {
+		return nil, err
+	}
+
+	return docs, nil
+}
+
+// FindActivityDefinitions は StatementStore.FindActivityDefinitions を実装する。
+func (m *MongoStore) FindActivityDefinitions(ctx context.Context, user, app, activityID string) ([]map[string]interface{}, error) {
+	return FindActivityDefinitions(ctx, m.db.Collection("statement"), user, app, activityID)
+}
+
+// FindAgentNames は StatementStore.FindAgentNames を実装する。
+func (m *MongoStore) FindAgentNames(ctx context.Context, user, app string, agent map[string]interface{}) ([]string, error) {
+	cursor, err := m.db.Collection("statement").Aggregate(ctx, agentNamesPipeline(user, app, agent))
+	if err != nil {
+		return nil, err
+	}
+
+	var groups []struct {
+		Name string `bson:"_id"`
+	}
+	if err := cursor.All(ctx, &groups); err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(groups))
+	for _, g := range groups {
+		names = append(names, g.Name)
+	}
+
+	return names, nil
+}
+
+// QuotaUsage は StatementStore.QuotaUsage を実装する。
+func (m *MongoStore) QuotaUsage(ctx context.Context, user string) (int64, error) {
+	quota, err := GetQuota(ctx, m.db, user)
+	if err != nil {
+		return 0, err
+	}
+
+	return quota.Usage, nil
+}
+
+// ConsistentThrough は StatementStore.ConsistentThrough を実装する。
+// 挿入中のバッチがある場合は、その stored より前の時刻とする。
+func (m *MongoStore) ConsistentThrough(ctx context.Context) time.Time {
+	return m.window.through(ConsistentThrough(ctx, m.db))
+}
+
+// InsertMoreCursor は StatementStore.InsertMoreCursor を実装する。
+func (m *MongoStore) InsertMoreCursor(ctx context.Context, cursor *MoreCursor) error {
+	return cursor.InsertTo(ctx, m.db.Collection("more"))
+}
+
+// FindMoreCursor は StatementStore.FindMoreCursor を実装する。
+func (m *MongoStore) FindMoreCursor(ctx context.Context, user, app, id string) (*MoreCursor, error) {
+	return FindMoreCursor(ctx, m.db.Collection("more"), user, app, id)
+}
+
+// bucket は添付ファイルを保存する GridFS のバケットを返す。
+func (m *MongoStore) bucket() (*gridfs.Bucket, error) {
+	return gridfs.NewBucket(m.db)
+}
+
+// PutAttachment は StatementStore.PutAttachment を実装する。
+func (m *MongoStore) PutAttachment(ctx context.Context, sha2, contentType, encoding string, r io.Reader) (interface{}, error) {
+	bucket, err := m.bucket()
+	if err != nil {
+		return nil, err
+	}
+
+	stream, err := bucket.OpenUploadStream(sha2, options.GridFSUpload().SetMetadata(bson.M{
+		"Content-Type":              contentType,
+		"Content-Transfer-Encoding": encoding,
+	}))
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := io.Copy(stream, r); err != nil {
+		stream.Abort()
+		return nil, err
+	}
+	if err := stream.Close(); err != nil {
+		return nil, err
+	}
+
+	return stream.FileID, nil
+}
+
+// OpenAttachment は StatementStore.OpenAttachment を実装する。
+// 同じ sha2 値のファイルが複数ある場合は、最も新しく保存されたものを開く。
+func (m *MongoStore) OpenAttachment(ctx context.Context, sha2 string) (*Attachment, error) {
+	bucket, err := m.bucket()
+	if err != nil {
+		return nil, err
+	}
+
+	stream, err := bucket.OpenDownloadStreamByName(sha2)
+	if err == gridfs.ErrFileNotFound {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	contentType, _, err := gridFileMetadata(stream.GetFile())
+	if err != nil {
+		stream.Close()
+		return nil, err
+	}
+
+	return &Attachment{stream, contentType}, nil
+}
+
+// gridFileMetadata は GridFS のファイルのメタデータから Content-Type と Content-Transfer-Encoding を返す。
+func gridFileMetadata(file *gridfs.File) (contentType, encoding string, err error) {
+	if len(file.Metadata) == 0 {
+		return "", "", nil
+	}
+
+	var metadata map[string]interface{}
+	if err := bson.Unmarshal(file.Metadata, &metadata); err != nil {
+		return "", "", err
+	}
+	contentType, _ = metadata["Content-Type"].(string)
+	encoding, _ = metadata["Content-Transfer-Encoding"].(string)
+
+	return contentType, encoding, nil
+}
+
+// RemoveAttachment は StatementStore.RemoveAttachment を実装する。
+func (m *MongoStore) RemoveAttachment(ctx context.Context, id interface{}) error {
+	bucket, err := m.bucket()
+	if err != nil {
+		return err
+	}
+
+	if err := bucket.DeleteContext(ctx, id); err != nil && err != gridfs.ErrFileNotFound {
+		return err
+	}
+
+	return nil
+}
+
+// EachStatement は MigratableStore.EachStatement を実装する。
+func (m *MongoStore) EachStatement(ctx context.Context, f func(doc *Document) error) error {
+	cursor, err := m.db.Collection("statement").Find(ctx, bson.M{}, options.Find().
+		SetSort(bson.D{{Key: "_id", Value: 1}}))
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		var doc Document
+		if err := cursor.Decode(&doc); err != nil {
+			return err
+		}
+		if err := f(&doc); err != nil {
+			return err
+		}
+	}
+
+	return cursor.Err()
+}
+
+// EachAttachment は MigratableStore.EachAttachment を実装する。
+func (m *MongoStore) EachAttachment(ctx context.Context, f func(sha2, contentType, encoding string, r io.Reader) error) error {
+	bucket, err := m.bucket()
+	if err != nil {
+		return err
+	}
+
+	cursor, err := bucket.FindContext(ctx, bson.M{}, options.GridFSFind().
+		SetSort(bson.D{{Key: "uploadDate", Value: 1}}))
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		var file gridfs.File
+		if err := cursor.Decode(&file); err != nil {
+			return err
+		}
+		contentType, encoding, err := gridFileMetadata(&file)
+		if err != nil {
+			return err
+		}
+
+		stream, err := bucket.OpenDownloadStream(file.ID)
+		if err != nil {
+			return err
+		}
+		err = f(file.Name, contentType, encoding, stream)
+		stream.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	return cursor.Err()
+}
+
+// EachQuota は MigratableStore.EachQuota を実装する。
+func (m *MongoStore) EachQuota(ctx context.Context, f func(user string, usage int64) error) error {
+	cursor, err := m.db.Collection("quota").Find(ctx, bson.M{}, options.Find().
+		SetSort(bson.D{{Key: "user", Value: 1}}))
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		var quota Quota
+		if err := cursor.Decode(&quota); err != nil {
+			return err
+		}
+		if err := f(quota.User, quota.Usage); err != nil {
+			return err
+		}
+	}
+
+	return cursor.Err()
+}
+
+// ImportStatements は MigratableStore.ImportStatements を実装する。
+// 挿入の途中で失敗した場合は、このバッチで挿入したステートメントを削除する。
+// 削除は _id により行うため、同じ _id のドキュメントが既にある場合は挿入しない。
+func (m *MongoStore) ImportStatements(ctx context.Context, docs DocumentSlice) error {
+	col := m.db.Collection("statement")
+
+	ids := make([]primitive.ObjectID, 0, len(docs))
+	for _, doc := range docs {
+		ids = append(ids, doc.ID)
+	}
+	n, err := col.CountDocuments(ctx, bson.M{"_id": bson.M{"$in": ids}})
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		return ErrDuplicateStatement
+	}
+
+	if err := docs.InsertTo(ctx, col); err != nil {
+		rollbackStatements(context.Background(), col, docs)
+
+		if mongo.IsDuplicateKeyError(err) {
+			return ErrDuplicateStatement
+		}
+		return err
+	}
+
+	return nil
+}
+
+// SetQuotaUsage は MigratableStore.SetQuotaUsage を実装する。
+func (m *MongoStore) SetQuotaUsage(ctx context.Context, user string, usage int64) error {
+	_, err := m.db.Collection("quota").UpdateOne(ctx,
+		bson.M{"user": user},
+		bson.M{"$set": bson.M{"usage": usage}},
+		options.Update().SetUpsert(true))
+	return err
+}
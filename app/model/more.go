@@ -0,0 +1,88 @@
+// Copyright 2015 realglobe, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package model
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// MoreCursor は more URL により続きを取得するための、ステートメント検索の状態を表す。
+// Timestamp, LastID は直前のページの最後のステートメントの位置を、
+// Snapshot は最初のページを検索した時刻を表す。Snapshot より後に保存された
+// ステートメントは続きのページに含めない。
+type MoreCursor struct {
+	ID        primitive.ObjectID `bson:"_id,omitempty"`
+	Version   string             `bson:"version"`
+	User      string             `bson:"user"`
+	App       string             `bson:"app"`
+	Params    string             `bson:"params"`
+	Timestamp time.Time          `bson:"timestamp"`
+	LastID    primitive.ObjectID `bson:"lastId"`
+	Snapshot  time.Time          `bson:"snapshot"`
+	Created   time.Time          `bson:"created"`
+}
+
+func NewMoreCursor(version, user, app, params string, last *Document, snapshot time.Time) *MoreCursor {
+	return &MoreCursor{
+		primitive.NewObjectID(),
+		version,
+		user,
+		app,
+		params,
+		last.Timestamp,
+		last.ID,
+		snapshot,
+		time.Now(),
+	}
+}
+
+func (m *MoreCursor) InsertTo(ctx context.Context, col *mongo.Collection) error {
+	_, err := col.InsertOne(ctx, m)
+	return err
+}
+
+// IsExpired は作成から expiration が経過しているかを返す。
+// TTL インデックスによる削除は即座に行われないため、取得時にも有効期間を確認する。
+func (m *MoreCursor) IsExpired(expiration time.Duration) bool {
+	return time.Since(m.Created) > expiration
+}
+
+// FindMoreCursor は id の MoreCursor を返す。存在しない場合は ErrNotFound を返す。
+func FindMoreCursor(ctx context.Context, col *mongo.Collection, user, app, id string) (*MoreCursor, error) {
+	oid, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, ErrNotFound
+	}
+
+	var cursor MoreCursor
+	err = col.FindOne(ctx, bson.M{
+		"_id":  oid,
+		"user": user,
+		"app":  app,
+	}).Decode(&cursor)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &cursor, nil
+}
@@ -0,0 +1,123 @@
+// Copyright 2015 realglobe, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package model
+
+import (
+	"database/sql"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// PostgresStore は PostgreSQL にステートメントを保存する StatementStore である。PostgreSQL 12 以降が必要となる。
+// 添付ファイルは bytea として保存する。
+type PostgresStore struct {
+	*sqlStore
+}
+
+// postgresSchema は sqlSchema に加えて PostgresStore が用いるインデックスである。
+var postgresSchema = []string{
+	// related_agents, related_activities の検索は data の包含 (@>) により行う
+	`CREATE INDEX IF NOT EXISTS statement_data_idx ON statement USING gin (data jsonb_path_ops)`,
+}
+
+// OpenPostgresStore は url (lib/pq の接続文字列) の PostgreSQL に接続し、
+// 必要なテーブルを作成した PostgresStore を返す。
+func OpenPostgresStore(url string) (*PostgresStore, error) {
+	db, err := sql.Open("postgres", url)
+	if err != nil {
+		return nil, err
+	}
+
+	store, err := openSQLStore(db, postgresDialect{}, postgresSchema...)
+	if err != nil {
+		return nil, err
+	}
+
+	return &PostgresStore{store}, nil
+}
+
+// postgresDialect は PostgreSQL の sqlDialect である。
+// ステートメントは JSONB として保存し、data の条件は包含 (@>) により GIN インデックスを用いて検索する。
+type postgresDialect struct{}
+
+func (postgresDialect) rebind(query string) string {
+	return query
+}
+
+func (postgresDialect) types() sqlTypes {
+	return sqlTypes{
+		// doc_id は MongoStore の _id と同じ順序でソートするため、照合順序を C とする
+		id:        `text COLLATE "C"`,
+		text:      "text",
+		integer:   "bigint",
+		time:      "timestamptz",
+		json:      "jsonb",
+		blob:      "bytea",
+		serial:    "bigserial PRIMARY KEY",
+		generated: " STORED",
+	}
+}
+
+func (postgresDialect) time(t time.Time) interface{} {
+	return t
+}
+
+func (postgresDialect) forUpdate() string {
+	return " FOR UPDATE"
+}
+
+func (postgresDialect) isDuplicate(err error) bool {
+	// unique_violation
+	e, ok := err.(*pq.Error)
+	return ok && e.Code == "23505"
+}
+
+// postgresPath は path を PostgreSQL のパスの配列の文字列リテラルとする。
+func postgresPath(path []string) string {
+	return "'{" + strings.Join(path, ",") + "}'"
+}
+
+func (postgresDialect) jsonText(data string, path ...string) string {
+	return "(" + data + " #>> " + postgresPath(path) + ")"
+}
+
+func (postgresDialect) jsonValue(data string, path ...string) string {
+	return "(" + data + " #> " + postgresPath(path) + ")"
+}
+
+func (postgresDialect) jsonType(data string, path ...string) string {
+	return "jsonb_typeof(" + data + " #> " + postgresPath(path) + ")"
+}
+
+func (postgresDialect) matchTerm(alias string, path []string, v map[string]interface{}, args *sqlArgs) string {
+	return alias + ".data @> " + args.add(containmentOf(path, v)) + "::jsonb"
+}
+
+func (postgresDialect) elemMatchTerm(alias string, path []string, v map[string]interface{}, args *sqlArgs) string {
+	return alias + ".data @> " + args.add(containmentOf(path, []interface{}{v})) + "::jsonb"
+}
+
+// containmentOf は path の位置に v を持つ JSON を返す。
+func containmentOf(path []string, v interface{}) string {
+	for i := len(path) - 1; i >= 0; i-- {
+		v = map[string]interface{}{path[i]: v}
+	}
+	b, _ := json.Marshal(v)
+
+	return string(b)
+}
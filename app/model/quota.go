@@ -15,48 +15,60 @@
 package model
 
 import (
+	"context"
+
 	"github.com/realglobe-Inc/edo-xrs/app/miscs"
-	"gopkg.in/mgo.v2"
-	"gopkg.in/mgo.v2/bson"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 type Quota struct {
-	ID    bson.ObjectId `bson:"_id,omitempty"`
-	User  string        `bson:"user"`
-	Usage int64         `bson:"usage"`
+	ID    primitive.ObjectID `bson:"_id,omitempty"`
+	User  string             `bson:"user"`
+	Usage int64              `bson:"usage"`
 }
 
 func (q *Quota) Check() bool {
 	return q.Usage < miscs.GlobalConfig.Quota.UserMaxUsage
 }
 
-func (q *Quota) IncrementUsageTo(db *mgo.Database, amount int64) error {
-	return db.C("quota").Update(bson.M{"_id": q.ID}, bson.M{"$inc": bson.M{"usage": amount}})
+func (q *Quota) IncrementUsageTo(ctx context.Context, db *mongo.Database, amount int64) error {
+	_, err := db.Collection("quota").UpdateOne(ctx, bson.M{"_id": q.ID}, bson.M{"$inc": bson.M{"usage": amount}})
+	return err
 }
 
-func GetQuota(db *mgo.Database, user string) (*Quota, error) {
-	col := db.C("quota")
+// ReserveUsageTo は使用量が上限に達していない場合に限り、使用量に amount を加える。
+// 確認と加算を一つの更新で行うため、同時に行われる他の加算と競合しない。
+// 上限に達している場合は ErrQuotaExceeded を返す。
+func (q *Quota) ReserveUsageTo(ctx context.Context, db *mongo.Database, amount int64) error {
+	result, err := db.Collection("quota").UpdateOne(ctx, bson.M{
+		"_id":   q.ID,
+		"usage": bson.M{"$lt": miscs.GlobalConfig.Quota.UserMaxUsage},
+	}, bson.M{"$inc": bson.M{"usage": amount}})
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrQuotaExceeded
+	}
+
+	return nil
+}
 
+// GetQuota はユーザーの Quota を返す。存在しない場合は使用量 0 の Quota を作成する。
+// 同時に作成しようとした場合も一つの Quota となるよう、upsert により作成する。
+func GetQuota(ctx context.Context, db *mongo.Database, user string) (*Quota, error) {
 	var quota Quota
-	if n, err := col.Find(bson.M{"user": user}).Count(); err == nil && n > 0 {
-		if err = col.Find(bson.M{"user": user}).One(&quota); err != nil {
-			return nil, err
-		}
-
-		return &quota, nil
-	} else if n == 0 {
-		quota.ID = bson.NewObjectId()
-		quota.User = user
-		quota.Usage = 0
-
-		if err = col.Insert(quota); err != nil {
-			return nil, err
-		}
-
-		return &quota, nil
-	} else {
+	err := db.Collection("quota").FindOneAndUpdate(ctx,
+		bson.M{"user": user},
+		bson.M{"$setOnInsert": bson.M{"usage": int64(0)}},
+		options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After),
+	).Decode(&quota)
+	if err != nil {
 		return nil, err
 	}
 
-	return nil, nil // unreached
+	return &quota, nil
 }
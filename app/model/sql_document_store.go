@@ -0,0 +1,471 @@
+// Copyright 2015 realglobe, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package model
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// sqlTxKey は InsertStatements が commit に渡す context に、実行中のトランザクションを保持するキーである。
+type sqlTxKey struct{}
+
+// queryer は ctx にトランザクションがあればそれを、なければデータベースを返す。
+// commit から呼ばれたドキュメントの書き込みは、ステートメントの挿入と同じトランザクションで行われる。
+func (s *sqlStore) queryer(ctx context.Context) sqlQueryer {
+	if tx, ok := ctx.Value(sqlTxKey{}).(*sql.Tx); ok {
+		return tx
+	}
+
+	return s.db
+}
+
+// sqlBool は真偽値を integer の列に保存する値とする。
+func sqlBool(b bool) int64 {
+	if b {
+		return 1
+	}
+
+	return 0
+}
+
+// sinceTerm は updated の列が since より後である条件を、since がゼロ値の場合は常に真となる条件を返す。
+func (s *sqlStore) sinceTerm(since time.Time, args *sqlArgs) string {
+	if since.IsZero() {
+		return "TRUE"
+	}
+
+	return "updated > " + args.add(s.d.time(since))
+}
+
+// queryStrings は一つの文字列の列を返すクエリを実行し、その値を返す。
+func (s *sqlStore) queryStrings(ctx context.Context, query string, args ...interface{}) ([]string, error) {
+	rows, err := s.query(ctx, s.queryer(ctx), query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	values := []string{}
+	for rows.Next() {
+		var v string
+		if err := rows.Scan(&v); err != nil {
+			return nil, err
+		}
+		values = append(values, v)
+	}
+
+	return values, rows.Err()
+}
+
+// removeRow は一つの行を削除するクエリを実行する。削除する行が無い場合は ErrNotFound を返す。
+func (s *sqlStore) removeRow(ctx context.Context, query string, args ...interface{}) error {
+	res, err := s.exec(ctx, s.queryer(ctx), query, args...)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+// SaveState は DocumentStore.SaveState を実装する。
+func (s *sqlStore) SaveState(ctx context.Context, state *State) error {
+	_, err := s.exec(ctx, s.queryer(ctx), `INSERT INTO state
+		("user", app, activity_id, agent, registration, state_id, content_type, content, updated)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		ON CONFLICT ("user", app, activity_id, agent, registration, state_id) DO UPDATE SET
+		content_type = excluded.content_type, content = excluded.content, updated = excluded.updated`,
+		state.User, state.App, state.ActivityID, state.Agent, state.Registration, state.StateID,
+		state.ContentType, state.Content, s.d.time(state.Updated))
+	return err
+}
+
+// FindState は DocumentStore.FindState を実装する。
+func (s *sqlStore) FindState(ctx context.Context, user, app, activityID, agent, registration, stateID string) (*State, error) {
+	state := State{
+		User:         user,
+		App:          app,
+		ActivityID:   activityID,
+		Agent:        agent,
+		Registration: registration,
+		StateID:      stateID,
+	}
+	err := s.queryRow(ctx, s.queryer(ctx), `SELECT content_type, content, updated FROM state
+		WHERE "user" = $1 AND app = $2 AND activity_id = $3 AND agent = $4 AND registration = $5 AND state_id = $6`,
+		user, app, activityID, agent, registration, stateID).Scan(&state.ContentType, &state.Content, sqlTime{&state.Updated})
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &state, nil
+}
+
+// stateSetTerm は stateSetQuery と同じ条件を返す。
+func stateSetTerm(user, app, activityID, agent, registration string, args *sqlArgs) string {
+	term := `"user" = ` + args.add(user) + ` AND app = ` + args.add(app) +
+		` AND activity_id = ` + args.add(activityID) + ` AND agent = ` + args.add(agent)
+	if len(registration) > 0 {
+		term += ` AND registration = ` + args.add(registration)
+	}
+
+	return term
+}
+
+// FindStateIDs は DocumentStore.FindStateIDs を実装する。
+func (s *sqlStore) FindStateIDs(ctx context.Context, user, app, activityID, agent, registration string, since time.Time) ([]string, error) {
+	var args sqlArgs
+	where := stateSetTerm(user, app, activityID, agent, registration, &args) + ` AND ` + s.sinceTerm(since, &args)
+
+	return s.queryStrings(ctx, `SELECT DISTINCT state_id FROM state WHERE `+where+` ORDER BY state_id`, args...)
+}
+
+// RemoveStates は DocumentStore.RemoveStates を実装する。
+func (s *sqlStore) RemoveStates(ctx context.Context, user, app, activityID, agent, registration, stateID string) (int64, error) {
+	var args sqlArgs
+	var where string
+	if len(stateID) > 0 {
+		where = stateSetTerm(user, app, activityID, agent, "", &args) +
+			` AND registration = ` + args.add(registration) + ` AND state_id = ` + args.add(stateID)
+	} else {
+		where = stateSetTerm(user, app, activityID, agent, registration, &args)
+	}
+
+	q := s.queryer(ctx)
+	var size sql.NullInt64
+	if err := s.queryRow(ctx, q, `SELECT SUM(LENGTH(content)) FROM state WHERE `+where, args...).Scan(&size); err != nil {
+		return 0, err
+	}
+	if _, err := s.exec(ctx, q, `DELETE FROM state WHERE `+where, args...); err != nil {
+		return 0, err
+	}
+
+	return size.Int64, nil
+}
+
+// SaveActivityProfile は DocumentStore.SaveActivityProfile を実装する。
+func (s *sqlStore) SaveActivityProfile(ctx context.Context, profile *ActivityProfile) error {
+	_, err := s.exec(ctx, s.queryer(ctx), `INSERT INTO activity_profile
+		("user", app, activity_id, profile_id, content_type, content, updated)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		ON CONFLICT ("user", app, activity_id, profile_id) DO UPDATE SET
+		content_type = excluded.content_type, content = excluded.content, updated = excluded.updated`,
+		profile.User, profile.App, profile.ActivityID, profile.ProfileID,
+		profile.ContentType, profile.Content, s.d.time(profile.Updated))
+	return err
+}
+
+// FindActivityProfile は DocumentStore.FindActivityProfile を実装する。
+func (s *sqlStore) FindActivityProfile(ctx context.Context, user, app, activityID, profileID string) (*ActivityProfile, error) {
+	profile := ActivityProfile{User: user, App: app, ActivityID: activityID, ProfileID: profileID}
+	err := s.queryRow(ctx, s.queryer(ctx), `SELECT content_type, content, updated FROM activity_profile
+		WHERE "user" = $1 AND app = $2 AND activity_id = $3 AND profile_id = $4`,
+		user, app, activityID, profileID).Scan(&profile.ContentType, &profile.Content, sqlTime{&profile.Updated})
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &profile, nil
+}
+
+// FindActivityProfileIDs は DocumentStore.FindActivityProfileIDs を実装する。
+func (s *sqlStore) FindActivityProfileIDs(ctx context.Context, user, app, activityID string, since time.Time) ([]string, error) {
+	args := sqlArgs{user, app, activityID}
+	return s.queryStrings(ctx, `SELECT profile_id FROM activity_profile
+		WHERE "user" = $1 AND app = $2 AND activity_id = $3 AND `+s.sinceTerm(since, &args)+`
+		ORDER BY profile_id`, args...)
+}
+
+// RemoveActivityProfile は DocumentStore.RemoveActivityProfile を実装する。
+func (s *sqlStore) RemoveActivityProfile(ctx context.Context, user, app, activityID, profileID string) error {
+	return s.removeRow(ctx, `DELETE FROM activity_profile
+		WHERE "user" = $1 AND app = $2 AND activity_id = $3 AND profile_id = $4`, user, app, activityID, profileID)
+}
+
+// SaveAgentProfile は DocumentStore.SaveAgentProfile を実装する。
+func (s *sqlStore) SaveAgentProfile(ctx context.Context, profile *AgentProfile) error {
+	_, err := s.exec(ctx, s.queryer(ctx), `INSERT INTO agent_profile
+		("user", app, agent, profile_id, content_type, content, updated)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		ON CONFLICT ("user", app, agent, profile_id) DO UPDATE SET
+		content_type = excluded.content_type, content = excluded.content, updated = excluded.updated`,
+		profile.User, profile.App, profile.Agent, profile.ProfileID,
+		profile.ContentType, profile.Content, s.d.time(profile.Updated))
+	return err
+}
+
+// FindAgentProfile は DocumentStore.FindAgentProfile を実装する。
+func (s *sqlStore) FindAgentProfile(ctx context.Context, user, app, agent, profileID string) (*AgentProfile, error) {
+	profile := AgentProfile{User: user, App: app, Agent: agent, ProfileID: profileID}
+	err := s.queryRow(ctx, s.queryer(ctx), `SELECT content_type, content, updated FROM agent_profile
+		WHERE "user" = $1 AND app = $2 AND agent = $3 AND profile_id = $4`,
+		user, app, agent, profileID).Scan(&profile.ContentType, &profile.Content, sqlTime{&profile.Updated})
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &profile, nil
+}
+
+// FindAgentProfileIDs は DocumentStore.FindAgentProfileIDs を実装する。
+func (s *sqlStore) FindAgentProfileIDs(ctx context.Context, user, app, agent string, since time.Time) ([]string, error) {
+	args := sqlArgs{user, app, agent}
+	return s.queryStrings(ctx, `SELECT profile_id FROM agent_profile
+		WHERE "user" = $1 AND app = $2 AND agent = $3 AND `+s.sinceTerm(since, &args)+`
+		ORDER BY profile_id`, args...)
+}
+
+// RemoveAgentProfile は DocumentStore.RemoveAgentProfile を実装する。
+func (s *sqlStore) RemoveAgentProfile(ctx context.Context, user, app, agent, profileID string) error {
+	return s.removeRow(ctx, `DELETE FROM agent_profile
+		WHERE "user" = $1 AND app = $2 AND agent = $3 AND profile_id = $4`, user, app, agent, profileID)
+}
+
+// SaveXAPIProfile は DocumentStore.SaveXAPIProfile を実装する。
+func (s *sqlStore) SaveXAPIProfile(ctx context.Context, profile *XAPIProfile) error {
+	_, err := s.exec(ctx, s.queryer(ctx), `INSERT INTO xapi_profile ("user", app, profile_id, content, updated)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT ("user", app, profile_id) DO UPDATE SET content = excluded.content, updated = excluded.updated`,
+		profile.User, profile.App, profile.ProfileID, profile.Content, s.d.time(profile.Updated))
+	return err
+}
+
+// FindXAPIProfile は DocumentStore.FindXAPIProfile を実装する。
+func (s *sqlStore) FindXAPIProfile(ctx context.Context, user, app, profileID string) (*XAPIProfile, error) {
+	profile := XAPIProfile{User: user, App: app, ProfileID: profileID}
+	err := s.queryRow(ctx, s.queryer(ctx), `SELECT content, updated FROM xapi_profile
+		WHERE "user" = $1 AND app = $2 AND profile_id = $3`,
+		user, app, profileID).Scan(&profile.Content, sqlTime{&profile.Updated})
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &profile, nil
+}
+
+// FindXAPIProfiles は DocumentStore.FindXAPIProfiles を実装する。
+func (s *sqlStore) FindXAPIProfiles(ctx context.Context, user, app string) ([]XAPIProfile, error) {
+	rows, err := s.query(ctx, s.queryer(ctx), `SELECT profile_id, content, updated FROM xapi_profile
+		WHERE "user" = $1 AND app = $2 ORDER BY profile_id`, user, app)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var profiles []XAPIProfile
+	for rows.Next() {
+		profile := XAPIProfile{User: user, App: app}
+		if err := rows.Scan(&profile.ProfileID, &profile.Content, sqlTime{&profile.Updated}); err != nil {
+			return nil, err
+		}
+		profiles = append(profiles, profile)
+	}
+
+	return profiles, rows.Err()
+}
+
+// RemoveXAPIProfile は DocumentStore.RemoveXAPIProfile を実装する。
+func (s *sqlStore) RemoveXAPIProfile(ctx context.Context, user, app, profileID string) error {
+	return s.removeRow(ctx, `DELETE FROM xapi_profile WHERE "user" = $1 AND app = $2 AND profile_id = $3`,
+		user, app, profileID)
+}
+
+// SaveCMI5Session は DocumentStore.SaveCMI5Session を実装する。
+func (s *sqlStore) SaveCMI5Session(ctx context.Context, session *CMI5Session) error {
+	_, err := s.exec(ctx, s.queryer(ctx), `INSERT INTO cmi5_session
+		("user", app, registration, session_id, launch_mode, state, updated)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		ON CONFLICT ("user", app, registration, session_id) DO UPDATE SET
+		launch_mode = excluded.launch_mode, state = excluded.state, updated = excluded.updated`,
+		session.User, session.App, session.Registration, session.SessionID,
+		session.LaunchMode, session.State, s.d.time(session.Updated))
+	return err
+}
+
+// FindCMI5Session は DocumentStore.FindCMI5Session を実装する。
+func (s *sqlStore) FindCMI5Session(ctx context.Context, user, app, registration, sessionID string) (*CMI5Session, error) {
+	session := CMI5Session{User: user, App: app, Registration: registration, SessionID: sessionID}
+	err := s.queryRow(ctx, s.queryer(ctx), `SELECT launch_mode, state, updated FROM cmi5_session
+		WHERE "user" = $1 AND app = $2 AND registration = $3 AND session_id = $4`,
+		user, app, registration, sessionID).Scan(&session.LaunchMode, &session.State, sqlTime{&session.Updated})
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &session, nil
+}
+
+// FindCMI5Sessions は DocumentStore.FindCMI5Sessions を実装する。
+func (s *sqlStore) FindCMI5Sessions(ctx context.Context, user, app, registration string) ([]CMI5Session, error) {
+	rows, err := s.query(ctx, s.queryer(ctx), `SELECT session_id, launch_mode, state, updated FROM cmi5_session
+		WHERE "user" = $1 AND app = $2 AND registration = $3 ORDER BY updated, session_id`, user, app, registration)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var sessions []CMI5Session
+	for rows.Next() {
+		session := CMI5Session{User: user, App: app, Registration: registration}
+		if err := rows.Scan(&session.SessionID, &session.LaunchMode, &session.State, sqlTime{&session.Updated}); err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, session)
+	}
+
+	return sessions, rows.Err()
+}
+
+// SaveCMI5Registration は DocumentStore.SaveCMI5Registration を実装する。
+func (s *sqlStore) SaveCMI5Registration(ctx context.Context, r *CMI5Registration) error {
+	_, err := s.exec(ctx, s.queryer(ctx), `INSERT INTO cmi5_registration
+		("user", app, registration, completed, passed, failed, satisfied, waived, updated)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		ON CONFLICT ("user", app, registration) DO UPDATE SET
+		completed = excluded.completed, passed = excluded.passed, failed = excluded.failed,
+		satisfied = excluded.satisfied, waived = excluded.waived, updated = excluded.updated`,
+		r.User, r.App, r.Registration, sqlBool(r.Completed), sqlBool(r.Passed), sqlBool(r.Failed),
+		sqlBool(r.Satisfied), sqlBool(r.Waived), s.d.time(r.Updated))
+	return err
+}
+
+// FindCMI5Registration は DocumentStore.FindCMI5Registration を実装する。
+func (s *sqlStore) FindCMI5Registration(ctx context.Context, user, app, registration string) (*CMI5Registration, error) {
+	r := CMI5Registration{User: user, App: app, Registration: registration}
+	var completed, passed, failed, satisfied, waived int64
+	err := s.queryRow(ctx, s.queryer(ctx), `SELECT completed, passed, failed, satisfied, waived, updated
+		FROM cmi5_registration WHERE "user" = $1 AND app = $2 AND registration = $3`,
+		user, app, registration).Scan(&completed, &passed, &failed, &satisfied, &waived, sqlTime{&r.Updated})
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	r.Completed, r.Passed, r.Failed, r.Satisfied, r.Waived = completed != 0, passed != 0, failed != 0, satisfied != 0, waived != 0
+
+	return &r, nil
+}
+
+// AddQuotaUsage は DocumentStore.AddQuotaUsage を実装する。
+func (s *sqlStore) AddQuotaUsage(ctx context.Context, user string, amount int64) error {
+	_, err := s.exec(ctx, s.queryer(ctx), `INSERT INTO quota ("user", usage) VALUES ($1, $2)
+		ON CONFLICT ("user") DO UPDATE SET usage = quota.usage + excluded.usage`, user, amount)
+	return err
+}
+
+// EachDocument は MigratableStore.EachDocument を実装する。
+// SQL のテーブルは ID を持たないため、各ドキュメントには新たな ID を与える。
+func (s *sqlStore) EachDocument(ctx context.Context, f func(doc interface{}) error) error {
+	tables := []struct {
+		query string
+		scan  func(rows *sql.Rows) (interface{}, error)
+	}{
+		{`SELECT "user", app, activity_id, agent, registration, state_id, content_type, content, updated FROM state
+			ORDER BY "user", app, activity_id, agent, registration, state_id`, func(rows *sql.Rows) (interface{}, error) {
+			d := State{ID: primitive.NewObjectID()}
+			err := rows.Scan(&d.User, &d.App, &d.ActivityID, &d.Agent, &d.Registration, &d.StateID,
+				&d.ContentType, &d.Content, sqlTime{&d.Updated})
+			return &d, err
+		}},
+		{`SELECT "user", app, activity_id, profile_id, content_type, content, updated FROM activity_profile
+			ORDER BY "user", app, activity_id, profile_id`, func(rows *sql.Rows) (interface{}, error) {
+			d := ActivityProfile{ID: primitive.NewObjectID()}
+			err := rows.Scan(&d.User, &d.App, &d.ActivityID, &d.ProfileID, &d.ContentType, &d.Content, sqlTime{&d.Updated})
+			return &d, err
+		}},
+		{`SELECT "user", app, agent, profile_id, content_type, content, updated FROM agent_profile
+			ORDER BY "user", app, agent, profile_id`, func(rows *sql.Rows) (interface{}, error) {
+			d := AgentProfile{ID: primitive.NewObjectID()}
+			err := rows.Scan(&d.User, &d.App, &d.Agent, &d.ProfileID, &d.ContentType, &d.Content, sqlTime{&d.Updated})
+			return &d, err
+		}},
+		{`SELECT "user", app, profile_id, content, updated FROM xapi_profile
+			ORDER BY "user", app, profile_id`, func(rows *sql.Rows) (interface{}, error) {
+			d := XAPIProfile{ID: primitive.NewObjectID()}
+			err := rows.Scan(&d.User, &d.App, &d.ProfileID, &d.Content, sqlTime{&d.Updated})
+			return &d, err
+		}},
+		{`SELECT "user", app, registration, session_id, launch_mode, state, updated FROM cmi5_session
+			ORDER BY "user", app, registration, session_id`, func(rows *sql.Rows) (interface{}, error) {
+			d := CMI5Session{ID: primitive.NewObjectID()}
+			err := rows.Scan(&d.User, &d.App, &d.Registration, &d.SessionID, &d.LaunchMode, &d.State, sqlTime{&d.Updated})
+			return &d, err
+		}},
+		{`SELECT "user", app, registration, completed, passed, failed, satisfied, waived, updated FROM cmi5_registration
+			ORDER BY "user", app, registration`, func(rows *sql.Rows) (interface{}, error) {
+			d := CMI5Registration{ID: primitive.NewObjectID()}
+			var completed, passed, failed, satisfied, waived int64
+			err := rows.Scan(&d.User, &d.App, &d.Registration, &completed, &passed, &failed, &satisfied, &waived, sqlTime{&d.Updated})
+			d.Completed, d.Passed, d.Failed, d.Satisfied, d.Waived = completed != 0, passed != 0, failed != 0, satisfied != 0, waived != 0
+			return &d, err
+		}},
+	}
+
+	for _, t := range tables {
+		if err := s.eachRow(ctx, t.query, func(rows *sql.Rows) error {
+			doc, err := t.scan(rows)
+			if err != nil {
+				return err
+			}
+			return f(doc)
+		}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// eachRow は query の結果の各行について f を呼ぶ。
+func (s *sqlStore) eachRow(ctx context.Context, query string, f func(rows *sql.Rows) error) error {
+	rows, err := s.query(ctx, s.db, query)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		if err := f(rows); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
@@ -0,0 +1,984 @@
+// Copyright 2015 realglobe, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package model
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/realglobe-Inc/edo-xrs/app/miscs"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// sqlDialect は sqlStore が発行する SQL の、データベースによる違いを表す。
+// sqlStore のクエリはプレースホルダを $1, $2, ... と書き、rebind によりデータベースの形式とする。
+type sqlDialect interface {
+	// rebind はクエリのプレースホルダをデータベースの形式に書き換える。
+	rebind(query string) string
+
+	// types はテーブルの列の型である。
+	types() sqlTypes
+
+	// time は時刻をデータベースに保存する値とする。
+	time(t time.Time) interface{}
+
+	// forUpdate は SELECT に加えて行をロックする句である。ロックできない場合は空文字列とする。
+	forUpdate() string
+
+	// isDuplicate は err が一意性制約の違反であるかを返す。
+	isDuplicate(err error) bool
+
+	// jsonText は JSON の式 data の path の位置にある値を、文字列などの SQL の値として返す式である。
+	jsonText(data string, path ...string) string
+
+	// jsonValue は JSON の式 data の path の位置にある値を、JSON として返す式である。
+	jsonValue(data string, path ...string) string
+
+	// jsonType は JSON の式 data の path の位置にある値の型 ('object', 'array' など) を返す式である。
+	jsonType(data string, path ...string) string
+
+	// matchTerm は alias の data の path にあるオブジェクトが、v の全てのフィールドと同じ値を持つ条件である。
+	matchTerm(alias string, path []string, v map[string]interface{}, args *sqlArgs) string
+
+	// elemMatchTerm は alias の data の path にある配列に、v の全てのフィールドと同じ値を持つ
+	// オブジェクトがある条件 (MongoDB の $elemMatch と同じ条件) である。
+	elemMatchTerm(alias string, path []string, v map[string]interface{}, args *sqlArgs) string
+}
+
+// sqlTypes は sqlSchema がテーブルの列に用いる型である。
+type sqlTypes struct {
+	id        string // doc_id の型。MongoStore の _id と同じ順序でソートされなければならない
+	text      string
+	integer   string
+	time      string
+	json      string
+	blob      string
+	serial    string // 自動的に採番される主キー
+	generated string // 生成列の定義の後に加える指定
+}
+
+// sqlSchema は sqlStore が用いるテーブルとインデックスである。
+// ステートメントは data に JSON として保存し、検索に用いるフィールドは生成列とする。
+// timestamp と stored は時刻への変換を生成列で行えないため、挿入時に値を与える。
+// voided_at は Document.VoidedAt である。
+// State、プロファイル、cmi5 の状態は、それぞれを一意に定めるキーを主キーとするテーブルに保存する。
+func sqlSchema(d sqlDialect) []string {
+	t := d.types()
+	generated := func(expr string) string {
+		return t.text + " GENERATED ALWAYS AS (" + expr + ")" + t.generated
+	}
+
+	return []string{
+		`CREATE TABLE IF NOT EXISTS statement (
+			doc_id       ` + t.id + ` PRIMARY KEY,
+			version      ` + t.text + ` NOT NULL,
+			"user"       ` + t.text + ` NOT NULL,
+			app          ` + t.text + ` NOT NULL,
+			timestamp    ` + t.time + ` NOT NULL,
+			stored       ` + t.time + ` NOT NULL,
+			data         ` + t.json + ` NOT NULL,
+			voided_at    ` + t.time + `,
+			statement_id ` + generated(d.jsonText("data", "id")) + `,
+			actor_ifi    ` + generated(`COALESCE(
+				'mbox:' || `+d.jsonText("data", "actor", "mbox")+`,
+				'mbox_sha1sum:' || `+d.jsonText("data", "actor", "mbox_sha1sum")+`,
+				'openid:' || `+d.jsonText("data", "actor", "openid")+`,
+				'account:' || `+d.jsonText("data", "actor", "account", "homePage")+` || ' ' || `+d.jsonText("data", "actor", "account", "name")+`)`) + `,
+			verb_id      ` + generated(d.jsonText("data", "verb", "id")) + `,
+			object_type  ` + generated(d.jsonText("data", "object", "objectType")) + `,
+			object_id    ` + generated(d.jsonText("data", "object", "id")) + `,
+			registration ` + generated(d.jsonText("data", "context", "registration")) + `
+		)`,
+		// ステートメントは xAPI のバージョンによらず user, app, id により一意に定まる
+		`CREATE UNIQUE INDEX IF NOT EXISTS statement_id_idx ON statement ("user", app, statement_id)`,
+		`CREATE INDEX IF NOT EXISTS statement_timestamp_idx ON statement ("user", app, timestamp, doc_id)`,
+		`CREATE INDEX IF NOT EXISTS statement_stored_idx ON statement ("user", app, stored)`,
+		`CREATE INDEX IF NOT EXISTS statement_actor_idx ON statement ("user", app, actor_ifi)`,
+		`CREATE INDEX IF NOT EXISTS statement_verb_idx ON statement ("user", app, verb_id)`,
+		`CREATE INDEX IF NOT EXISTS statement_object_idx ON statement ("user", app, object_id)`,
+		`CREATE INDEX IF NOT EXISTS statement_registration_idx ON statement ("user", app, registration)`,
+		`CREATE TABLE IF NOT EXISTS attachment (
+			id           ` + t.serial + `,
+			sha2         ` + t.text + ` NOT NULL,
+			content_type ` + t.text + ` NOT NULL,
+			encoding     ` + t.text + ` NOT NULL,
+			content      ` + t.blob + ` NOT NULL
+		)`,
+		`CREATE INDEX IF NOT EXISTS attachment_sha2_idx ON attachment (sha2, id)`,
+		`CREATE TABLE IF NOT EXISTS quota (
+			"user" ` + t.text + ` PRIMARY KEY,
+			usage  ` + t.integer + ` NOT NULL
+		)`,
+		`CREATE TABLE IF NOT EXISTS more (
+			id        ` + t.text + ` PRIMARY KEY,
+			version   ` + t.text + ` NOT NULL,
+			"user"    ` + t.text + ` NOT NULL,
+			app       ` + t.text + ` NOT NULL,
+			params    ` + t.text + ` NOT NULL,
+			timestamp ` + t.time + ` NOT NULL,
+			last_id   ` + t.text + ` NOT NULL,
+			snapshot  ` + t.time + ` NOT NULL,
+			created   ` + t.time + ` NOT NULL
+		)`,
+		`CREATE INDEX IF NOT EXISTS more_created_idx ON more (created)`,
+		`CREATE TABLE IF NOT EXISTS state (
+			"user"       ` + t.text + ` NOT NULL,
+			app          ` + t.text + ` NOT NULL,
+			activity_id  ` + t.text + ` NOT NULL,
+			agent        ` + t.text + ` NOT NULL,
+			registration ` + t.text + ` NOT NULL,
+			state_id     ` + t.text + ` NOT NULL,
+			content_type ` + t.text + ` NOT NULL,
+			content      ` + t.blob + ` NOT NULL,
+			updated      ` + t.time + ` NOT NULL,
+			PRIMARY KEY ("user", app, activity_id, agent, registration, state_id)
+		)`,
+		`CREATE TABLE IF NOT EXISTS activity_profile (
+			"user"       ` + t.text + ` NOT NULL,
+			app          ` + t.text + ` NOT NULL,
+			activity_id  ` + t.text + ` NOT NULL,
+			profile_id   ` + t.text + ` NOT NULL,
+			content_type ` + t.text + ` NOT NULL,
+			content      ` + t.blob + ` NOT NULL,
+			updated      ` + t.time + ` NOT NULL,
+			PRIMARY KEY ("user", app, activity_id, profile_id)
+		)`,
+		`CREATE TABLE IF NOT EXISTS agent_profile (
+			"user"       ` + t.text + ` NOT NULL,
+			app          ` + t.text + ` NOT NULL,
+			agent        ` + t.text + ` NOT NULL,
+			profile_id   ` + t.text + ` NOT NULL,
+			content_type ` + t.text + ` NOT NULL,
+			content      ` + t.blob + ` NOT NULL,
+			updated      ` + t.time + ` NOT NULL,
+			PRIMARY KEY ("user", app, agent, profile_id)
+		)`,
+		`CREATE TABLE IF NOT EXISTS xapi_profile (
+			"user"     ` + t.text + ` NOT NULL,
+			app        ` + t.text + ` NOT NULL,
+			profile_id ` + t.text + ` NOT NULL,
+			content    ` + t.blob + ` NOT NULL,
+			updated    ` + t.time + ` NOT NULL,
+			PRIMARY KEY ("user", app, profile_id)
+		)`,
+		`CREATE TABLE IF NOT EXISTS cmi5_session (
+			"user"       ` + t.text + ` NOT NULL,
+			app          ` + t.text + ` NOT NULL,
+			registration ` + t.text + ` NOT NULL,
+			session_id   ` + t.text + ` NOT NULL,
+			launch_mode  ` + t.text + ` NOT NULL,
+			state        ` + t.text + ` NOT NULL,
+			updated      ` + t.time + ` NOT NULL,
+			PRIMARY KEY ("user", app, registration, session_id)
+		)`,
+		`CREATE TABLE IF NOT EXISTS cmi5_registration (
+			"user"       ` + t.text + ` NOT NULL,
+			app          ` + t.text + ` NOT NULL,
+			registration ` + t.text + ` NOT NULL,
+			completed    ` + t.integer + ` NOT NULL,
+			passed       ` + t.integer + ` NOT NULL,
+			failed       ` + t.integer + ` NOT NULL,
+			satisfied    ` + t.integer + ` NOT NULL,
+			waived       ` + t.integer + ` NOT NULL,
+			updated      ` + t.time + ` NOT NULL,
+			PRIMARY KEY ("user", app, registration)
+		)`,
+	}
+}
+
+// sqlStore は SQL のデータベースにステートメントを保存する StatementStore である。
+// PostgresStore と SQLiteStore は、データベースによる違いを sqlDialect として与えてこれを用いる。
+type sqlStore struct {
+	db     *sql.DB
+	d      sqlDialect
+	window insertWindow
+}
+
+// openSQLStore は db に sqlSchema と schema のテーブルとインデックスを作成した sqlStore を返す。
+// 失敗した場合は db を閉じる。
+func openSQLStore(db *sql.DB, d sqlDialect, schema ...string) (*sqlStore, error) {
+	for _, stmt := range append(sqlSchema(d), schema...) {
+		if _, err := db.Exec(stmt); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+
+	return &sqlStore{db: db, d: d}, nil
+}
+
+// Close はデータベースとの接続を閉じる。
+func (s *sqlStore) Close() error {
+	return s.db.Close()
+}
+
+// sqlQueryer は *sql.DB と *sql.Tx に共通する、クエリを発行するメソッドである。
+type sqlQueryer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+func (s *sqlStore) exec(ctx context.Context, q sqlQueryer, query string, args ...interface{}) (sql.Result, error) {
+	return q.ExecContext(ctx, s.d.rebind(query), args...)
+}
+
+func (s *sqlStore) query(ctx context.Context, q sqlQueryer, query string, args ...interface{}) (*sql.Rows, error) {
+	return q.QueryContext(ctx, s.d.rebind(query), args...)
+}
+
+func (s *sqlStore) queryRow(ctx context.Context, q sqlQueryer, query string, args ...interface{}) *sql.Row {
+	return q.QueryRowContext(ctx, s.d.rebind(query), args...)
+}
+
+// sqlArgs は SQL のプレースホルダに与える値を順に保持する。
+type sqlArgs []interface{}
+
+// add は v を加え、そのプレースホルダを返す。
+func (a *sqlArgs) add(v interface{}) string {
+	*a = append(*a, v)
+	return "$" + strconv.Itoa(len(*a))
+}
+
+// sqlNullTime は NULL となりうる時刻の列を読むための sql.Scanner である。NULL の場合は nil とする。
+type sqlNullTime struct {
+	t **time.Time
+}
+
+func (s sqlNullTime) Scan(src interface{}) error {
+	if src == nil {
+		*s.t = nil
+		return nil
+	}
+
+	var t time.Time
+	if err := (sqlTime{&t}).Scan(src); err != nil {
+		return err
+	}
+	*s.t = &t
+
+	return nil
+}
+
+// nullTime は t を NULL となりうる時刻の列に保存する値とする。
+func (s *sqlStore) nullTime(t *time.Time) interface{} {
+	if t == nil {
+		return nil
+	}
+
+	return s.d.time(*t)
+}
+
+// sqlTime は時刻の列を読むための sql.Scanner である。
+// SQLite のように時刻を文字列として保存するデータベースの場合は RFC 3339 として解析する。
+type sqlTime struct {
+	t *time.Time
+}
+
+func (s sqlTime) Scan(src interface{}) error {
+	var text string
+	switch v := src.(type) {
+	case time.Time:
+		*s.t = v
+		return nil
+	case string:
+		text = v
+	case []byte:
+		text = string(v)
+	default:
+		return fmt.Errorf("cannot scan %T as time", src)
+	}
+
+	t, err := time.Parse(time.RFC3339Nano, text)
+	if err != nil {
+		return err
+	}
+	*s.t = t
+
+	return nil
+}
+
+// InsertStatements は StatementStore.InsertStatements を実装する。
+// バッチの挿入、commit、ディスク使用量の更新を一つのトランザクションで行う。
+func (s *sqlStore) InsertStatements(ctx context.Context, user, app string, docs DocumentSlice, usage int64, commit func(ctx context.Context) error) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// 同じユーザーの挿入を直列化するため、quota の行をロックする
+	if _, err := s.exec(ctx, tx, `INSERT INTO quota ("user", usage) VALUES ($1, 0) ON CONFLICT DO NOTHING`, user); err != nil {
+		return err
+	}
+	var quota Quota
+	if err := s.queryRow(ctx, tx, `SELECT usage FROM quota WHERE "user" = $1`+s.d.forUpdate(), user).Scan(&quota.Usage); err != nil {
+		return err
+	}
+	if !quota.Check() {
+		return ErrQuotaExceeded
+	}
+
+	// stored は挿入の時刻とする。コミットするまで ConsistentThrough はこれより前の時刻を返す
+	stored, done := s.window.begin()
+	defer done()
+
+	batch := make(DocumentSlice, 0, len(docs))
+	for _, doc := range docs {
+		doc.User, doc.App = user, app
+		batch = append(batch, doc)
+	}
+	batch.setStored(stored)
+
+	voided, err := s.voidedIDs(ctx, tx, user, app, batch.statementIDs())
+	if err != nil {
+		return err
+	}
+	targets := batch.applyVoiding(voided)
+
+	if err := s.insertStatements(ctx, tx, batch); err != nil {
+		return err
+	}
+	for target, t := range targets {
+		if _, err := s.exec(ctx, tx, `UPDATE statement SET voided_at = $4
+			WHERE "user" = $1 AND app = $2 AND statement_id = $3 AND voided_at IS NULL`,
+			user, app, target, s.d.time(t)); err != nil {
+			return err
+		}
+	}
+
+	if commit != nil {
+		// commit によるドキュメントの書き込みも同じトランザクションで行う
+		if err := commit(context.WithValue(ctx, sqlTxKey{}, tx)); err != nil {
+			return err
+		}
+	}
+
+	if _, err := s.exec(ctx, tx, `UPDATE quota SET usage = usage + $2 WHERE "user" = $1`, user, usage); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// voidedIDs は ids のうち、既に保存されている voiding ステートメントにより Voided となっているものを返す。
+func (s *sqlStore) voidedIDs(ctx context.Context, q sqlQueryer, user, app string, ids []string) (map[string]bool, error) {
+	voided := make(map[string]bool)
+	if len(ids) == 0 {
+		return voided, nil
+	}
+
+	var args sqlArgs
+	verbArg, userArg, appArg := args.add(miscs.GlobalConfig.Global.VoidedStatementID), args.add(user), args.add(app)
+	placeholders := make([]string, 0, len(ids))
+	for _, id := range ids {
+		placeholders = append(placeholders, args.add(id))
+	}
+	rows, err := s.query(ctx, q, `SELECT object_id FROM statement WHERE "user" = `+userArg+` AND app = `+appArg+`
+		AND verb_id = `+verbArg+` AND object_type = 'StatementRef' AND object_id IN (`+strings.Join(placeholders, ", ")+`)`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		voided[id] = true
+	}
+
+	return voided, rows.Err()
+}
+
+// insertStatements は tx によりドキュメントを挿入する。
+// 同じ ID のステートメントが既にある場合は ErrDuplicateStatement を返す。
+func (s *sqlStore) insertStatements(ctx context.Context, tx *sql.Tx, docs DocumentSlice) error {
+	for _, doc := range docs {
+		data, err := json.Marshal(doc.Data)
+		if err != nil {
+			return err
+		}
+
+		_, err = s.exec(ctx, tx, `INSERT INTO statement (doc_id, version, "user", app, timestamp, stored, data, voided_at)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`,
+			doc.ID.Hex(), doc.Version, doc.User, doc.App, s.d.time(doc.Timestamp), s.d.time(storedAt(doc.Data)), string(data),
+			s.nullTime(doc.VoidedAt))
+		if s.d.isDuplicate(err) {
+			return ErrDuplicateStatement
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// statementColumns は scanStatement により読むステートメントの列である。
+const statementColumns = `doc_id, version, "user", app, timestamp, data, voided_at`
+
+// scanStatement は statementColumns を選択した結果の現在の行をドキュメントとして読む。
+// doc_id が ObjectId でない行の場合は nil を返す。
+func scanStatement(rows *sql.Rows) (*Document, error) {
+	var doc Document
+	var id string
+	var data []byte
+	if err := rows.Scan(&id, &doc.Version, &doc.User, &doc.App, sqlTime{&doc.Timestamp}, &data, sqlNullTime{&doc.VoidedAt}); err != nil {
+		return nil, err
+	}
+	var err error
+	if doc.ID, err = primitive.ObjectIDFromHex(id); err != nil {
+		return nil, nil
+	}
+
+	if err := json.Unmarshal(data, &doc.Data); err != nil {
+		return nil, err
+	}
+
+	return &doc, nil
+}
+
+// scanStatements は statementColumns を選択した結果をドキュメントとして読む。
+func scanStatements(rows *sql.Rows) (DocumentSlice, error) {
+	defer rows.Close()
+
+	var docs DocumentSlice
+	for rows.Next() {
+		doc, err := scanStatement(rows)
+		if err != nil {
+			return nil, err
+		}
+		if doc != nil {
+			docs = append(docs, *doc)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return docs, nil
+}
+
+// FindStatement は StatementStore.FindStatement を実装する。
+func (s *sqlStore) FindStatement(ctx context.Context, user, app, id string) (*Document, error) {
+	docs, err := s.FindStatements(ctx, user, app, []string{id})
+	if err != nil {
+		return nil, err
+	}
+	if len(docs) == 0 {
+		return nil, ErrNotFound
+	}
+
+	return &docs[0], nil
+}
+
+// FindStatements は StatementStore.FindStatements を実装する。
+func (s *sqlStore) FindStatements(ctx context.Context, user, app string, ids []string) (DocumentSlice, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	var args sqlArgs
+	userArg, appArg := args.add(user), args.add(app)
+	placeholders := make([]string, 0, len(ids))
+	for _, id := range ids {
+		placeholders = append(placeholders, args.add(id))
+	}
+
+	rows, err := s.query(ctx, s.db, `SELECT `+statementColumns+` FROM statement
+		WHERE "user" = `+userArg+` AND app = `+appArg+` AND statement_id IN (`+strings.Join(placeholders, ", ")+`)`, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	return scanStatements(rows)
+}
+
+// IsVoided は StatementStore.IsVoided を実装する。
+func (s *sqlStore) IsVoided(ctx context.Context, user, app, id string) (bool, error) {
+	var voided bool
+	err := s.queryRow(ctx, s.db, `SELECT EXISTS (SELECT 1 FROM statement
+		WHERE "user" = $1 AND app = $2 AND verb_id = $3 AND object_type = 'StatementRef' AND object_id = $4)`,
+		user, app, miscs.GlobalConfig.Global.VoidedStatementID, id).Scan(&voided)
+
+	return voided, err
+}
+
+// QueryStatements は StatementStore.QueryStatements を実装する。
+func (s *sqlStore) QueryStatements(ctx context.Context, user, app string, filter *StatementFilter) (DocumentSlice, error) {
+	var args sqlArgs
+	userArg, appArg, snapshotArg := args.add(user), args.add(app), args.add(s.d.time(filter.Snapshot))
+
+	// snapshot までに保存された、user, app のステートメントの条件
+	visible := func(alias string) string {
+		return alias + `."user" = ` + userArg + ` AND ` + alias + `.app = ` + appArg +
+			` AND ` + alias + `.stored <= ` + snapshotArg
+	}
+
+	terms := []string{visible("s")}
+
+	if !filter.Since.IsZero() {
+		terms = append(terms, "s.timestamp > "+args.add(s.d.time(filter.Since)))
+	}
+	if !filter.Until.IsZero() {
+		terms = append(terms, "s.timestamp < "+args.add(s.d.time(filter.Until)))
+	}
+
+	// 同じ timestamp のステートメントの順序を固定するため doc_id でもソートする
+	order, positionOp := "DESC", "<"
+	if filter.Ascending {
+		order, positionOp = "ASC", ">"
+	}
+	if cursor := filter.Cursor; cursor != nil {
+		ts, lastID := args.add(s.d.time(cursor.Timestamp)), args.add(cursor.LastID.Hex())
+		terms = append(terms, "(s.timestamp "+positionOp+" "+ts+
+			" OR (s.timestamp = "+ts+" AND s.doc_id "+positionOp+" "+lastID+"))")
+	}
+
+	// 条件に合うステートメントを StatementRef により (間接的に) 参照するステートメントも含める
+	var with string
+	if content := s.filterTerms("t", filter, &args); len(content) > 0 {
+		with = `WITH RECURSIVE referring(id) AS (
+			SELECT r.statement_id FROM statement r JOIN statement t
+				ON t."user" = r."user" AND t.app = r.app AND t.statement_id = r.object_id
+				WHERE ` + visible("r") + ` AND r.object_type = 'StatementRef'
+				AND ` + visible("t") + ` AND ` + strings.Join(content, " AND ") + `
+			UNION
+			SELECT r.statement_id FROM statement r JOIN referring ON r.object_id = referring.id
+				WHERE ` + visible("r") + ` AND r.object_type = 'StatementRef'
+		) `
+		terms = append(terms, "(("+strings.Join(s.filterTerms("s", filter, &args), " AND ")+
+			") OR s.statement_id IN (SELECT id FROM referring))")
+	}
+
+	// Voided となったステートメントは含めない (Experience API, Section 2.5 を参照)
+	terms = append(terms, "(s.voided_at IS NULL OR s.voided_at > "+snapshotArg+")")
+
+	query := with + `SELECT s.doc_id, s.version, s."user", s.app, s.timestamp, s.data, s.voided_at FROM statement s
+		WHERE ` + strings.Join(terms, " AND ") + `
+		ORDER BY s.timestamp ` + order + `, s.doc_id ` + order
+	if filter.Limit > 0 {
+		query += " LIMIT " + args.add(filter.Limit)
+	}
+
+	rows, err := s.query(ctx, s.db, query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	return scanStatements(rows)
+}
+
+// filterTerms は filter のうち、ステートメントの内容に対する条件を alias のテーブルに対する
+// SQL の条件として返す。MongoStore のクエリ (statementFilterTerms) と同じ条件となるようにする。
+func (s *sqlStore) filterTerms(alias string, filter *StatementFilter, args *sqlArgs) []string {
+	var terms []string
+
+	if filter.Agent != nil {
+		terms = append(terms, s.agentTerm(alias, filter.Agent, filter.RelatedAgents, args))
+	}
+
+	if len(filter.Verb) > 0 {
+		terms = append(terms, alias+".verb_id = "+args.add(filter.Verb))
+	}
+
+	if id := filter.Activity; len(id) > 0 {
+		activityTerms := []string{"(" + alias + ".object_type = 'Activity' AND " + alias + ".object_id = " + args.add(id) + ")"}
+		if filter.RelatedActivities {
+			for _, field := range []string{"parent", "grouping", "category", "other"} {
+				activityTerms = append(activityTerms, s.d.elemMatchTerm(alias,
+					[]string{"context", "contextActivities", field}, map[string]interface{}{"id": id}, args))
+			}
+		}
+		terms = append(terms, "("+strings.Join(activityTerms, " OR ")+")")
+	}
+
+	if len(filter.Registration) > 0 {
+		terms = append(terms, alias+".registration = "+args.add(filter.Registration))
+	}
+
+	return terms
+}
+
+// agentTerm は agent (グループの場合はそのメンバーのいずれか) と同じ IFI を持つ
+// エージェントがステートメントに現れる条件を返す。actor は生成列 actor_ifi により、
+// 関連するエージェントは data の各フィールドにより検索する。
+func (s *sqlStore) agentTerm(alias string, agent map[string]interface{}, related bool, args *sqlArgs) string {
+	agents := []map[string]interface{}{agent}
+	if members, ok := agent["member"].([]interface{}); ok {
+		for _, member := range members {
+			if m, ok := member.(map[string]interface{}); ok {
+				agents = append(agents, m)
+			}
+		}
+	}
+
+	var terms []string
+	for _, a := range agents {
+		ifi, key := agentIFI(a)
+		if ifi == nil {
+			continue
+		}
+
+		terms = append(terms, alias+".actor_ifi = "+args.add(key))
+		if !related {
+			continue
+		}
+		for _, path := range relatedAgentPaths {
+			terms = append(terms, s.d.matchTerm(alias, path, ifi, args))
+		}
+		for _, path := range relatedMemberPaths {
+			terms = append(terms, s.d.elemMatchTerm(alias, path, ifi, args))
+		}
+	}
+	if len(terms) == 0 {
+		return "FALSE"
+	}
+
+	return "(" + strings.Join(terms, " OR ") + ")"
+}
+
+// agentIFI はエージェントの IFI のみを持つオブジェクトと、それを actor_ifi 列と同じ形式で
+// 表した文字列を返す。IFI を持たない場合は nil を返す。
+func agentIFI(agent map[string]interface{}) (map[string]interface{}, string) {
+	for _, field := range []string{"mbox", "mbox_sha1sum", "openid"} {
+		if v, ok := agent[field].(string); ok {
+			return map[string]interface{}{field: v}, field + ":" + v
+		}
+	}
+
+	if account, ok := agent["account"].(map[string]interface{}); ok {
+		homePage, _ := account["homePage"].(string)
+		name, _ := account["name"].(string)
+		return map[string]interface{}{
+			"account": map[string]interface{}{"homePage": homePage, "name": name},
+		}, "account:" + homePage + " " + name
+	}
+
+	return nil, ""
+}
+
+// jsonLeaf は JSON のオブジェクトの、オブジェクトでない値とその位置である。
+type jsonLeaf struct {
+	path  []string
+	value interface{}
+}
+
+// jsonLeaves は path の位置にある v の、オブジェクトでない値を全て返す。
+// SQL を一意に定めるため、フィールド名の順に並べる。
+func jsonLeaves(path []string, v map[string]interface{}) []jsonLeaf {
+	keys := make([]string, 0, len(v))
+	for k := range v {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var leaves []jsonLeaf
+	for _, k := range keys {
+		p := append(append([]string{}, path...), k)
+		if m, ok := v[k].(map[string]interface{}); ok {
+			leaves = append(leaves, jsonLeaves(p, m)...)
+		} else {
+			leaves = append(leaves, jsonLeaf{p, v[k]})
+		}
+	}
+
+	return leaves
+}
+
+// FindActivityDefinitions は StatementStore.FindActivityDefinitions を実装する。
+func (s *sqlStore) FindActivityDefinitions(ctx context.Context, user, app, activityID string) ([]map[string]interface{}, error) {
+	rows, err := s.query(ctx, s.db, `SELECT `+s.d.jsonValue("data", "object", "definition")+` FROM statement
+		WHERE "user" = $1 AND app = $2 AND object_id = $3
+		AND (object_type = 'Activity' OR object_type IS NULL)
+		AND `+s.d.jsonType("data", "object", "definition")+` = 'object'
+		ORDER BY stored DESC`, user, app, activityID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var definitions []map[string]interface{}
+	for rows.Next() {
+		var b []byte
+		if err := rows.Scan(&b); err != nil {
+			return nil, err
+		}
+		var definition map[string]interface{}
+		if err := json.Unmarshal(b, &definition); err != nil {
+			return nil, err
+		}
+		definitions = append(definitions, definition)
+	}
+
+	return definitions, rows.Err()
+}
+
+// FindAgentNames は StatementStore.FindAgentNames を実装する。
+// ステートメント全体を読まないよう、エージェントのフィールドのみを取り出す。
+func (s *sqlStore) FindAgentNames(ctx context.Context, user, app string, agent map[string]interface{}) ([]string, error) {
+	paths := append([][]string{{"actor"}}, relatedAgentPaths...)
+	columns := make([]string, 0, len(paths)+len(relatedMemberPaths))
+	for _, path := range append(paths, relatedMemberPaths...) {
+		columns = append(columns, s.d.jsonValue("s.data", path...))
+	}
+
+	var args sqlArgs
+	rows, err := s.query(ctx, s.db, `SELECT DISTINCT `+strings.Join(columns, ", ")+` FROM statement s
+		WHERE s."user" = `+args.add(user)+` AND s.app = `+args.add(app)+` AND s.voided_at IS NULL
+		AND `+s.agentTerm("s", agent, true, &args), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	names := make(map[string]bool)
+	values := make([][]byte, len(columns))
+	dest := make([]interface{}, len(columns))
+	for i := range values {
+		dest[i] = &values[i]
+	}
+	for rows.Next() {
+		if err := rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+
+		var candidates []map[string]interface{}
+		for i, b := range values {
+			if b == nil {
+				continue
+			}
+			if i < len(paths) {
+				var candidate map[string]interface{}
+				if json.Unmarshal(b, &candidate) == nil {
+					candidates = append(candidates, candidate)
+				}
+			} else {
+				var members []map[string]interface{}
+				if json.Unmarshal(b, &members) == nil {
+					candidates = append(candidates, members...)
+				}
+			}
+		}
+		agentNamesOf(names, agent, candidates)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return sortedNames(names), nil
+}
+
+// QuotaUsage は StatementStore.QuotaUsage を実装する。
+func (s *sqlStore) QuotaUsage(ctx context.Context, user string) (int64, error) {
+	var usage int64
+	err := s.queryRow(ctx, s.db, `SELECT usage FROM quota WHERE "user" = $1`, user).Scan(&usage)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+
+	return usage, err
+}
+
+// ConsistentThrough は StatementStore.ConsistentThrough を実装する。
+// ステートメントはコミットした時点で検索の対象となるため、コミットしていないバッチの stored より前の時刻を返す。
+func (s *sqlStore) ConsistentThrough(ctx context.Context) time.Time {
+	return s.window.through(time.Now())
+}
+
+// InsertMoreCursor は StatementStore.InsertMoreCursor を実装する。
+// 有効期間が過ぎた MoreCursor はこの際に削除する。
+func (s *sqlStore) InsertMoreCursor(ctx context.Context, cursor *MoreCursor) error {
+	if expiration := miscs.GlobalConfig.Global.MoreExpiration; expiration > 0 {
+		deadline := time.Now().Add(-time.Duration(expiration) * time.Second)
+		if _, err := s.exec(ctx, s.db, `DELETE FROM more WHERE created < $1`, s.d.time(deadline)); err != nil {
+			return err
+		}
+	}
+
+	_, err := s.exec(ctx, s.db, `INSERT INTO more (id, version, "user", app, params, timestamp, last_id, snapshot, created)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`,
+		cursor.ID.Hex(), cursor.Version, cursor.User, cursor.App, cursor.Params,
+		s.d.time(cursor.Timestamp), cursor.LastID.Hex(), s.d.time(cursor.Snapshot), s.d.time(cursor.Created))
+
+	return err
+}
+
+// FindMoreCursor は StatementStore.FindMoreCursor を実装する。
+func (s *sqlStore) FindMoreCursor(ctx context.Context, user, app, id string) (*MoreCursor, error) {
+	oid, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, ErrNotFound
+	}
+
+	var cursor MoreCursor
+	var lastID string
+	err = s.queryRow(ctx, s.db, `SELECT version, params, timestamp, last_id, snapshot, created FROM more
+		WHERE id = $1 AND "user" = $2 AND app = $3`, id, user, app).Scan(
+		&cursor.Version, &cursor.Params, sqlTime{&cursor.Timestamp}, &lastID, sqlTime{&cursor.Snapshot}, sqlTime{&cursor.Created})
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if cursor.LastID, err = primitive.ObjectIDFromHex(lastID); err != nil {
+		return nil, ErrNotFound
+	}
+	cursor.ID, cursor.User, cursor.App = oid, user, app
+
+	return &cursor, nil
+}
+
+// PutAttachment は StatementStore.PutAttachment を実装する。
+func (s *sqlStore) PutAttachment(ctx context.Context, sha2, contentType, encoding string, r io.Reader) (interface{}, error) {
+	content, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var id int64
+	err = s.queryRow(ctx, s.db, `INSERT INTO attachment (sha2, content_type, encoding, content)
+		VALUES ($1, $2, $3, $4) RETURNING id`, sha2, contentType, encoding, content).Scan(&id)
+	if err != nil {
+		return nil, err
+	}
+
+	return id, nil
+}
+
+// OpenAttachment は StatementStore.OpenAttachment を実装する。
+// 同じ sha2 値のファイルが複数ある場合は、最も新しく保存されたものを開く。
+func (s *sqlStore) OpenAttachment(ctx context.Context, sha2 string) (*Attachment, error) {
+	var contentType string
+	var content []byte
+	err := s.queryRow(ctx, s.db, `SELECT content_type, content FROM attachment
+		WHERE sha2 = $1 ORDER BY id DESC LIMIT 1`, sha2).Scan(&contentType, &content)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &Attachment{ioutil.NopCloser(bytes.NewReader(content)), contentType}, nil
+}
+
+// RemoveAttachment は StatementStore.RemoveAttachment を実装する。
+func (s *sqlStore) RemoveAttachment(ctx context.Context, id interface{}) error {
+	_, err := s.exec(ctx, s.db, `DELETE FROM attachment WHERE id = $1`, id)
+	return err
+}
+
+// EachStatement は MigratableStore.EachStatement を実装する。
+func (s *sqlStore) EachStatement(ctx context.Context, f func(doc *Document) error) error {
+	rows, err := s.query(ctx, s.db, `SELECT `+statementColumns+` FROM statement ORDER BY doc_id`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		doc, err := scanStatement(rows)
+		if err != nil {
+			return err
+		}
+		if doc == nil {
+			continue
+		}
+		if err := f(doc); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+// EachAttachment は MigratableStore.EachAttachment を実装する。
+func (s *sqlStore) EachAttachment(ctx context.Context, f func(sha2, contentType, encoding string, r io.Reader) error) error {
+	rows, err := s.query(ctx, s.db, `SELECT sha2, content_type, encoding, content FROM attachment ORDER BY id`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var sha2, contentType, encoding string
+		var content []byte
+		if err := rows.Scan(&sha2, &contentType, &encoding, &content); err != nil {
+			return err
+		}
+		if err := f(sha2, contentType, encoding, bytes.NewReader(content)); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+// EachQuota は MigratableStore.EachQuota を実装する。
+func (s *sqlStore) EachQuota(ctx context.Context, f func(user string, usage int64) error) error {
+	rows, err := s.query(ctx, s.db, `SELECT "user", usage FROM quota ORDER BY "user"`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var user string
+		var usage int64
+		if err := rows.Scan(&user, &usage); err != nil {
+			return err
+		}
+		if err := f(user, usage); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+// ImportStatements は MigratableStore.ImportStatements を実装する。
+func (s *sqlStore) ImportStatements(ctx context.Context, docs DocumentSlice) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := s.insertStatements(ctx, tx, docs); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// SetQuotaUsage は MigratableStore.SetQuotaUsage を実装する。
+func (s *sqlStore) SetQuotaUsage(ctx context.Context, user string, usage int64) error {
+	_, err := s.exec(ctx, s.db, `INSERT INTO quota ("user", usage) VALUES ($1, $2)
+		ON CONFLICT ("user") DO UPDATE SET usage = excluded.usage`, user, usage)
+	return err
+}
@@ -0,0 +1,142 @@
+// Copyright 2015 realglobe, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package model
+
+import (
+	"database/sql"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// SQLiteStore は SQLite のデータベースファイルにステートメントを保存する StatementStore である。
+// SQLite 3.38 以降が必要となる。添付ファイルは BLOB として保存する。
+type SQLiteStore struct {
+	*sqlStore
+}
+
+// OpenSQLiteStore は path のデータベースファイルを開き (無い場合は作成し)、必要なテーブルを作成した
+// SQLiteStore を返す。wal が true の場合は WAL モードを、false の場合はロールバックジャーナルを用いる。
+func OpenSQLiteStore(path string, wal bool) (*SQLiteStore, error) {
+	journalMode := "DELETE"
+	if wal {
+		journalMode = "WAL"
+	}
+
+	// 書き込むトランザクションは開始時にロックを取得し、他の接続の書き込みは待たせる
+	db, err := sql.Open("sqlite3", path+"?_journal_mode="+journalMode+"&_busy_timeout=5000&_txlock=immediate")
+	if err != nil {
+		return nil, err
+	}
+
+	store, err := openSQLStore(db, sqliteDialect{})
+	if err != nil {
+		return nil, err
+	}
+
+	return &SQLiteStore{store}, nil
+}
+
+// sqliteDialect は SQLite の sqlDialect である。
+// 時刻は文字列の順序と時刻の順序が一致するよう、sqliteTime により UTC の固定長の文字列として保存する。
+type sqliteDialect struct{}
+
+// sqlitePlaceholder は sqlStore のクエリのプレースホルダである。
+var sqlitePlaceholder = regexp.MustCompile(`\$([0-9]+)`)
+
+func (sqliteDialect) rebind(query string) string {
+	return sqlitePlaceholder.ReplaceAllString(query, "?${1}")
+}
+
+func (sqliteDialect) types() sqlTypes {
+	return sqlTypes{
+		id:      "TEXT",
+		text:    "TEXT",
+		integer: "INTEGER",
+		time:    "TEXT",
+		json:    "TEXT",
+		blob:    "BLOB",
+		serial:  "INTEGER PRIMARY KEY AUTOINCREMENT",
+	}
+}
+
+// sqliteTimeLayout は SQLiteStore が時刻を保存する形式である。
+const sqliteTimeLayout = "2006-01-02T15:04:05.000000000Z07:00"
+
+// sqliteTime は t を SQLiteStore が保存する形式の文字列とする。
+func sqliteTime(t time.Time) string {
+	return t.UTC().Format(sqliteTimeLayout)
+}
+
+func (sqliteDialect) time(t time.Time) interface{} {
+	return sqliteTime(t)
+}
+
+// forUpdate は空文字列を返す。書き込むトランザクションは開始時にデータベース全体をロックする。
+func (sqliteDialect) forUpdate() string {
+	return ""
+}
+
+func (sqliteDialect) isDuplicate(err error) bool {
+	e, ok := err.(sqlite3.Error)
+	return ok && (e.ExtendedCode == sqlite3.ErrConstraintUnique || e.ExtendedCode == sqlite3.ErrConstraintPrimaryKey)
+}
+
+// sqliteJSONPath は path を JSON パスの SQL の文字列リテラルとする。
+func sqliteJSONPath(path ...string) string {
+	return "'$." + strings.Join(path, ".") + "'"
+}
+
+func (sqliteDialect) jsonText(data string, path ...string) string {
+	return "json_extract(" + data + ", " + sqliteJSONPath(path...) + ")"
+}
+
+func (d sqliteDialect) jsonValue(data string, path ...string) string {
+	return d.jsonText(data, path...)
+}
+
+func (sqliteDialect) jsonType(data string, path ...string) string {
+	return "json_type(" + data + ", " + sqliteJSONPath(path...) + ")"
+}
+
+func (sqliteDialect) matchTerm(alias string, path []string, v map[string]interface{}, args *sqlArgs) string {
+	return sqliteMatchTerm(alias+".data", "", path, v, args)
+}
+
+// elemMatchTerm は sqlDialect.elemMatchTerm を実装する。配列の要素がオブジェクトでない場合に
+// エラーとならないよう、要素は data からのパス (fullkey) により参照する。
+func (sqliteDialect) elemMatchTerm(alias string, path []string, v map[string]interface{}, args *sqlArgs) string {
+	jsonPath := sqliteJSONPath(path...)
+
+	return "(json_type(" + alias + ".data, " + jsonPath + ") = 'array' AND EXISTS (SELECT 1 FROM json_each(" +
+		alias + ".data, " + jsonPath + ") e WHERE " + sqliteMatchTerm(alias+".data", "e.fullkey", nil, v, args) + "))"
+}
+
+// sqliteMatchTerm は JSON の式 data の path の位置にあるオブジェクトが、v の全てのフィールドと同じ値を持つ
+// 条件を返す。base が空でない場合、path は SQL の式 base が表す JSON パスからの位置とする。
+func sqliteMatchTerm(data, base string, path []string, v map[string]interface{}, args *sqlArgs) string {
+	var terms []string
+	for _, leaf := range jsonLeaves(path, v) {
+		leafPath := sqliteJSONPath(leaf.path...)
+		if len(base) > 0 {
+			leafPath = base + " || '." + strings.Join(leaf.path, ".") + "'"
+		}
+		terms = append(terms, "json_extract("+data+", "+leafPath+") = "+args.add(leaf.value))
+	}
+
+	return "(" + strings.Join(terms, " AND ") + ")"
+}
@@ -0,0 +1,178 @@
+// Copyright 2015 realglobe, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package model
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// State represents a document stored by the State API.
+// Agent には IFI を一意に表す文字列が入る。
+type State struct {
+	ID           primitive.ObjectID `bson:"_id,omitempty"`
+	User         string             `bson:"user"`
+	App          string             `bson:"app"`
+	ActivityID   string             `bson:"activityId"`
+	Agent        string             `bson:"agent"`
+	Registration string             `bson:"registration"`
+	StateID      string             `bson:"stateId"`
+	ContentType  string             `bson:"contentType"`
+	Content      []byte             `bson:"content"`
+	Updated      time.Time          `bson:"updated"`
+}
+
+func NewState(user, app, activityID, agent, registration, stateID, contentType string, content []byte, updated time.Time) *State {
+	return &State{
+		primitive.NewObjectID(),
+		user,
+		app,
+		activityID,
+		agent,
+		registration,
+		stateID,
+		contentType,
+		content,
+		updated,
+	}
+}
+
+// stateQuery は一つの State を定めるキーのうち、stateId 以外のものに一致するクエリを返す。
+// registration が空の場合は registration を持たない State に一致する。
+func stateQuery(user, app, activityID, agent, registration string) bson.M {
+	return bson.M{
+		"user":         user,
+		"app":          app,
+		"activityId":   activityID,
+		"agent":        agent,
+		"registration": registration,
+	}
+}
+
+// stateSetQuery は複数の State に対する操作のためのクエリを返す。
+// registration が空の場合は registration によらず全ての State に一致する。
+func stateSetQuery(user, app, activityID, agent, registration string) bson.M {
+	query := stateQuery(user, app, activityID, agent, registration)
+	if len(registration) == 0 {
+		delete(query, "registration")
+	}
+
+	return query
+}
+
+// SaveTo は同じキーを持つ State を置き換えて保存する。
+func (s *State) SaveTo(ctx context.Context, col *mongo.Collection) error {
+	query := stateQuery(s.User, s.App, s.ActivityID, s.Agent, s.Registration)
+	query["stateId"] = s.StateID
+
+	_, err := col.UpdateOne(ctx, query, bson.M{
+		"$set": bson.M{
+			"contentType": s.ContentType,
+			"content":     s.Content,
+			"updated":     s.Updated,
+		},
+		"$setOnInsert": bson.M{"_id": s.ID},
+	}, options.Update().SetUpsert(true))
+	return err
+}
+
+// FindState は指定されたキーの State を返す。存在しない場合は ErrNotFound を返す。
+func FindState(ctx context.Context, col *mongo.Collection, user, app, activityID, agent, registration, stateID string) (*State, error) {
+	query := stateQuery(user, app, activityID, agent, registration)
+	query["stateId"] = stateID
+
+	var state State
+	err := col.FindOne(ctx, query).Decode(&state)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &state, nil
+}
+
+// FindStateIDs は since 以降に更新された State の stateId を返す。
+// since がゼロ値の場合は全ての stateId を返す。registration が空の場合は全ての registration の State を対象とし、
+// 同じ stateId は一度だけ返す。
+func FindStateIDs(ctx context.Context, col *mongo.Collection, user, app, activityID, agent, registration string, since time.Time) ([]string, error) {
+	query := stateSetQuery(user, app, activityID, agent, registration)
+	if !since.IsZero() {
+		query["updated"] = bson.M{"$gt": since}
+	}
+
+	cursor, err := col.Find(ctx, query, options.Find().
+		SetProjection(bson.M{"stateId": 1}).
+		SetSort(bson.D{{Key: "stateId", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+
+	var states []State
+	if err := cursor.All(ctx, &states); err != nil {
+		return nil, err
+	}
+
+	ids := make([]string, 0, len(states))
+	for _, s := range states {
+		// stateId の順に並んでいるため、重複は隣り合う
+		if len(ids) > 0 && ids[len(ids)-1] == s.StateID {
+			continue
+		}
+		ids = append(ids, s.StateID)
+	}
+
+	return ids, nil
+}
+
+// RemoveStates は stateId が空でなければその State を、空であれば
+// activityId, agent, registration が一致する全ての State を削除する。
+// stateId と registration が共に空の場合は、全ての registration の State を削除する。
+// 返り値は削除した State の Content の合計サイズである。
+func RemoveStates(ctx context.Context, col *mongo.Collection, user, app, activityID, agent, registration, stateID string) (int64, error) {
+	var query bson.M
+	if len(stateID) > 0 {
+		query = stateQuery(user, app, activityID, agent, registration)
+		query["stateId"] = stateID
+	} else {
+		query = stateSetQuery(user, app, activityID, agent, registration)
+	}
+
+	cursor, err := col.Find(ctx, query)
+	if err != nil {
+		return 0, err
+	}
+
+	var states []State
+	if err := cursor.All(ctx, &states); err != nil {
+		return 0, err
+	}
+
+	var size int64
+	for _, s := range states {
+		if _, err := col.DeleteOne(ctx, bson.M{"_id": s.ID}); err != nil {
+			return size, err
+		}
+		size += int64(len(s.Content))
+	}
+
+	return size, nil
+}
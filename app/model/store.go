@@ -0,0 +1,203 @@
+// Copyright 2015 realglobe, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package model
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+)
+
+var (
+	// ErrNotFound は検索したステートメントや添付ファイルが存在しないことを表す。
+	ErrNotFound = errors.New("not found")
+	// ErrDuplicateStatement は同じ ID のステートメントが既に保存されていることを表す。
+	ErrDuplicateStatement = errors.New("duplicate statement")
+	// ErrQuotaExceeded はユーザーのディスク使用量が上限に達していることを表す。
+	ErrQuotaExceeded = errors.New("quota exceeded")
+)
+
+// StatementStore はステートメントと添付ファイル、ユーザーのディスク使用量を保存するストレージである。
+// コントローラはこのインターフェースを通してのみステートメントを扱うため、実装を差し替えることができる。
+// 各メソッドの ctx にはリクエストのコンテキストを与え、キャンセルされた場合は処理を中断する。
+type StatementStore interface {
+	// InsertStatements は docs を一つのバッチとして保存し、ユーザーのディスク使用量に usage を加える。
+	// ステートメントの stored は保存の直前に設定する。
+	// バッチは全て保存されるか、全く保存されないかのいずれかとする。commit が nil でない場合は
+	// 挿入の後に呼び、エラーを返した場合はバッチを取り消してそのエラーを返す。commit には
+	// 挿入と同じトランザクションで書き込むためのコンテキストを与える。
+	// 同じ ID のステートメントが既にある場合は ErrDuplicateStatement を、
+	// ディスク使用量が上限に達している場合は ErrQuotaExceeded を返す。
+	InsertStatements(ctx context.Context, user, app string, docs DocumentSlice, usage int64, commit func(ctx context.Context) error) error
+
+	// FindStatement は id のステートメントを返す。存在しない場合は ErrNotFound を返す。
+	FindStatement(ctx context.Context, user, app, id string) (*Document, error)
+
+	// FindStatements は ids のうち保存されているステートメントを返す。
+	FindStatements(ctx context.Context, user, app string, ids []string) (DocumentSlice, error)
+
+	// IsVoided は id のステートメントが voiding ステートメントにより Voided となっているかを返す。
+	IsVoided(ctx context.Context, user, app, id string) (bool, error)
+
+	// QueryStatements は filter に合うステートメントを返す。filter.Ascending が false の場合は
+	// timestamp の降順 (新しいものから順) に、true の場合は昇順に並べ、同じ timestamp のステートメントは
+	// ID により順序を定める。(Experience API, Section 7.2.3 を参照)
+	QueryStatements(ctx context.Context, user, app string, filter *StatementFilter) (DocumentSlice, error)
+
+	// FindActivityDefinitions は object が activityID の Activity であるステートメントから
+	// object.definition を集め、新しく保存されたものから順に返す。
+	FindActivityDefinitions(ctx context.Context, user, app, activityID string) ([]map[string]interface{}, error)
+
+	// FindAgentNames は Voided となっていないステートメントの、actor と関連するエージェントとして検索する
+	// フィールド (StatementFilter.RelatedAgents を参照) に現れる、agent と同じ IFI を持つエージェントの
+	// name を重複なく、名前の順に返す。
+	FindAgentNames(ctx context.Context, user, app string, agent map[string]interface{}) ([]string, error)
+
+	// QuotaUsage はユーザーのディスク使用量を返す。
+	QuotaUsage(ctx context.Context, user string) (int64, error)
+
+	// ConsistentThrough は、返す時刻以前に保存されたステートメントが、この後の検索の結果に
+	// 全て含まれることを保証できる時刻を返す。検索の前に呼ばなければならない。
+	ConsistentThrough(ctx context.Context) time.Time
+
+	// InsertMoreCursor は more URL のための検索の状態を保存する。
+	InsertMoreCursor(ctx context.Context, cursor *MoreCursor) error
+
+	// FindMoreCursor は id の MoreCursor を返す。存在しない場合は ErrNotFound を返す。
+	FindMoreCursor(ctx context.Context, user, app, id string) (*MoreCursor, error)
+
+	// PutAttachment は sha2 値が sha2 の添付ファイルの内容を r から読んで保存し、その ID を返す。
+	PutAttachment(ctx context.Context, sha2, contentType, encoding string, r io.Reader) (interface{}, error)
+
+	// OpenAttachment は sha2 値が sha2 の添付ファイルを開く。存在しない場合は ErrNotFound を返す。
+	OpenAttachment(ctx context.Context, sha2 string) (*Attachment, error)
+
+	// RemoveAttachment は PutAttachment が返した ID の添付ファイルを削除する。
+	RemoveAttachment(ctx context.Context, id interface{}) error
+}
+
+// DocumentStore は State, Activity Profile, Agent Profile, xAPI Profile と cmi5 の状態を保存するストレージである。
+// これらのドキュメントのサイズはステートメントと同じディスク使用量に数える。
+type DocumentStore interface {
+	// SaveState は同じキーを持つ State を置き換えて保存する。
+	SaveState(ctx context.Context, state *State) error
+
+	// FindState は指定されたキーの State を返す。存在しない場合は ErrNotFound を返す。
+	FindState(ctx context.Context, user, app, activityID, agent, registration, stateID string) (*State, error)
+
+	// FindStateIDs は since 以降に更新された State の stateId を、stateId の順に重複なく返す。
+	// since がゼロ値の場合は全ての stateId を返す。registration が空の場合は全ての registration の State を対象とする。
+	FindStateIDs(ctx context.Context, user, app, activityID, agent, registration string, since time.Time) ([]string, error)
+
+	// RemoveStates は stateId が空でなければその State を、空であれば
+	// activityId, agent, registration が一致する全ての State を削除する。
+	// stateId と registration が共に空の場合は、全ての registration の State を削除する。
+	// 返り値は削除した State の Content の合計サイズである。
+	RemoveStates(ctx context.Context, user, app, activityID, agent, registration, stateID string) (int64, error)
+
+	// SaveActivityProfile は同じキーを持つ ActivityProfile を置き換えて保存する。
+	SaveActivityProfile(ctx context.Context, profile *ActivityProfile) error
+
+	// FindActivityProfile は指定されたキーの ActivityProfile を返す。存在しない場合は ErrNotFound を返す。
+	FindActivityProfile(ctx context.Context, user, app, activityID, profileID string) (*ActivityProfile, error)
+
+	// FindActivityProfileIDs は since 以降に更新された ActivityProfile の profileId を、profileId の順に返す。
+	// since がゼロ値の場合は全ての profileId を返す。
+	FindActivityProfileIDs(ctx context.Context, user, app, activityID string, since time.Time) ([]string, error)
+
+	// RemoveActivityProfile は指定されたキーの ActivityProfile を削除する。存在しない場合は ErrNotFound を返す。
+	RemoveActivityProfile(ctx context.Context, user, app, activityID, profileID string) error
+
+	// SaveAgentProfile は同じキーを持つ AgentProfile を置き換えて保存する。
+	SaveAgentProfile(ctx context.Context, profile *AgentProfile) error
+
+	// FindAgentProfile は指定されたキーの AgentProfile を返す。存在しない場合は ErrNotFound を返す。
+	FindAgentProfile(ctx context.Context, user, app, agent, profileID string) (*AgentProfile, error)
+
+	// FindAgentProfileIDs は since 以降に更新された AgentProfile の profileId を、profileId の順に返す。
+	// since がゼロ値の場合は全ての profileId を返す。
+	FindAgentProfileIDs(ctx context.Context, user, app, agent string, since time.Time) ([]string, error)
+
+	// RemoveAgentProfile は指定されたキーの AgentProfile を削除する。存在しない場合は ErrNotFound を返す。
+	RemoveAgentProfile(ctx context.Context, user, app, agent, profileID string) error
+
+	// SaveXAPIProfile は同じ profileId を持つ XAPIProfile を置き換えて保存する。
+	SaveXAPIProfile(ctx context.Context, profile *XAPIProfile) error
+
+	// FindXAPIProfile は profileId の XAPIProfile を返す。存在しない場合は ErrNotFound を返す。
+	FindXAPIProfile(ctx context.Context, user, app, profileID string) (*XAPIProfile, error)
+
+	// FindXAPIProfiles は app に登録されている全ての XAPIProfile を profileId の順に返す。
+	FindXAPIProfiles(ctx context.Context, user, app string) ([]XAPIProfile, error)
+
+	// RemoveXAPIProfile は profileId の XAPIProfile を削除する。存在しない場合は ErrNotFound を返す。
+	RemoveXAPIProfile(ctx context.Context, user, app, profileID string) error
+
+	// SaveCMI5Session は同じセッションの CMI5Session を置き換えて保存する。
+	// InsertStatements の commit から呼んだ場合は、ステートメントと共に保存する。
+	SaveCMI5Session(ctx context.Context, session *CMI5Session) error
+
+	// FindCMI5Session は指定されたセッションの CMI5Session を返す。存在しない場合は ErrNotFound を返す。
+	FindCMI5Session(ctx context.Context, user, app, registration, sessionID string) (*CMI5Session, error)
+
+	// FindCMI5Sessions は registration の全ての CMI5Session を更新された順に返す。
+	FindCMI5Sessions(ctx context.Context, user, app, registration string) ([]CMI5Session, error)
+
+	// SaveCMI5Registration は同じ registration の CMI5Registration を置き換えて保存する。
+	// InsertStatements の commit から呼んだ場合は、ステートメントと共に保存する。
+	SaveCMI5Registration(ctx context.Context, registration *CMI5Registration) error
+
+	// FindCMI5Registration は registration の CMI5Registration を返す。存在しない場合は ErrNotFound を返す。
+	FindCMI5Registration(ctx context.Context, user, app, registration string) (*CMI5Registration, error)
+
+	// AddQuotaUsage はユーザーのディスク使用量に amount を加える。amount は負であってもよい。
+	AddQuotaUsage(ctx context.Context, user string, amount int64) error
+}
+
+// Store はステートメントとドキュメントを保存するストレージである。
+// MongoStore, MemoryStore, PostgresStore, SQLiteStore はこれを実装する。
+type Store interface {
+	StatementStore
+	DocumentStore
+}
+
+// StatementFilter は複数ステートメントの検索条件を表す。(Experience API, Section 7.2.3 を参照)
+// Agent, Verb, Activity, Registration の条件は、StatementRef により参照されるステートメントにも適用し、
+// 条件に合うステートメントを参照するステートメントも結果に含める。Voided となったステートメントは含めない。
+type StatementFilter struct {
+	Agent             map[string]interface{} // nil の場合は条件としない
+	RelatedAgents     bool
+	Verb              string
+	Activity          string
+	RelatedActivities bool
+	Registration      string
+	Since             time.Time // ゼロ値の場合は条件としない
+	Until             time.Time // ゼロ値の場合は条件としない
+	Ascending         bool      // true の場合は古いものから順に並べる
+	Limit             int       // 0 以下の場合は制限しない
+
+	// Snapshot より後に保存されたステートメントは含めない
+	Snapshot time.Time
+	// Cursor が nil でない場合は、Cursor が表す位置より後のステートメントを返す
+	Cursor *MoreCursor
+}
+
+// Attachment は保存されている添付ファイルの内容を読むために開いたものである。
+// 読み終えたら Close しなければならない。
+type Attachment struct {
+	io.ReadCloser
+	ContentType string
+}
@@ -0,0 +1,434 @@
+// Copyright 2015 realglobe, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package model
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/realglobe-Inc/edo-xrs/app/miscs"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// テストは MemoryStore と SQLiteStore に対して常に行い、以下の環境変数が与えられた場合は
+// PostgreSQL と MongoDB に対しても行う。同じデータベースでテストを繰り返せるよう、
+// 各テストはユーザーを新たに作りデータを分ける。
+//
+//	XRS_TEST_POSTGRESQL_URL: PostgreSQL の接続先 (例: postgres://localhost/xrs_test?sslmode=disable)
+//	XRS_TEST_MONGODB_URL:    MongoDB の接続先 (例: mongodb://localhost:27017)。データベースは xrs_test を用いる
+const (
+	testPostgreSQLURLEnv = "XRS_TEST_POSTGRESQL_URL"
+	testMongoDBURLEnv    = "XRS_TEST_MONGODB_URL"
+	testMongoDBName      = "xrs_test"
+)
+
+const testVoidedVerb = "http://adlnet.gov/expapi/verbs/voided"
+
+func TestMain(m *testing.M) {
+	miscs.GlobalConfig.Quota.UserMaxUsage = 1 << 30
+	miscs.GlobalConfig.Global.VoidedStatementID = testVoidedVerb
+
+	os.Exit(m.Run())
+}
+
+// testStores はテストの対象とするストレージを返す。ストレージはテストの終了時に閉じる。
+func testStores(t *testing.T) map[string]Store {
+	stores := map[string]Store{"memory": NewMemoryStore()}
+
+	sqlite, err := OpenSQLiteStore(filepath.Join(t.TempDir(), "xrs.db"), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sqlite.Close() })
+	stores["sqlite"] = sqlite
+
+	if url := os.Getenv(testPostgreSQLURLEnv); len(url) > 0 {
+		postgres, err := OpenPostgresStore(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { postgres.Close() })
+		stores["postgresql"] = postgres
+	}
+
+	if url := os.Getenv(testMongoDBURLEnv); len(url) > 0 {
+		ctx := context.Background()
+		client, err := Connect(ctx, url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		db := client.Database(testMongoDBName)
+		InitDB(ctx, db)
+		mongo := NewMongoStore(db)
+		t.Cleanup(func() { mongo.Close() })
+		stores["mongodb"] = mongo
+	}
+
+	return stores
+}
+
+// testUser はテストごとに異なるユーザー名を返す。
+func testUser() string {
+	return "test-" + primitive.NewObjectID().Hex()
+}
+
+// testStatement は id のステートメントを返す。extra のフィールドは既定の値を置き換える。
+func testStatement(id string, extra map[string]interface{}) map[string]interface{} {
+	data := map[string]interface{}{
+		"id":     id,
+		"stored": time.Now().UTC().Format(time.RFC3339Nano),
+		"actor":  map[string]interface{}{"mbox": "mailto:a@example.com"},
+		"verb":   map[string]interface{}{"id": "http://example.com/verbs/tested"},
+		"object": map[string]interface{}{
+			"objectType": "Activity",
+			"id":         "http://example.com/activities/test",
+			"definition": map[string]interface{}{"type": "http://example.com/types/test"},
+		},
+	}
+	for k, v := range extra {
+		data[k] = v
+	}
+
+	return data
+}
+
+// testVoidingStatement は target を取り消す id のステートメントを返す。
+func testVoidingStatement(id, target string) map[string]interface{} {
+	return testStatement(id, map[string]interface{}{
+		"verb":   map[string]interface{}{"id": testVoidedVerb},
+		"object": map[string]interface{}{"objectType": "StatementRef", "id": target},
+	})
+}
+
+func insertTestStatements(t *testing.T, store StatementStore, user string, statements ...map[string]interface{}) {
+	docs := make(DocumentSlice, 0, len(statements))
+	for _, data := range statements {
+		docs = append(docs, *NewDocument("1.0.3", user, "app", time.Now(), data))
+	}
+	if err := store.InsertStatements(context.Background(), user, "app", docs, int64(len(docs)), nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// queryTestStatements は filter に一致するステートメントの ID を返す。
+func queryTestStatements(t *testing.T, store StatementStore, user string, filter *StatementFilter) map[string]bool {
+	// 保存した直後に検索しても含まれることを確認するため、検索する時刻とする
+	if filter.Snapshot.IsZero() {
+		filter.Snapshot = time.Now()
+	}
+	docs, err := store.QueryStatements(context.Background(), user, "app", filter)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ids := make(map[string]bool)
+	for _, doc := range docs {
+		ids[doc.Data["id"].(string)] = true
+	}
+
+	return ids
+}
+
+func TestQueryStatements(t *testing.T) {
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			user := testUser()
+			insertTestStatements(t, store, user, testStatement("s1", nil))
+			insertTestStatements(t, store, user, testStatement("s2", map[string]interface{}{
+				"actor": map[string]interface{}{"mbox": "mailto:b@example.com"},
+				"context": map[string]interface{}{
+					"instructor":        map[string]interface{}{"mbox": "mailto:a@example.com"},
+					"contextActivities": map[string]interface{}{"parent": []interface{}{map[string]interface{}{"id": "http://example.com/activities/parent"}}},
+				},
+			}))
+			insertTestStatements(t, store, user, testStatement("s3", map[string]interface{}{
+				"actor": map[string]interface{}{"objectType": "Group", "member": []interface{}{
+					map[string]interface{}{"account": map[string]interface{}{"homePage": "http://example.com", "name": "member"}},
+				}},
+			}))
+			insertTestStatements(t, store, user, testStatement("s4", map[string]interface{}{
+				"actor":  map[string]interface{}{"mbox": "mailto:c@example.com"},
+				"object": map[string]interface{}{"objectType": "StatementRef", "id": "s2"},
+			}))
+
+			tests := []struct {
+				name     string
+				filter   *StatementFilter
+				expected []string
+			}{
+				{"agent", &StatementFilter{Agent: map[string]interface{}{"mbox": "mailto:a@example.com"}}, []string{"s1"}},
+				{"related agents", &StatementFilter{Agent: map[string]interface{}{"mbox": "mailto:a@example.com"}, RelatedAgents: true}, []string{"s1", "s2", "s4"}},
+				{"group member", &StatementFilter{
+					Agent:         map[string]interface{}{"account": map[string]interface{}{"homePage": "http://example.com", "name": "member"}},
+					RelatedAgents: true,
+				}, []string{"s3"}},
+				{"activity", &StatementFilter{Activity: "http://example.com/activities/parent"}, nil},
+				{"related activities", &StatementFilter{Activity: "http://example.com/activities/parent", RelatedActivities: true}, []string{"s2", "s4"}},
+			}
+			for _, test := range tests {
+				got := queryTestStatements(t, store, user, test.filter)
+				if len(got) != len(test.expected) {
+					t.Errorf("Expected %v statements by %s; got %v", test.expected, test.name, got)
+					continue
+				}
+				for _, id := range test.expected {
+					if !got[id] {
+						t.Errorf("Expected %v statements by %s; got %v", test.expected, test.name, got)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestQueryStatementsOrder(t *testing.T) {
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			user := testUser()
+			base := time.Now().Add(-time.Hour).UTC()
+			ids := []string{"o1", "o2", "o3"}
+			for i, id := range ids {
+				timestamp := base.Add(time.Duration(i) * time.Minute)
+				insertTestStatements(t, store, user, testStatement(id, map[string]interface{}{"timestamp": timestamp.Format(time.RFC3339Nano)}))
+			}
+
+			snapshot := time.Now()
+			for _, ascending := range []bool{false, true} {
+				// 2 件ずつ取得し、MoreCursor により残りを取得する
+				filter := &StatementFilter{Ascending: ascending, Limit: 2, Snapshot: snapshot}
+				docs, err := store.QueryStatements(ctx, user, "app", filter)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got, expected := len(docs), 2; got != expected {
+					t.Fatalf("Expected %v statements; got %v", expected, got)
+				}
+				last := docs[len(docs)-1]
+				var got []string
+				for _, doc := range docs {
+					got = append(got, doc.Data["id"].(string))
+				}
+
+				filter.Cursor = NewMoreCursor("1.0.3", user, "app", "", &last, snapshot)
+				docs, err = store.QueryStatements(ctx, user, "app", filter)
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, doc := range docs {
+					got = append(got, doc.Data["id"].(string))
+				}
+
+				expected := []string{"o3", "o2", "o1"}
+				if ascending {
+					expected = ids
+				}
+				if len(got) != len(expected) || got[0] != expected[0] || got[2] != expected[2] {
+					t.Errorf("Expected %v with ascending=%v; got %v", expected, ascending, got)
+				}
+			}
+		})
+	}
+}
+
+func TestFindStatements(t *testing.T) {
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			user := testUser()
+			insertTestStatements(t, store, user, testStatement("f1", nil), testStatement("f2", nil))
+
+			docs, err := store.FindStatements(ctx, user, "app", []string{"f1", "f2", "unknown"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, expected := len(docs), 2; got != expected {
+				t.Errorf("Expected %v statements; got %v", expected, got)
+			}
+			if _, err := store.FindStatement(ctx, user, "app", "unknown"); err != ErrNotFound {
+				t.Errorf("Expected ErrNotFound; got %v", err)
+			}
+
+			// 同じ ID のステートメントは保存できず、ディスク使用量も増えない
+			doc := NewDocument("1.0.3", user, "app", time.Now(), testStatement("f1", nil))
+			if err := store.InsertStatements(ctx, user, "app", DocumentSlice{*doc}, 1, nil); err != ErrDuplicateStatement {
+				t.Errorf("Expected ErrDuplicateStatement; got %v", err)
+			}
+			if usage, err := store.QuotaUsage(ctx, user); err != nil || usage != 2 {
+				t.Errorf("Expected usage 2; got %v (%v)", usage, err)
+			}
+
+			defs, err := store.FindActivityDefinitions(ctx, user, "app", "http://example.com/activities/test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(defs) != 2 || defs[0]["type"] != "http://example.com/types/test" {
+				t.Errorf("Unexpected activity definitions: %v", defs)
+			}
+		})
+	}
+}
+
+func TestVoidedStatements(t *testing.T) {
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			user := testUser()
+
+			// voiding ステートメントが対象より先に保存された場合
+			insertTestStatements(t, store, user, testVoidingStatement("v1", "t1"))
+			insertTestStatements(t, store, user, testStatement("t1", nil))
+			// 同じバッチの場合
+			insertTestStatements(t, store, user, testVoidingStatement("v2", "t2"), testStatement("t2", nil))
+			// 対象より後に保存された場合
+			insertTestStatements(t, store, user, testStatement("t3", nil))
+			time.Sleep(2 * time.Millisecond)
+			before := store.ConsistentThrough(ctx)
+			time.Sleep(5 * time.Millisecond)
+			insertTestStatements(t, store, user, testVoidingStatement("v3", "t3"))
+
+			got := queryTestStatements(t, store, user, &StatementFilter{})
+			if len(got) != 3 || got["t1"] || got["t2"] || got["t3"] {
+				t.Errorf("Expected only voiding statements; got %v", got)
+			}
+			for _, id := range []string{"t1", "t2", "t3"} {
+				if voided, err := store.IsVoided(ctx, user, "app", id); err != nil || !voided {
+					t.Errorf("Expected %v to be voided; got %v (%v)", id, voided, err)
+				}
+			}
+
+			// 取り消される前の時点の検索では t3 は取り消されていない
+			got = queryTestStatements(t, store, user, &StatementFilter{Snapshot: before})
+			if !got["t3"] || got["t1"] {
+				t.Errorf("Expected t3 before voided; got %v", got)
+			}
+		})
+	}
+}
+
+func TestFindAgentNames(t *testing.T) {
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			user := testUser()
+			insertTestStatements(t, store, user, testStatement("n1", map[string]interface{}{
+				"actor": map[string]interface{}{"mbox": "mailto:a@example.com", "name": "A1"},
+			}))
+			insertTestStatements(t, store, user, testStatement("n2", map[string]interface{}{
+				"actor":   map[string]interface{}{"mbox": "mailto:b@example.com", "name": "B"},
+				"context": map[string]interface{}{"instructor": map[string]interface{}{"mbox": "mailto:a@example.com", "name": "A2"}},
+			}))
+			insertTestStatements(t, store, user, testStatement("n3", map[string]interface{}{
+				"actor": map[string]interface{}{"objectType": "Group", "member": []interface{}{
+					map[string]interface{}{"mbox": "mailto:a@example.com", "name": "A3"},
+					map[string]interface{}{"mbox": "mailto:c@example.com", "name": "C"},
+				}},
+			}))
+			insertTestStatements(t, store, user, testStatement("n4", map[string]interface{}{
+				"actor": map[string]interface{}{"mbox": "mailto:a@example.com", "name": "A4"},
+			}))
+			// 取り消されたステートメントの名前は含まない
+			insertTestStatements(t, store, user, testVoidingStatement("n5", "n4"))
+
+			names, err := store.FindAgentNames(context.Background(), user, "app", map[string]interface{}{"mbox": "mailto:a@example.com"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(names) != 3 || names[0] != "A1" || names[1] != "A2" || names[2] != "A3" {
+				t.Errorf("Expected [A1 A2 A3]; got %v", names)
+			}
+		})
+	}
+}
+
+func TestConsistentThrough(t *testing.T) {
+	for name, store := range testStores(t) {
+		if name == "memory" {
+			// MemoryStore はロックを保持したまま commit を呼ぶため、挿入中の時刻を観測できない
+			continue
+		}
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			user := testUser()
+			doc := NewDocument("1.0.3", user, "app", time.Now(), testStatement("w1", nil))
+
+			inside, release := make(chan bool), make(chan bool)
+			errc := make(chan error)
+			go func() {
+				errc <- store.InsertStatements(ctx, user, "app", DocumentSlice{*doc}, 1, func(context.Context) error {
+					inside <- true
+					<-release
+					return nil
+				})
+			}()
+			<-inside
+			time.Sleep(3 * time.Millisecond)
+			through := store.ConsistentThrough(ctx)
+			close(release)
+			if err := <-errc; err != nil {
+				t.Fatal(err)
+			}
+
+			saved, err := store.FindStatement(ctx, user, "app", "w1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			stored := storedAt(saved.Data)
+			if dt, ok := saved.Data["stored"].(primitive.DateTime); ok {
+				stored = dt.Time()
+			}
+			if !through.Before(stored) {
+				t.Errorf("Expected ConsistentThrough %v before stored %v", through, stored)
+			}
+		})
+	}
+}
+
+func TestAttachments(t *testing.T) {
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			sha2 := testUser()
+			id, err := store.PutAttachment(ctx, sha2, "text/plain", "", bytes.NewReader([]byte("hello")))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			attachment, err := store.OpenAttachment(ctx, sha2)
+			if err != nil {
+				t.Fatal(err)
+			}
+			content, err := ioutil.ReadAll(attachment)
+			attachment.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(content) != "hello" || attachment.ContentType != "text/plain" {
+				t.Errorf("Unexpected attachment: %s (%s)", content, attachment.ContentType)
+			}
+
+			if err := store.RemoveAttachment(ctx, id); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := store.OpenAttachment(ctx, sha2); err != ErrNotFound {
+				t.Errorf("Expected ErrNotFound; got %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,106 @@
+// Copyright 2015 realglobe, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package model
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// XAPIProfile represents an xAPI Profile document registered for each app.
+type XAPIProfile struct {
+	ID        primitive.ObjectID `bson:"_id,omitempty"`
+	User      string             `bson:"user"`
+	App       string             `bson:"app"`
+	ProfileID string             `bson:"profileId"`
+	Content   []byte             `bson:"content"`
+	Updated   time.Time          `bson:"updated"`
+}
+
+func NewXAPIProfile(user, app, profileID string, content []byte, updated time.Time) *XAPIProfile {
+	return &XAPIProfile{
+		primitive.NewObjectID(),
+		user,
+		app,
+		profileID,
+		content,
+		updated,
+	}
+}
+
+// SaveTo は同じ profileId を持つ XAPIProfile を置き換えて保存する。
+func (p *XAPIProfile) SaveTo(ctx context.Context, col *mongo.Collection) error {
+	_, err := col.UpdateOne(ctx, bson.M{
+		"user":      p.User,
+		"app":       p.App,
+		"profileId": p.ProfileID,
+	}, bson.M{
+		"$set": bson.M{
+			"content": p.Content,
+			"updated": p.Updated,
+		},
+		"$setOnInsert": bson.M{"_id": p.ID},
+	}, options.Update().SetUpsert(true))
+	return err
+}
+
+// FindXAPIProfile は profileId の XAPIProfile を返す。
+// 存在しない場合は ErrNotFound を返す。
+func FindXAPIProfile(ctx context.Context, col *mongo.Collection, user, app, profileID string) (*XAPIProfile, error) {
+	var profile XAPIProfile
+	err := col.FindOne(ctx, bson.M{
+		"user":      user,
+		"app":       app,
+		"profileId": profileID,
+	}).Decode(&profile)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &profile, nil
+}
+
+// FindXAPIProfiles は app に登録されている全ての XAPIProfile を返す。
+func FindXAPIProfiles(ctx context.Context, col *mongo.Collection, user, app string) ([]XAPIProfile, error) {
+	cursor, err := col.Find(ctx, bson.M{"user": user, "app": app}, options.Find().
+		SetSort(bson.D{{Key: "profileId", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+
+	var profiles []XAPIProfile
+	if err := cursor.All(ctx, &profiles); err != nil {
+		return nil, err
+	}
+
+	return profiles, nil
+}
+
+// RemoveXAPIProfile は profileId の XAPIProfile を削除する。
+func RemoveXAPIProfile(ctx context.Context, col *mongo.Collection, user, app, profileID string) error {
+	return removeOne(ctx, col, bson.M{
+		"user":      user,
+		"app":       app,
+		"profileId": profileID,
+	})
+}
@@ -0,0 +1,168 @@
+// Copyright 2015 realglobe, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package validator
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/miyazakijunichi/gojsonschema"
+)
+
+// FieldError はステートメント中に見つかった一つの違反を表す。
+type FieldError struct {
+	Index   int    `json:"index"`   // バッチ中のステートメントの位置
+	Pointer string `json:"pointer"` // 違反したフィールドの JSON Pointer (RFC 6901)
+	Rule    string `json:"rule"`    // 違反した JSON Schema のキーワード
+	Message string `json:"message"`
+}
+
+// ValidationError はステートメントが正しくない場合に返す違反の列である。
+type ValidationError []FieldError
+
+func (e ValidationError) Error() string {
+	messages := make([]string, 0, len(e))
+	for _, fe := range e {
+		pointer := fe.Pointer
+		if len(pointer) == 0 {
+			pointer = "/"
+		}
+		messages = append(messages, fmt.Sprintf("statement %d: %s: %s (%s)", fe.Index, pointer, fe.Message, fe.Rule))
+	}
+
+	return strings.Join(messages, "; ")
+}
+
+// gojsonschema のエラーの種類と JSON Schema のキーワードの対応
+var schemaRules = map[string]string{
+	"required":                        "required",
+	"invalid_type":                    "type",
+	"enum":                            "enum",
+	"does_not_match_pattern":          "pattern",
+	"format":                          "format",
+	"number_one_of":                   "oneOf",
+	"number_any_of":                   "anyOf",
+	"number_all_of":                   "allOf",
+	"number_not":                      "not",
+	"additional_property_not_allowed": "additionalProperties",
+	"invalid_property_pattern":        "patternProperties",
+	"array_min_items":                 "minItems",
+	"array_max_items":                 "maxItems",
+	"unique":                          "uniqueItems",
+	"array_no_additional_items":       "additionalItems",
+	"string_gte":                      "minLength",
+	"string_lte":                      "maxLength",
+	"number_gte":                      "minimum",
+	"number_gt":                       "exclusiveMinimum",
+	"number_lte":                      "maximum",
+	"number_lt":                       "exclusiveMaximum",
+	"multiple_of":                     "multipleOf",
+	"array_min_properties":            "minProperties",
+	"array_max_properties":            "maxProperties",
+	"missing_dependency":              "dependencies",
+}
+
+// toFieldErrors は gojsonschema のエラーを FieldError に変換する。
+// body はフィールドの位置を JSON Pointer に変換するために用いる。
+// gojsonschema はプロパティを map により辿るため、エラーは JSON Pointer の順に並べ替える。
+func toFieldErrors(body interface{}, errs []gojsonschema.ResultError) ValidationError {
+	fieldErrors := make(ValidationError, 0, len(errs))
+
+	for _, desc := range errs {
+		rule, ok := schemaRules[desc.Type()]
+		if !ok {
+			rule = desc.Type()
+		}
+
+		pointer := fieldToPointer(body, desc.Field())
+		// required の場合、Field は親のオブジェクトを指すため、欠けているプロパティを加える
+		if rule == "required" {
+			if property, ok := desc.Details()["property"].(string); ok {
+				pointer += "/" + escapePointerToken(property)
+			}
+		}
+
+		fieldErrors = append(fieldErrors, FieldError{
+			Pointer: pointer,
+			Rule:    rule,
+			Message: desc.Description(),
+		})
+	}
+	sortFieldErrors(fieldErrors)
+
+	return fieldErrors
+}
+
+// sortFieldErrors は errs を JSON Pointer, キーワード, メッセージの順に並べ替える。
+func sortFieldErrors(errs ValidationError) {
+	sort.SliceStable(errs, func(i, j int) bool {
+		a, b := errs[i], errs[j]
+		if a.Pointer != b.Pointer {
+			return a.Pointer < b.Pointer
+		}
+		if a.Rule != b.Rule {
+			return a.Rule < b.Rule
+		}
+		return a.Message < b.Message
+	})
+}
+
+// fieldToPointer は gojsonschema の "." 区切りのフィールドを JSON Pointer に変換する。
+// extensions のキーのように "." を含むプロパティがあるため、body を辿りながら
+// 存在するプロパティのうち最も長いものに対応させる。
+func fieldToPointer(body interface{}, field string) string {
+	if len(field) == 0 || field == "(root)" {
+		return ""
+	}
+
+	segments := strings.Split(field, ".")
+	pointer := ""
+	current := body
+
+	for i := 0; i < len(segments); {
+		n := 1
+		switch t := current.(type) {
+		case map[string]interface{}:
+			for j := len(segments); j > i+1; j-- {
+				if _, ok := t[strings.Join(segments[i:j], ".")]; ok {
+					n = j - i
+					break
+				}
+			}
+			key := strings.Join(segments[i:i+n], ".")
+			current = t[key]
+			pointer += "/" + escapePointerToken(key)
+		case []interface{}:
+			if index, err := strconv.Atoi(segments[i]); err == nil && index >= 0 && index < len(t) {
+				current = t[index]
+			} else {
+				current = nil
+			}
+			pointer += "/" + segments[i]
+		default:
+			current = nil
+			pointer += "/" + escapePointerToken(segments[i])
+		}
+		i += n
+	}
+
+	return pointer
+}
+
+func escapePointerToken(token string) string {
+	return strings.Replace(strings.Replace(token, "~", "~0", -1), "/", "~1", -1)
+}
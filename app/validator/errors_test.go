@@ -0,0 +1,120 @@
+// Copyright 2015 realglobe, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package validator
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestFieldToPointer(t *testing.T) {
+	var body map[string]interface{}
+	if err := json.Unmarshal([]byte(`{
+		"actor": {"mbox": "mailto:a@example.com"},
+		"context": {"extensions": {"http://example.com/ext.v1": {"a/b": 1}}},
+		"attachments": [{"usageType": "a"}, {"usageType": "b"}]
+	}`), &body); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		field    string
+		expected string
+	}{
+		{"(root)", ""},
+		{"", ""},
+		{"actor.mbox", "/actor/mbox"},
+		{"attachments.1.usageType", "/attachments/1/usageType"},
+		{"attachments.5", "/attachments/5"},
+		{"context.extensions.http://example.com/ext.v1.a/b", "/context/extensions/http:~1~1example.com~1ext.v1/a~1b"},
+		{"verb.id", "/verb/id"},
+	} {
+		if got := fieldToPointer(body, c.field); got != c.expected {
+			t.Errorf("Expected %q for %q; got %q", c.expected, c.field, got)
+		}
+	}
+}
+
+func TestValidationErrorString(t *testing.T) {
+	err := ValidationError{
+		{Index: 0, Pointer: "", Rule: "required", Message: "actor is required"},
+		{Index: 1, Pointer: "/verb/id", Rule: "format", Message: "invalid IRI"},
+	}
+	if got, expected := err.Error(), "statement 0: /: actor is required (required); statement 1: /verb/id: invalid IRI (format)"; got != expected {
+		t.Errorf("Expected %q; got %q", expected, got)
+	}
+}
+
+func TestSchemaErrors(t *testing.T) {
+	for _, c := range []struct {
+		name      string
+		statement string
+		expected  []FieldError
+	}{
+		{"valid", `{
+			"actor": {"objectType": "Agent", "mbox": "mailto:a@example.com"},
+			"verb": {"id": "http://example.com/verbs/tested"},
+			"object": {"id": "http://example.com/activities/a"}
+		}`, nil},
+		{"missing", `{
+			"verb": {"id": "http://example.com/verbs/tested"}
+		}`, []FieldError{
+			{Pointer: "/actor", Rule: "required"},
+			{Pointer: "/object", Rule: "required"},
+		}},
+		{"types", `{
+			"actor": {"objectType": "Agent", "mbox": "mailto:a@example.com"},
+			"verb": {"id": "http://example.com/verbs/tested"},
+			"object": {"id": "http://example.com/activities/a"},
+			"context": {"revision": 1},
+			"result": {"success": "yes"}
+		}`, []FieldError{
+			{Pointer: "/context/revision", Rule: "type"},
+			{Pointer: "/result/success", Rule: "type"},
+		}},
+	} {
+		var statement map[string]interface{}
+		if err := json.Unmarshal([]byte(c.statement), &statement); err != nil {
+			t.Fatal(err)
+		}
+
+		// エラーの順序は毎回同じとなる
+		for i := 0; i < 10; i++ {
+			err := validate(XAPIVersion10x, "statement", statement)
+			if c.expected == nil {
+				if err != nil {
+					t.Fatalf("%s: Expected no error; got %v", c.name, err)
+				}
+				continue
+			}
+			verrs, ok := err.(ValidationError)
+			if !ok {
+				t.Fatalf("%s: Expected ValidationError; got %v", c.name, err)
+			}
+			if !sort.SliceIsSorted(verrs, func(i, j int) bool { return verrs[i].Pointer < verrs[j].Pointer }) {
+				t.Fatalf("%s: Expected errors sorted by pointer; got %v", c.name, verrs)
+			}
+			var got []FieldError
+			for _, fe := range verrs {
+				got = append(got, FieldError{Pointer: fe.Pointer, Rule: fe.Rule})
+			}
+			if !reflect.DeepEqual(got, c.expected) {
+				t.Fatalf("%s: Expected %v; got %v", c.name, c.expected, got)
+			}
+		}
+	}
+}
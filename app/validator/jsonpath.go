@@ -0,0 +1,217 @@
+// Copyright 2015 realglobe, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package validator
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// JSONPath は xAPI Profile のルールで用いる、コンパイル済みの JSONPath 式である。
+// xAPI Profile の仕様が求める範囲のみに対応する。すなわち、ルート "$"、".name" または "['name']" による子の参照、
+// 配列の添字 "[n]"、ワイルドカード ".*" と "[*]"、"|" によるパス全体の和である。
+type JSONPath [][]pathStep
+
+type pathStep struct {
+	wildcard bool
+	names    []string
+	indexes  []int
+}
+
+// CompileJSONPath は JSONPath 式を解析する。
+func CompileJSONPath(expr string) (JSONPath, error) {
+	var path JSONPath
+
+	for _, alt := range splitTopLevel(expr, '|') {
+		steps, err := compilePathSteps(strings.TrimSpace(alt))
+		if err != nil {
+			return nil, fmt.Errorf("invalid JSONPath %q: %s", expr, err)
+		}
+		path = append(path, steps)
+	}
+
+	return path, nil
+}
+
+func compilePathSteps(expr string) ([]pathStep, error) {
+	if !strings.HasPrefix(expr, "$") {
+		return nil, errors.New("path must start with $")
+	}
+
+	var steps []pathStep
+	rest := expr[1:]
+	for len(rest) > 0 {
+		switch rest[0] {
+		case '.':
+			rest = rest[1:]
+			if strings.HasPrefix(rest, "*") {
+				steps = append(steps, pathStep{wildcard: true})
+				rest = rest[1:]
+				continue
+			}
+			end := strings.IndexAny(rest, ".[")
+			if end < 0 {
+				end = len(rest)
+			}
+			if end == 0 {
+				return nil, errors.New("empty name")
+			}
+			steps = append(steps, pathStep{names: []string{rest[:end]}})
+			rest = rest[end:]
+		case '[':
+			end := closingBracket(rest)
+			if end < 0 {
+				return nil, errors.New("unclosed bracket")
+			}
+			step, err := compileBracket(rest[1:end])
+			if err != nil {
+				return nil, err
+			}
+			steps = append(steps, step)
+			rest = rest[end+1:]
+		default:
+			return nil, fmt.Errorf("unexpected character %q", rest[0])
+		}
+	}
+
+	return steps, nil
+}
+
+// compileBracket は括弧の中身を解析する。中身は "*"、引用符で囲んだ名前のカンマ区切りの列、
+// 添字のカンマ区切りの列のいずれかである。
+func compileBracket(content string) (pathStep, error) {
+	content = strings.TrimSpace(content)
+	if content == "*" {
+		return pathStep{wildcard: true}, nil
+	}
+
+	var step pathStep
+	for _, elem := range splitTopLevel(content, ',') {
+		elem = strings.TrimSpace(elem)
+		if len(elem) >= 2 && (elem[0] == '\'' || elem[0] == '"') && elem[len(elem)-1] == elem[0] {
+			step.names = append(step.names, elem[1:len(elem)-1])
+			continue
+		}
+		index, err := strconv.Atoi(elem)
+		if err != nil {
+			return pathStep{}, fmt.Errorf("invalid bracket element %q", elem)
+		}
+		step.indexes = append(step.indexes, index)
+	}
+	if len(step.names) > 0 && len(step.indexes) > 0 {
+		return pathStep{}, errors.New("names and indexes cannot be mixed in brackets")
+	}
+
+	return step, nil
+}
+
+// closingBracket は s[0] の括弧を閉じる括弧の位置を返す。引用符で囲まれた部分は飛ばす。
+func closingBracket(s string) int {
+	var quote byte
+	for i := 1; i < len(s); i++ {
+		switch {
+		case quote != 0:
+			if s[i] == quote {
+				quote = 0
+			}
+		case s[i] == '\'' || s[i] == '"':
+			quote = s[i]
+		case s[i] == ']':
+			return i
+		}
+	}
+
+	return -1
+}
+
+// splitTopLevel は括弧や引用符の中に無い sep により s を分割する。
+func splitTopLevel(s string, sep byte) []string {
+	var (
+		parts []string
+		quote byte
+		depth int
+		start int
+	)
+	for i := 0; i < len(s); i++ {
+		switch {
+		case quote != 0:
+			if s[i] == quote {
+				quote = 0
+			}
+		case s[i] == '\'' || s[i] == '"':
+			quote = s[i]
+		case s[i] == '[':
+			depth++
+		case s[i] == ']':
+			depth--
+		case s[i] == sep && depth == 0:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+
+	return append(parts, s[start:])
+}
+
+// Evaluate はパスが指す root 中の全ての値を返す。
+func (p JSONPath) Evaluate(root interface{}) []interface{} {
+	var values []interface{}
+
+	for _, steps := range p {
+		current := []interface{}{root}
+		for _, step := range steps {
+			current = step.apply(current)
+		}
+		values = append(values, current...)
+	}
+
+	return values
+}
+
+func (s pathStep) apply(values []interface{}) []interface{} {
+	var result []interface{}
+
+	for _, value := range values {
+		switch t := value.(type) {
+		case map[string]interface{}:
+			if s.wildcard {
+				for _, v := range t {
+					result = append(result, v)
+				}
+			}
+			for _, name := range s.names {
+				if v, ok := t[name]; ok {
+					result = append(result, v)
+				}
+			}
+		case []interface{}:
+			if s.wildcard {
+				result = append(result, t...)
+			}
+			for _, index := range s.indexes {
+				if index < 0 {
+					index += len(t)
+				}
+				if index >= 0 && index < len(t) {
+					result = append(result, t[index])
+				}
+			}
+		}
+	}
+
+	return result
+}
@@ -0,0 +1,97 @@
+// Copyright 2015 realglobe, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package validator
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestCompileJSONPath(t *testing.T) {
+	for _, c := range []struct {
+		expr  string
+		valid bool
+	}{
+		{"$.verb.id", true},
+		{"$['verb']['id']", true},
+		{"$.context.contextActivities.category[*].id", true},
+		{"$.attachments[0,1].usageType", true},
+		{"$.object.definition.extensions['http://example.com/ext']", true},
+		{"$.result.score.raw | $.result.score.scaled", true},
+		{"$.*", true},
+		{"verb.id", false},
+		{"$.", false},
+		{"$.verb[", false},
+		{"$['verb', 0]", false},
+		{"$[x]", false},
+		{"$verb", false},
+	} {
+		_, err := CompileJSONPath(c.expr)
+		if got := err == nil; got != c.valid {
+			t.Errorf("Expected valid=%v for %q; got error %v", c.valid, c.expr, err)
+		}
+	}
+}
+
+func TestJSONPathEvaluate(t *testing.T) {
+	var statement map[string]interface{}
+	if err := json.Unmarshal([]byte(`{
+		"verb": {"id": "http://example.com/verbs/tested"},
+		"object": {"definition": {"extensions": {"http://example.com/ext": 1}}},
+		"result": {"score": {"raw": 10, "scaled": 0.5}},
+		"attachments": [{"usageType": "a"}, {"usageType": "b"}, {"usageType": "c"}]
+	}`), &statement); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		expr     string
+		expected []interface{}
+	}{
+		{"$.verb.id", []interface{}{"http://example.com/verbs/tested"}},
+		{"$['verb']['id']", []interface{}{"http://example.com/verbs/tested"}},
+		{"$.object.definition.extensions['http://example.com/ext']", []interface{}{1.0}},
+		{"$.attachments[*].usageType", []interface{}{"a", "b", "c"}},
+		{"$.attachments[0,2].usageType", []interface{}{"a", "c"}},
+		{"$.attachments[-1].usageType", []interface{}{"c"}},
+		{"$.attachments[3].usageType", nil},
+		{"$.result.score.raw | $.result.score.scaled", []interface{}{10.0, 0.5}},
+		{"$.context.contextActivities.category[*].id", nil},
+	} {
+		path, err := CompileJSONPath(c.expr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := path.Evaluate(statement); !reflect.DeepEqual(got, c.expected) {
+			t.Errorf("Expected %v for %q; got %v", c.expected, c.expr, got)
+		}
+	}
+
+	// オブジェクトのワイルドカードは全ての値を返す (順序は問わない)
+	path, err := CompileJSONPath("$.result.score.*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []float64
+	for _, v := range path.Evaluate(statement) {
+		got = append(got, v.(float64))
+	}
+	sort.Float64s(got)
+	if expected := []float64{0.5, 10}; !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected %v for $.result.score.*; got %v", expected, got)
+	}
+}
@@ -0,0 +1,295 @@
+// Copyright 2015 realglobe, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package validator
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+)
+
+// Profile は xAPI Profile のドキュメントである。ステートメントの検査に用いる部分のみを持つ。
+type Profile struct {
+	ID        string              `json:"id"`
+	Type      string              `json:"type"`
+	Templates []StatementTemplate `json:"templates"`
+}
+
+// StatementTemplate は xAPI Profile の Statement Template である。
+type StatementTemplate struct {
+	ID                          string         `json:"id"`
+	Verb                        string         `json:"verb"`
+	ObjectActivityType          string         `json:"objectActivityType"`
+	ContextGroupingActivityType []string       `json:"contextGroupingActivityType"`
+	ContextParentActivityType   []string       `json:"contextParentActivityType"`
+	ContextOtherActivityType    []string       `json:"contextOtherActivityType"`
+	ContextCategoryActivityType []string       `json:"contextCategoryActivityType"`
+	AttachmentUsageType         []string       `json:"attachmentUsageType"`
+	Rules                       []TemplateRule `json:"rules"`
+}
+
+// TemplateRule は Statement Template のルールである。
+type TemplateRule struct {
+	Location string        `json:"location"`
+	Selector string        `json:"selector"`
+	Presence string        `json:"presence"`
+	Any      []interface{} `json:"any"`
+	All      []interface{} `json:"all"`
+	None     []interface{} `json:"none"`
+
+	location JSONPath
+	selector JSONPath
+}
+
+// ProfileError はステートメントが満たさない Statement Template のルールを表す。
+type ProfileError struct {
+	ProfileID  string
+	TemplateID string
+	Rule       int // Statement Template 中のルールの位置
+	Location   string
+	Reason     string
+}
+
+func (e *ProfileError) Error() string {
+	return fmt.Sprintf("rule %d (location: %s) of statement template %s in profile %s is not satisfied: %s",
+		e.Rule, e.Location, e.TemplateID, e.ProfileID, e.Reason)
+}
+
+// ParseProfile は xAPI Profile のドキュメントを解析し、ルールの JSONPath をコンパイルする。
+func ParseProfile(b []byte) (*Profile, error) {
+	var profile Profile
+	if err := json.Unmarshal(b, &profile); err != nil {
+		return nil, err
+	}
+
+	if len(profile.ID) == 0 {
+		return nil, errors.New("id is required in profile")
+	}
+	if profile.Type != "Profile" {
+		return nil, errors.New("type of profile must be Profile")
+	}
+
+	for i := range profile.Templates {
+		template := &profile.Templates[i]
+		if len(template.ID) == 0 {
+			return nil, errors.New("id is required in statement template")
+		}
+
+		for j := range template.Rules {
+			rule := &template.Rules[j]
+			if err := rule.compile(); err != nil {
+				return nil, fmt.Errorf("rule %d of statement template %s: %s", j, template.ID, err)
+			}
+		}
+	}
+
+	return &profile, nil
+}
+
+func (r *TemplateRule) compile() error {
+	var err error
+
+	if len(r.Location) == 0 {
+		return errors.New("location is required")
+	}
+	if r.location, err = CompileJSONPath(r.Location); err != nil {
+		return err
+	}
+	if len(r.Selector) > 0 {
+		if r.selector, err = CompileJSONPath(r.Selector); err != nil {
+			return err
+		}
+	}
+
+	switch r.Presence {
+	case "", "included", "excluded", "recommended":
+	default:
+		return fmt.Errorf("invalid presence: %s", r.Presence)
+	}
+	if len(r.Presence) == 0 && r.Any == nil && r.All == nil && r.None == nil {
+		return errors.New("at least one of presence, any, all or none is required")
+	}
+
+	return nil
+}
+
+// ValidateProfiles は profiles の Statement Template のうち、Determining Properties がステートメントに合う
+// 全てのものによりステートメントを検査する。ステートメントが満たさないルールがある場合は、
+// 最初のものを表す *ProfileError を返す。
+func ValidateProfiles(profiles []*Profile, statement map[string]interface{}) error {
+	for _, profile := range profiles {
+		for i := range profile.Templates {
+			template := &profile.Templates[i]
+			if !template.Matches(statement) {
+				continue
+			}
+
+			for j := range template.Rules {
+				rule := &template.Rules[j]
+				if reason := rule.check(statement); len(reason) > 0 {
+					return &ProfileError{
+						ProfileID:  profile.ID,
+						TemplateID: template.ID,
+						Rule:       j,
+						Location:   rule.Location,
+						Reason:     reason,
+					}
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+var (
+	verbPath               = mustCompileJSONPath("$.verb.id")
+	objectActivityTypePath = mustCompileJSONPath("$.object.definition.type")
+	attachmentUsageTypes   = mustCompileJSONPath("$.attachments[*].usageType")
+
+	contextGroupingActivityTypes = mustCompileJSONPath("$.context.contextActivities.grouping[*].definition.type")
+	contextParentActivityTypes   = mustCompileJSONPath("$.context.contextActivities.parent[*].definition.type")
+	contextOtherActivityTypes    = mustCompileJSONPath("$.context.contextActivities.other[*].definition.type")
+	contextCategoryActivityTypes = mustCompileJSONPath("$.context.contextActivities.category[*].definition.type")
+)
+
+func mustCompileJSONPath(expr string) JSONPath {
+	path, err := CompileJSONPath(expr)
+	if err != nil {
+		panic(err)
+	}
+
+	return path
+}
+
+// Matches は Statement Template の Determining Properties がステートメントに合うかを返す。
+func (t *StatementTemplate) Matches(statement map[string]interface{}) bool {
+	if len(t.Verb) > 0 && !containsValue(verbPath.Evaluate(statement), t.Verb) {
+		return false
+	}
+	if len(t.ObjectActivityType) > 0 && !containsValue(objectActivityTypePath.Evaluate(statement), t.ObjectActivityType) {
+		return false
+	}
+
+	for _, c := range []struct {
+		path  JSONPath
+		types []string
+	}{
+		{contextGroupingActivityTypes, t.ContextGroupingActivityType},
+		{contextParentActivityTypes, t.ContextParentActivityType},
+		{contextOtherActivityTypes, t.ContextOtherActivityType},
+		{contextCategoryActivityTypes, t.ContextCategoryActivityType},
+	} {
+		if len(c.types) == 0 {
+			continue
+		}
+		values := c.path.Evaluate(statement)
+		for _, typ := range c.types {
+			if !containsValue(values, typ) {
+				return false
+			}
+		}
+	}
+
+	if len(t.AttachmentUsageType) > 0 {
+		values := attachmentUsageTypes.Evaluate(statement)
+		for _, typ := range t.AttachmentUsageType {
+			if !containsValue(values, typ) {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// check はステートメントがルールを満たさない理由を返す。満たす場合は空文字列を返す。
+func (r *TemplateRule) check(statement map[string]interface{}) string {
+	values := r.location.Evaluate(statement)
+
+	// selector が値を返さない場合、その値は unmatchable となる
+	unmatchable := false
+	if r.selector != nil {
+		var selected []interface{}
+		for _, v := range values {
+			s := r.selector.Evaluate(v)
+			if len(s) == 0 {
+				unmatchable = true
+			}
+			selected = append(selected, s...)
+		}
+		values = selected
+	}
+
+	switch r.Presence {
+	case "included":
+		if len(values) == 0 || unmatchable {
+			return "value must be included"
+		}
+	case "excluded":
+		if len(values) > 0 {
+			return "value must be excluded"
+		}
+		return ""
+	}
+
+	// 値が無い場合、any, all, none は確認しない
+	if len(values) == 0 {
+		return ""
+	}
+
+	if r.Any != nil {
+		found := false
+		for _, v := range values {
+			if containsValue(r.Any, v) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return "no value is in any"
+		}
+	}
+	if r.All != nil {
+		if unmatchable {
+			return "unmatchable value found with all"
+		}
+		for _, v := range values {
+			if !containsValue(r.All, v) {
+				return fmt.Sprintf("value %v is not in all", v)
+			}
+		}
+	}
+	if r.None != nil {
+		for _, v := range values {
+			if containsValue(r.None, v) {
+				return fmt.Sprintf("value %v is in none", v)
+			}
+		}
+	}
+
+	return ""
+}
+
+func containsValue(values []interface{}, value interface{}) bool {
+	for _, v := range values {
+		if reflect.DeepEqual(v, value) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,139 @@
+// Copyright 2015 realglobe, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package validator
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+const testProfile = `{
+	"id": "http://example.com/profiles/test",
+	"type": "Profile",
+	"templates": [{
+		"id": "http://example.com/profiles/test/templates/scored",
+		"verb": "http://example.com/verbs/scored",
+		"contextCategoryActivityType": ["http://example.com/types/course"],
+		"rules": [
+			{"location": "$.result.score.raw", "presence": "included"},
+			{"location": "$.result.success", "presence": "excluded"},
+			{"location": "$.result.completion", "any": [true]},
+			{"location": "$.context.extensions['http://example.com/ext/level']", "all": ["easy", "normal"]},
+			{"location": "$.context.extensions['http://example.com/ext/level']", "none": ["hard"]},
+			{"location": "$.context.contextActivities.parent[*]", "selector": "$.id", "presence": "recommended", "all": ["http://example.com/parent"]}
+		]
+	}]
+}`
+
+func TestParseProfile(t *testing.T) {
+	for _, c := range []struct {
+		name  string
+		doc   string
+		valid bool
+	}{
+		{"valid", testProfile, true},
+		{"no id", `{"type": "Profile"}`, false},
+		{"wrong type", `{"id": "http://example.com/p", "type": "Pattern"}`, false},
+		{"no template id", `{"id": "http://example.com/p", "type": "Profile", "templates": [{}]}`, false},
+		{"no location", `{"id": "http://example.com/p", "type": "Profile", "templates": [{"id": "t", "rules": [{"presence": "included"}]}]}`, false},
+		{"invalid location", `{"id": "http://example.com/p", "type": "Profile", "templates": [{"id": "t", "rules": [{"location": "result", "presence": "included"}]}]}`, false},
+		{"invalid presence", `{"id": "http://example.com/p", "type": "Profile", "templates": [{"id": "t", "rules": [{"location": "$.result", "presence": "required"}]}]}`, false},
+		{"no requirement", `{"id": "http://example.com/p", "type": "Profile", "templates": [{"id": "t", "rules": [{"location": "$.result"}]}]}`, false},
+		{"not json", `{`, false},
+	} {
+		_, err := ParseProfile([]byte(c.doc))
+		if got := err == nil; got != c.valid {
+			t.Errorf("%s: Expected valid=%v; got error %v", c.name, c.valid, err)
+		}
+	}
+}
+
+func TestValidateProfiles(t *testing.T) {
+	profile, err := ParseProfile([]byte(testProfile))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		name      string
+		statement string
+		rule      int // 満たさないルールの位置。-1 は全て満たす
+	}{
+		{"satisfied", `{
+			"verb": {"id": "http://example.com/verbs/scored"},
+			"result": {"score": {"raw": 1}, "completion": true},
+			"context": {
+				"contextActivities": {
+					"category": [{"id": "http://example.com/course", "definition": {"type": "http://example.com/types/course"}}],
+					"parent": [{"id": "http://example.com/parent"}]
+				},
+				"extensions": {"http://example.com/ext/level": "easy"}
+			}
+		}`, -1},
+		{"other verb", `{"verb": {"id": "http://example.com/verbs/other"}}`, -1},
+		{"no category", `{"verb": {"id": "http://example.com/verbs/scored"}}`, -1},
+		{"raw missing", `{
+			"verb": {"id": "http://example.com/verbs/scored"},
+			"context": {"contextActivities": {"category": [{"id": "http://example.com/course", "definition": {"type": "http://example.com/types/course"}}]}}
+		}`, 0},
+		{"success present", `{
+			"verb": {"id": "http://example.com/verbs/scored"},
+			"result": {"score": {"raw": 1}, "success": true},
+			"context": {"contextActivities": {"category": [{"id": "http://example.com/course", "definition": {"type": "http://example.com/types/course"}}]}}
+		}`, 1},
+		{"completion not in any", `{
+			"verb": {"id": "http://example.com/verbs/scored"},
+			"result": {"score": {"raw": 1}, "completion": false},
+			"context": {"contextActivities": {"category": [{"id": "http://example.com/course", "definition": {"type": "http://example.com/types/course"}}]}}
+		}`, 2},
+		{"level not in all", `{
+			"verb": {"id": "http://example.com/verbs/scored"},
+			"result": {"score": {"raw": 1}},
+			"context": {
+				"contextActivities": {"category": [{"id": "http://example.com/course", "definition": {"type": "http://example.com/types/course"}}]},
+				"extensions": {"http://example.com/ext/level": "hard"}
+			}
+		}`, 3},
+		{"parent unmatchable", `{
+			"verb": {"id": "http://example.com/verbs/scored"},
+			"result": {"score": {"raw": 1}},
+			"context": {"contextActivities": {
+				"category": [{"id": "http://example.com/course", "definition": {"type": "http://example.com/types/course"}}],
+				"parent": [{"id": "http://example.com/parent"}, {"objectType": "Activity"}]
+			}}
+		}`, 5},
+	} {
+		var statement map[string]interface{}
+		if err := json.Unmarshal([]byte(c.statement), &statement); err != nil {
+			t.Fatal(err)
+		}
+
+		err := ValidateProfiles([]*Profile{profile}, statement)
+		if c.rule < 0 {
+			if err != nil {
+				t.Errorf("%s: Expected no error; got %v", c.name, err)
+			}
+			continue
+		}
+		perr, ok := err.(*ProfileError)
+		if !ok {
+			t.Errorf("%s: Expected *ProfileError; got %v", c.name, err)
+			continue
+		}
+		if perr.Rule != c.rule || perr.ProfileID != profile.ID || perr.TemplateID != profile.Templates[0].ID {
+			t.Errorf("%s: Expected rule %d of %s; got %v", c.name, c.rule, profile.Templates[0].ID, perr)
+		}
+	}
+}
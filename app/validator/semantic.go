@@ -0,0 +1,151 @@
+// Copyright 2015 realglobe, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package validator
+
+import (
+	"fmt"
+	"net/mail"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// ISO 8601 の期間 (PnYnMnDTnHnMnS, PnW)
+var validDuration = regexp.MustCompile(`^P(?:(?:\d+(?:\.\d+)?Y)?(?:\d+(?:\.\d+)?M)?(?:\d+(?:\.\d+)?D)?(?:T(?:\d+(?:\.\d+)?H)?(?:\d+(?:\.\d+)?M)?(?:\d+(?:\.\d+)?S)?)?|\d+(?:\.\d+)?W)$`)
+
+// IsDuration は ISO 8601 の期間であるかを検査する。
+func IsDuration(text string) bool {
+	return validDuration.MatchString(text) && text != "P" && !strings.HasSuffix(text, "T")
+}
+
+// IsMailtoIRI は mbox の mailto IRI であるかを検査する。
+func IsMailtoIRI(text string) bool {
+	if !strings.HasPrefix(text, "mailto:") {
+		return false
+	}
+
+	addr, err := mail.ParseAddress(strings.TrimPrefix(text, "mailto:"))
+	return err == nil && len(addr.Name) == 0 && "mailto:"+addr.Address == text
+}
+
+// checkSemantics は JSON Schema では表現できない xAPI の規則によりステートメントを検査する。
+// スキーマによる検査の後に呼ばれるため、各フィールドの型は正しいものとして扱う。
+// voidingVerb は voiding ステートメントの Verb の ID である。
+func checkSemantics(body map[string]interface{}, voidingVerb string) error {
+	var errs ValidationError
+	add := func(pointer, rule, format string, a ...interface{}) {
+		errs = append(errs, FieldError{
+			Pointer: pointer,
+			Rule:    rule,
+			Message: fmt.Sprintf(format, a...),
+		})
+	}
+
+	// mbox は mailto IRI でなければならない
+	walkObjects(body, "", func(pointer string, m map[string]interface{}) {
+		if mbox, ok := m["mbox"].(string); ok && !IsMailtoIRI(mbox) {
+			add(pointer+"/mbox", "mailto", "mbox must be a valid mailto IRI: %s", mbox)
+		}
+	})
+
+	checkStatementSemantics(body, "", add)
+
+	// SubStatement は入れ子にできない
+	if object, ok := body["object"].(map[string]interface{}); ok && object["objectType"] == "SubStatement" {
+		checkStatementSemantics(object, "/object", add)
+
+		if inner, ok := object["object"].(map[string]interface{}); ok && inner["objectType"] == "SubStatement" {
+			add("/object/object/objectType", "subStatement", "SubStatement must not contain a SubStatement")
+		}
+	}
+
+	// voiding ステートメントは添付ファイルを持てない
+	if verb, ok := body["verb"].(map[string]interface{}); ok && verb["id"] == voidingVerb {
+		if _, ok := body["attachments"]; ok {
+			add("/attachments", "voiding", "Voiding statement must not have attachments")
+		}
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+
+	return nil
+}
+
+// checkStatementSemantics はステートメントと SubStatement に共通する規則を検査する。
+func checkStatementSemantics(stmt map[string]interface{}, prefix string, add func(pointer, rule, format string, a ...interface{})) {
+	if result, ok := stmt["result"].(map[string]interface{}); ok {
+		if duration, ok := result["duration"].(string); ok && !IsDuration(duration) {
+			add(prefix+"/result/duration", "duration", "duration must be an ISO 8601 duration: %s", duration)
+		}
+
+		if score, ok := result["score"].(map[string]interface{}); ok {
+			if scaled, ok := score["scaled"].(float64); ok && (scaled < -1 || scaled > 1) {
+				add(prefix+"/result/score/scaled", "score", "scaled must be between -1 and 1: %v", scaled)
+			}
+
+			min, hasMin := score["min"].(float64)
+			max, hasMax := score["max"].(float64)
+			if hasMin && hasMax && min > max {
+				add(prefix+"/result/score/min", "score", "min must not be greater than max: %v > %v", min, max)
+			}
+			if raw, ok := score["raw"].(float64); ok {
+				if hasMin && raw < min {
+					add(prefix+"/result/score/raw", "score", "raw must not be less than min: %v < %v", raw, min)
+				}
+				if hasMax && raw > max {
+					add(prefix+"/result/score/raw", "score", "raw must not be greater than max: %v > %v", raw, max)
+				}
+			}
+		}
+	}
+
+	// revision と platform は object が Activity の場合にのみ使用できる
+	if context, ok := stmt["context"].(map[string]interface{}); ok {
+		object, _ := stmt["object"].(map[string]interface{})
+		objectType, ok := object["objectType"]
+		if ok && objectType != "Activity" {
+			for _, field := range []string{"revision", "platform"} {
+				if _, ok := context[field]; ok {
+					add(prefix+"/context/"+field, "activityContext", "context.%s is allowed only when object is an Activity", field)
+				}
+			}
+		}
+	}
+}
+
+// walkObjects は extensions を除く全てのオブジェクトを JSON Pointer とともに辿る。
+// エラーの順序が毎回同じとなるよう、オブジェクトのプロパティはキーの順に辿る。
+func walkObjects(data interface{}, pointer string, f func(string, map[string]interface{})) {
+	switch t := data.(type) {
+	case map[string]interface{}:
+		f(pointer, t)
+		keys := make([]string, 0, len(t))
+		for k := range t {
+			if k != "extensions" {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			walkObjects(t[k], pointer+"/"+escapePointerToken(k), f)
+		}
+	case []interface{}:
+		for i, v := range t {
+			walkObjects(v, fmt.Sprintf("%s/%d", pointer, i), f)
+		}
+	}
+}
@@ -0,0 +1,159 @@
+// Copyright 2015 realglobe, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package validator
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+const testVoidingVerb = "http://adlnet.gov/expapi/verbs/voided"
+
+func TestIsDuration(t *testing.T) {
+	for _, c := range []struct {
+		text     string
+		expected bool
+	}{
+		{"PT1H30M", true},
+		{"P1Y2M3DT4H5M6.7S", true},
+		{"P3W", true},
+		{"PT0.5S", true},
+		{"P", false},
+		{"PT", false},
+		{"P1DT", false},
+		{"1H", false},
+		{"P1H", false},
+		{"P1W2D", false},
+	} {
+		if got := IsDuration(c.text); got != c.expected {
+			t.Errorf("Expected %v for %q; got %v", c.expected, c.text, got)
+		}
+	}
+}
+
+func TestIsMailtoIRI(t *testing.T) {
+	for _, c := range []struct {
+		text     string
+		expected bool
+	}{
+		{"mailto:test@example.com", true},
+		{"mailto:first.last+tag@sub.example.com", true},
+		{"mbox:test@example.com", false},
+		{"test@example.com", false},
+		{"mailto:", false},
+		{"mailto:test", false},
+		{"mailto:Test <test@example.com>", false},
+		{"mailto: test@example.com", false},
+	} {
+		if got := IsMailtoIRI(c.text); got != c.expected {
+			t.Errorf("Expected %v for %q; got %v", c.expected, c.text, got)
+		}
+	}
+}
+
+func TestCheckSemantics(t *testing.T) {
+	for _, c := range []struct {
+		name      string
+		statement string
+		expected  []FieldError // Pointer と Rule のみ比較する
+	}{
+		{"valid", `{
+			"actor": {"objectType": "Agent", "mbox": "mailto:a@example.com"},
+			"verb": {"id": "http://example.com/verbs/tested"},
+			"object": {"objectType": "Activity", "id": "http://example.com/a"},
+			"result": {"duration": "PT1M", "score": {"scaled": 0.5, "raw": 5, "min": 0, "max": 10}},
+			"context": {"revision": "1", "platform": "web", "extensions": {"http://example.com/ext": {"mbox": "not checked"}}}
+		}`, nil},
+		{"mbox", `{
+			"actor": {"objectType": "Group", "mbox": "mbox:g@example.com", "member": [{"mbox": "a@example.com"}]},
+			"verb": {"id": "http://example.com/verbs/tested"},
+			"object": {"objectType": "Agent", "mbox": "mailto:b@example.com"},
+			"context": {"instructor": {"mbox": "mailto:Instructor <i@example.com>"}}
+		}`, []FieldError{
+			{Pointer: "/actor/mbox", Rule: "mailto"},
+			{Pointer: "/actor/member/0/mbox", Rule: "mailto"},
+			{Pointer: "/context/instructor/mbox", Rule: "mailto"},
+		}},
+		{"result", `{
+			"verb": {"id": "http://example.com/verbs/tested"},
+			"result": {"duration": "1 minute", "score": {"scaled": 1.5, "raw": 11, "min": 12, "max": 10}}
+		}`, []FieldError{
+			{Pointer: "/result/duration", Rule: "duration"},
+			{Pointer: "/result/score/scaled", Rule: "score"},
+			{Pointer: "/result/score/min", Rule: "score"},
+			{Pointer: "/result/score/raw", Rule: "score"},
+			{Pointer: "/result/score/raw", Rule: "score"},
+		}},
+		{"revision", `{
+			"verb": {"id": "http://example.com/verbs/tested"},
+			"object": {"objectType": "StatementRef", "id": "1cabcb4f-c41c-49a5-ad89-9a9c8c5fd20a"},
+			"context": {"revision": "1", "platform": "web"}
+		}`, []FieldError{
+			{Pointer: "/context/revision", Rule: "activityContext"},
+			{Pointer: "/context/platform", Rule: "activityContext"},
+		}},
+		{"subStatement", `{
+			"verb": {"id": "http://example.com/verbs/tested"},
+			"object": {
+				"objectType": "SubStatement",
+				"result": {"duration": "P"},
+				"object": {"objectType": "SubStatement"}
+			}
+		}`, []FieldError{
+			{Pointer: "/object/result/duration", Rule: "duration"},
+			{Pointer: "/object/object/objectType", Rule: "subStatement"},
+		}},
+		{"voiding", `{
+			"verb": {"id": "` + testVoidingVerb + `"},
+			"object": {"objectType": "StatementRef", "id": "1cabcb4f-c41c-49a5-ad89-9a9c8c5fd20a"},
+			"attachments": []
+		}`, []FieldError{
+			{Pointer: "/attachments", Rule: "voiding"},
+		}},
+		{"not voiding", `{
+			"verb": {"id": "http://example.com/verbs/voided"},
+			"object": {"objectType": "StatementRef", "id": "1cabcb4f-c41c-49a5-ad89-9a9c8c5fd20a"},
+			"attachments": []
+		}`, nil},
+	} {
+		var statement map[string]interface{}
+		if err := json.Unmarshal([]byte(c.statement), &statement); err != nil {
+			t.Fatal(err)
+		}
+
+		// エラーの順序は毎回同じとなる
+		for i := 0; i < 10; i++ {
+			err := checkSemantics(statement, testVoidingVerb)
+			if c.expected == nil {
+				if err != nil {
+					t.Fatalf("%s: Expected no error; got %v", c.name, err)
+				}
+				continue
+			}
+			verrs, ok := err.(ValidationError)
+			if !ok {
+				t.Fatalf("%s: Expected ValidationError; got %v", c.name, err)
+			}
+			var got []FieldError
+			for _, fe := range verrs {
+				got = append(got, FieldError{Pointer: fe.Pointer, Rule: fe.Rule})
+			}
+			if !reflect.DeepEqual(got, c.expected) {
+				t.Fatalf("%s: Expected %v; got %v", c.name, c.expected, got)
+			}
+		}
+	}
+}
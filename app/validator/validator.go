@@ -16,7 +16,6 @@ package validator
 
 import (
 	"errors"
-	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
@@ -40,46 +39,51 @@ func GetXAPISchemaInstance() *XAPISchema {
 	return schema
 }
 
+// schemaDirs は対応する各バージョンの JSON Schema のディレクトリである。
+var schemaDirs = map[XAPIVersion]string{
+	XAPIVersion10x: "xapi_1.0.2",
+	XAPIVersion20:  "xapi_2.0.0",
+}
+
 func init() {
 	var err error
 
-	var schemaPathV10x string
+	var schemaPath string
 	gopath := os.Getenv("GOPATH")
 	if len(gopath) != 0 {
-		schemaPathV10x = gopath + "/src/github.com/realglobe-Inc/edo-xrs/jsonschema/xapi_1.0.2"
+		schemaPath = gopath + "/src/github.com/realglobe-Inc/edo-xrs/jsonschema"
 	} else {
-		if schemaPathV10x, err = filepath.Abs("jsonschema/xapi_1.0.2"); err != nil {
+		if schemaPath, err = filepath.Abs("jsonschema"); err != nil {
 			logger.Err("Invalid schema-path given: ", err)
 			os.Exit(1)
 		}
 	}
 
 	// JSON Schema をロード
-	v10xstatement, err := readSchema(schemaPathV10x + "/statement.json")
-	if err != nil {
-		logger.Err(err)
-		os.Exit(1)
-	}
-	v10xagent, err := readSchema(schemaPathV10x + "/agent.json")
-	if err != nil {
-		logger.Err(err)
-		os.Exit(1)
+	for version, dir := range schemaDirs {
+		set, err := readSchemaSet(schemaPath + "/" + dir)
+		if err != nil {
+			logger.Err(err)
+			os.Exit(1)
+		}
+		(*schema)[version] = set
 	}
+}
 
-	v10xlangmap, err := readSchema(schemaPathV10x + "/langmap.json")
-	if err != nil {
-		logger.Err(err)
-		os.Exit(1)
-	}
+func readSchemaSet(dir string) (map[string]*gojsonschema.Schema, error) {
+	set := make(map[string]*gojsonschema.Schema)
 
-	(*schema)[XAPIVersion10x] = map[string]*gojsonschema.Schema{
-		"statement": v10xstatement,
-		"agent":     v10xagent,
-		"langmap":   v10xlangmap,
+	for _, name := range []string{"statement", "agent", "langmap"} {
+		scm, err := readSchema(dir + "/" + name + ".json")
+		if err != nil {
+			return nil, err
+		}
+		set[name] = scm
 	}
+
+	return set, nil
 }
 
-// readSchema は与えられたパスの JSON Schema を読み込み、そのインスタンスを返す。
 func readSchema(path string) (*gojsonschema.Schema, error) {
 	var err error
 
@@ -98,6 +102,7 @@ func readSchema(path string) (*gojsonschema.Schema, error) {
 }
 
 // validate は与えられた body が kind であることを検査する。
+// body が正しくない場合は ValidationError を返す。
 func validate(version XAPIVersion, kind string, body map[string]interface{}) error {
 	if s, ok := (*schema)[version]; ok {
 		res, err := s[kind].Validate(gojsonschema.NewGoLoader(body))
@@ -107,12 +112,7 @@ func validate(version XAPIVersion, kind string, body map[string]interface{}) err
 		}
 
 		if !res.Valid() {
-			emessage := "The document is not valid. see errors: \n"
-
-			for _, desc := range res.Errors() {
-				emessage += fmt.Sprintf("- %s", desc)
-			}
-			return errors.New(emessage)
+			return toFieldErrors(body, res.Errors())
 		}
 	} else {
 		return errors.New("Invalid XAPI version given.")
@@ -130,27 +130,54 @@ func Agent(version XAPIVersion, body map[string]interface{}) error {
 
 // Statement は body により与えられたステートメントの JSON の構造が
 // xapiVersion により与えられる XAPIバージョンの正しいステートメントであることを検査する。
+// JSON Schema による検査の後、スキーマでは表現できない規則 (mbox の形式, score の範囲など) を検査する。
+// voidingVerb は voiding ステートメントの Verb の ID である。
 // ステートメントが正しくない場合、err != nil となる。
-func Statement(version XAPIVersion, body map[string]interface{}) error {
-	return validate(version, "statement", body)
+func Statement(version XAPIVersion, body map[string]interface{}, voidingVerb string) error {
+	if err := validate(version, "statement", body); err != nil {
+		return err
+	}
+
+	return checkSemantics(body, voidingVerb)
 }
 
 // MultStatement は body により与えられたステートメントの列を検査する。
-// 配列の各ステートメントは Statement と同様に検査する。
-func MultStatement(version XAPIVersion, body []interface{}) error {
+// 配列の各ステートメントは Statement と同様に検査し、正しくないステートメントがある場合は
+// 全てのステートメントのエラーを、配列中の位置とともに ValidationError として返す。
+func MultStatement(version XAPIVersion, body []interface{}, voidingVerb string) error {
+	var errs ValidationError
 
-	for _, stmt := range body {
+	for i, stmt := range body {
 		// ステートメントは必ず map[string]inteface{} の構造をしているので、それ以外はエラーを返す。
-		if _, ok := stmt.(map[string]interface{}); !ok {
-			return errors.New("The structure of statement doesn't satisfy specification.")
+		s, ok := stmt.(map[string]interface{})
+		if !ok {
+			errs = append(errs, FieldError{
+				Index:   i,
+				Rule:    "type",
+				Message: "The structure of statement doesn't satisfy specification.",
+			})
+			continue
 		}
 
 		// Statement を検査。
 		// MultStatement では XAPIバージョンのチェックを行っていないが、バージョンが合致しない場合、
 		// Statement によりエラーが返されるのため差し障りがない。
-		if err := Statement(version, stmt.(map[string]interface{})); err != nil {
+		err := Statement(version, s, voidingVerb)
+		if err == nil {
+			continue
+		}
+		verrs, ok := err.(ValidationError)
+		if !ok {
 			return err
 		}
+		for _, fe := range verrs {
+			fe.Index = i
+			errs = append(errs, fe)
+		}
+	}
+
+	if len(errs) > 0 {
+		return errs
 	}
 
 	return nil
@@ -26,24 +26,57 @@ const (
 	XAPIVersionVoid XAPIVersion = iota
 	// XAPIVersion10x indicates xAPI version 1.0.*.
 	XAPIVersion10x
+	// XAPIVersion20 indicates xAPI version 2.0.0.
+	XAPIVersion20
 )
 
-var version10x = regexp.MustCompile(`^1\.0\.[0-9]+$`)
+var (
+	version10x = regexp.MustCompile(`^1\.0\.[0-9]+$`)
+	version20  = regexp.MustCompile(`^2\.0\.0$`)
+)
 
 // SupportedVersions returns all versions supported by this validator.
 func SupportedVersions() []XAPIVersion {
-	return []XAPIVersion{XAPIVersion10x}
+	return []XAPIVersion{XAPIVersion10x, XAPIVersion20}
 }
 
 // ToXAPIVersion converts XAPI version string to constant.
 func ToXAPIVersion(version string) XAPIVersion {
-	if version10x.MatchString(version) {
+	switch {
+	case version10x.MatchString(version):
 		return XAPIVersion10x
+	case version20.MatchString(version):
+		return XAPIVersion20
 	}
 
 	return XAPIVersionVoid
 }
 
+// String returns the latest patch version of v, which is sent back to clients
+// in X-Experience-API-Version header.
+func (v XAPIVersion) String() string {
+	switch v {
+	case XAPIVersion10x:
+		return "1.0.2"
+	case XAPIVersion20:
+		return "2.0.0"
+	}
+
+	return ""
+}
+
+// PatchVersions returns all version strings of v accepted by this validator.
+func (v XAPIVersion) PatchVersions() []string {
+	switch v {
+	case XAPIVersion10x:
+		return []string{"1.0.0", "1.0.1", "1.0.2"}
+	case XAPIVersion20:
+		return []string{"2.0.0"}
+	}
+
+	return nil
+}
+
 // IsValidXAPIVersion validates XAPI version string.
 func IsValidXAPIVersion(version string) bool {
 	return ToXAPIVersion(version) != XAPIVersionVoid
@@ -0,0 +1,51 @@
+// Copyright 2015 realglobe, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package validator
+
+import "testing"
+
+func TestToXAPIVersion(t *testing.T) {
+	for _, c := range []struct {
+		version  string
+		expected XAPIVersion
+	}{
+		{"1.0.0", XAPIVersion10x},
+		{"1.0.2", XAPIVersion10x},
+		{"1.0.3", XAPIVersion10x},
+		{"2.0.0", XAPIVersion20},
+		{"2.0.7", XAPIVersionVoid},
+		{"2.1.0", XAPIVersionVoid},
+		{"0.9.5", XAPIVersionVoid},
+		{"1.0", XAPIVersionVoid},
+		{"", XAPIVersionVoid},
+	} {
+		if got := ToXAPIVersion(c.version); got != c.expected {
+			t.Errorf("Expected %v for %q; got %v", c.expected, c.version, got)
+		}
+	}
+}
+
+func TestPatchVersions(t *testing.T) {
+	for _, v := range SupportedVersions() {
+		for _, version := range v.PatchVersions() {
+			if got := ToXAPIVersion(version); got != v {
+				t.Errorf("Expected %v for %q; got %v", v, version, got)
+			}
+		}
+		if got := ToXAPIVersion(v.String()); got != v {
+			t.Errorf("Expected %v for %q; got %v", v, v.String(), got)
+		}
+	}
+}
@@ -17,17 +17,22 @@ package main
 import (
 	//	"net/http"
 	//	_ "net/http/pprof"
+	"context"
+	"encoding/json"
 	"flag"
+	"fmt"
+	"io"
 	"net/http"
 	"os"
+	"time"
 
 	"github.com/go-martini/martini"
 	"github.com/martini-contrib/acceptlang"
 	"github.com/realglobe-Inc/edo-xrs/app/controller"
 	"github.com/realglobe-Inc/edo-xrs/app/miscs"
 	"github.com/realglobe-Inc/edo-xrs/app/model"
+	"github.com/realglobe-Inc/edo-xrs/app/validator"
 	"github.com/realglobe-Inc/go-lib/rglog"
-	"gopkg.in/mgo.v2"
 )
 
 var (
@@ -57,16 +62,25 @@ func main() {
 	//	logger.Info(http.ListenAndServe("localhost:6000", nil))
 	//}()
 
+	// migrate data between storages
+	flag.Parse()
+	if flag.Arg(0) == "migrate" {
+		if err := migrate(flag.Arg(1), flag.Arg(2)); err != nil {
+			logger.Err(err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	// start routing
-	session, err := mgo.Dial(miscs.GlobalConfig.MongoDB.URL)
-	defer session.Close()
+	store, err := openStorage(miscs.GlobalConfig.Storage.Backend)
 	if err != nil {
 		logger.Err(err)
 		os.Exit(1)
 	}
-	model.InitDB(session.DB(miscs.GlobalConfig.MongoDB.DBName))
+	defer closeStorage(store)
 
-	c := controller.New(session)
+	c := controller.New(store)
 
 	router := martini.Classic()
 	router.Get("/", func() string { return "Welcome to xRS API Server." })
@@ -75,19 +89,124 @@ func main() {
 	router.Options("**", func(params martini.Params, w http.ResponseWriter) {
 		w.Header().Set("Content-Type", "application/json; charset=utf-8")
 		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Headers", "X-Experience-API-Version")
+		w.Header().Set("Access-Control-Allow-Headers", "X-Experience-API-Version, Content-Type, If-Match, If-None-Match")
 	})
 	router.Get("/:user/:app/about", func(params martini.Params, w http.ResponseWriter) (int, string) {
 		w.Header().Set("Content-Type", "application/json; charset=utf-8")
 		w.Header().Set("Access-Control-Allow-Origin", "*")
 		w.Header().Set("Access-Control-Allow-Headers", "X-Experience-API-Version")
 
-		return http.StatusOK, `{"version": ["1.0.0", "1.0.1", "1.0.2"]}`
+		var versions []string
+		for _, v := range validator.SupportedVersions() {
+			versions = append(versions, v.PatchVersions()...)
+		}
+		body, err := json.Marshal(map[string]interface{}{"version": versions})
+		if err != nil {
+			logger.Err("An unexpected error occured: ", err)
+			return http.StatusInternalServerError, "Internal Server Error"
+		}
+
+		return http.StatusOK, string(body)
 	})
 	router.Put("/:user/:app/statements", c.StoreStatement)
-	router.Post("/:user/:app/statements", c.StoreMultStatement)
-	router.Head("/:user/:app/statements", c.FindStatementHead)
+	router.Post("/:user/:app/statements", controller.AlternateRequest, acceptlang.Languages(), c.DispatchStatement)
+	router.Head("/:user/:app/statements", acceptlang.Languages(), c.FindStatementHead)
 	router.Get("/:user/:app/statements", acceptlang.Languages(), c.FindStatement)
+	router.Get("/:user/:app/statements/more/:more", acceptlang.Languages(), c.FindMoreStatements)
+	router.Get("/:user/:app/activities", c.FindActivity)
+	router.Get("/:user/:app/agents", c.FindAgent)
+	router.Put("/:user/:app/activities/state", c.StoreState)
+	router.Post("/:user/:app/activities/state", c.MergeState)
+	router.Get("/:user/:app/activities/state", c.FindState)
+	router.Delete("/:user/:app/activities/state", c.DeleteState)
+	router.Put("/:user/:app/activities/profile", c.StoreActivityProfile)
+	router.Post("/:user/:app/activities/profile", c.MergeActivityProfile)
+	router.Get("/:user/:app/activities/profile", c.FindActivityProfile)
+	router.Delete("/:user/:app/activities/profile", c.DeleteActivityProfile)
+	router.Put("/:user/:app/agents/profile", c.StoreAgentProfile)
+	router.Post("/:user/:app/agents/profile", c.MergeAgentProfile)
+	router.Get("/:user/:app/agents/profile", c.FindAgentProfile)
+	router.Delete("/:user/:app/agents/profile", c.DeleteAgentProfile)
+	router.Put("/:user/:app/profiles", c.StoreXAPIProfile)
+	router.Get("/:user/:app/profiles", c.FindXAPIProfile)
+	router.Delete("/:user/:app/profiles", c.DeleteXAPIProfile)
+	router.Get("/:user/:app/cmi5/status", c.FindCMI5Status)
 
 	router.Run()
 }
+
+// MongoDB への接続とインデックスの作成に待つ時間
+const mongoConnectTimeout = 30 * time.Second
+
+// openStorage は backend のストレージを開く。
+func openStorage(backend string) (model.Store, error) {
+	switch backend {
+	case "", "mongodb":
+		ctx, cancel := context.WithTimeout(context.Background(), mongoConnectTimeout)
+		defer cancel()
+
+		client, err := model.Connect(ctx, miscs.GlobalConfig.MongoDB.URL)
+		if err != nil {
+			return nil, err
+		}
+		db := client.Database(miscs.GlobalConfig.MongoDB.DBName)
+		model.InitDB(ctx, db)
+
+		return model.NewMongoStore(db), nil
+	case "memory":
+		logger.Warn("Statements are stored in memory and lost on exit")
+		return model.NewMemoryStore(), nil
+	case "postgresql":
+		store, err := model.OpenPostgresStore(miscs.GlobalConfig.PostgreSQL.URL)
+		if err != nil {
+			return nil, err
+		}
+		return store, nil
+	case "sqlite":
+		store, err := model.OpenSQLiteStore(miscs.GlobalConfig.SQLite.Path, miscs.GlobalConfig.SQLite.WAL)
+		if err != nil {
+			return nil, err
+		}
+		return store, nil
+	default:
+		return nil, fmt.Errorf("unknown storage backend: %s", backend)
+	}
+}
+
+// closeStorage は openStorage により開いたストレージを閉じる。
+func closeStorage(store model.Store) {
+	if closer, ok := store.(io.Closer); ok {
+		closer.Close()
+	}
+}
+
+// migrate は from のストレージのステートメント、添付ファイル、ドキュメント、ディスク使用量を to のストレージに移す。
+// 各ストレージの接続先は設定ファイルのものを用いる。
+func migrate(from, to string) error {
+	if len(from) == 0 || len(to) == 0 || from == to {
+		return fmt.Errorf("usage: %s migrate <from> <to> (from and to are mongodb, postgresql or sqlite)", os.Args[0])
+	}
+
+	var stores []model.MigratableStore
+	for _, backend := range []string{from, to} {
+		store, err := openStorage(backend)
+		if err != nil {
+			return err
+		}
+		defer closeStorage(store)
+
+		migratable, ok := store.(model.MigratableStore)
+		if !ok {
+			return fmt.Errorf("storage backend does not support migration: %s", backend)
+		}
+		stores = append(stores, migratable)
+	}
+
+	result, err := model.Migrate(context.Background(), stores[1], stores[0])
+	if result != nil {
+		fmt.Printf("Migrated from %s to %s: %d statements (%d skipped), %d attachments (%d skipped), %d documents, quota of %d users\n",
+			from, to, result.Statements, result.SkippedStatements, result.Attachments, result.SkippedAttachments, result.Documents, result.Users)
+	}
+
+	return err
+}